@@ -0,0 +1,103 @@
+// Copyright (c) 2024 MWS and/or its affiliates.
+//
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at:
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fanout
+
+import (
+	"math"
+	"time"
+)
+
+const (
+	// minWeightScore keeps degraded upstreams from being starved completely, so they can recover.
+	minWeightScore = 0.05
+	// weightSmoothing is the share of the distance to the target weight covered on each update.
+	weightSmoothing = 0.5
+)
+
+// weightAdapter periodically derives effective weights of a WeightedPolicy from the success rate and
+// latency observed since the previous update. Upstreams without traffic decay back to their configured weight.
+type weightAdapter struct {
+	policy     *WeightedPolicy
+	configured []int
+	effective  []float64
+	previous   []statsSnapshot
+}
+
+func newWeightAdapter(p *WeightedPolicy) *weightAdapter {
+	configured := p.LoadFactor()
+	effective := make([]float64, len(configured))
+	for i, w := range configured {
+		effective[i] = float64(w)
+	}
+	return &weightAdapter{
+		policy:     p,
+		configured: configured,
+		effective:  effective,
+		previous:   make([]statsSnapshot, len(configured)),
+	}
+}
+
+// task updates weights every interval. After SetPolicy, the weights of the new policy are adapted from
+// its configured ones, if it is weighted.
+func (a *weightAdapter) task(f *Fanout, interval time.Duration) task {
+	return task{interval: interval, run: func(time.Time) bool {
+		p := weightedStage(f.selectionPolicy())
+		if p == nil || len(p.LoadFactor()) != len(f.clients) {
+			return true
+		}
+		if p != a.policy {
+			*a = *newWeightAdapter(p)
+		}
+		a.update(f.clients, f.statsFor)
+		return true
+	}}
+}
+
+func (a *weightAdapter) update(clients []Client, statsFor func(string) *upstreamStats) {
+	current := make([]statsSnapshot, len(clients))
+	fastest := time.Duration(math.MaxInt64)
+	for i, c := range clients {
+		current[i] = statsFor(c.Endpoint()).snapshot()
+		if current[i].Requests > a.previous[i].Requests && current[i].RTT > 0 {
+			fastest = min(fastest, current[i].RTT)
+		}
+	}
+
+	weights := make([]int, len(clients))
+	for i := range clients {
+		target := float64(a.configured[i]) * a.score(a.previous[i], current[i], fastest)
+		a.effective[i] += (target - a.effective[i]) * weightSmoothing
+		weights[i] = max(minLoadFactor, int(math.Round(a.effective[i])))
+	}
+	a.previous = current
+	logErrIfNotNil(a.policy.SetLoadFactor(weights))
+}
+
+// score rates an upstream between minWeightScore and 1 by its success rate and its latency relative to the
+// fastest upstream over the last interval.
+func (a *weightAdapter) score(prev, cur statsSnapshot, fastest time.Duration) float64 {
+	requests := cur.Requests - prev.Requests
+	if requests == 0 {
+		return 1
+	}
+	successRate := 1 - float64(cur.Failures-prev.Failures)/float64(requests)
+	latency := 1.0
+	if cur.RTT > 0 && fastest > 0 {
+		latency = float64(fastest) / float64(cur.RTT)
+	}
+	return max(minWeightScore, successRate*latency)
+}
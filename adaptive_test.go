@@ -0,0 +1,83 @@
+// Copyright (c) 2024 MWS and/or its affiliates.
+//
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at:
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fanout
+
+import (
+	"testing"
+	"time"
+
+	"github.com/coredns/caddy"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWeightAdapterFollowsSuccessRateAndLatency(t *testing.T) {
+	f := New()
+	f.AddClient(NewClient("192.0.2.1:53", UDP))
+	f.AddClient(NewClient("192.0.2.2:53", UDP))
+	f.AddClient(NewClient("192.0.2.3:53", UDP))
+	p, err := NewWeightedPolicy([]int{100, 100, 100})
+	require.NoError(t, err)
+	a := newWeightAdapter(p)
+
+	for i := 0; i < 10; i++ {
+		f.statsFor("192.0.2.1:53").observe(10*time.Millisecond, nil, time.Now())
+		f.statsFor("192.0.2.2:53").observe(40*time.Millisecond, nil, time.Now())
+		f.statsFor("192.0.2.3:53").observe(0, errors.New("timeout"), time.Now())
+	}
+	a.update(f.clients, f.statsFor)
+	require.Equal(t, []int{100, 63, 53}, p.LoadFactor())
+
+	// Without new traffic the weights decay back toward the configured ones.
+	for i := 0; i < 10; i++ {
+		a.update(f.clients, f.statsFor)
+	}
+	require.Equal(t, []int{100, 100, 100}, p.LoadFactor())
+}
+
+func TestColdUpstreamFirstSampleIsDiscounted(t *testing.T) {
+	var s upstreamStats
+	now := time.Now()
+	s.observe(10*time.Millisecond, nil, now)
+	require.False(t, s.snapshot().cold(now))
+	require.True(t, s.snapshot().cold(now.Add(coldIdleInterval)))
+
+	// the handshake after an idle period doesn't count against the upstream
+	now = now.Add(time.Hour)
+	s.observe(500*time.Millisecond, nil, now)
+	require.Equal(t, 10*time.Millisecond, s.snapshot().RTT)
+	require.Equal(t, uint64(2), s.snapshot().Requests)
+
+	now = now.Add(time.Second)
+	s.observe(20*time.Millisecond, nil, now)
+	require.Equal(t, 12*time.Millisecond, s.snapshot().RTT)
+}
+
+func TestSetupAdaptiveWeights(t *testing.T) {
+	fs, err := parseFanout(caddy.NewTestController("dns", "fanout . 127.0.0.1 127.0.0.2 {\npolicy weighted-random\nadaptive-weights 5s\n}"))
+	require.NoError(t, err)
+	require.Equal(t, 5*time.Second, fs[0].adaptiveInterval)
+
+	fs, err = parseFanout(caddy.NewTestController("dns", "fanout . 127.0.0.1 127.0.0.2 {\npolicy weighted-random\nadaptive-weights\n}"))
+	require.NoError(t, err)
+	require.Equal(t, defaultAdaptiveInterval, fs[0].adaptiveInterval)
+
+	_, err = parseFanout(caddy.NewTestController("dns", "fanout . 127.0.0.1 127.0.0.2 {\nadaptive-weights\n}"))
+	require.ErrorContains(t, err, "requires the weighted-random policy")
+	_, err = parseFanout(caddy.NewTestController("dns", "fanout . 127.0.0.1 {\npolicy weighted-random\nadaptive-weights soon\n}"))
+	require.ErrorContains(t, err, "invalid adaptive-weights interval")
+}
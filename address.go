@@ -0,0 +1,118 @@
+// Copyright (c) 2024 MWS and/or its affiliates.
+//
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at:
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fanout
+
+import (
+	"net"
+	"net/netip"
+	"strconv"
+	"strings"
+
+	"github.com/coredns/coredns/plugin/pkg/transport"
+	"github.com/pkg/errors"
+)
+
+// errNotIPAddress is returned by normalizeUpstream for addresses whose host is not an IP literal, such as
+// resolv.conf style files.
+var errNotIPAddress = errors.New("not an IP address")
+
+// defaultPorts maps upstream schemes to the port used when an address has none.
+var defaultPorts = map[string]string{
+	transport.DNS:   transport.Port,
+	transport.TLS:   transport.TLSPort,
+	transport.HTTPS: transport.HTTPSPort,
+	transport.QUIC:  transport.QUICPort,
+}
+
+// normalizeUpstream normalizes an upstream of the TO list with an IP literal host to host:port, prefixed
+// with its scheme unless it is plain DNS. The port defaults to the one of the scheme.
+func normalizeUpstream(addr string) (string, error) {
+	scheme, host := transport.DNS, addr
+	if s, h, ok := strings.Cut(addr, "://"); ok {
+		scheme, host = strings.ToLower(s), h
+	}
+	port, ok := defaultPorts[scheme]
+	if !ok {
+		return "", errors.Errorf("unsupported upstream scheme in %q", addr)
+	}
+	hostPort, err := normalizeAddr(host, port)
+	if err != nil {
+		return "", errors.Wrapf(err, "invalid upstream %q", addr)
+	}
+	h, _, _ := net.SplitHostPort(hostPort)
+	if _, err := netip.ParseAddr(h); err != nil {
+		return "", errNotIPAddress
+	}
+	if scheme == transport.DNS {
+		return hostPort, nil
+	}
+	return scheme + "://" + hostPort, nil
+}
+
+// normalizeAddr returns addr as host:port, adding defaultPort when addr has no port. IPv6 literals, with
+// or without brackets and with an optional zone, are validated and bracketed.
+func normalizeAddr(addr, defaultPort string) (string, error) {
+	if addr == "" {
+		return "", errors.New("empty address")
+	}
+	if ip, ok := strings.CutPrefix(addr, "["); ok && strings.HasSuffix(ip, "]") {
+		addr = strings.TrimSuffix(ip, "]")
+	}
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		host, port = addr, defaultPort
+	}
+	if strings.Contains(host, ":") || strings.Contains(host, "%") {
+		ip, err := netip.ParseAddr(host)
+		if err != nil || !ip.Is6() {
+			return "", errors.Errorf("invalid IPv6 address %q", host)
+		}
+	}
+	if host == "" {
+		return "", errors.Errorf("missing host in %q", addr)
+	}
+	if p, err := strconv.Atoi(port); err != nil || p < 1 || p > 65535 {
+		return "", errors.Errorf("invalid port %q", port)
+	}
+	return net.JoinHostPort(host, port), nil
+}
+
+// defaultPort returns the default port of upstreams using the given network type.
+func defaultPort(network string) string {
+	if network == TCPTLS {
+		return defaultPorts[transport.TLS]
+	}
+	return defaultPorts[transport.DNS]
+}
+
+// clientAddr normalizes the address given to a client constructor, keeping it unchanged if it is invalid.
+func clientAddr(addr, network string) string {
+	if hostPort, err := normalizeAddr(addr, defaultPort(network)); err == nil {
+		return hostPort
+	}
+	return addr
+}
+
+// addrHost returns the host of a host:port address without the IPv6 zone, e.g. for TLS server names.
+func addrHost(addr string) string {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		host = strings.Trim(addr, "[]")
+	}
+	host, _, _ = strings.Cut(host, "%")
+	return host
+}
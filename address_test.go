@@ -0,0 +1,87 @@
+// Copyright (c) 2024 MWS and/or its affiliates.
+//
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at:
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fanout
+
+import (
+	"testing"
+
+	"github.com/coredns/caddy"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNormalizeUpstream(t *testing.T) {
+	valid := map[string]string{
+		"127.0.0.1":            "127.0.0.1:53",
+		"dns://127.0.0.1:5353": "127.0.0.1:5353",
+		"tls://9.9.9.9":        "tls://9.9.9.9:853",
+		"TLS://9.9.9.9:8853":   "tls://9.9.9.9:8853",
+		"quic://9.9.9.9":       "quic://9.9.9.9:853",
+		"::1":                  "[::1]:53",
+		"[2001:db8::1]":        "[2001:db8::1]:53",
+		"tls://[2001:db8::1]":  "tls://[2001:db8::1]:853",
+		"fe80::1%eth0":         "[fe80::1%eth0]:53",
+		"[fe80::1%eth0]:5353":  "[fe80::1%eth0]:5353",
+		"tls://[fe80::1%eth0]": "tls://[fe80::1%eth0]:853",
+	}
+	for addr, expected := range valid {
+		actual, err := normalizeUpstream(addr)
+		require.NoError(t, err, addr)
+		require.Equal(t, expected, actual, addr)
+	}
+
+	invalid := map[string]string{
+		"127.0.0.1:0":      "invalid port",
+		"127.0.0.1:65536":  "invalid port",
+		"[fe80::1%]:53":    "invalid IPv6 address",
+		"192.0.2.1%eth0":   "invalid IPv6 address",
+		"[gg::1]:53":       "invalid IPv6 address",
+		"grpc://127.0.0.1": "unsupported upstream scheme",
+		"tls://":           "empty address",
+	}
+	for addr, expectedErr := range invalid {
+		_, err := normalizeUpstream(addr)
+		require.ErrorContains(t, err, expectedErr, addr)
+	}
+	_, err := normalizeUpstream("/etc/resolv.conf")
+	require.ErrorIs(t, err, errNotIPAddress)
+}
+
+func TestSetupNormalizesUpstreams(t *testing.T) {
+	fs, err := parseFanout(caddy.NewTestController("dns", "fanout . 127.0.0.1 [::1]:5353 fe80::1%lo tls://127.0.0.2"))
+	require.NoError(t, err)
+	require.Equal(t, []string{"127.0.0.1:53", "[::1]:5353", "[fe80::1%lo]:53", "127.0.0.2:853"}, endpoints(fs[0].clients))
+
+	tests := map[string]string{
+		"fanout . 127.0.0.1:99999":              "invalid port",
+		"fanout . [fe80::1%]:53":                "invalid IPv6 address",
+		"fanout . quic://127.0.0.1":             "DNS-over-QUIC upstream",
+		"fanout . https://[fe80::1%]/dns-query": "invalid DNS-over-HTTPS upstream",
+		"fanout . dns.google":                   "not an IP address or file",
+	}
+	for input, expectedErr := range tests {
+		_, err := parseFanout(caddy.NewTestController("dns", input))
+		require.ErrorContains(t, err, expectedErr, input)
+	}
+}
+
+func TestClientDefaultPort(t *testing.T) {
+	require.Equal(t, "192.0.2.1:53", NewClient("192.0.2.1", UDP).Endpoint())
+	require.Equal(t, "192.0.2.1:853", NewClient("192.0.2.1", TCPTLS).Endpoint())
+	require.Equal(t, "[2001:db8::1]:53", NewClient("2001:db8::1", TCP).Endpoint())
+	require.Equal(t, "192.0.2.1:5353", NewClient("192.0.2.1:5353", UDP).Endpoint())
+	require.Equal(t, "fe80::1", addrHost("[fe80::1%eth0]:853"))
+}
@@ -0,0 +1,108 @@
+// Copyright (c) 2024 MWS and/or its affiliates.
+//
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at:
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fanout
+
+import (
+	"context"
+	"net/netip"
+	"slices"
+	"strings"
+
+	"github.com/coredns/caddy/caddyfile"
+	"github.com/coredns/coredns/plugin"
+	"github.com/coredns/coredns/request"
+	"github.com/miekg/dns"
+	"github.com/pkg/errors"
+)
+
+// clientNetworks restricts the fanout to the queries from a set of client networks.
+type clientNetworks struct {
+	prefixes []netip.Prefix
+	refuse   bool
+}
+
+// parseAllowFrom parses `allow-from CIDR... [refuse|next]`. The option may be repeated, adding networks.
+func parseAllowFrom(f *Fanout, c *caddyfile.Dispenser) error {
+	args := c.RemainingArgs()
+	if f.allowFrom == nil {
+		f.allowFrom = &clientNetworks{}
+	}
+	if n := len(args); n > 0 {
+		switch strings.ToLower(args[n-1]) {
+		case classFilterRefuse:
+			f.allowFrom.refuse = true
+			args = args[:n-1]
+		case classFilterNext:
+			args = args[:n-1]
+		}
+	}
+	if len(args) == 0 {
+		return c.ArgErr()
+	}
+	for _, arg := range args {
+		prefix, err := parseClientNetwork(arg)
+		if err != nil {
+			return err
+		}
+		f.allowFrom.prefixes = append(f.allowFrom.prefixes, prefix)
+	}
+	return nil
+}
+
+// parseClientNetwork parses a CIDR, or an address standing for the network of this address alone.
+func parseClientNetwork(s string) (netip.Prefix, error) {
+	if !strings.Contains(s, "/") {
+		addr, err := netip.ParseAddr(s)
+		if err != nil {
+			return netip.Prefix{}, errors.Errorf("invalid client network %q", s)
+		}
+		return netip.PrefixFrom(addr.Unmap(), addr.Unmap().BitLen()), nil
+	}
+	prefix, err := netip.ParsePrefix(s)
+	if err != nil {
+		return netip.Prefix{}, errors.Errorf("invalid client network %q", s)
+	}
+	if prefix.Addr().Is4In6() {
+		prefix = netip.PrefixFrom(prefix.Addr().Unmap(), prefix.Bits()-96)
+	}
+	return prefix.Masked(), nil
+}
+
+// allows reports whether the client address ip belongs to one of the networks.
+func (n *clientNetworks) allows(ip string) bool {
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return false
+	}
+	addr = addr.Unmap()
+	return slices.ContainsFunc(n.prefixes, func(p netip.Prefix) bool {
+		return p.Contains(addr)
+	})
+}
+
+// serveAllowFrom passes the queries from clients outside of the allow-from networks to the next plugin, or
+// refuses them. It returns false if the query is to be served by the fanout.
+func (f *Fanout) serveAllowFrom(ctx context.Context, req *request.Request) (rcode int, handled bool, err error) {
+	if f.allowFrom == nil || f.allowFrom.allows(req.IP()) {
+		return 0, false, nil
+	}
+	if f.allowFrom.refuse {
+		return dns.RcodeRefused, true, nil
+	}
+	rcode, err = plugin.NextOrFailure(f.Name(), f.Next, ctx, req.W, req.Req)
+	return rcode, true, err
+}
@@ -0,0 +1,74 @@
+// Copyright (c) 2024 MWS and/or its affiliates.
+//
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at:
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fanout
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+
+	"github.com/coredns/caddy"
+	"github.com/coredns/coredns/plugin/pkg/dnstest"
+	"github.com/coredns/coredns/plugin/test"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAllowFrom(t *testing.T) {
+	var upstream atomic.Int32
+	s := newServer(UDP, func(w dns.ResponseWriter, r *dns.Msg) {
+		upstream.Add(1)
+		msg := new(dns.Msg)
+		msg.SetReply(r)
+		logErrIfNotNil(w.WriteMsg(msg))
+	})
+	defer s.close()
+
+	serve := func(config string, w dns.ResponseWriter) int {
+		fs, err := parseFanout(caddy.NewTestController("dns", "fanout . "+s.addr+" {\n"+config+"\n}"))
+		require.NoError(t, err)
+		fs[0].Next = test.HandlerFunc(func(_ context.Context, w dns.ResponseWriter, r *dns.Msg) (int, error) {
+			msg := new(dns.Msg)
+			msg.SetRcode(r, dns.RcodeNameError)
+			logErrIfNotNil(w.WriteMsg(msg))
+			return dns.RcodeNameError, nil
+		})
+		req := new(dns.Msg)
+		req.SetQuestion(testQuery, dns.TypeA)
+		rec := dnstest.NewRecorder(w)
+		rcode, err := fs[0].ServeDNS(context.Background(), rec, req)
+		require.NoError(t, err)
+		if rec.Msg != nil {
+			rcode = rec.Msg.Rcode
+		}
+		return rcode
+	}
+
+	// the test response writers report the clients 10.240.0.1 and fe80::42:ff:feca:4c65
+	require.Equal(t, dns.RcodeSuccess, serve("allow-from 10.240.0.0/16", &test.ResponseWriter{}))
+	require.Equal(t, dns.RcodeSuccess, serve("allow-from 192.0.2.0/24\nallow-from fe80::/64", &test.ResponseWriter6{}))
+	require.Equal(t, int32(2), upstream.Load())
+
+	require.Equal(t, dns.RcodeNameError, serve("allow-from 192.0.2.0/24 fe80::/64", &test.ResponseWriter{}))
+	require.Equal(t, dns.RcodeRefused, serve("allow-from 10.0.0.0/16 refuse", &test.ResponseWriter{}))
+	require.Equal(t, int32(2), upstream.Load(), "queries from other clients don't reach the upstreams")
+
+	for _, config := range []string{"allow-from", "allow-from refuse", "allow-from 10.0.0.0/33", "allow-from example.com"} {
+		_, err := parseFanout(caddy.NewTestController("dns", "fanout . "+s.addr+" {\n"+config+"\n}"))
+		require.Error(t, err, config)
+	}
+}
@@ -0,0 +1,59 @@
+// Copyright (c) 2024 MWS and/or its affiliates.
+//
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at:
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fanout
+
+import (
+	"math/rand/v2"
+	"slices"
+
+	"github.com/miekg/dns"
+)
+
+// reorderAnswer rotates or shuffles the A and AAAA records of the answer section in place, so that clients
+// get distributed orderings even when the upstream always returns the same one. Other records keep their
+// position, so a CNAME chain stays in front of the addresses it leads to.
+func (f *Fanout) reorderAnswer(m *dns.Msg) {
+	if f.answerOrder == "" {
+		return
+	}
+	for _, qtype := range []uint16{dns.TypeA, dns.TypeAAAA} {
+		var idx []int
+		for i, rr := range m.Answer {
+			if rr.Header().Rrtype == qtype {
+				idx = append(idx, i)
+			}
+		}
+		if len(idx) < 2 {
+			continue
+		}
+		rrs := make([]dns.RR, len(idx))
+		for i, j := range idx {
+			rrs[i] = m.Answer[j]
+		}
+		switch f.answerOrder {
+		case answerOrderRotate:
+			shift := int(f.answerRotation.Add(1) % uint32(len(rrs))) //nolint:gosec // len(rrs) is bounded by the message size
+			rrs = slices.Concat(rrs[shift:], rrs[:shift])
+		case answerOrderShuffle:
+			//nolint:gosec // record order does not need cryptographic randomness
+			rand.Shuffle(len(rrs), func(i, j int) { rrs[i], rrs[j] = rrs[j], rrs[i] })
+		}
+		for i, j := range idx {
+			m.Answer[j] = rrs[i]
+		}
+	}
+}
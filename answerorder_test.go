@@ -0,0 +1,103 @@
+// Copyright (c) 2024 MWS and/or its affiliates.
+//
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at:
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fanout
+
+import (
+	"testing"
+
+	"github.com/coredns/caddy"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+)
+
+func answerAddresses(m *dns.Msg) []string {
+	var addrs []string
+	for _, rr := range m.Answer {
+		switch rr := rr.(type) {
+		case *dns.A:
+			addrs = append(addrs, rr.A.String())
+		case *dns.AAAA:
+			addrs = append(addrs, rr.AAAA.String())
+		case *dns.CNAME:
+			addrs = append(addrs, rr.Target)
+		}
+	}
+	return addrs
+}
+
+func answerWithAddresses(t *testing.T) *dns.Msg {
+	m := new(dns.Msg)
+	for _, s := range []string{
+		"example1. 300 IN CNAME example2.",
+		"example2. 300 IN A 10.0.0.1",
+		"example2. 300 IN AAAA ::1",
+		"example2. 300 IN A 10.0.0.2",
+		"example2. 300 IN A 10.0.0.3",
+	} {
+		rr, err := dns.NewRR(s)
+		require.NoError(t, err)
+		m.Answer = append(m.Answer, rr)
+	}
+	return m
+}
+
+func TestReorderAnswerRotate(t *testing.T) {
+	f := New()
+	f.answerOrder = answerOrderRotate
+	var orders [][]string
+	for i := 0; i < 3; i++ {
+		m := answerWithAddresses(t)
+		f.reorderAnswer(m)
+		orders = append(orders, answerAddresses(m))
+	}
+	require.Equal(t, [][]string{
+		{"example2.", "10.0.0.2", "::1", "10.0.0.3", "10.0.0.1"},
+		{"example2.", "10.0.0.3", "::1", "10.0.0.1", "10.0.0.2"},
+		{"example2.", "10.0.0.1", "::1", "10.0.0.2", "10.0.0.3"},
+	}, orders)
+}
+
+func TestReorderAnswerShuffle(t *testing.T) {
+	f := New()
+	f.answerOrder = answerOrderShuffle
+	seen := map[string]bool{}
+	for i := 0; i < 100; i++ {
+		m := answerWithAddresses(t)
+		f.reorderAnswer(m)
+		addrs := answerAddresses(m)
+		require.Equal(t, "example2.", addrs[0])
+		require.Equal(t, "::1", addrs[2])
+		require.ElementsMatch(t, []string{"10.0.0.1", "10.0.0.2", "10.0.0.3"}, []string{addrs[1], addrs[3], addrs[4]})
+		seen[addrs[1]] = true
+	}
+	require.Len(t, seen, 3)
+}
+
+func TestReorderAnswerKeepsOrderByDefault(t *testing.T) {
+	m := answerWithAddresses(t)
+	New().reorderAnswer(m)
+	require.Equal(t, []string{"example2.", "10.0.0.1", "::1", "10.0.0.2", "10.0.0.3"}, answerAddresses(m))
+}
+
+func TestSetupAnswerOrder(t *testing.T) {
+	fs, err := parseFanout(caddy.NewTestController("dns", "fanout . 127.0.0.1 {\nanswer-order shuffle\n}"))
+	require.NoError(t, err)
+	require.Equal(t, answerOrderShuffle, fs[0].answerOrder)
+
+	_, err = parseFanout(caddy.NewTestController("dns", "fanout . 127.0.0.1 {\nanswer-order random\n}"))
+	require.ErrorContains(t, err, "unsupported answer-order")
+}
@@ -0,0 +1,120 @@
+// Copyright (c) 2024 MWS and/or its affiliates.
+//
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at:
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fanout
+
+import (
+	"context"
+	"sync"
+
+	"github.com/coredns/coredns/request"
+	"github.com/miekg/dns"
+)
+
+// anyTypes are the types an ANY query is expanded into for upstreams refusing ANY.
+var anyTypes = []uint16{dns.TypeA, dns.TypeAAAA, dns.TypeMX}
+
+// requestAny sends r to c. With expand-any, ANY queries to upstreams known to refuse them are expanded into
+// queries for anyTypes, whose answers are merged into the response. An upstream is known to refuse ANY
+// once it answered an ANY query with NOTIMP, REFUSED or the minimal HINFO response of RFC 8482.
+func (f *Fanout) requestAny(ctx context.Context, c Client, r *request.Request) (*dns.Msg, error) {
+	if !f.expandAny || r.QType() != dns.TypeANY {
+		return f.flights.request(ctx, c, r)
+	}
+	if _, ok := f.refusesAny.Load(c.Endpoint()); !ok {
+		msg, err := f.flights.request(ctx, c, r)
+		if err != nil || !refusesAny(msg) {
+			return msg, err
+		}
+		log.Infof("upstream %s refuses ANY queries, expanding them into A, AAAA and MX queries", c.Endpoint())
+		f.refusesAny.Store(c.Endpoint(), struct{}{})
+	}
+	return f.expandANY(ctx, c, r)
+}
+
+// refusesAny returns true if m answers an ANY query without the records of the name.
+func refusesAny(m *dns.Msg) bool {
+	if m.Rcode == dns.RcodeNotImplemented || m.Rcode == dns.RcodeRefused {
+		return true
+	}
+	if m.Rcode != dns.RcodeSuccess || len(m.Answer) != 1 {
+		return false
+	}
+	hinfo, ok := m.Answer[0].(*dns.HINFO)
+	return ok && hinfo.Cpu == "RFC8482"
+}
+
+// expandANY queries c for each of anyTypes in parallel and merges the answers into a response to r.
+func (f *Fanout) expandANY(ctx context.Context, c Client, r *request.Request) (*dns.Msg, error) {
+	responses := make([]*dns.Msg, len(anyTypes))
+	errs := make([]error, len(anyTypes))
+	var wg sync.WaitGroup
+	for i, qtype := range anyTypes {
+		wg.Go(func() {
+			m := r.Req.Copy()
+			m.Question[0].Qtype = qtype
+			responses[i], errs[i] = f.flights.request(ctx, c, &request.Request{W: r.W, Req: m})
+		})
+	}
+	wg.Wait()
+	return mergeANY(r.Req, responses, errs)
+}
+
+// mergeANY returns the response to the ANY query req made of the responses to its expanded queries. It
+// succeeds as long as one of them did, with NXDOMAIN only if the name doesn't exist for any of them.
+func mergeANY(req *dns.Msg, responses []*dns.Msg, errs []error) (*dns.Msg, error) {
+	var merged *dns.Msg
+	seen := map[string]bool{}
+	for i, m := range responses {
+		if errs[i] != nil || (m.Rcode != dns.RcodeSuccess && m.Rcode != dns.RcodeNameError) {
+			continue
+		}
+		if merged == nil {
+			merged = m.Copy()
+			merged.Answer, merged.Ns, merged.Extra = nil, m.Ns, nil
+			if opt := m.IsEdns0(); opt != nil {
+				merged.Extra = []dns.RR{opt}
+			}
+		}
+		if m.Rcode == dns.RcodeSuccess {
+			merged.Rcode = dns.RcodeSuccess
+		}
+		for _, rr := range m.Answer {
+			if key := rr.String(); !seen[key] {
+				seen[key] = true
+				merged.Answer = append(merged.Answer, rr)
+			}
+		}
+	}
+	if merged == nil {
+		// no expanded query succeeded, answer with the first failure
+		for i, m := range responses {
+			if errs[i] == nil {
+				merged = m.Copy()
+				break
+			}
+		}
+		if merged == nil {
+			return nil, errs[0]
+		}
+	}
+	if len(merged.Answer) > 0 {
+		merged.Ns = nil
+	}
+	merged.Id = req.Id
+	merged.Question = req.Question
+	return merged, nil
+}
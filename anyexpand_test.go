@@ -0,0 +1,98 @@
+// Copyright (c) 2024 MWS and/or its affiliates.
+//
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at:
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fanout
+
+import (
+	"context"
+	"sync"
+	"testing"
+
+	"github.com/coredns/caddy"
+	"github.com/coredns/coredns/plugin/pkg/dnstest"
+	"github.com/coredns/coredns/plugin/test"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+)
+
+func TestExpandAny(t *testing.T) {
+	var mu sync.Mutex
+	var qtypes []uint16
+	s := newServer(UDP, func(w dns.ResponseWriter, r *dns.Msg) {
+		mu.Lock()
+		qtypes = append(qtypes, r.Question[0].Qtype)
+		mu.Unlock()
+		msg := new(dns.Msg)
+		msg.SetReply(r)
+		switch r.Question[0].Qtype {
+		case dns.TypeANY:
+			msg.Answer = []dns.RR{&dns.HINFO{Hdr: dns.RR_Header{Name: r.Question[0].Name, Rrtype: dns.TypeHINFO, Class: dns.ClassINET, Ttl: 3600}, Cpu: "RFC8482"}}
+		case dns.TypeA:
+			msg.Answer = []dns.RR{makeRecordA("example1. 3600 IN A 10.0.0.1")}
+		case dns.TypeMX:
+			rr, err := dns.NewRR("example1. 3600 IN MX 10 mail.example1.")
+			require.NoError(t, err)
+			msg.Answer = []dns.RR{rr}
+		}
+		logErrIfNotNil(w.WriteMsg(msg))
+	})
+	defer s.close()
+	fs, err := parseFanout(caddy.NewTestController("dns", "fanout . "+s.addr+" {\nexpand-any\n}"))
+	require.NoError(t, err)
+	f := fs[0]
+	query := func() (*dns.Msg, []uint16) {
+		mu.Lock()
+		qtypes = nil
+		mu.Unlock()
+		req := new(dns.Msg)
+		req.SetQuestion(testQuery, dns.TypeANY)
+		rec := dnstest.NewRecorder(&test.ResponseWriter{})
+		_, err := f.ServeDNS(context.Background(), rec, req)
+		require.NoError(t, err)
+		require.Equal(t, req.Id, rec.Msg.Id)
+		require.Equal(t, dns.TypeANY, rec.Msg.Question[0].Qtype)
+		mu.Lock()
+		defer mu.Unlock()
+		return rec.Msg, qtypes
+	}
+
+	m, sent := query()
+	require.ElementsMatch(t, []uint16{dns.TypeANY, dns.TypeA, dns.TypeAAAA, dns.TypeMX}, sent)
+	require.Len(t, m.Answer, 2, "the answers of the expanded queries are merged")
+	m, sent = query()
+	require.ElementsMatch(t, []uint16{dns.TypeA, dns.TypeAAAA, dns.TypeMX}, sent, "upstreams refusing ANY are remembered")
+	require.Len(t, m.Answer, 2)
+}
+
+func TestMergeANY(t *testing.T) {
+	req := new(dns.Msg)
+	req.SetQuestion(testQuery, dns.TypeANY)
+	reply := func(rcode int) *dns.Msg {
+		m := new(dns.Msg)
+		m.SetRcode(req, rcode)
+		return m
+	}
+	m, err := mergeANY(req, []*dns.Msg{reply(dns.RcodeNameError), reply(dns.RcodeNameError)}, []error{nil, nil})
+	require.NoError(t, err)
+	require.Equal(t, dns.RcodeNameError, m.Rcode)
+
+	m, err = mergeANY(req, []*dns.Msg{nil, reply(dns.RcodeServerFailure)}, []error{dns.ErrTime, nil})
+	require.NoError(t, err)
+	require.Equal(t, dns.RcodeServerFailure, m.Rcode, "the failure of the upstream is returned when every expanded query failed")
+
+	_, err = mergeANY(req, []*dns.Msg{nil, nil}, []error{dns.ErrTime, dns.ErrTime})
+	require.ErrorIs(t, err, dns.ErrTime)
+}
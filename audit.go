@@ -0,0 +1,100 @@
+// Copyright (c) 2024 MWS and/or its affiliates.
+//
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at:
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fanout
+
+import (
+	"context"
+	"slices"
+	"strings"
+
+	"github.com/coredns/caddy/caddyfile"
+	"github.com/coredns/coredns/plugin"
+	"github.com/coredns/coredns/request"
+	"github.com/miekg/dns"
+	"github.com/pkg/errors"
+)
+
+// maxTXTStringLen is the maximum length of a single character string of a TXT record.
+const maxTXTStringLen = 255
+
+// parseDebugSuffix parses `debug-suffix SUFFIX`.
+func parseDebugSuffix(f *Fanout, c *caddyfile.Dispenser) error {
+	args := c.RemainingArgs()
+	if len(args) != 1 {
+		return c.ArgErr()
+	}
+	normalized := plugin.Host(args[0]).NormalizeExact()
+	if len(normalized) == 0 || normalized[0] == "." {
+		return errors.Errorf("invalid debug-suffix %q", args[0])
+	}
+	f.debugSuffix = normalized[0]
+	return nil
+}
+
+// serveAudit resolves the name of req without the debug suffix, and answers with TXT records describing
+// the upstreams queried, their rcodes and timings, and the selected answer.
+func (f *Fanout) serveAudit(ctx context.Context, req *request.Request) (int, error) {
+	name := strings.TrimSuffix(req.Name(), f.debugSuffix)
+	if name == "" {
+		name = "."
+	}
+	sub := req.Req.Copy()
+	sub.Question[0].Name = name
+	subReq := &request.Request{W: req.W, Req: sub}
+	if !f.match(subReq) {
+		return plugin.NextOrFailure(f.Name(), f.Next, ctx, req.W, req.Req)
+	}
+
+	trace := newDecisionTrace(f.clock)
+	timeoutContext, cancel := context.WithTimeout(withTrace(ctx, trace), f.Timeout)
+	defer cancel()
+	result := f.resolve(withTrace(ctx, trace), timeoutContext, subReq)
+
+	trace.mutex.Lock()
+	entries := append(slices.Clone(trace.entries), auditOutcome(result))
+	trace.mutex.Unlock()
+	m := new(dns.Msg)
+	m.SetReply(req.Req)
+	for _, entry := range entries {
+		m.Answer = append(m.Answer, &dns.TXT{
+			Hdr: dns.RR_Header{Name: req.QName(), Rrtype: dns.TypeTXT, Class: dns.ClassINET},
+			Txt: splitTXT(entry),
+		})
+	}
+	logErrIfNotNil(req.W.WriteMsg(m))
+	return dns.RcodeSuccess, nil
+}
+
+func auditOutcome(result *response) string {
+	switch {
+	case result == nil:
+		return "no result"
+	case result.err != nil:
+		return "failed: " + result.err.Error()
+	}
+	return "selected " + result.client.Endpoint() + ": " + dns.RcodeToString[result.response.Rcode]
+}
+
+// splitTXT splits s into character strings of at most maxTXTStringLen bytes.
+func splitTXT(s string) []string {
+	var parts []string
+	for len(s) > maxTXTStringLen {
+		parts = append(parts, s[:maxTXTStringLen])
+		s = s[maxTXTStringLen:]
+	}
+	return append(parts, s)
+}
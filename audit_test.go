@@ -0,0 +1,73 @@
+// Copyright (c) 2024 MWS and/or its affiliates.
+//
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at:
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fanout
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/coredns/caddy"
+	"github.com/coredns/coredns/plugin/pkg/dnstest"
+	"github.com/coredns/coredns/plugin/test"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDebugSuffixAudit(t *testing.T) {
+	s := newServer(UDP, func(w dns.ResponseWriter, r *dns.Msg) {
+		msg := new(dns.Msg)
+		msg.SetReply(r)
+		if r.Question[0].Name == "example.org." {
+			msg.Answer = append(msg.Answer, makeRecordA("example.org. 300 IN A 192.0.2.1"))
+		} else {
+			msg.Rcode = dns.RcodeNameError
+		}
+		logErrIfNotNil(w.WriteMsg(msg))
+	})
+	defer s.close()
+
+	fs, err := parseFanout(caddy.NewTestController("dns", "fanout . "+s.addr+" {\ndebug-suffix fanout-debug\n}"))
+	require.NoError(t, err)
+	req := new(dns.Msg)
+	req.SetQuestion("example.org.Fanout-Debug.", dns.TypeA)
+	rec := dnstest.NewRecorder(&test.ResponseWriter{})
+	_, err = fs[0].ServeDNS(context.Background(), rec, req)
+	require.NoError(t, err)
+
+	var lines []string
+	for _, rr := range rec.Msg.Answer {
+		txt, ok := rr.(*dns.TXT)
+		require.True(t, ok)
+		require.Equal(t, "example.org.Fanout-Debug.", txt.Hdr.Name)
+		lines = append(lines, strings.Join(txt.Txt, ""))
+	}
+	require.Len(t, lines, 3)
+	require.Contains(t, lines[0], "picked "+s.addr)
+	require.Contains(t, lines[1], s.addr+": NOERROR with 1 answers after")
+	require.Equal(t, "selected "+s.addr+": NOERROR", lines[2])
+
+	req.SetQuestion("example.org.", dns.TypeA)
+	rec = dnstest.NewRecorder(&test.ResponseWriter{})
+	_, err = fs[0].ServeDNS(context.Background(), rec, req)
+	require.NoError(t, err)
+	require.IsType(t, &dns.A{}, rec.Msg.Answer[0], "queries without the suffix are answered as usual")
+
+	_, err = parseFanout(caddy.NewTestController("dns", "fanout . 127.0.0.1 {\ndebug-suffix .\n}"))
+	require.ErrorContains(t, err, "invalid debug-suffix")
+	require.Equal(t, []string{strings.Repeat("a", 255), "b"}, splitTXT(strings.Repeat("a", 255)+"b"))
+}
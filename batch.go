@@ -0,0 +1,314 @@
+// Copyright (c) 2024 MWS and/or its affiliates.
+//
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at:
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fanout
+
+import (
+	"context"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/coredns/caddy/caddyfile"
+	"github.com/miekg/dns"
+	"github.com/pkg/errors"
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+// batchConn sends and receives several datagrams per call, with sendmmsg and recvmmsg on Linux. Elsewhere
+// each call moves a single datagram.
+type batchConn interface {
+	ReadBatch(ms []ipv4.Message, flags int) (int, error)
+	WriteBatch(ms []ipv4.Message, flags int) (int, error)
+}
+
+// batchResult is the outcome of a batched query.
+type batchResult struct {
+	msg *dns.Msg
+	err error
+}
+
+// batchQuery is a query waiting on the shared socket, keyed by the message ID it was sent with.
+type batchQuery struct {
+	id       uint16
+	question []dns.Question
+	wire     []byte
+	result   chan batchResult
+}
+
+// udpBatcher multiplexes the UDP queries to an upstream over a single connected socket. A writer sends the
+// queued queries and a reader receives the responses in batches of up to size datagrams, cutting the
+// syscalls per query at high rates. Responses are matched to the queries by message ID and question.
+type udpBatcher struct {
+	conn      net.Conn
+	pc        batchConn
+	size      int
+	out       chan *batchQuery
+	mutex     sync.Mutex
+	pending   map[uint16]*batchQuery
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+func newUDPBatcher(conn *net.UDPConn, size int) *udpBatcher {
+	b := &udpBatcher{
+		conn:    conn,
+		size:    size,
+		out:     make(chan *batchQuery, size),
+		pending: map[uint16]*batchQuery{},
+		done:    make(chan struct{}),
+	}
+	if addr, ok := conn.RemoteAddr().(*net.UDPAddr); ok && addr.IP.To4() == nil {
+		b.pc = ipv6.NewPacketConn(conn)
+	} else {
+		b.pc = ipv4.NewPacketConn(conn)
+	}
+	go b.writeLoop()
+	go b.readLoop()
+	return b
+}
+
+// exchange sends req over the shared socket with an ID unique among the pending queries and waits for the
+// response, restoring the ID of req on it.
+func (b *udpBatcher) exchange(ctx context.Context, req *dns.Msg) (*dns.Msg, error) {
+	q, err := b.register(req)
+	if err != nil {
+		return nil, err
+	}
+	defer b.unregister(q)
+	timer := time.NewTimer(readTimeout)
+	defer timer.Stop()
+	select {
+	case b.out <- q:
+	case <-b.done:
+		return nil, net.ErrClosed
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	select {
+	case r := <-q.result:
+		if r.err != nil {
+			return nil, r.err
+		}
+		r.msg.Id = req.Id
+		return r.msg, nil
+	case <-timer.C:
+		return nil, &net.OpError{Op: "read", Net: UDP, Addr: b.conn.RemoteAddr(), Err: os.ErrDeadlineExceeded}
+	case <-b.done:
+		return nil, net.ErrClosed
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+func (b *udpBatcher) register(req *dns.Msg) (*batchQuery, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if len(b.pending) >= maxUDPBatchPending {
+		return nil, errors.Errorf("too many queries in flight to %s", b.conn.RemoteAddr())
+	}
+	id := dns.Id()
+	for b.pending[id] != nil {
+		id = dns.Id()
+	}
+	m := *req
+	m.Id = id
+	wire, err := m.Pack()
+	if err != nil {
+		return nil, err
+	}
+	q := &batchQuery{id: id, question: req.Question, wire: wire, result: make(chan batchResult, 1)}
+	b.pending[id] = q
+	return q, nil
+}
+
+func (b *udpBatcher) unregister(q *batchQuery) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if b.pending[q.id] == q {
+		delete(b.pending, q.id)
+	}
+}
+
+// writeLoop sends the queued queries, batching the ones queued while the previous batch was written.
+func (b *udpBatcher) writeLoop() {
+	msgs := make([]ipv4.Message, b.size)
+	queries := make([]*batchQuery, b.size)
+	for {
+		select {
+		case queries[0] = <-b.out:
+		case <-b.done:
+			return
+		}
+		n := 1
+	fill:
+		for n < b.size {
+			select {
+			case queries[n] = <-b.out:
+				n++
+			default:
+				break fill
+			}
+		}
+		for i, q := range queries[:n] {
+			msgs[i].Buffers = [][]byte{q.wire}
+		}
+		b.write(msgs[:n], queries[:n])
+		clear(queries)
+	}
+}
+
+// write sends msgs, failing the queries of the messages which could not be sent.
+func (b *udpBatcher) write(msgs []ipv4.Message, queries []*batchQuery) {
+	for len(msgs) > 0 {
+		n, err := b.pc.WriteBatch(msgs, 0)
+		if err != nil {
+			for _, q := range queries {
+				b.finish(q.id, batchResult{err: err})
+			}
+			return
+		}
+		msgs, queries = msgs[n:], queries[n:]
+	}
+}
+
+// readLoop receives the responses until the socket is closed and hands them to the pending queries.
+func (b *udpBatcher) readLoop() {
+	msgs := make([]ipv4.Message, b.size)
+	for i := range msgs {
+		msgs[i].Buffers = [][]byte{make([]byte, dns.MaxMsgSize)}
+	}
+	for {
+		n, err := b.pc.ReadBatch(msgs, 0)
+		if err != nil {
+			select {
+			case <-b.done:
+				return
+			default:
+				// other errors, such as the refusal reported for an earlier datagram, don't belong to a query
+			}
+		}
+		for i := range msgs[:n] {
+			b.dispatch(msgs[i].Buffers[0][:msgs[i].N])
+		}
+	}
+}
+
+// dispatch delivers a response to the query with its ID and question. Other responses are dropped, as
+// exchange does, leaving the query waiting.
+func (b *udpBatcher) dispatch(wire []byte) {
+	ret := new(dns.Msg)
+	if err := ret.Unpack(wire); err != nil {
+		return
+	}
+	b.mutex.Lock()
+	q := b.pending[ret.Id]
+	b.mutex.Unlock()
+	if q != nil && sameQuestion(q.question, ret.Question) {
+		b.finish(ret.Id, batchResult{msg: ret})
+	}
+}
+
+// finish hands r to the pending query with the ID, if any.
+func (b *udpBatcher) finish(id uint16, r batchResult) {
+	b.mutex.Lock()
+	q := b.pending[id]
+	delete(b.pending, id)
+	b.mutex.Unlock()
+	if q != nil {
+		q.result <- r
+	}
+}
+
+func (b *udpBatcher) close() {
+	b.closeOnce.Do(func() {
+		close(b.done)
+		_ = b.conn.Close()
+	})
+}
+
+func sameQuestion(a, b []dns.Question) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i].Qtype != b[i].Qtype || a[i].Qclass != b[i].Qclass || !strings.EqualFold(a[i].Name, b[i].Name) {
+			return false
+		}
+	}
+	return true
+}
+
+// batcher returns the shared socket of the transport, dialing it on first use. It returns nil when
+// batching is disabled or the dialer doesn't return a UDP socket, in which case every query dials its own.
+func (t *transportImpl) batcher(ctx context.Context) (*udpBatcher, error) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if t.udpBatch == 0 || t.tlsConfig != nil {
+		return nil, nil
+	}
+	if t.batch != nil {
+		return t.batch, nil
+	}
+	conn, err := t.dialContext(ctx, UDP, t.addr)
+	if err != nil {
+		return nil, err
+	}
+	uc, ok := conn.(*net.UDPConn)
+	if !ok {
+		_ = conn.Close()
+		t.udpBatch = 0
+		return nil, nil
+	}
+	t.batch = newUDPBatcher(uc, t.udpBatch)
+	return t.batch, nil
+}
+
+// exchangeBatched exchanges req over the shared socket of the client transport. It reports false when UDP
+// batching isn't used for the client.
+func (c *client) exchangeBatched(ctx context.Context, req *dns.Msg) (*dns.Msg, bool, error) {
+	t, ok := c.transport.(*transportImpl)
+	if !ok {
+		return nil, false, nil
+	}
+	b, err := t.batcher(ctx)
+	if b == nil {
+		return nil, err != nil, err
+	}
+	ret, err := b.exchange(ctx, req)
+	return ret, true, err
+}
+
+// parseUDPBatch parses `udp-batch [SIZE]`.
+func parseUDPBatch(f *Fanout, c *caddyfile.Dispenser) error {
+	args := c.RemainingArgs()
+	if len(args) > 1 {
+		return c.ArgErr()
+	}
+	f.udpBatch = defaultUDPBatchSize
+	if len(args) == 1 {
+		size, err := strconv.Atoi(args[0])
+		if err != nil || size < 1 || size > maxUDPBatchSize {
+			return errors.Errorf("udp-batch size must be between 1 and %d, got %q", maxUDPBatchSize, args[0])
+		}
+		f.udpBatch = size
+	}
+	return nil
+}
@@ -0,0 +1,82 @@
+// Copyright (c) 2024 MWS and/or its affiliates.
+//
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at:
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fanout
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sync"
+	"testing"
+
+	"github.com/coredns/caddy"
+	"github.com/coredns/coredns/plugin/test"
+	"github.com/coredns/coredns/request"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/goleak"
+)
+
+func TestUDPBatch(t *testing.T) {
+	defer goleak.VerifyNone(t)
+	var mutex sync.Mutex
+	ids := map[uint16]bool{}
+	s := newServer(UDP, func(w dns.ResponseWriter, r *dns.Msg) {
+		mutex.Lock()
+		ids[r.Id] = true
+		mutex.Unlock()
+		msg := dns.Msg{Answer: []dns.RR{makeRecordA(r.Question[0].Name + " 3600 IN A 10.0.0.1")}}
+		msg.SetReply(r)
+		logErrIfNotNil(w.WriteMsg(&msg))
+	})
+	defer s.close()
+	_, port, err := net.SplitHostPort(s.addr)
+	require.NoError(t, err)
+
+	for _, addr := range []string{s.addr, net.JoinHostPort("127.0.0.1", port)} {
+		c := NewClient(addr, UDP).(*client)
+		c.transport.(*transportImpl).udpBatch = 8
+		var wg sync.WaitGroup
+		for i := range 100 {
+			wg.Go(func() {
+				req := new(dns.Msg)
+				req.SetQuestion(fmt.Sprintf("host%d.example.", i), dns.TypeA)
+				req.Id = 42
+				ret, err := c.Request(context.Background(), &request.Request{W: &test.ResponseWriter{}, Req: req})
+				require.NoError(t, err)
+				require.Equal(t, uint16(42), ret.Id, "the response carries the ID of the client")
+				require.Equal(t, req.Question, ret.Question)
+				require.Len(t, ret.Answer, 1)
+			})
+		}
+		wg.Wait()
+		require.NotNil(t, c.transport.(*transportImpl).batch, "the queries share a socket")
+		c.closeIdle()
+		require.Nil(t, c.transport.(*transportImpl).batch)
+	}
+	mutex.Lock()
+	require.Greater(t, len(ids), 1, "queries on the shared socket get distinct IDs")
+	mutex.Unlock()
+
+	fs, err := parseFanout(caddy.NewTestController("dns", "fanout . "+s.addr+" {\nudp-batch 16\n}"))
+	require.NoError(t, err)
+	require.Equal(t, 16, fs[0].clients[0].(*client).transport.(*transportImpl).udpBatch)
+	for _, config := range []string{"udp-batch 0", "udp-batch 2000", "udp-batch 8 16"} {
+		_, err = parseFanout(caddy.NewTestController("dns", "fanout . "+s.addr+" {\n"+config+"\n}"))
+		require.Error(t, err, config)
+	}
+}
@@ -0,0 +1,60 @@
+// Copyright (c) 2024 MWS and/or its affiliates.
+//
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at:
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fanout
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// bootstrapTracker records, for each upstream, the time from its first attempt after startup or reload
+// to its first successful response, revealing upstreams that answer but take seconds to warm up.
+type bootstrapTracker struct {
+	upstreams sync.Map
+}
+
+type bootstrapState struct {
+	first time.Time
+	done  atomic.Bool
+}
+
+// attempt records an attempt to the upstream with the given endpoint started at now.
+func (b *bootstrapTracker) attempt(addr string, now time.Time) {
+	if b == nil {
+		return
+	}
+	if _, ok := b.upstreams.Load(addr); !ok {
+		b.upstreams.LoadOrStore(addr, &bootstrapState{first: now})
+	}
+}
+
+// success records a successful response of the upstream with the given endpoint received at now,
+// setting its bootstrap metric the first time.
+func (b *bootstrapTracker) success(addr string, now time.Time) {
+	if b == nil {
+		return
+	}
+	v, ok := b.upstreams.Load(addr)
+	if !ok {
+		return
+	}
+	s := v.(*bootstrapState)
+	if s.done.CompareAndSwap(false, true) {
+		UpstreamBootstrapDuration.WithLabelValues(addr).Set(now.Sub(s.first).Seconds())
+	}
+}
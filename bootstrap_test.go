@@ -0,0 +1,73 @@
+// Copyright (c) 2024 MWS and/or its affiliates.
+//
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at:
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fanout
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/coredns/caddy"
+	"github.com/coredns/coredns/plugin/test"
+	"github.com/miekg/dns"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/require"
+
+	"github.com/hurricanehrndz/fanout/v2/clock"
+)
+
+func TestBootstrapTracker(t *testing.T) {
+	addr := "198.18.2.1:53"
+	start := time.Now()
+	b := &bootstrapTracker{}
+	b.success(addr, start)
+	b.attempt(addr, start)
+	b.attempt(addr, start.Add(time.Second))
+	b.success(addr, start.Add(3*time.Second))
+	b.success(addr, start.Add(time.Minute))
+	require.Equal(t, 3.0, testutil.ToFloat64(UpstreamBootstrapDuration.WithLabelValues(addr)),
+		"only the first success since the first attempt counts")
+
+	var untracked *bootstrapTracker
+	untracked.attempt(addr, start)
+	untracked.success(addr, start)
+}
+
+func TestUpstreamBootstrapMetric(t *testing.T) {
+	s := newServer(UDP, func(w dns.ResponseWriter, r *dns.Msg) {
+		msg := new(dns.Msg)
+		msg.SetReply(r)
+		logErrIfNotNil(w.WriteMsg(msg))
+	})
+	defer s.close()
+
+	fs, err := parseFanout(caddy.NewTestController("dns", "fanout . "+s.addr))
+	require.NoError(t, err)
+	f := fs[0]
+	clk := clock.NewManual(time.Now())
+	f.clock = clk
+	require.NoError(t, f.OnStartup())
+	defer func() { logErrIfNotNil(f.OnShutdown()) }()
+	f.bootstrap.attempt(s.addr, clk.Now().Add(-2*time.Second))
+
+	req := new(dns.Msg)
+	req.SetQuestion(testQuery, dns.TypeA)
+	_, err = f.ServeDNS(context.Background(), &test.ResponseWriter{}, req)
+	require.NoError(t, err)
+	require.Equal(t, 2.0, testutil.ToFloat64(UpstreamBootstrapDuration.WithLabelValues(s.addr)),
+		"the metric counts from the first attempt after startup")
+}
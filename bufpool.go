@@ -0,0 +1,41 @@
+// Copyright (c) 2024 MWS and/or its affiliates.
+//
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at:
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fanout
+
+import (
+	"sync"
+
+	"github.com/miekg/dns"
+)
+
+// bufferPool keeps the buffers used to pack requests and read responses, sized for the largest DNS message.
+var bufferPool = sync.Pool{
+	New: func() any {
+		BufferPoolMisses.Inc()
+		buf := make([]byte, dns.MaxMsgSize)
+		return &buf
+	},
+}
+
+func getBuffer() *[]byte {
+	BufferPoolGets.Inc()
+	return bufferPool.Get().(*[]byte)
+}
+
+func putBuffer(buf *[]byte) {
+	bufferPool.Put(buf)
+}
@@ -0,0 +1,239 @@
+// Copyright (c) 2024 MWS and/or its affiliates.
+//
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at:
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fanout
+
+import (
+	"crypto/tls"
+	"strings"
+	"time"
+
+	"github.com/coredns/coredns/plugin"
+	"github.com/hurricanehrndz/fanout/v2/clock"
+	"github.com/pkg/errors"
+)
+
+// Builder assembles a Fanout for programs embedding the plugin outside of a Corefile.
+// Settings are validated the same way as the corresponding Corefile options; the first
+// invalid setting is reported by Build.
+type Builder struct {
+	f     *Fanout
+	hosts []string
+	err   error
+}
+
+// NewBuilder returns a Builder for a fanout serving the root zone with default settings.
+func NewBuilder() *Builder {
+	f := New()
+	f.From = "."
+	return &Builder{f: f}
+}
+
+// WithFrom sets the zone handled by the fanout.
+func (b *Builder) WithFrom(zone string) *Builder {
+	normalized := plugin.Host(zone).NormalizeExact()
+	if len(normalized) == 0 {
+		return b.fail(errors.Errorf("unable to normalize '%s'", zone))
+	}
+	b.f.From = normalized[0]
+	return b
+}
+
+// WithUpstream adds upstreams using the Corefile TO syntax, e.g. "10.0.0.1:53", "tls://9.9.9.9"
+// or a path to a resolv.conf file.
+func (b *Builder) WithUpstream(addrs ...string) *Builder {
+	hosts, err := parseHosts(addrs)
+	if err != nil {
+		return b.fail(err)
+	}
+	b.hosts = append(b.hosts, hosts...)
+	return b
+}
+
+// WithClient adds a preconfigured client, e.g. one using a custom Transport.
+func (b *Builder) WithClient(c Client) *Builder {
+	if c == nil {
+		return b.fail(errors.New("client must not be nil"))
+	}
+	b.f.clients = append(b.f.clients, c)
+	return b
+}
+
+// WithPolicy sets the server selection policy, "sequential", "weighted-random", "latency", "sticky" or a chain
+// such as "weighted-random then latency". For the weighted random policy loadFactor optionally lists the
+// weight of each upstream in order.
+func (b *Builder) WithPolicy(name string, loadFactor ...int) *Builder {
+	stages, err := parsePolicyChain(strings.Fields(name))
+	if err != nil {
+		return b.fail(err)
+	}
+	if len(stages) == 0 {
+		return b.fail(errors.Errorf("unknown policy %q", name))
+	}
+	if err := validateLoadFactor(loadFactor); err != nil {
+		return b.fail(err)
+	}
+	b.f.policyType, b.f.policyThen = stages[0], stages[1:]
+	b.f.loadFactor = loadFactor
+	return b
+}
+
+// WithServerCount limits the number of upstreams requested per query.
+func (b *Builder) WithServerCount(n int) *Builder {
+	if n < 0 {
+		return b.fail(errors.New("server count should be positive"))
+	}
+	b.f.serverCount = n
+	return b
+}
+
+// WithTimeout sets the overall request timeout.
+func (b *Builder) WithTimeout(d time.Duration) *Builder {
+	if d <= 0 {
+		return b.fail(errors.New("timeout should be positive"))
+	}
+	b.f.Timeout = d
+	return b
+}
+
+// WithWorkerCount sets the number of parallel queries per request.
+func (b *Builder) WithWorkerCount(n int) *Builder {
+	if n < minWorkerCount {
+		return b.fail(errors.New("worker count should be more or equal 2. Consider to use Forward plugin"))
+	}
+	if n > maxWorkerCount {
+		return b.fail(errors.Errorf("worker count more then max value: %v", maxWorkerCount))
+	}
+	b.f.WorkerCount = n
+	return b
+}
+
+// WithAttempts sets the number of attempts per upstream, zero means retrying until the timeout.
+func (b *Builder) WithAttempts(n int) *Builder {
+	if n < 0 {
+		return b.fail(errors.New("attempt count should be positive"))
+	}
+	b.f.Attempts = n
+	return b
+}
+
+// WithNetwork sets the upstream network protocol: "udp", "tcp" or "tcp-tls".
+func (b *Builder) WithNetwork(network string) *Builder {
+	network = strings.ToLower(network)
+	if network != TCP && network != UDP && network != TCPTLS {
+		return b.fail(errors.New("unknown network protocol"))
+	}
+	b.f.net = network
+	return b
+}
+
+// WithTLSConfig sets the TLS configuration used for DNS-over-TLS upstreams.
+func (b *Builder) WithTLSConfig(cfg *tls.Config) *Builder {
+	if cfg == nil {
+		return b.fail(errors.New("tls config must not be nil"))
+	}
+	b.f.tlsConfig = cfg
+	b.f.tlsServerName = cfg.ServerName
+	return b
+}
+
+// WithDialer sets the function used to open connections to upstreams added with WithUpstream.
+func (b *Builder) WithDialer(dial DialFunc) *Builder {
+	b.f.dialer = dial
+	return b
+}
+
+// WithExcept excludes domains from proxying.
+func (b *Builder) WithExcept(domains ...string) *Builder {
+	for _, d := range domains {
+		normalized := plugin.Host(d).NormalizeExact()
+		if len(normalized) == 0 {
+			return b.fail(errors.Errorf("unable to normalize '%s'", d))
+		}
+		b.f.ExcludeDomains.AddString(normalized[0])
+	}
+	return b
+}
+
+// WithRace returns the first valid response instead of waiting for an answer-bearing one.
+func (b *Builder) WithRace() *Builder {
+	b.f.Race = true
+	return b
+}
+
+// WithClock sets the time source of attempt delays, health probe intervals and upstream statistics, e.g.
+// a clock.Manual to simulate the passing of time in tests.
+func (b *Builder) WithClock(c clock.Clock) *Builder {
+	if c == nil {
+		return b.fail(errors.New("clock must not be nil"))
+	}
+	b.f.clock = c
+	return b
+}
+
+// WithResponseComparator sets the comparator deciding which upstream response is the better answer and
+// whether it is worth waiting for the other upstreams.
+func (b *Builder) WithResponseComparator(c ResponseComparator) *Builder {
+	if c == nil {
+		return b.fail(errors.New("response comparator must not be nil"))
+	}
+	b.f.comparator = c
+	return b
+}
+
+// WithPreResolveHook sets the hook called before querying the upstreams, which can answer the query
+// instead, e.g. from an external cache.
+func (b *Builder) WithPreResolveHook(h PreResolveHook) *Builder {
+	if h == nil {
+		return b.fail(errors.New("pre-resolution hook must not be nil"))
+	}
+	b.f.preResolveHook = h
+	return b
+}
+
+// WithPostResolveHook sets the hook called with the upstream responses written to the clients, e.g. to
+// populate an external cache.
+func (b *Builder) WithPostResolveHook(h PostResolveHook) *Builder {
+	if h == nil {
+		return b.fail(errors.New("post-resolution hook must not be nil"))
+	}
+	b.f.postResolveHook = h
+	return b
+}
+
+// Build validates the settings and returns the configured Fanout.
+func (b *Builder) Build() (*Fanout, error) {
+	if b.err != nil {
+		return nil, b.err
+	}
+	if len(b.hosts) == 0 && len(b.f.clients) == 0 {
+		return nil, errors.New("at least one upstream is required")
+	}
+	if len(b.hosts)+len(b.f.clients) > maxIPCount {
+		return nil, errors.Errorf("more than %d TOs configured: %d", maxIPCount, len(b.hosts)+len(b.f.clients))
+	}
+	if err := initFanout(b.f, b.hosts); err != nil {
+		return nil, err
+	}
+	return b.f, nil
+}
+
+func (b *Builder) fail(err error) *Builder {
+	if b.err == nil {
+		b.err = err
+	}
+	return b
+}
@@ -0,0 +1,185 @@
+// Copyright (c) 2024 MWS and/or its affiliates.
+//
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at:
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fanout
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/coredns/coredns/plugin/pkg/dnstest"
+	"github.com/coredns/coredns/plugin/test"
+	"github.com/coredns/coredns/request"
+	"github.com/hurricanehrndz/fanout/v2/clock"
+	"github.com/miekg/dns"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBuilder(t *testing.T) {
+	s := newServer(UDP, func(w dns.ResponseWriter, r *dns.Msg) {
+		msg := dns.Msg{Answer: []dns.RR{makeRecordA("example1. 3600 IN A 10.0.0.1")}}
+		msg.SetReply(r)
+		logErrIfNotNil(w.WriteMsg(&msg))
+	})
+	defer s.close()
+
+	f, err := NewBuilder().
+		WithUpstream(s.addr, "127.0.0.2").
+		WithClient(NewClient("127.0.0.3:53", UDP)).
+		WithPolicy(policyWeightedRandom).
+		WithTimeout(time.Second).
+		WithAttempts(1).
+		WithExcept("example.org").
+		Build()
+	require.NoError(t, err)
+	require.Len(t, f.clients, 3)
+	require.Equal(t, "127.0.0.3:53", f.clients[0].Endpoint())
+	require.Equal(t, "127.0.0.2:53", f.clients[2].Endpoint())
+	require.Equal(t, 3, f.WorkerCount)
+	require.Equal(t, 3, f.serverCount)
+	require.Equal(t, time.Second, f.Timeout)
+	require.True(t, f.ExcludeDomains.Contains("example.org."))
+	require.IsType(t, &WeightedPolicy{}, f.ServerSelectionPolicy)
+
+	f, err = NewBuilder().WithUpstream(s.addr).Build()
+	require.NoError(t, err)
+	req := new(dns.Msg)
+	req.SetQuestion(testQuery, dns.TypeA)
+	rec := &cachedDNSWriter{ResponseWriter: new(test.ResponseWriter)}
+	_, err = f.ServeDNS(context.Background(), rec, req)
+	require.NoError(t, err)
+	require.Len(t, rec.answers, 1)
+}
+
+func TestBuilderValidation(t *testing.T) {
+	tests := map[string]struct {
+		builder     *Builder
+		expectedErr string
+	}{
+		"no upstreams":    {builder: NewBuilder(), expectedErr: "at least one upstream is required"},
+		"bad upstream":    {builder: NewBuilder().WithUpstream("aaa"), expectedErr: "not an IP address or file"},
+		"bad zone":        {builder: NewBuilder().WithFrom(".:").WithUpstream("127.0.0.1"), expectedErr: "unable to normalize"},
+		"bad policy":      {builder: NewBuilder().WithUpstream("127.0.0.1").WithPolicy("fastest"), expectedErr: "unknown policy"},
+		"bad load factor": {builder: NewBuilder().WithUpstream("127.0.0.1", "127.0.0.2").WithPolicy(policyWeightedRandom, 50), expectedErr: "load-factor params count"},
+		"bad workers":     {builder: NewBuilder().WithUpstream("127.0.0.1").WithWorkerCount(1), expectedErr: "use Forward plugin"},
+		"bad network":     {builder: NewBuilder().WithUpstream("127.0.0.1").WithNetwork("quic"), expectedErr: "unknown network protocol"},
+		"first error":     {builder: NewBuilder().WithTimeout(0).WithNetwork("quic"), expectedErr: "timeout should be positive"},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			_, err := tc.builder.Build()
+			require.ErrorContains(t, err, tc.expectedErr)
+		})
+	}
+}
+
+func TestBuilderWithClock(t *testing.T) {
+	clk := clock.NewManual(time.Now())
+	c := &staticClient{addr: "203.0.113.2:53", err: errors.New("unreachable")}
+	f, err := NewBuilder().WithClient(c).WithAttempts(3).WithClock(clk).Build()
+	require.NoError(t, err)
+
+	done := make(chan error)
+	go func() {
+		req := new(dns.Msg)
+		req.SetQuestion(testQuery, dns.TypeA)
+		_, err := f.ServeDNS(context.Background(), &cachedDNSWriter{ResponseWriter: new(test.ResponseWriter)}, req)
+		done <- err
+	}()
+	for attempt := int32(1); attempt < 3; attempt++ {
+		require.Eventually(t, func() bool { return clk.Waiters() == 1 }, time.Second, time.Millisecond)
+		require.Equal(t, attempt, c.requests.Load(), "the next attempt waits for the clock")
+		clk.Advance(attemptDelay)
+	}
+	require.ErrorContains(t, <-done, "attempt limit has been reached")
+	require.Equal(t, int32(3), c.requests.Load())
+
+	_, err = NewBuilder().WithClient(c).WithClock(nil).Build()
+	require.Error(t, err)
+}
+
+// answerCountComparator prefers responses with more answers and waits for two of them.
+type answerCountComparator struct{}
+
+func (answerCountComparator) Better(_, current, candidate *dns.Msg) bool {
+	return len(candidate.Answer) > len(current.Answer)
+}
+
+func (answerCountComparator) Final(_, m *dns.Msg) bool {
+	return len(m.Answer) >= 2
+}
+
+func TestBuilderWithResponseComparator(t *testing.T) {
+	req := new(dns.Msg)
+	req.SetQuestion(testQuery, dns.TypeA)
+	one := new(dns.Msg)
+	one.SetReply(req)
+	one.Answer = []dns.RR{makeRecordA("example1. 3600 IN A 10.0.0.1")}
+	two := one.Copy()
+	two.Answer = append(two.Answer, makeRecordA("example1. 3600 IN A 10.0.0.2"))
+
+	f, err := NewBuilder().WithClient(&staticClient{addr: "203.0.113.2:53", reply: one}).
+		WithResponseComparator(answerCountComparator{}).Build()
+	require.NoError(t, err)
+	result := func(msgs ...*dns.Msg) *dns.Msg {
+		responses := make(chan *response, len(msgs))
+		for _, m := range msgs {
+			responses <- &response{response: m}
+		}
+		close(responses)
+		return f.getFanoutResult(context.Background(), &request.Request{Req: req}, responses).response
+	}
+	require.Same(t, two, result(one, two), "the comparator makes the fanout wait for two answers")
+	require.Same(t, two, result(two, one), "a final response ends the wait")
+	require.Same(t, one, result(one), "the best response is kept once every upstream answered")
+
+	_, err = NewBuilder().WithClient(&staticClient{addr: "203.0.113.2:53"}).WithResponseComparator(nil).Build()
+	require.ErrorContains(t, err, "response comparator must not be nil")
+}
+
+func TestBuilderResolveHooks(t *testing.T) {
+	req := new(dns.Msg)
+	req.SetQuestion(testQuery, dns.TypeA)
+	reply := new(dns.Msg)
+	reply.SetReply(req)
+	reply.Answer = []dns.RR{makeRecordA("example1. 3600 IN A 10.0.0.1")}
+	upstream := &staticClient{addr: "203.0.113.2:53", reply: reply}
+
+	var cached *dns.Msg
+	f, err := NewBuilder().WithClient(upstream).
+		WithPreResolveHook(func(_ context.Context, _ *dns.Msg) *dns.Msg { return cached }).
+		WithPostResolveHook(func(_ context.Context, _, resp *dns.Msg) { cached = resp }).
+		Build()
+	require.NoError(t, err)
+	for _, id := range []uint16{req.Id, req.Id + 1} {
+		m := req.Copy()
+		m.Id = id
+		rec := dnstest.NewRecorder(&test.ResponseWriter{})
+		_, err = f.ServeDNS(context.Background(), rec, m)
+		require.NoError(t, err)
+		require.Equal(t, id, rec.Msg.Id)
+		require.Len(t, rec.Msg.Answer, 1)
+	}
+	require.Equal(t, int32(1), upstream.requests.Load(), "the second query is answered by the hook")
+	require.NotSame(t, reply, cached, "the post-resolution hook gets a copy")
+
+	_, err = NewBuilder().WithClient(upstream).WithPreResolveHook(nil).Build()
+	require.ErrorContains(t, err, "pre-resolution hook must not be nil")
+	_, err = NewBuilder().WithClient(upstream).WithPostResolveHook(nil).Build()
+	require.ErrorContains(t, err, "post-resolution hook must not be nil")
+}
@@ -0,0 +1,385 @@
+// Copyright (c) 2024 MWS and/or its affiliates.
+//
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at:
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fanout
+
+import (
+	"context"
+	"encoding/binary"
+	"math"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/coredns/caddy/caddyfile"
+	"github.com/coredns/coredns/request"
+	lru "github.com/hashicorp/golang-lru/v2"
+	"github.com/miekg/dns"
+	"github.com/pkg/errors"
+)
+
+// cacheEntry is a cached response, packed, with the time it was stored at and the upstream it came from.
+type cacheEntry struct {
+	wire     []byte
+	upstream string
+	stored   time.Time
+	expiry   time.Time
+}
+
+// responseCache caches the upstream responses in a local tier, optionally backed by a Redis tier shared by
+// several instances. Concurrent misses of the same query wait for the first one to fill the cache instead
+// of all querying the upstreams.
+type responseCache struct {
+	size    int
+	local   *lru.Cache[string, cacheEntry]
+	shared  *redisBackend
+	mutex   sync.Mutex
+	filling map[string]chan struct{}
+	hits    atomic.Uint64
+	misses  atomic.Uint64
+}
+
+func newResponseCache(size int) (*responseCache, error) {
+	local, err := lru.New[string, cacheEntry](size)
+	if err != nil {
+		return nil, err
+	}
+	return &responseCache{size: size, local: local, filling: map[string]chan struct{}{}}, nil
+}
+
+// debug returns the state of the cache reported by the debug handler, nil without a cache.
+func (c *responseCache) debug() *debugCache {
+	if c == nil {
+		return nil
+	}
+	c.mutex.Lock()
+	filling := len(c.filling)
+	c.mutex.Unlock()
+	return &debugCache{
+		Entries: c.local.Len(),
+		Size:    c.size,
+		Filling: filling,
+		Shared:  c.shared != nil,
+		Hits:    c.hits.Load(),
+		Misses:  c.misses.Load(),
+	}
+}
+
+// parseCache parses `cache [SIZE]`.
+func parseCache(f *Fanout, c *caddyfile.Dispenser) error {
+	args := c.RemainingArgs()
+	if len(args) > 1 {
+		return c.ArgErr()
+	}
+	size := defaultCacheSize
+	if len(args) == 1 {
+		n, err := strconv.Atoi(args[0])
+		if err != nil || n < 1 {
+			return errors.Errorf("invalid cache size %q", args[0])
+		}
+		size = n
+	}
+	cache, err := newResponseCache(size)
+	if err != nil {
+		return err
+	}
+	if f.cache != nil {
+		cache.shared = f.cache.shared
+	}
+	f.cache = cache
+	return nil
+}
+
+// parseCacheRedis parses `cache-redis ADDRESS [PREFIX]`.
+func parseCacheRedis(f *Fanout, c *caddyfile.Dispenser) error {
+	args := c.RemainingArgs()
+	if len(args) == 0 || len(args) > 2 {
+		return c.ArgErr()
+	}
+	addr, err := normalizeAddr(args[0], defaultRedisPort)
+	if err != nil {
+		return errors.Wrap(err, "invalid cache-redis address")
+	}
+	prefix := defaultRedisPrefix
+	if len(args) == 2 {
+		prefix = args[1]
+	}
+	if f.cache == nil {
+		if f.cache, err = newResponseCache(defaultCacheSize); err != nil {
+			return err
+		}
+	}
+	f.cache.shared = newRedisBackend(addr, prefix)
+	return nil
+}
+
+// cacheKey returns the key of the responses to m, or false if they are not cached: queries with several
+// questions or with EDNS options other than cookies, padding and a client subnet are not. Responses to
+// queries with a client subnet are keyed by the subnet, so that answers scoped to it by geo-targeting
+// upstreams aren't served to other subnets.
+func cacheKey(m *dns.Msg) (string, bool) {
+	if len(m.Question) != 1 {
+		return "", false
+	}
+	q := m.Question[0]
+	do := false
+	subnet := ""
+	if opt := m.IsEdns0(); opt != nil {
+		for _, o := range opt.Option {
+			switch o := o.(type) {
+			case *dns.EDNS0_COOKIE, *dns.EDNS0_PADDING:
+			case *dns.EDNS0_SUBNET:
+				subnet = cacheSubnet(o)
+			default:
+				return "", false
+			}
+		}
+		do = opt.Do()
+	}
+	var b strings.Builder
+	b.WriteString(strings.ToLower(q.Name))
+	for _, v := range []uint16{q.Qtype, q.Qclass} {
+		b.WriteByte('/')
+		b.WriteString(strconv.Itoa(int(v)))
+	}
+	for _, flag := range []bool{m.CheckingDisabled, do} {
+		b.WriteByte('/')
+		b.WriteString(strconv.FormatBool(flag))
+	}
+	if subnet != "" {
+		b.WriteByte('/')
+		b.WriteString(subnet)
+	}
+	return b.String(), true
+}
+
+// cacheSubnet returns the client subnet of o, its address masked to its source prefix.
+func cacheSubnet(o *dns.EDNS0_SUBNET) string {
+	bits := net.IPv4len * 8
+	if o.Family == 2 {
+		bits = net.IPv6len * 8
+	}
+	prefix := int(min(o.SourceNetmask, uint8(bits)))
+	return o.Address.Mask(net.CIDRMask(prefix, bits)).String() + "/" + strconv.Itoa(prefix)
+}
+
+// cacheTTL returns how long m may be cached: the smallest TTL of its records, or for negative responses
+// the SOA minimum as RFC 2308 says, capped by maxCacheTTL. Truncated responses, failures and responses
+// without records are not cached.
+func cacheTTL(m *dns.Msg) (time.Duration, bool) {
+	if m.Truncated || (m.Rcode != dns.RcodeSuccess && m.Rcode != dns.RcodeNameError) {
+		return 0, false
+	}
+	ttl := uint32(math.MaxUint32)
+	negative := len(m.Answer) == 0
+	found := false
+	for _, section := range [][]dns.RR{m.Answer, m.Ns, m.Extra} {
+		for _, rr := range section {
+			h := rr.Header()
+			if h.Rrtype == dns.TypeOPT {
+				continue
+			}
+			ttl = min(ttl, h.Ttl)
+			if soa, ok := rr.(*dns.SOA); ok && negative {
+				ttl = min(ttl, soa.Minttl)
+				found = true
+			}
+			found = found || !negative
+		}
+	}
+	if !found || ttl == 0 {
+		return 0, false
+	}
+	return min(time.Duration(ttl)*time.Second, maxCacheTTL), true
+}
+
+// lookup returns the cached response to req, with the TTLs decreased by the time spent in the cache, and
+// the upstream it came from.
+func (c *responseCache) lookup(ctx context.Context, key string, now time.Time) (*dns.Msg, string) {
+	e, ok := c.local.Get(key)
+	if ok && now.Before(e.expiry) {
+		CacheHitCount.WithLabelValues(cacheTierLocal).Inc()
+		c.hits.Add(1)
+		return e.msg(now), e.upstream
+	}
+	if c.shared == nil {
+		return nil, ""
+	}
+	value, err := c.shared.get(ctx, key)
+	if err != nil {
+		if !errors.Is(err, errRedisNil) {
+			log.Debugf("cache %s: %v", key, err)
+		}
+		return nil, ""
+	}
+	e, ok = decodeCacheEntry(value)
+	if !ok || !now.Before(e.expiry) {
+		return nil, ""
+	}
+	CacheHitCount.WithLabelValues(cacheTierShared).Inc()
+	c.hits.Add(1)
+	c.local.Add(key, e)
+	return e.msg(now), e.upstream
+}
+
+// store caches m, the response of upstream written to a client, in both tiers. The shared tier is written in
+// the background so the reply doesn't wait for it.
+func (c *responseCache) store(key string, m *dns.Msg, upstream string, now time.Time) {
+	ttl, ok := cacheTTL(m)
+	if !ok {
+		return
+	}
+	wire, err := m.Pack()
+	if err != nil {
+		return
+	}
+	e := cacheEntry{wire: wire, upstream: upstream, stored: now, expiry: now.Add(ttl)}
+	c.local.Add(key, e)
+	if c.shared == nil {
+		return
+	}
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), redisTimeout)
+		defer cancel()
+		if err := c.shared.set(ctx, key, e.encode(), ttl); err != nil {
+			log.Debugf("cache %s: %v", key, err)
+		}
+	}()
+}
+
+// fill makes the caller the one filling the cache for key. Callers arriving while another one fills it wait
+// until it is done, at most until ctx is done, and get false to look the cache up again; a miss then means
+// the filling query failed. done must be called once the response is stored or the query failed.
+func (c *responseCache) fill(ctx context.Context, key string) (done func(), filling bool) {
+	c.mutex.Lock()
+	ch, ok := c.filling[key]
+	if !ok {
+		ch = make(chan struct{})
+		c.filling[key] = ch
+		c.mutex.Unlock()
+		return func() {
+			c.mutex.Lock()
+			delete(c.filling, key)
+			c.mutex.Unlock()
+			close(ch)
+		}, true
+	}
+	c.mutex.Unlock()
+	select {
+	case <-ch:
+	case <-ctx.Done():
+	}
+	return func() {}, false
+}
+
+// msg unpacks the entry, decreasing the TTLs of the records by the time elapsed since it was stored.
+func (e cacheEntry) msg(now time.Time) *dns.Msg {
+	m := new(dns.Msg)
+	if err := m.Unpack(e.wire); err != nil {
+		return nil
+	}
+	elapsed := uint32(now.Sub(e.stored) / time.Second)
+	for _, section := range [][]dns.RR{m.Answer, m.Ns, m.Extra} {
+		for _, rr := range section {
+			if h := rr.Header(); h.Rrtype != dns.TypeOPT {
+				h.Ttl -= min(h.Ttl, elapsed)
+			}
+		}
+	}
+	return m
+}
+
+// encode returns the entry as stored in the shared tier: the time it was stored at, in Unix milliseconds,
+// and the length of the upstream, followed by the upstream and the packed response.
+func (e cacheEntry) encode() []byte {
+	upstream := e.upstream[:min(len(e.upstream), math.MaxUint8)]
+	b := make([]byte, 0, cacheHeaderSize+len(upstream)+len(e.wire))
+	b = binary.BigEndian.AppendUint64(b, uint64(e.stored.UnixMilli()))
+	b = append(b, byte(len(upstream)))
+	b = append(b, upstream...)
+	return append(b, e.wire...)
+}
+
+func decodeCacheEntry(b []byte) (cacheEntry, bool) {
+	if len(b) <= cacheHeaderSize || len(b) <= cacheHeaderSize+int(b[cacheHeaderSize-1]) {
+		return cacheEntry{}, false
+	}
+	end := cacheHeaderSize + int(b[cacheHeaderSize-1])
+	e := cacheEntry{
+		wire:     b[end:],
+		upstream: string(b[cacheHeaderSize:end]),
+		stored:   time.UnixMilli(int64(binary.BigEndian.Uint64(b))),
+	}
+	m := new(dns.Msg)
+	if err := m.Unpack(e.wire); err != nil {
+		return cacheEntry{}, false
+	}
+	ttl, ok := cacheTTL(m)
+	if !ok {
+		return cacheEntry{}, false
+	}
+	e.expiry = e.stored.Add(ttl)
+	return e, true
+}
+
+// serveCached answers the query from the cache. On a miss, it returns the function to call once the
+// response is stored, or the query failed, releasing the concurrent misses of the same query.
+func (f *Fanout) serveCached(ctx context.Context, req *request.Request) (hit bool, done func()) {
+	key, ok := cacheKey(req.Req)
+	if f.cache == nil || !ok {
+		return false, func() {}
+	}
+	if f.replyCached(ctx, req, key) {
+		return true, nil
+	}
+	done, filling := f.cache.fill(ctx, key)
+	if !filling && ctx.Err() == nil && f.replyCached(ctx, req, key) {
+		return true, nil
+	}
+	// when the filling query failed, its waiters all query the upstreams at once rather than taking turns
+	// filling the cache, each waiting for the upstream timeout
+	CacheMissCount.Inc()
+	f.cache.misses.Add(1)
+	return false, done
+}
+
+// replyCached writes the cached response to req if there is one, ordered and tagged with its upstream as
+// the responses of the upstreams are.
+func (f *Fanout) replyCached(ctx context.Context, req *request.Request, key string) bool {
+	m, upstream := f.cache.lookup(ctx, key, f.clock.Now())
+	if m == nil {
+		return false
+	}
+	m.Id = req.Req.Id
+	m.Question = req.Req.Question
+	f.reorderAnswer(m)
+	f.provenance.tag(req, m, upstream)
+	if f.limitResponseSize {
+		f.truncate(req, m)
+	}
+	logErrIfNotNil(req.W.WriteMsg(m))
+	return true
+}
+
+// storeCached caches the response of upstream, before it is ordered and tagged for the client.
+func (f *Fanout) storeCached(req *request.Request, m *dns.Msg, upstream string) {
+	if key, ok := cacheKey(req.Req); ok && f.cache != nil {
+		f.cache.store(key, m, upstream, f.clock.Now())
+	}
+}
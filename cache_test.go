@@ -0,0 +1,370 @@
+// Copyright (c) 2024 MWS and/or its affiliates.
+//
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at:
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fanout
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/coredns/caddy"
+	"github.com/coredns/coredns/plugin/pkg/dnstest"
+	"github.com/coredns/coredns/plugin/test"
+	"github.com/hurricanehrndz/fanout/v2/clock"
+	"github.com/miekg/dns"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCache(t *testing.T) {
+	var requests atomic.Int32
+	release := make(chan struct{})
+	s := newServer(UDP, func(w dns.ResponseWriter, r *dns.Msg) {
+		requests.Add(1)
+		<-release
+		msg := dns.Msg{Answer: []dns.RR{makeRecordA("example1. 300 IN A 10.0.0.1")}}
+		msg.SetReply(r)
+		logErrIfNotNil(w.WriteMsg(&msg))
+	})
+	defer s.close()
+	fs, err := parseFanout(caddy.NewTestController("dns", "fanout . "+s.addr+" {\ncache 100\n}"))
+	require.NoError(t, err)
+	f := fs[0]
+	manual := clock.NewManual(time.Now())
+	f.clock = manual
+
+	const queries = 10
+	var wg sync.WaitGroup
+	for i := range queries {
+		wg.Go(func() {
+			req := new(dns.Msg)
+			req.SetQuestion(testQuery, dns.TypeA)
+			req.Id = uint16(i)
+			rec := dnstest.NewRecorder(&test.ResponseWriter{})
+			_, err := f.ServeDNS(context.Background(), rec, req)
+			require.NoError(t, err)
+			require.Equal(t, uint16(i), rec.Msg.Id)
+			require.Len(t, rec.Msg.Answer, 1)
+		})
+	}
+	require.Eventually(t, func() bool { return requests.Load() == 1 }, time.Second, time.Millisecond)
+	close(release)
+	wg.Wait()
+	require.Equal(t, int32(1), requests.Load(), "concurrent misses wait for the first one")
+
+	manual.Advance(100 * time.Second)
+	req := new(dns.Msg)
+	req.SetQuestion("EXAMPLE1.", dns.TypeA)
+	rec := dnstest.NewRecorder(&test.ResponseWriter{})
+	_, err = f.ServeDNS(context.Background(), rec, req)
+	require.NoError(t, err)
+	require.Equal(t, int32(1), requests.Load(), "names are cached case-insensitively")
+	require.Equal(t, "EXAMPLE1.", rec.Msg.Question[0].Name)
+	require.Equal(t, uint32(200), rec.Msg.Answer[0].Header().Ttl, "TTLs decrease with the time spent in the cache")
+
+	manual.Advance(200 * time.Second)
+	rec = dnstest.NewRecorder(&test.ResponseWriter{})
+	_, err = f.ServeDNS(context.Background(), rec, req)
+	require.NoError(t, err)
+	require.Equal(t, int32(2), requests.Load(), "expired responses are not served")
+}
+
+func TestCacheTTL(t *testing.T) {
+	soa := &dns.SOA{Hdr: dns.RR_Header{Name: "example.", Rrtype: dns.TypeSOA, Class: dns.ClassINET, Ttl: 3600}, Minttl: 60}
+	nxdomain := &dns.Msg{MsgHdr: dns.MsgHdr{Rcode: dns.RcodeNameError}, Ns: []dns.RR{soa}}
+	ttl, ok := cacheTTL(nxdomain)
+	require.True(t, ok)
+	require.Equal(t, time.Minute, ttl, "negative responses are cached for the SOA minimum")
+
+	long := &dns.Msg{Answer: []dns.RR{makeRecordA("example1. 86400 IN A 10.0.0.1")}}
+	ttl, ok = cacheTTL(long)
+	require.True(t, ok)
+	require.Equal(t, maxCacheTTL, ttl)
+
+	for name, m := range map[string]*dns.Msg{
+		"servfail":  {MsgHdr: dns.MsgHdr{Rcode: dns.RcodeServerFailure}},
+		"truncated": {MsgHdr: dns.MsgHdr{Truncated: true}, Answer: long.Answer},
+		"empty":     {},
+		"zero":      {Answer: []dns.RR{makeRecordA("example1. 0 IN A 10.0.0.1")}},
+	} {
+		_, ok = cacheTTL(m)
+		require.False(t, ok, name)
+	}
+
+}
+
+func TestCacheKeyEDNSOptions(t *testing.T) {
+	key := func(options ...dns.EDNS0) (string, bool) {
+		m := new(dns.Msg)
+		m.SetQuestion(testQuery, dns.TypeA)
+		m.SetEdns0(dns.DefaultMsgSize, false)
+		m.IsEdns0().Option = options
+		return cacheKey(m)
+	}
+	subnet := func(addr string, prefix uint8) *dns.EDNS0_SUBNET {
+		ip := net.ParseIP(addr)
+		family := uint16(1)
+		if ip.To4() == nil {
+			family = 2
+		}
+		return &dns.EDNS0_SUBNET{Code: dns.EDNS0SUBNET, Family: family, SourceNetmask: prefix, Address: ip}
+	}
+	plain, ok := key()
+	require.True(t, ok)
+	cookie, ok := key(&dns.EDNS0_COOKIE{Code: dns.EDNS0COOKIE, Cookie: "0123456789abcdef"},
+		&dns.EDNS0_PADDING{Padding: make([]byte, 16)})
+	require.True(t, ok)
+	require.Equal(t, plain, cookie, "cookies and padding don't change the responses")
+
+	first, ok := key(subnet("192.0.2.1", 24))
+	require.True(t, ok)
+	second, _ := key(subnet("192.0.2.200", 24))
+	other, _ := key(subnet("198.51.100.1", 24))
+	wider, _ := key(subnet("192.0.2.1", 16))
+	v6, _ := key(subnet("2001:db8::1", 56))
+	require.Equal(t, first, second, "clients of the same subnet share the responses")
+	require.NotEqual(t, plain, first)
+	require.NotEqual(t, first, other)
+	require.NotEqual(t, first, wider)
+	require.Contains(t, v6, "2001:db8::/56")
+
+	_, ok = key(&dns.EDNS0_NSID{Code: dns.EDNS0NSID})
+	require.False(t, ok, "queries with other EDNS options are not cached")
+}
+
+func TestCacheFailedFillReleasesWaiters(t *testing.T) {
+	var requests atomic.Int32
+	first, others := make(chan struct{}), make(chan struct{})
+	s := newServer(UDP, func(w dns.ResponseWriter, r *dns.Msg) {
+		if requests.Add(1) == 1 {
+			<-first
+		} else {
+			<-others
+		}
+		msg := new(dns.Msg)
+		msg.SetRcode(r, dns.RcodeServerFailure)
+		logErrIfNotNil(w.WriteMsg(msg))
+	})
+	defer s.close()
+	fs, err := parseFanout(caddy.NewTestController("dns", "fanout . "+s.addr+" {\ncache 100\n}"))
+	require.NoError(t, err)
+	f := fs[0]
+
+	const queries = 5
+	var wg sync.WaitGroup
+	for range queries {
+		wg.Go(func() {
+			req := new(dns.Msg)
+			req.SetQuestion(testQuery, dns.TypeA)
+			_, err := f.ServeDNS(context.Background(), dnstest.NewRecorder(&test.ResponseWriter{}), req)
+			require.NoError(t, err)
+		})
+	}
+	require.Eventually(t, func() bool { return requests.Load() == 1 }, time.Second, time.Millisecond)
+	close(first)
+	parallel := assert.Eventually(t, func() bool { return requests.Load() >= queries }, time.Second, time.Millisecond)
+	close(others)
+	wg.Wait()
+	require.True(t, parallel, "the waiters of a failed fill query the upstreams in parallel")
+}
+
+func TestCacheRedis(t *testing.T) {
+	redis := newFakeRedis(t)
+	var requests atomic.Int32
+	s := newServer(UDP, func(w dns.ResponseWriter, r *dns.Msg) {
+		requests.Add(1)
+		msg := dns.Msg{Answer: []dns.RR{makeRecordA("example1. 300 IN A 10.0.0.1")}}
+		msg.SetReply(r)
+		logErrIfNotNil(w.WriteMsg(&msg))
+	})
+	defer s.close()
+	var instances []*Fanout
+	for range 2 {
+		fs, err := parseFanout(caddy.NewTestController("dns", "fanout . "+s.addr+" {\ncache-redis "+redis.addr+" test:\n}"))
+		require.NoError(t, err)
+		instances = append(instances, fs[0])
+		defer fs[0].closeIdleClients()
+	}
+
+	req := new(dns.Msg)
+	req.SetQuestion(testQuery, dns.TypeA)
+	_, err := instances[0].ServeDNS(context.Background(), dnstest.NewRecorder(&test.ResponseWriter{}), req)
+	require.NoError(t, err)
+	require.Eventually(t, func() bool { return redis.len() == 1 }, time.Second, time.Millisecond)
+	require.True(t, redis.has("test:example1./1/1/false/false"))
+
+	hits := testutil.ToFloat64(CacheHitCount.WithLabelValues(cacheTierShared))
+	rec := dnstest.NewRecorder(&test.ResponseWriter{})
+	_, err = instances[1].ServeDNS(context.Background(), rec, req)
+	require.NoError(t, err)
+	require.Len(t, rec.Msg.Answer, 1)
+	require.Equal(t, int32(1), requests.Load(), "instances share the cached responses")
+	require.Equal(t, hits+1, testutil.ToFloat64(CacheHitCount.WithLabelValues(cacheTierShared)))
+
+	redis.close()
+	instances[1].closeIdleClients()
+	req.SetQuestion("example2.", dns.TypeA)
+	rec = dnstest.NewRecorder(&test.ResponseWriter{})
+	_, err = instances[1].ServeDNS(context.Background(), rec, req)
+	require.NoError(t, err)
+	require.Len(t, rec.Msg.Answer, 1, "an unreachable Redis counts as a miss")
+}
+
+// fakeRedis speaks just enough of the Redis protocol to serve GET and SET.
+type fakeRedis struct {
+	addr     string
+	listener net.Listener
+	mutex    sync.Mutex
+	values   map[string][]byte
+}
+
+func newFakeRedis(t *testing.T) *fakeRedis {
+	listener, err := net.Listen(TCP, "127.0.0.1:0")
+	require.NoError(t, err)
+	r := &fakeRedis{addr: listener.Addr().String(), listener: listener, values: map[string][]byte{}}
+	t.Cleanup(r.close)
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go r.serve(conn)
+		}
+	}()
+	return r
+}
+
+func (r *fakeRedis) serve(conn net.Conn) {
+	defer conn.Close()
+	br := bufio.NewReader(conn)
+	for {
+		args, err := readFakeRedisCommand(br)
+		if err != nil {
+			return
+		}
+		reply := "-ERR unknown command\r\n"
+		r.mutex.Lock()
+		switch {
+		case string(args[0]) == "GET" && len(args) == 2:
+			if v, ok := r.values[string(args[1])]; ok {
+				reply = "$" + strconv.Itoa(len(v)) + "\r\n" + string(v) + "\r\n"
+			} else {
+				reply = "$-1\r\n"
+			}
+		case string(args[0]) == "SET" && len(args) >= 3:
+			r.values[string(args[1])] = args[2]
+			reply = "+OK\r\n"
+		}
+		r.mutex.Unlock()
+		if _, err = io.WriteString(conn, reply); err != nil {
+			return
+		}
+	}
+}
+
+func readFakeRedisCommand(r *bufio.Reader) ([][]byte, error) {
+	var n int
+	if err := readRedisLine(r, '*', &n); err != nil {
+		return nil, err
+	}
+	args := make([][]byte, n)
+	for i := range args {
+		var size int
+		if err := readRedisLine(r, '$', &size); err != nil {
+			return nil, err
+		}
+		args[i] = make([]byte, size+2)
+		if _, err := io.ReadFull(r, args[i]); err != nil {
+			return nil, err
+		}
+		args[i] = args[i][:size]
+	}
+	return args, nil
+}
+
+// readRedisLine reads a line made of prefix followed by an integer.
+func readRedisLine(r *bufio.Reader, prefix byte, n *int) error {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return err
+	}
+	if len(line) < 3 || line[0] != prefix {
+		return io.ErrUnexpectedEOF
+	}
+	*n, err = strconv.Atoi(line[1 : len(line)-2])
+	return err
+}
+
+func (r *fakeRedis) len() int {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return len(r.values)
+}
+
+func (r *fakeRedis) has(key string) bool {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	_, ok := r.values[key]
+	return ok
+}
+
+func (r *fakeRedis) close() {
+	_ = r.listener.Close()
+}
+
+func TestCacheOrdersAndTagsHits(t *testing.T) {
+	var requests atomic.Int32
+	s := newServer(UDP, func(w dns.ResponseWriter, r *dns.Msg) {
+		requests.Add(1)
+		msg := dns.Msg{Answer: []dns.RR{
+			makeRecordA("example1. 300 IN A 10.0.0.1"),
+			makeRecordA("example1. 300 IN A 10.0.0.2"),
+			makeRecordA("example1. 300 IN A 10.0.0.3"),
+		}}
+		msg.SetReply(r)
+		logErrIfNotNil(w.WriteMsg(&msg))
+	})
+	defer s.close()
+	fs, err := parseFanout(caddy.NewTestController("dns", "fanout . "+s.addr+" {\ncache 100\nanswer-order rotate\nprovenance txt\n}"))
+	require.NoError(t, err)
+
+	var orders [][]string
+	for range 3 {
+		req := new(dns.Msg)
+		req.SetQuestion(testQuery, dns.TypeA)
+		rec := dnstest.NewRecorder(&test.ResponseWriter{})
+		_, err = fs[0].ServeDNS(context.Background(), rec, req)
+		require.NoError(t, err)
+		orders = append(orders, answerAddresses(rec.Msg))
+		require.Len(t, rec.Msg.Extra, 1, "the cached response is tagged once")
+		require.Equal(t, []string{s.addr}, rec.Msg.Extra[0].(*dns.TXT).Txt, "hits are tagged with the upstream of the response")
+	}
+	require.Equal(t, int32(1), requests.Load())
+	require.Equal(t, [][]string{
+		{"10.0.0.2", "10.0.0.3", "10.0.0.1"},
+		{"10.0.0.3", "10.0.0.1", "10.0.0.2"},
+		{"10.0.0.1", "10.0.0.2", "10.0.0.3"},
+	}, orders, "hits are rotated from the order of the upstream")
+}
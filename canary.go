@@ -0,0 +1,132 @@
+// Copyright (c) 2024 MWS and/or its affiliates.
+//
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at:
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fanout
+
+import (
+	"strings"
+	"time"
+
+	"github.com/coredns/caddy/caddyfile"
+	"github.com/miekg/dns"
+	"github.com/pkg/errors"
+)
+
+// canary is a query with a known-correct answer, sent periodically to every upstream to detect upstreams
+// serving forged or poisoned records.
+type canary struct {
+	name     string
+	qtype    uint16
+	expected map[string]struct{}
+}
+
+// parseCanary parses `canary NAME TYPE DATA...`, each DATA being the data of an expected record.
+func parseCanary(f *Fanout, c *caddyfile.Dispenser) error {
+	args := c.RemainingArgs()
+	if len(args) < 3 {
+		return c.ArgErr()
+	}
+	qtype, ok := dns.StringToType[strings.ToUpper(args[1])]
+	if !ok {
+		return errors.Errorf("unknown canary type %q", args[1])
+	}
+	cn := canary{name: dns.CanonicalName(args[0]), qtype: qtype, expected: map[string]struct{}{}}
+	for _, data := range args[2:] {
+		rr, err := dns.NewRR(cn.name + " 0 IN " + dns.TypeToString[qtype] + " " + data)
+		if err != nil || rr == nil {
+			return errors.Errorf("invalid canary %s record data %q", args[1], data)
+		}
+		cn.expected[rdata(rr)] = struct{}{}
+	}
+	f.canaries = append(f.canaries, cn)
+	return nil
+}
+
+func parseCanaryInterval(f *Fanout, c *caddyfile.Dispenser) error {
+	if !c.NextArg() {
+		return c.ArgErr()
+	}
+	d, err := time.ParseDuration(c.Val())
+	if err != nil || d <= 0 {
+		return errors.Errorf("invalid canary-interval %q", c.Val())
+	}
+	if c.NextArg() {
+		return c.ArgErr()
+	}
+	f.canaryInterval = d
+	return nil
+}
+
+// rdata returns the presentation format of the data of rr, without its header.
+func rdata(rr dns.RR) string {
+	return strings.TrimPrefix(rr.String(), rr.Header().String())
+}
+
+// diverges reports whether the answer m of an upstream doesn't match the canary: it must hold at least one
+// record of the canary type, all of them expected.
+func (cn *canary) diverges(m *dns.Msg) bool {
+	found := false
+	for _, rr := range m.Answer {
+		if rr.Header().Rrtype != cn.qtype {
+			continue
+		}
+		if _, ok := cn.expected[rdata(rr)]; !ok {
+			return true
+		}
+		found = true
+	}
+	return !found
+}
+
+// canaryTask sends the canaries to every upstream about every canary-interval, from startup until
+// shutdown. Upstreams which don't answer are left to the health probes; the others
+// are flagged as divergent with a metric and a warning when their answer doesn't match.
+func (f *Fanout) canaryTask() task {
+	divergent := map[string]bool{}
+	stop := f.tasks.done()
+	return task{interval: f.canaryInterval, jitter: taskJitter, immediate: true, run: func(time.Time) bool {
+		for _, c := range f.upstreams() {
+			for i := range f.canaries {
+				f.checkCanary(c, &f.canaries[i], divergent, stop)
+			}
+		}
+		return true
+	}}
+}
+
+// checkCanary sends the canary to c, warning when the upstream starts diverging. divergent holds the
+// previous outcome of each upstream and canary, keyed by its name and type.
+func (f *Fanout) checkCanary(c Client, cn *canary, divergent map[string]bool, stop <-chan struct{}) {
+	m := new(dns.Msg)
+	m.SetQuestion(cn.name, cn.qtype)
+	resp, err := probeQuery(c, m, stop)
+	if err != nil {
+		return
+	}
+	qtype := dns.TypeToString[cn.qtype]
+	key := c.Endpoint() + " " + cn.name + " " + qtype
+	diverges := cn.diverges(resp)
+	if diverges && !divergent[key] {
+		log.Warningf("fanout: upstream %s answers canary %s %s with unexpected records, it may be poisoned",
+			c.Endpoint(), cn.name, qtype)
+	}
+	divergent[key] = diverges
+	value := 0.0
+	if diverges {
+		value = 1
+	}
+	UpstreamCanaryDivergent.WithLabelValues(c.Endpoint(), cn.name, qtype).Set(value)
+}
@@ -0,0 +1,83 @@
+// Copyright (c) 2024 MWS and/or its affiliates.
+//
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at:
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fanout
+
+import (
+	"testing"
+	"time"
+
+	"github.com/coredns/caddy"
+	"github.com/miekg/dns"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/goleak"
+)
+
+func TestCanary(t *testing.T) {
+	defer goleak.VerifyNone(t)
+	answer := func(data string) dns.HandlerFunc {
+		return func(w dns.ResponseWriter, r *dns.Msg) {
+			msg := new(dns.Msg)
+			msg.SetReply(r)
+			if r.Question[0].Qtype == dns.TypeA {
+				rr, err := dns.NewRR(r.Question[0].Name + " 60 IN A " + data)
+				require.NoError(t, err)
+				msg.Answer = append(msg.Answer, rr)
+			}
+			logErrIfNotNil(w.WriteMsg(msg))
+		}
+	}
+	honest := newServer(UDP, answer("192.0.2.10"))
+	defer honest.close()
+	poisoned := newServer(UDP, answer("203.0.113.66"))
+	defer poisoned.close()
+
+	fs, err := parseFanout(caddy.NewTestController("dns", "fanout . "+honest.addr+" "+poisoned.addr+
+		" {\ncanary canary.example.net A 192.0.2.10 192.0.2.11\ncanary canary.example.net TXT expected\ncanary-interval 1h\n}"))
+	require.NoError(t, err)
+	f := fs[0]
+	require.NoError(t, f.OnStartup())
+	defer func() { require.NoError(t, f.OnShutdown()) }()
+
+	divergent := func(addr, qtype string) float64 {
+		return testutil.ToFloat64(UpstreamCanaryDivergent.WithLabelValues(addr, "canary.example.net.", qtype))
+	}
+	require.Eventually(t, func() bool { return divergent(poisoned.addr, "A") == 1 }, time.Second, 10*time.Millisecond)
+	require.Eventually(t, func() bool { return divergent(honest.addr, "TXT") == 1 }, time.Second, 10*time.Millisecond)
+	require.Zero(t, divergent(honest.addr, "A"), "the canaries of the same name are tracked by type")
+
+	for _, config := range []string{"canary a.example A", "canary a.example BOGUS 1.2.3.4", "canary a.example A not-an-ip", "canary-interval 0s"} {
+		_, err = parseFanout(caddy.NewTestController("dns", "fanout . 127.0.0.1 {\n"+config+"\n}"))
+		require.Error(t, err, config)
+	}
+}
+
+func TestCanaryDiverges(t *testing.T) {
+	cn := &canary{qtype: dns.TypeA, expected: map[string]struct{}{"192.0.2.10": {}}}
+	msg := func(rrs ...string) *dns.Msg {
+		m := new(dns.Msg)
+		for _, s := range rrs {
+			rr, err := dns.NewRR(s)
+			require.NoError(t, err)
+			m.Answer = append(m.Answer, rr)
+		}
+		return m
+	}
+	require.False(t, cn.diverges(msg("c.example. 60 IN CNAME t.example.", "t.example. 60 IN A 192.0.2.10")))
+	require.True(t, cn.diverges(msg()), "an empty answer diverges")
+	require.True(t, cn.diverges(msg("t.example. 60 IN A 192.0.2.10", "t.example. 60 IN A 198.51.100.1")))
+}
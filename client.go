@@ -19,14 +19,17 @@ package fanout
 import (
 	"context"
 	"crypto/tls"
-	"fmt"
+	"io"
 	"math"
+	"syscall"
 	"time"
 
 	"github.com/coredns/coredns/request"
+	"github.com/hurricanehrndz/fanout/v2/clock"
 	"github.com/miekg/dns"
 	ot "github.com/opentracing/opentracing-go"
 	otext "github.com/opentracing/opentracing-go/ext"
+	"github.com/pkg/errors"
 )
 
 // Client represents the proxy for remote DNS server
@@ -43,30 +46,52 @@ type client struct {
 	net                   string
 	udpBufferSize         uint16
 	udpBufferSizeOverride uint16
+	randomizeID           bool
+	matchTransport        bool
+	answerSizes           *answerSizes
+	caps                  *ednsCapabilities
+	clock                 clock.Clock
 }
 
-// NewClient creates new client with specific addr and network
+// NewClient creates new client with specific addr and network. An address without a port gets the
+// default port of the network, 53 or 853 for DNS-over-TLS.
 func NewClient(addr, net string) Client {
+	addr = clientAddr(addr, net)
 	a := &client{
 		addr:          addr,
 		net:           net,
 		transport:     NewTransport(addr),
 		udpBufferSize: minUDPBufferSize,
+		clock:         clock.Real(),
 	}
 	return a
 }
 
 // NewClientWithUDPBufferSize creates a client with a specific UDP buffer size.
 func NewClientWithUDPBufferSize(addr, net string, udpBufferSize uint16) Client {
+	addr = clientAddr(addr, net)
 	a := &client{
 		addr:          addr,
 		net:           net,
 		transport:     NewTransport(addr),
 		udpBufferSize: udpBufferSize,
+		clock:         clock.Real(),
 	}
 	return a
 }
 
+// NewClientWithTransport creates a client with a specific addr and network which connects to the
+// upstream using the provided transport.
+func NewClientWithTransport(addr, net string, t Transport) Client {
+	return &client{
+		addr:          clientAddr(addr, net),
+		net:           net,
+		transport:     t,
+		udpBufferSize: minUDPBufferSize,
+		clock:         clock.Real(),
+	}
+}
+
 // SetTLSConfig sets tls config for client
 func (c *client) SetTLSConfig(cfg *tls.Config) {
 	if cfg != nil {
@@ -95,31 +120,88 @@ func (c *client) Request(ctx context.Context, r *request.Request) (*dns.Msg, err
 		defer childSpan.Finish()
 	}
 	start := time.Now()
+	ret, proto, err := c.request(ctx, r)
+	observeRequest(ctx, c.addr, proto, ret, err, start)
+	return ret, err
+}
+
+// request sends the request over the network of the client, resending it once when the upstream rejects
+// EDNS or the cookie it carries. It returns the protocol of the exchange for the metrics.
+func (c *client) request(ctx context.Context, r *request.Request) (*dns.Msg, string, error) {
 	network := c.net
-	requestDone := make(chan struct{})
-	defer close(requestDone)
+	if network == UDP && (c.answerSizes.preferTCP(r.QType()) || c.matchTransport && r.Proto() == TCP) {
+		// a client asking over TCP likely got a truncated response already, the UDP attempt would be too
+		network = TCP
+	}
+	req, cookie := c.prepare(ctx, r, network)
+	ret, proto, err := c.send(ctx, r, network, req)
+	if err == nil && c.caps.retry(req, ret, c.clock.Now()) {
+		// the upstream rejected EDNS or the server cookie, resend as it is now known to expect
+		req, cookie = c.prepare(ctx, r, network)
+		ret, proto, err = c.send(ctx, r, network, req)
+	}
+	if err != nil {
+		c.caps.failed(req, network, err, c.clock.Now())
+		return nil, proto, err
+	}
+	c.caps.observe(ret, cookie)
+	return ret, proto, nil
+}
 
+// prepare returns the request to send to the upstream over network, and whether a cookie was added to it.
+func (c *client) prepare(ctx context.Context, r *request.Request, network string) (*dns.Msg, bool) {
 	req := r.Req
-	if network == UDP {
+	if network == UDP || c.randomizeID || c.caps != nil || hasHops(ctx) {
 		req = r.Req.Copy()
+	}
+	now := c.clock.Now()
+	if c.caps.withoutEDNS(now) {
+		stripEDNS(req)
+	} else if network == UDP {
 		opt := req.IsEdns0()
 		if opt == nil {
 			size := c.udpBufferSize
 			if c.udpBufferSizeOverride != 0 {
 				size = c.udpBufferSizeOverride
 			}
-			req.SetEdns0(size, false)
+			req.SetEdns0(c.caps.udpSize(size, now), false)
 		} else if c.udpBufferSizeOverride != 0 {
-			opt.SetUDPSize(c.udpBufferSizeOverride)
+			opt.SetUDPSize(c.caps.udpSize(c.udpBufferSizeOverride, now))
+		} else {
+			opt.SetUDPSize(c.caps.udpSize(opt.UDPSize(), now))
 		}
 	}
+	if !c.caps.withoutEDNS(now) {
+		setHops(ctx, req)
+	}
+	if c.randomizeID {
+		req.Id = dns.Id()
+	}
+	return req, c.caps.addCookie(req)
+}
 
+// send exchanges req with the upstream over network, retrying over TCP when the UDP response is truncated.
+func (c *client) send(ctx context.Context, r *request.Request, network string, req *dns.Msg) (*dns.Msg, string, error) {
+	reuse, fellBack := true, false
+	if network == UDP {
+		ret, batched, err := c.exchangeBatched(ctx, req)
+		if batched {
+			if err != nil {
+				return nil, protoLabel(network, fellBack), err
+			}
+			c.answerSizes.observe(r.QType(), ret)
+			if !ret.Truncated {
+				ret.Id = r.Req.Id
+				return ret, protoLabel(network, fellBack), nil
+			}
+			network, fellBack = TCP, true
+		}
+	}
 	for {
-		conn, err := c.transport.Dial(ctx, network)
+		conn, reused, err := c.dial(ctx, network, reuse)
 		if err != nil {
-			return nil, err
+			return nil, protoLabel(network, fellBack), err
 		}
-		defer conn.Close() //nolint:errcheck
 
 		udpSize := r.Size()
 		if udpSize > math.MaxUint16 {
@@ -127,47 +209,143 @@ func (c *client) Request(ctx context.Context, r *request.Request) (*dns.Msg, err
 		}
 		conn.UDPSize = max(uint16(udpSize), c.udpBufferSize)
 
-		go func(conn *dns.Conn) {
-			select {
-			case <-ctx.Done():
-				_ = conn.Close()
-			case <-requestDone:
-			}
-		}(conn)
-		if err = conn.SetWriteDeadline(time.Now().Add(maxTimeout)); err != nil {
-			return nil, err
-		}
-		if err = conn.WriteMsg(req); err != nil {
-			return nil, err
-		}
-		if err = conn.SetReadDeadline(time.Now().Add(readTimeout)); err != nil {
-			return nil, err
+		if err = setDeadlines(ctx, conn); err != nil {
+			_ = conn.Close()
+			return nil, protoLabel(network, fellBack), err
 		}
-		var ret *dns.Msg
-
-		for {
-			ret, err = conn.ReadMsg()
-			if err != nil {
-				return nil, err
-			}
-			if r.Req.Id == ret.Id {
-				break
+		stop := interruptOnDone(ctx, conn)
+		ret, err := exchangeWithFailpoint(ctx, c.addr, conn, req)
+		interrupted := stop()
+		if err != nil {
+			_ = conn.Close()
+			if reused && !interrupted && isStaleConnErr(err) {
+				// the upstream closed the idle connection, retry once on a fresh one
+				StaleConnCount.WithLabelValues(c.addr).Add(1)
+				reuse = false
+				continue
 			}
+			return nil, protoLabel(network, fellBack), err
 		}
+		c.answerSizes.observe(r.QType(), ret)
 
 		if ret.Truncated && network == UDP {
 			_ = conn.Close()
-			network = TCP
+			network, fellBack = TCP, true
 			continue
 		}
+		if interrupted {
+			_ = conn.Close()
+		} else {
+			c.transport.Yield(conn)
+		}
+
+		// with randomized IDs the response carries the upstream ID, restore the one of the client
+		ret.Id = r.Req.Id
 
-		rc, ok := dns.RcodeToString[ret.Rcode]
-		if !ok {
-			rc = fmt.Sprint(ret.Rcode)
+		return ret, protoLabel(network, fellBack), nil
+	}
+}
+
+// dial returns a connection to the upstream and whether it was taken from the pool of the transport. With
+// reuse unset, a fresh connection is opened when the transport is the built-in one.
+func (c *client) dial(ctx context.Context, network string, reuse bool) (*dns.Conn, bool, error) {
+	if t, ok := c.transport.(*transportImpl); ok {
+		return t.dialPooled(ctx, network, reuse)
+	}
+	conn, err := c.transport.Dial(ctx, network)
+	return conn, false, err
+}
+
+// isStaleConnErr reports whether err is the reset or end of file met on a connection the peer closed.
+func isStaleConnErr(err error) bool {
+	return errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) ||
+		errors.Is(err, syscall.ECONNRESET) || errors.Is(err, syscall.EPIPE)
+}
+
+// Prewarm establishes a stream connection to the upstream, completing any TLS handshake, and keeps it
+// for the next request. Plain UDP clients have nothing to prewarm.
+func (c *client) Prewarm(ctx context.Context) error {
+	if c.net == UDP {
+		return nil
+	}
+	conn, err := c.transport.Dial(ctx, c.net)
+	if err != nil {
+		return err
+	}
+	c.transport.Yield(conn)
+	return nil
+}
+
+// pingIdle checks the pooled connections of the client transport idle for at least idle.
+func (c *client) pingIdle(idle time.Duration) {
+	if t, ok := c.transport.(*transportImpl); ok {
+		t.pingIdle(idle)
+	}
+}
+
+// closeIdle closes connections kept for reuse by the client transport.
+func (c *client) closeIdle() {
+	if t, ok := c.transport.(*transportImpl); ok {
+		t.closeIdle()
+	}
+}
+
+// exchange writes the request to conn and reads replies until one matches the request ID. The request is
+// packed and the replies are read using a pooled buffer.
+func exchange(conn *dns.Conn, req *dns.Msg) (*dns.Msg, error) {
+	buf := getBuffer()
+	defer putBuffer(buf)
+	out, err := req.PackBuffer(*buf)
+	if err != nil {
+		return nil, err
+	}
+	if _, err = conn.Write(out); err != nil {
+		return nil, err
+	}
+	for {
+		n, err := conn.Read(*buf)
+		if err != nil {
+			return nil, err
 		}
-		RequestCount.WithLabelValues(c.addr).Add(1)
-		RcodeCount.WithLabelValues(rc, c.addr).Add(1)
-		RequestDuration.WithLabelValues(c.addr).Observe(time.Since(start).Seconds())
-		return ret, nil
+		ret := new(dns.Msg)
+		if err := ret.Unpack((*buf)[:n]); err != nil {
+			return nil, err
+		}
+		if req.Id == ret.Id {
+			return ret, nil
+		}
+	}
+}
+
+// setDeadlines sets the write and read deadlines of an exchange over conn from the remaining time in ctx,
+// capped by maxTimeout and readTimeout, so retries near the fanout timeout don't outlive it.
+func setDeadlines(ctx context.Context, conn *dns.Conn) error {
+	now := time.Now()
+	write, read := now.Add(maxTimeout), now.Add(readTimeout)
+	if d, ok := ctx.Deadline(); ok {
+		write, read = minTime(write, d), minTime(read, d)
+	}
+	if err := conn.SetWriteDeadline(write); err != nil {
+		return err
+	}
+	return conn.SetReadDeadline(read)
+}
+
+func minTime(a, b time.Time) time.Time {
+	if b.Before(a) {
+		return b
+	}
+	return a
+}
+
+// interruptOnDone expires the deadlines of conn once ctx is done, unblocking a pending write or read. conn is
+// never closed by the watch, it stays owned by the caller, and no goroutine is started unless ctx is done.
+// stop unregisters the watch and reports whether conn has been interrupted, in which case it must not be reused.
+func interruptOnDone(ctx context.Context, conn *dns.Conn) (stop func() bool) {
+	unregister := context.AfterFunc(ctx, func() {
+		_ = conn.SetDeadline(time.Unix(1, 0))
+	})
+	return func() bool {
+		return !unregister()
 	}
 }
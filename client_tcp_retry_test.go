@@ -25,6 +25,7 @@ import (
 
 	"github.com/coredns/coredns/plugin/test"
 	"github.com/coredns/coredns/request"
+	"github.com/hurricanehrndz/fanout/v2/clock"
 	"github.com/miekg/dns"
 	"github.com/stretchr/testify/require"
 	"go.uber.org/goleak"
@@ -101,6 +102,7 @@ func TestTCPRetryOnTruncatedUDP(t *testing.T) {
 	require.Equal(t, int32(1), udpCallCount.Load(), "Expected exactly 1 UDP call")
 	require.Equal(t, int32(1), tcpCallCount.Load(), "Expected exactly 1 TCP call")
 	require.Len(t, resp.Answer, 2, "TCP response should have 2 answers")
+	require.Equal(t, uint64(1), sampleCount(t, RequestDuration.WithLabelValues(tcpListener.Addr().String(), protoUDPTCP, "NOERROR", "")))
 }
 
 func TestClientCancellationDuringUDPToTCPFallbackIsRaceFree(t *testing.T) {
@@ -117,7 +119,7 @@ func TestClientCancellationDuringUDPToTCPFallbackIsRaceFree(t *testing.T) {
 			Transport: NewTransport(s.addr),
 			tcpDialed: make(chan struct{}),
 		}
-		c := &client{addr: s.addr, net: UDP, transport: transport, udpBufferSize: minUDPBufferSize}
+		c := &client{addr: s.addr, net: UDP, transport: transport, udpBufferSize: minUDPBufferSize, clock: clock.Real()}
 		req := new(dns.Msg)
 		req.SetQuestion(testQuery, dns.TypeA)
 		ctx, cancel := context.WithCancel(context.Background())
@@ -18,8 +18,12 @@ package fanout
 
 import (
 	"context"
+	"fmt"
+	"runtime"
 	"testing"
+	"time"
 
+	"github.com/coredns/caddy"
 	"github.com/coredns/coredns/plugin/test"
 	"github.com/coredns/coredns/request"
 	"github.com/miekg/dns"
@@ -178,3 +182,93 @@ func TestClientDoesNotOverrideEDNSForTCP(t *testing.T) {
 		})
 	}
 }
+
+func TestClientLeavesNoWatcherBehindAfterResponse(t *testing.T) {
+	s := newServer(TCP, func(w dns.ResponseWriter, req *dns.Msg) {
+		resp := new(dns.Msg)
+		resp.SetReply(req)
+		logErrIfNotNil(w.WriteMsg(resp))
+	})
+	defer s.close()
+	c := NewClient(s.addr, TCP)
+	defer c.(*client).closeIdle()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	request := func() {
+		req := new(dns.Msg)
+		req.SetQuestion(testQuery, dns.TypeA)
+		_, err := c.Request(ctx, &request.Request{W: &test.ResponseWriter{TCP: true}, Req: req})
+		require.NoError(t, err)
+	}
+	request()
+	before := runtime.NumGoroutine()
+	for i := 0; i < 10; i++ {
+		request()
+	}
+	require.LessOrEqual(t, runtime.NumGoroutine(), before)
+}
+
+func TestClientCancellationInterruptsExchange(t *testing.T) {
+	s := newServer(TCP, func(dns.ResponseWriter, *dns.Msg) {})
+	defer s.close()
+	tr := NewTransport(s.addr).(*transportImpl)
+	c := NewClientWithTransport(s.addr, TCP, tr)
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(100*time.Millisecond, cancel)
+
+	req := new(dns.Msg)
+	req.SetQuestion(testQuery, dns.TypeA)
+	start := time.Now()
+	_, err := c.Request(ctx, &request.Request{W: &test.ResponseWriter{TCP: true}, Req: req})
+	require.Error(t, err)
+	require.Less(t, time.Since(start), time.Second)
+	require.Empty(t, tr.conns[TCP])
+}
+
+func TestClientDeadlineFollowsContext(t *testing.T) {
+	s := newServer(UDP, func(dns.ResponseWriter, *dns.Msg) {})
+	defer s.close()
+	c := NewClient(s.addr, UDP)
+	ctx, cancel := context.WithTimeout(context.Background(), 150*time.Millisecond)
+	defer cancel()
+
+	req := new(dns.Msg)
+	req.SetQuestion(testQuery, dns.TypeA)
+	start := time.Now()
+	_, err := c.Request(ctx, &request.Request{W: &test.ResponseWriter{}, Req: req})
+	require.Error(t, err)
+	require.Less(t, time.Since(start), readTimeout/2)
+}
+
+func TestClientRandomizesIDPerUpstream(t *testing.T) {
+	received := make(chan uint16, 2)
+	handler := func(w dns.ResponseWriter, r *dns.Msg) {
+		received <- r.Id
+		msg := dns.Msg{Answer: []dns.RR{makeRecordA("example1. 3600 IN A 10.0.0.1")}}
+		msg.SetReply(r)
+		logErrIfNotNil(w.WriteMsg(&msg))
+	}
+	s1 := newServer(UDP, handler)
+	defer s1.close()
+	s2 := newServer(UDP, handler)
+	defer s2.close()
+
+	input := fmt.Sprintf("fanout . %s %s {\nrandomize-id\n}", s1.addr, s2.addr)
+	fs, err := parseFanout(caddy.NewTestController("dns", input))
+	require.NoError(t, err)
+	f := fs[0]
+
+	req := new(dns.Msg)
+	req.SetQuestion(testQuery, dns.TypeA)
+	req.Id = 4242
+	writer := &cachedDNSWriter{ResponseWriter: new(test.ResponseWriter)}
+	_, err = f.ServeDNS(context.Background(), writer, req)
+	require.NoError(t, err)
+	require.Len(t, writer.answers, 1)
+	require.Equal(t, uint16(4242), writer.answers[0].Id)
+	require.Equal(t, uint16(4242), req.Id)
+
+	// a collision of the random IDs is possible but unlikely enough for the test
+	require.NotEqual(t, <-received, <-received)
+}
@@ -0,0 +1,72 @@
+// Copyright (c) 2024 MWS and/or its affiliates.
+//
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at:
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fanout
+
+import (
+	"sync"
+
+	"github.com/coredns/coredns/request"
+	"github.com/miekg/dns"
+)
+
+// clientLimiter caps the number of requests a single downstream client IP may have in flight, so that one
+// misbehaving stub can't flood the upstreams.
+type clientLimiter struct {
+	limit    int
+	truncate bool
+	mutex    sync.Mutex
+	active   map[string]int
+}
+
+func newClientLimiter(limit int, truncate bool) *clientLimiter {
+	return &clientLimiter{limit: limit, truncate: truncate, active: map[string]int{}}
+}
+
+// acquire returns false if the client already has limit requests in flight, otherwise the caller must release.
+func (l *clientLimiter) acquire(ip string) bool {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if l.active[ip] >= l.limit {
+		return false
+	}
+	l.active[ip]++
+	return true
+}
+
+func (l *clientLimiter) release(ip string) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if l.active[ip] <= 1 {
+		delete(l.active, ip)
+		return
+	}
+	l.active[ip]--
+}
+
+// reject answers a request over the limit: with an empty truncated response over UDP when configured to,
+// sending the client to TCP, and with REFUSED otherwise.
+func (l *clientLimiter) reject(req *request.Request) (int, error) {
+	ClientLimitedCount.Add(1)
+	if !l.truncate || req.Proto() != UDP {
+		return dns.RcodeRefused, nil
+	}
+	m := new(dns.Msg)
+	m.SetReply(req.Req)
+	m.Truncated = true
+	logErrIfNotNil(req.W.WriteMsg(m))
+	return 0, nil
+}
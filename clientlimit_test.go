@@ -0,0 +1,94 @@
+// Copyright (c) 2024 MWS and/or its affiliates.
+//
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at:
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fanout
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/coredns/caddy"
+	"github.com/coredns/coredns/plugin/test"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMaxConcurrentPerClient(t *testing.T) {
+	release := make(chan struct{})
+	s := newServer(UDP, func(w dns.ResponseWriter, r *dns.Msg) {
+		<-release
+		msg := dns.Msg{Answer: []dns.RR{makeRecordA("example1. 3600 IN A 10.0.0.1")}}
+		msg.SetReply(r)
+		logErrIfNotNil(w.WriteMsg(&msg))
+	})
+	defer s.close()
+
+	for action, expected := range map[string]int{clientLimitRefused: dns.RcodeRefused, clientLimitTruncate: 0} {
+		input := fmt.Sprintf("fanout . %s {\nmax-concurrent-per-client 1 %s\n}", s.addr, action)
+		fs, err := parseFanout(caddy.NewTestController("dns", input))
+		require.NoError(t, err)
+		f := fs[0]
+
+		serve := func(ip string) (int, *cachedDNSWriter) {
+			req := new(dns.Msg)
+			req.SetQuestion(testQuery, dns.TypeA)
+			writer := &cachedDNSWriter{ResponseWriter: &test.ResponseWriter{RemoteIP: ip}}
+			rcode, err := f.ServeDNS(context.Background(), writer, req)
+			require.NoError(t, err)
+			return rcode, writer
+		}
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			_, writer := serve("10.0.0.1")
+			require.Len(t, writer.answers, 1)
+			require.Len(t, writer.answers[0].Answer, 1)
+		}()
+		require.Eventually(t, func() bool {
+			f.clientLimit.mutex.Lock()
+			defer f.clientLimit.mutex.Unlock()
+			return f.clientLimit.active["10.0.0.1"] == 1
+		}, time.Second, 5*time.Millisecond)
+
+		rcode, writer := serve("10.0.0.1")
+		require.Equal(t, expected, rcode, action)
+		if action == clientLimitTruncate {
+			require.Len(t, writer.answers, 1)
+			require.True(t, writer.answers[0].Truncated)
+		}
+
+		go func() { release <- struct{}{} }()
+		go func() { release <- struct{}{} }()
+		_, writer = serve("10.0.0.2")
+		require.Len(t, writer.answers, 1, "other clients are not limited")
+		<-done
+		require.Empty(t, f.clientLimit.active)
+	}
+}
+
+func TestSetupMaxConcurrentPerClient(t *testing.T) {
+	fs, err := parseFanout(caddy.NewTestController("dns", "fanout . 127.0.0.1 {\nmax-concurrent-per-client 10\n}"))
+	require.NoError(t, err)
+	require.Equal(t, 10, fs[0].clientLimit.limit)
+	require.False(t, fs[0].clientLimit.truncate)
+
+	for _, input := range []string{"max-concurrent-per-client", "max-concurrent-per-client 0", "max-concurrent-per-client 1 drop"} {
+		_, err = parseFanout(caddy.NewTestController("dns", "fanout . 127.0.0.1 {\n"+input+"\n}"))
+		require.Error(t, err, input)
+	}
+}
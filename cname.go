@@ -0,0 +1,94 @@
+// Copyright (c) 2024 MWS and/or its affiliates.
+//
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at:
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fanout
+
+import (
+	"context"
+	"slices"
+	"strings"
+
+	"github.com/coredns/coredns/request"
+	"github.com/miekg/dns"
+)
+
+// completeCNAME resolves the target of a dangling CNAME chain in m through the upstreams the target is routed
+// to, when they differ from the upstreams that answered, and splices their answer into m. This way a CNAME
+// leading into a zone served by another upstream group doesn't reach the client unresolved.
+func (f *Fanout) completeCNAME(ctx context.Context, req *request.Request, m *dns.Msg) {
+	qtype := req.QType()
+	if qtype == dns.TypeCNAME || len(f.groups) == 0 {
+		return
+	}
+	clients, _, _ := f.route(req)
+	for range maxCNAMEChain {
+		if m.Rcode != dns.RcodeSuccess && m.Rcode != dns.RcodeNameError {
+			return
+		}
+		target := danglingCNAME(m, req.Name(), qtype)
+		if target == "" {
+			return
+		}
+		next, p, serverCount := f.routeName(target, qtype)
+		if slices.Equal(next, clients) {
+			return
+		}
+		sub := new(dns.Msg)
+		sub.SetQuestion(target, qtype)
+		sub.RecursionDesired = req.Req.RecursionDesired
+		if opt := req.Req.IsEdns0(); opt != nil {
+			sub.SetEdns0(opt.UDPSize(), opt.Do())
+		}
+		subReq := &request.Request{W: req.W, Req: sub}
+		r := f.getFanoutResult(ctx, subReq, f.runWorkersOn(ctx, subReq, next, p, serverCount))
+		if r == nil || r.err != nil {
+			return
+		}
+		log.Debugf("completing CNAME chain of %s with %s from %s", req.Name(), target, r.client.Endpoint())
+		m.Answer = append(m.Answer, r.response.Answer...)
+		m.Ns = r.response.Ns
+		m.Rcode = r.response.Rcode
+		clients = next
+	}
+}
+
+// danglingCNAME follows the CNAME chain of the answer from name and returns its final target when the
+// answer has no record of qtype for it, or an empty string when there's nothing to complete.
+func danglingCNAME(m *dns.Msg, name string, qtype uint16) string {
+	target := name
+	for range maxCNAMEChain {
+		next := ""
+		for _, rr := range m.Answer {
+			if cname, ok := rr.(*dns.CNAME); ok && strings.EqualFold(cname.Hdr.Name, target) {
+				next = cname.Target
+				break
+			}
+		}
+		if next == "" {
+			break
+		}
+		target = next
+	}
+	if strings.EqualFold(target, name) {
+		return ""
+	}
+	for _, rr := range m.Answer {
+		if rr.Header().Rrtype == qtype && strings.EqualFold(rr.Header().Name, target) {
+			return ""
+		}
+	}
+	return target
+}
@@ -0,0 +1,86 @@
+// Copyright (c) 2024 MWS and/or its affiliates.
+//
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at:
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fanout
+
+import (
+	"context"
+	"fmt"
+	"sync/atomic"
+	"testing"
+
+	"github.com/coredns/caddy"
+	"github.com/coredns/coredns/plugin/test"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCompleteCNAMEAcrossGroups(t *testing.T) {
+	public := newServer(UDP, func(w dns.ResponseWriter, r *dns.Msg) {
+		msg := dns.Msg{Answer: []dns.RR{makeRR(t, r.Question[0].Name+" 300 IN CNAME app.corp.local.")}}
+		msg.SetReply(r)
+		logErrIfNotNil(w.WriteMsg(&msg))
+	})
+	defer public.close()
+	var corpCount atomic.Int32
+	corp := newServer(UDP, func(w dns.ResponseWriter, r *dns.Msg) {
+		corpCount.Add(1)
+		require.Equal(t, "app.corp.local.", r.Question[0].Name)
+		msg := dns.Msg{Answer: []dns.RR{makeRecordA("app.corp.local. 300 IN A 10.0.0.7")}}
+		msg.SetReply(r)
+		logErrIfNotNil(w.WriteMsg(&msg))
+	})
+	defer corp.close()
+
+	input := fmt.Sprintf("fanout . %s {\nexcept corp.local -> %s\n}", public.addr, corp.addr)
+	fs, err := parseFanout(caddy.NewTestController("dns", input))
+	require.NoError(t, err)
+
+	req := new(dns.Msg)
+	req.SetQuestion("www.example.com.", dns.TypeA)
+	writer := &cachedDNSWriter{ResponseWriter: new(test.ResponseWriter)}
+	_, err = fs[0].ServeDNS(context.Background(), writer, req)
+	require.NoError(t, err)
+	require.Len(t, writer.answers, 1)
+	answer := writer.answers[0].Answer
+	require.Len(t, answer, 2)
+	require.Equal(t, "app.corp.local.", answer[0].(*dns.CNAME).Target)
+	require.Equal(t, "10.0.0.7", answer[1].(*dns.A).A.String())
+	require.Equal(t, int32(1), corpCount.Load())
+}
+
+func makeRR(t *testing.T, s string) dns.RR {
+	rr, err := dns.NewRR(s)
+	require.NoError(t, err)
+	return rr
+}
+
+func TestDanglingCNAME(t *testing.T) {
+	chain := []dns.RR{
+		makeRR(t, "a.example. 300 IN CNAME B.example."),
+		makeRR(t, "b.example. 300 IN CNAME c.example."),
+	}
+	require.Equal(t, "c.example.", danglingCNAME(&dns.Msg{Answer: chain}, "a.example.", dns.TypeA))
+	complete := append(chain, makeRecordA("c.example. 300 IN A 10.0.0.1"))
+	require.Empty(t, danglingCNAME(&dns.Msg{Answer: complete}, "a.example.", dns.TypeA))
+	require.Empty(t, danglingCNAME(&dns.Msg{}, "a.example.", dns.TypeA))
+
+	loop := []dns.RR{
+		makeRR(t, "a.example. 300 IN CNAME b.example."),
+		makeRR(t, "b.example. 300 IN CNAME a.example."),
+	}
+	require.NotPanics(t, func() { danglingCNAME(&dns.Msg{Answer: loop}, "a.example.", dns.TypeA) })
+}
@@ -0,0 +1,59 @@
+// Copyright (c) 2024 MWS and/or its affiliates.
+//
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at:
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fanout
+
+import (
+	"github.com/coredns/coredns/request"
+	"github.com/miekg/dns"
+)
+
+// ResponseComparator defines which upstream response is the better answer to a query, replacing the
+// default preference for NOERROR responses and the wait for an answer-bearing one. It only sees responses
+// matching the query; failed attempts always lose against them.
+type ResponseComparator interface {
+	// Better reports whether candidate should replace current as the answer to req.
+	Better(req, current, candidate *dns.Msg) bool
+	// Final reports whether m answers req well enough to stop waiting for the other upstreams.
+	Final(req, m *dns.Msg) bool
+}
+
+// defaultComparator prefers NOERROR responses and waits for an answer-bearing one.
+type defaultComparator struct{}
+
+func (defaultComparator) Better(_, current, candidate *dns.Msg) bool {
+	return current.Rcode != dns.RcodeSuccess && candidate.Rcode == dns.RcodeSuccess
+}
+
+func (defaultComparator) Final(_, m *dns.Msg) bool {
+	return isPositiveResponse(m)
+}
+
+// better reports whether candidate, a response matching req or a failed attempt, should replace current.
+func (f *Fanout) better(req *request.Request, current, candidate *response) bool {
+	if current == nil || current.err != nil || current.response == nil || candidate.err != nil {
+		return isBetter(current, candidate)
+	}
+	return f.responseComparator().Better(req.Req, current.response, candidate.response)
+}
+
+// responseComparator returns the configured comparator, or the default one.
+func (f *Fanout) responseComparator() ResponseComparator {
+	if f.comparator == nil {
+		return defaultComparator{}
+	}
+	return f.comparator
+}
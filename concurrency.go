@@ -0,0 +1,71 @@
+// Copyright (c) 2024 MWS and/or its affiliates.
+//
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at:
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fanout
+
+import (
+	"context"
+	"sync/atomic"
+	"time"
+
+	"github.com/hurricanehrndz/fanout/v2/clock"
+	"github.com/pkg/errors"
+)
+
+// ErrLimitExceeded is returned when a request is rejected because max-concurrent requests are in flight and
+// the queue is full or the request timed out waiting in it.
+var ErrLimitExceeded = errors.New("concurrent queries exceeded maximum")
+
+// concurrencyLimiter bounds the requests in flight for a fanout instance, letting up to queueSize more
+// wait for a slot, so that memory use stays bounded under query floods.
+type concurrencyLimiter struct {
+	slots     chan struct{}
+	queueSize int32
+	queued    atomic.Int32
+}
+
+func newConcurrencyLimiter(limit, queueSize int) *concurrencyLimiter {
+	//nolint:gosec // queueSize is bounded by parseConcurrencyLimit
+	return &concurrencyLimiter{slots: make(chan struct{}, limit), queueSize: int32(queueSize)}
+}
+
+// acquire takes a slot, waiting for one in the queue for up to timeout of clk when there is room in it. On
+// success, the caller must release.
+func (l *concurrencyLimiter) acquire(ctx context.Context, clk clock.Clock, timeout time.Duration) error {
+	select {
+	case l.slots <- struct{}{}:
+		return nil
+	default:
+	}
+	if l.queued.Add(1) > l.queueSize {
+		l.queued.Add(-1)
+		RejectedCount.Add(1)
+		return ErrLimitExceeded
+	}
+	defer l.queued.Add(-1)
+	select {
+	case l.slots <- struct{}{}:
+		return nil
+	case <-clk.After(timeout):
+	case <-ctx.Done():
+	}
+	RejectedCount.Add(1)
+	return ErrLimitExceeded
+}
+
+func (l *concurrencyLimiter) release() {
+	<-l.slots
+}
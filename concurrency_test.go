@@ -0,0 +1,64 @@
+// Copyright (c) 2024 MWS and/or its affiliates.
+//
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at:
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fanout
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/coredns/caddy"
+	"github.com/hurricanehrndz/fanout/v2/clock"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/require"
+)
+
+func TestConcurrencyLimiterQueue(t *testing.T) {
+	l := newConcurrencyLimiter(1, 1)
+	ctx := context.Background()
+	clk := clock.NewManual(time.Now())
+	rejected := testutil.ToFloat64(RejectedCount)
+	require.NoError(t, l.acquire(ctx, clk, time.Second))
+
+	queued := make(chan error)
+	go func() { queued <- l.acquire(ctx, clk, time.Second) }()
+	require.Eventually(t, func() bool { return clk.Waiters() == 1 }, time.Second, time.Millisecond)
+	require.ErrorIs(t, l.acquire(ctx, clk, time.Second), ErrLimitExceeded, "the queue is full")
+
+	l.release()
+	require.NoError(t, <-queued, "a queued request takes the released slot")
+	go func() { queued <- l.acquire(ctx, clk, time.Second) }()
+	// the wait of the first queued request is still pending on the clock
+	require.Eventually(t, func() bool { return clk.Waiters() == 2 }, time.Second, time.Millisecond)
+	clk.Advance(time.Second)
+	require.ErrorIs(t, <-queued, ErrLimitExceeded, "queued requests time out")
+	l.release()
+	require.Equal(t, rejected+2, testutil.ToFloat64(RejectedCount))
+	require.Zero(t, l.queued.Load())
+}
+
+func TestSetupMaxConcurrent(t *testing.T) {
+	fs, err := parseFanout(caddy.NewTestController("dns", "fanout . 127.0.0.1 {\nmax-concurrent 100 1000\n}"))
+	require.NoError(t, err)
+	require.Equal(t, 100, cap(fs[0].concurrency.slots))
+	require.Equal(t, int32(1000), fs[0].concurrency.queueSize)
+
+	for _, input := range []string{"max-concurrent", "max-concurrent 0", "max-concurrent 1 -1", "max-concurrent 1 2 3"} {
+		_, err = parseFanout(caddy.NewTestController("dns", "fanout . 127.0.0.1 {\n"+input+"\n}"))
+		require.Error(t, err, input)
+	}
+}
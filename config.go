@@ -0,0 +1,162 @@
+// Copyright (c) 2024 MWS and/or its affiliates.
+//
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at:
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fanout
+
+import (
+	"bytes"
+	"strconv"
+	"strings"
+
+	"github.com/coredns/caddy/caddyfile"
+	"github.com/pkg/errors"
+	"gopkg.in/yaml.v3"
+)
+
+// Config describes a fanout instance the way a Corefile stanza does, for automation systems generating
+// instances programmatically. Options without a dedicated field are given in Options, in Corefile order.
+type Config struct {
+	// From is the zone handled by the instance, "." by default.
+	From string `json:"from,omitempty" yaml:"from,omitempty"`
+	// To lists the upstreams using the Corefile TO syntax.
+	To []string `json:"to" yaml:"to"`
+	// Except lists the domains excluded from proxying.
+	Except []string `json:"except,omitempty" yaml:"except,omitempty"`
+	// Network is the upstream network protocol: "udp", "tcp" or "tcp-tls".
+	Network string `json:"network,omitempty" yaml:"network,omitempty"`
+	// TLS holds the arguments of the tls option: CERT KEY CA, CERT KEY or CA.
+	TLS []string `json:"tls,omitempty" yaml:"tls,omitempty"`
+	// TLSServer is the server name verified for DNS-over-TLS upstreams.
+	TLSServer string `json:"tls_server,omitempty" yaml:"tls_server,omitempty"`
+	// Policy is the server selection policy, e.g. "weighted-random" or "weighted-random then latency".
+	Policy string `json:"policy,omitempty" yaml:"policy,omitempty"`
+	// LoadFactor lists the weight of each upstream for the weighted random policy.
+	LoadFactor []int `json:"load_factor,omitempty" yaml:"load_factor,omitempty"`
+	// ServerCount limits the number of upstreams requested per query.
+	ServerCount int `json:"server_count,omitempty" yaml:"server_count,omitempty"`
+	// WorkerCount is the number of parallel queries per request.
+	WorkerCount int `json:"worker_count,omitempty" yaml:"worker_count,omitempty"`
+	// Attempts is the number of attempts per upstream, zero meaning retrying until the timeout.
+	Attempts *int `json:"attempts,omitempty" yaml:"attempts,omitempty"`
+	// Timeout is the overall request timeout as a duration, e.g. "5s".
+	Timeout string `json:"timeout,omitempty" yaml:"timeout,omitempty"`
+	// Race returns the first valid response instead of waiting for an answer-bearing one.
+	Race bool `json:"race,omitempty" yaml:"race,omitempty"`
+	// Options lists the other Corefile options.
+	Options []ConfigOption `json:"options,omitempty" yaml:"options,omitempty"`
+}
+
+// ConfigOption is a Corefile option with its arguments and, for options such as qtype, its block.
+type ConfigOption struct {
+	Name  string         `json:"name" yaml:"name"`
+	Args  []string       `json:"args,omitempty" yaml:"args,omitempty"`
+	Block []ConfigOption `json:"block,omitempty" yaml:"block,omitempty"`
+}
+
+// ParseConfig decodes a Config from YAML or JSON, rejecting unknown fields.
+func ParseConfig(data []byte) (Config, error) {
+	var cfg Config
+	dec := yaml.NewDecoder(bytes.NewReader(data))
+	dec.KnownFields(true)
+	if err := dec.Decode(&cfg); err != nil {
+		return Config{}, errors.Wrap(err, "invalid fanout config")
+	}
+	return cfg, nil
+}
+
+// FromConfig returns the Fanout described by cfg, validated the same way as the Corefile stanza.
+func FromConfig(cfg Config) (*Fanout, error) {
+	c := caddyfile.NewDispenserTokens("config", cfg.tokens())
+	c.Next()
+	return parsefanoutStanza(&c)
+}
+
+// tokens renders cfg as the tokens of a Corefile stanza, one option per line.
+func (cfg Config) tokens() []caddyfile.Token {
+	t := &configTokens{}
+	from := cfg.From
+	if from == "" {
+		from = "."
+	}
+	t.line(append([]string{pluginName, from}, cfg.To...)...)
+	t.add("{")
+	t.option("except", cfg.Except...)
+	t.option("network", cfg.Network)
+	t.option("tls", cfg.TLS...)
+	t.option("tls-server", cfg.TLSServer)
+	t.option("policy", strings.Fields(cfg.Policy)...)
+	t.option("weighted-random-load-factor", itoa(cfg.LoadFactor...)...)
+	if cfg.ServerCount != 0 {
+		t.option("weighted-random-server-count", strconv.Itoa(cfg.ServerCount))
+	}
+	if cfg.WorkerCount != 0 {
+		t.option("worker-count", strconv.Itoa(cfg.WorkerCount))
+	}
+	if cfg.Attempts != nil {
+		t.option("attempt-count", strconv.Itoa(*cfg.Attempts))
+	}
+	t.option("timeout", cfg.Timeout)
+	if cfg.Race {
+		t.line("race")
+	}
+	t.options(cfg.Options)
+	t.line("}")
+	return t.tokens
+}
+
+type configTokens struct {
+	tokens []caddyfile.Token
+	lineNo int
+}
+
+// line starts a new line with the given tokens.
+func (t *configTokens) line(texts ...string) {
+	t.lineNo++
+	t.add(texts...)
+}
+
+func (t *configTokens) add(texts ...string) {
+	for _, text := range texts {
+		t.tokens = append(t.tokens, caddyfile.Token{File: "config", Line: t.lineNo, Text: text})
+	}
+}
+
+// option adds an option line unless it has no arguments.
+func (t *configTokens) option(name string, args ...string) {
+	if len(args) == 0 || len(args) == 1 && args[0] == "" {
+		return
+	}
+	t.line(append([]string{name}, args...)...)
+}
+
+func (t *configTokens) options(options []ConfigOption) {
+	for _, o := range options {
+		t.line(append([]string{o.Name}, o.Args...)...)
+		if len(o.Block) > 0 {
+			t.add("{")
+			t.options(o.Block)
+			t.line("}")
+		}
+	}
+}
+
+func itoa(values ...int) []string {
+	var s []string
+	for _, v := range values {
+		s = append(s, strconv.Itoa(v))
+	}
+	return s
+}
@@ -0,0 +1,90 @@
+// Copyright (c) 2024 MWS and/or its affiliates.
+//
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at:
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fanout
+
+import (
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFromConfig(t *testing.T) {
+	attempts := 0
+	f, err := FromConfig(Config{
+		From:        "example.org",
+		To:          []string{"127.0.0.1:53", "127.0.0.2:53"},
+		Except:      []string{"internal.example.org"},
+		Policy:      "weighted-random then latency",
+		LoadFactor:  []int{50, 100},
+		WorkerCount: 2,
+		Attempts:    &attempts,
+		Timeout:     "2s",
+		Race:        true,
+		Options: []ConfigOption{
+			{Name: "randomize-id"},
+			{Name: "qtype", Args: []string{"PTR"}, Block: []ConfigOption{{Name: "to", Args: []string{"127.0.0.3:53"}}}},
+		},
+	})
+	require.NoError(t, err)
+	require.Equal(t, "example.org.", f.From)
+	require.Len(t, f.clients, 2)
+	require.Equal(t, []int{50, 100}, f.loadFactor)
+	require.Equal(t, []string{policyLatency}, f.policyThen)
+	require.Equal(t, 2, f.WorkerCount)
+	require.Equal(t, 0, f.Attempts)
+	require.Equal(t, 2*time.Second, f.Timeout)
+	require.True(t, f.Race)
+	require.True(t, f.randomizeID)
+	require.True(t, f.ExcludeDomains.Contains("host.internal.example.org."))
+	require.Len(t, f.groups, 1)
+	require.Equal(t, []uint16{dns.TypePTR}, f.groups[0].qtypes)
+}
+
+func TestFromConfigInvalid(t *testing.T) {
+	_, err := FromConfig(Config{To: []string{"127.0.0.1:53"}, WorkerCount: 2, Options: []ConfigOption{{Name: "no-such-option"}}})
+	require.Error(t, err)
+	_, err = FromConfig(Config{})
+	require.Error(t, err, "at least one upstream is required")
+}
+
+func TestParseConfig(t *testing.T) {
+	yamlConfig := `
+to: [127.0.0.1:53, 127.0.0.2:53]
+network: tcp
+worker_count: 2
+options:
+  - name: answer-order
+    args: [rotate]
+`
+	jsonConfig := `{"to": ["127.0.0.1:53", "127.0.0.2:53"], "network": "tcp", "worker_count": 2,
+		"options": [{"name": "answer-order", "args": ["rotate"]}]}`
+	for _, data := range []string{yamlConfig, jsonConfig} {
+		cfg, err := ParseConfig([]byte(data))
+		require.NoError(t, err)
+		f, err := FromConfig(cfg)
+		require.NoError(t, err)
+		require.Equal(t, ".", f.From)
+		require.Equal(t, TCP, f.net)
+		require.Equal(t, 2, f.WorkerCount)
+		require.Equal(t, "rotate", f.answerOrder)
+	}
+
+	_, err := ParseConfig([]byte("to: [127.0.0.1:53]\nworkers: 2\n"))
+	require.Error(t, err, "unknown fields are rejected")
+}
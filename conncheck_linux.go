@@ -0,0 +1,62 @@
+// Copyright (c) 2024 MWS and/or its affiliates.
+//
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at:
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build linux
+
+package fanout
+
+import (
+	"crypto/tls"
+	"net"
+	"os"
+	"syscall"
+
+	"github.com/pkg/errors"
+)
+
+// peerClosed peeks at the socket of a pooled stream connection without blocking. It reports true if the
+// peer closed the connection or it failed, and for plain TCP, where nothing is expected between queries,
+// if unread data is waiting, which would be mistaken for the answer to the next query.
+func peerClosed(conn net.Conn) bool {
+	tlsConn, isTLS := conn.(*tls.Conn)
+	if isTLS {
+		conn = tlsConn.NetConn()
+	}
+	sc, ok := conn.(syscall.Conn)
+	if !ok {
+		return false
+	}
+	rc, err := sc.SyscallConn()
+	if err != nil {
+		return true
+	}
+	closed := false
+	err = rc.Read(func(fd uintptr) bool {
+		var b [1]byte
+		n, _, err := syscall.Recvfrom(int(fd), b[:], syscall.MSG_PEEK|syscall.MSG_DONTWAIT)
+		switch {
+		case errors.Is(err, syscall.EAGAIN):
+		case err != nil || n == 0:
+			closed = true
+		default:
+			// a TLS peer may send session tickets at any time
+			closed = !isTLS
+		}
+		return true
+	})
+	// an expired deadline only fails the wait, the connection itself is fine
+	return closed || err != nil && !errors.Is(err, os.ErrDeadlineExceeded)
+}
@@ -17,6 +17,8 @@
 package fanout
 
 import (
+	"context"
+	"sync/atomic"
 	"time"
 
 	"github.com/miekg/dns"
@@ -27,12 +29,87 @@ type response struct {
 	response *dns.Msg
 	start    time.Time
 	err      error
+	// attempts is the number of attempts made for the response, the last one included.
+	attempts int
+	// proto is the protocol of the last attempt, as labelled in the metrics, e.g. udp-tcp after a
+	// truncated UDP response. It is empty if the client doesn't report it.
+	proto string
+	// size is the size of the response in wire format, with name compression.
+	size int
+}
+
+type exchangeKey struct{}
+
+// exchangeInfo collects what the clients report about the exchanges made for a response.
+type exchangeInfo struct {
+	proto atomic.Pointer[string]
+}
+
+func withExchangeInfo(ctx context.Context, info *exchangeInfo) context.Context {
+	return context.WithValue(ctx, exchangeKey{}, info)
+}
+
+// recordProto records the protocol of an exchange made with ctx, if it carries an exchangeInfo.
+func recordProto(ctx context.Context, proto string) {
+	if info, ok := ctx.Value(exchangeKey{}).(*exchangeInfo); ok {
+		info.proto.Store(&proto)
+	}
+}
+
+// protocol returns the protocol of the last exchange recorded.
+func (i *exchangeInfo) protocol() string {
+	if p := i.proto.Load(); p != nil {
+		return *p
+	}
+	return ""
+}
+
+// response returns the response of c made of msg or err after the given number of attempts.
+func (i *exchangeInfo) response(c Client, msg *dns.Msg, start time.Time, err error, attempts int) response {
+	resp := response{client: c, response: msg, start: start, err: err, attempts: attempts, proto: i.protocol()}
+	if msg != nil {
+		resp.size = wireSize(msg)
+	}
+	return resp
+}
+
+// wireSize returns the size of m packed with name compression, as upstreams send it.
+func wireSize(m *dns.Msg) int {
+	compress := m.Compress
+	m.Compress = true
+	n := m.Len()
+	m.Compress = compress
+	return n
 }
 
 func isPositiveResponse(msg *dns.Msg) bool {
 	return msg.Rcode == dns.RcodeSuccess && len(msg.Answer) > 0
 }
 
+// quality ranks a response for the race tie-break: answers beat NODATA and negative responses, which beat
+// failures. With prefer-dnssec, authenticated data breaks ties within a rank.
+func (f *Fanout) quality(msg *dns.Msg) int {
+	rank := 0
+	switch {
+	case isPositiveResponse(msg):
+		rank = 4
+	case msg.Rcode == dns.RcodeSuccess || msg.Rcode == dns.RcodeNameError:
+		rank = 2
+	}
+	if f.preferDNSSEC && msg.AuthenticatedData {
+		rank++
+	}
+	return rank
+}
+
+// topQuality is the quality of a response no other one can beat.
+func (f *Fanout) topQuality() int {
+	if f.preferDNSSEC {
+		return 5
+	}
+	return 4
+}
+
 func isBetter(left, right *response) bool {
 	if right == nil {
 		return false
@@ -16,22 +16,136 @@
 
 package fanout
 
-import "time"
+import (
+	"math"
+	"time"
+)
 
 const (
-	maxIPCount           = 100
-	maxLoadFactor        = 100
-	minLoadFactor        = 1
-	policyWeightedRandom = "weighted-random"
-	policySequential     = "sequential"
-	maxWorkerCount       = 32
-	minWorkerCount       = 2
-	maxTimeout           = 2 * time.Second
-	defaultTimeout       = 30 * time.Second
-	readTimeout          = 2 * time.Second
-	attemptDelay         = time.Millisecond * 100
-	minUDPBufferSize     = 1232 // Minimum UDP buffer size for DNS (RFC 6891)
-	pluginName           = "fanout"
+	maxIPCount               = 100
+	defaultLoadFactor        = 100
+	minLoadFactor            = 1
+	maxLoadFactorSum         = math.MaxInt32
+	policyWeightedRandom     = "weighted-random"
+	policySequential         = "sequential"
+	policyLatency            = "latency"
+	policySticky             = "sticky"
+	everyDay                 = 1<<7 - 1
+	classFilterRefuse        = "refuse"
+	classFilterDrop          = "drop"
+	classFilterNext          = "next"
+	chaosIDNSID              = "nsid"
+	opcodeRefuse             = "refuse"
+	opcodeNotImp             = "notimp"
+	opcodeNext               = "next"
+	multiQuestionFormErr     = "formerr"
+	multiQuestionFirst       = "first"
+	multiQuestionSplit       = "split"
+	tsigFudge                = 300
+	defaultCanaryInterval    = time.Minute
+	provenanceEDNS           = "edns"
+	provenanceTXT            = "txt"
+	provenanceTXTName        = "fanout-upstream."
+	defaultProvenanceCode    = 65001
+	defaultHopsCode          = 65002
+	defaultUDPBatchSize      = 32
+	maxUDPBatchSize          = 1024
+	maxUDPBatchPending       = 1 << 15
+	ednsCapabilitiesTTL      = 10 * time.Minute
+	defaultCacheSize         = 10000
+	maxCacheTTL              = time.Hour
+	cacheHeaderSize          = 9
+	maxCacheEntrySize        = cacheHeaderSize + math.MaxUint8 + math.MaxUint16
+	cacheTierLocal           = "local"
+	cacheTierShared          = "shared"
+	defaultRedisPort         = "6379"
+	defaultRedisPrefix       = "fanout:"
+	redisTimeout             = 100 * time.Millisecond
+	sloSlots                 = 10
+	rttSamples               = 128
+	minRTTSamples            = 20
+	rttQuantileRefresh       = 8
+	defaultTimeoutQuantile   = 0.95
+	defaultTimeoutFactor     = 3
+	minAdaptiveTimeout       = 50 * time.Millisecond
+	keepaliveUnit            = 100 * time.Millisecond
+	defaultDnstapFileSize    = 100
+	defaultDnstapFileKeep    = 5
+	dnstapFileQueue          = 4096
+	dnstapSampleFailures     = "failures"
+	dnstapSampleMismatches   = "mismatches"
+	defaultSlowStartFailures = 5
+	minSlowStartShare        = 0.05
+	errorBudgetSlots         = 10
+	defaultErrorBudgetWindow = 30 * time.Second
+	defaultBudgetAttempts    = 10
+	defaultSLOWindow         = 5 * time.Minute
+	policyThen               = "then"
+	modeParallel             = "parallel"
+	modeFailover             = "failover"
+	modeMirror               = "mirror"
+	attemptPolicySame        = "same"
+	attemptPolicyRotate      = "rotate"
+	exceptRedirect           = "->"
+	answerOrderRotate        = "rotate"
+	answerOrderShuffle       = "shuffle"
+	maxCNAMEChain            = 8
+	maxSVCBTargets           = 4
+	clientLimitRefused       = "refused"
+	clientLimitTruncate      = "truncate"
+	maxConcurrentQueue       = 1 << 20
+	validateQuestion         = "question"
+	validateRebind           = "rebind"
+	validateTTL              = "ttl"
+	validateReject           = "reject"
+	validateLog              = "log"
+	maxSaneTTL               = 7 * 24 * 3600
+	dohScheme                = "https://"
+	dohMediaType             = "application/dns-message"
+	httpVersion1             = "1.1"
+	httpVersion2             = "2"
+	httpVersion3             = "3"
+	dohFallbackInterval      = 5 * time.Minute
+	dohH3HandshakeTimeout    = time.Second
+	odohScheme               = "odoh://"
+	odohMediaType            = "application/oblivious-dns-message"
+	odohConfigPath           = "/.well-known/odohconfigs"
+	odohConfigTTL            = time.Hour
+	odohVersion              = 0x0001
+	odohQueryType            = 0x01
+	odohResponseType         = 0x02
+	odohNonceSize            = 12
+	odohPaddingBlock         = 128
+	secretEnvPrefix          = "env:"
+	secretFilePrefix         = "file:"
+	defaultServfailThreshold = 5
+	defaultServfailDuration  = 5 * time.Minute
+	maxServfailEntries       = 10000
+	maxWorkerCount           = 32
+	minWorkerCount           = 2
+	maxTimeout               = 2 * time.Second
+	defaultTimeout           = 30 * time.Second
+	readTimeout              = 2 * time.Second
+	attemptDelay             = time.Millisecond * 100
+	healthProbeInterval      = time.Second
+	taskJitter               = 0.1
+	sockoptFastOpen          = "tcp-fast-open"
+	defaultHostTTL           = 5 * time.Minute
+	minHostTTL               = 30 * time.Second
+	maxHostTTL               = time.Hour
+	defaultServfailTTL       = 5 * time.Second
+	maxServfailTTL           = 5 * time.Minute
+	loopDetectFail           = "fail"
+	loopDetectDisable        = "disable"
+	loopProbeLabel           = "fanout-loop"
+	connExpire               = 10 * time.Second
+	coldIdleInterval         = connExpire
+	maxPooledConns           = 16
+	maxDSCP                  = 63
+	defaultAdaptiveInterval  = 10 * time.Second
+	pairWindow               = time.Second
+	minUDPBufferSize         = 1232 // Minimum UDP buffer size for DNS (RFC 6891)
+	pluginName               = "fanout"
 
 	// TCPTLS is the DNS-over-TLS network type for a Client.
 	TCPTLS = "tcp-tls"
@@ -39,4 +153,11 @@ const (
 	TCP = "tcp"
 	// UDP is the UDP network type for a Client.
 	UDP = "udp"
+	// DOH is the DNS-over-HTTPS network type for a Client.
+	DOH = "https"
+	// ODOH is the Oblivious DNS-over-HTTPS network type for a Client.
+	ODOH = "odoh"
 )
+
+// defaultPrivateZones are the zones whose names may resolve to private addresses despite the rebind check.
+var defaultPrivateZones = []string{"local.", "localhost.", "home.arpa.", "internal."}
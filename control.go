@@ -0,0 +1,162 @@
+// Copyright (c) 2024 MWS and/or its affiliates.
+//
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at:
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fanout
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"net/http"
+	"slices"
+	"strings"
+
+	"github.com/coredns/caddy/caddyfile"
+	"github.com/pkg/errors"
+)
+
+// upstreamOverride is the body of a PUT request of the control API. Omitted fields are left unchanged.
+type upstreamOverride struct {
+	Weight   *int  `json:"weight"`
+	Healthy  *bool `json:"healthy"`
+	Draining *bool `json:"draining"`
+}
+
+// parseControlToken parses `control-token TOKEN`.
+func parseControlToken(f *Fanout, c *caddyfile.Dispenser) error {
+	args := c.RemainingArgs()
+	if len(args) != 1 {
+		return c.ArgErr()
+	}
+	token, err := resolveSecret(args[0])
+	if err != nil {
+		return errors.Wrap(err, "invalid control-token")
+	}
+	f.controlToken = token
+	return nil
+}
+
+// checkControlToken makes sure the control API has a server to be served on.
+func checkControlToken(f *Fanout) error {
+	if f.controlToken != "" && f.debugAddr == "" {
+		return errors.New("control-token requires debug-addr")
+	}
+	return nil
+}
+
+// ControlHandler returns an http.Handler letting an external controller steer the upstreams at
+// /fanout/upstreams/{endpoint}: PUT overrides the weight, health or draining flag of the upstream with an
+// upstreamOverride body, DELETE lifts the health override and the draining flag. Both reply with the
+// state of the upstream. The handler doesn't authenticate requests, debug-addr serves it behind
+// control-token.
+func (f *Fanout) ControlHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("PUT /fanout/upstreams/{endpoint}", func(w http.ResponseWriter, r *http.Request) {
+		var o upstreamOverride
+		if err := json.NewDecoder(r.Body).Decode(&o); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		f.serveControl(w, r.PathValue("endpoint"), func(addr string) (int, error) {
+			return f.applyOverride(addr, o)
+		})
+	})
+	mux.HandleFunc("DELETE /fanout/upstreams/{endpoint}", func(w http.ResponseWriter, r *http.Request) {
+		f.serveControl(w, r.PathValue("endpoint"), func(addr string) (int, error) {
+			f.healthOverrides.Delete(addr)
+			return http.StatusOK, f.UndrainUpstream(addr)
+		})
+	})
+	return mux
+}
+
+func (f *Fanout) serveControl(w http.ResponseWriter, addr string, apply func(string) (int, error)) {
+	if !f.hasUpstream(addr) {
+		http.Error(w, "unknown upstream "+addr, http.StatusNotFound)
+		return
+	}
+	if status, err := apply(addr); err != nil {
+		http.Error(w, err.Error(), status)
+		return
+	}
+	for _, u := range f.debugState().Upstreams {
+		if u.Endpoint == addr {
+			w.Header().Set("Content-Type", "application/json")
+			logErrIfNotNil(json.NewEncoder(w).Encode(u))
+			return
+		}
+	}
+}
+
+// applyOverride applies o to the upstream, returning the HTTP status of the failure if any.
+func (f *Fanout) applyOverride(addr string, o upstreamOverride) (int, error) {
+	if o.Weight != nil {
+		if status, err := f.overrideWeight(addr, *o.Weight); err != nil {
+			return status, err
+		}
+	}
+	if o.Healthy != nil {
+		f.healthOverrides.Store(addr, *o.Healthy)
+	}
+	if o.Draining != nil && *o.Draining {
+		return http.StatusOK, f.DrainUpstream(addr)
+	}
+	if o.Draining != nil {
+		return http.StatusOK, f.UndrainUpstream(addr)
+	}
+	return http.StatusOK, nil
+}
+
+// overrideWeight sets the weight of the upstream in the weighted selection policy.
+func (f *Fanout) overrideWeight(addr string, weight int) (int, error) {
+	p := weightedStage(f.selectionPolicy())
+	if p == nil {
+		return http.StatusConflict, errors.New("weights require the weighted_random policy")
+	}
+	if f.adaptiveInterval > 0 {
+		return http.StatusConflict, errors.New("weights are managed by adaptive-weights")
+	}
+	i := slices.IndexFunc(f.clients, func(c Client) bool { return c.Endpoint() == addr })
+	loadFactor := p.LoadFactor()
+	if i < 0 || i >= len(loadFactor) {
+		return http.StatusConflict, errors.Errorf("upstream %s has no weight", addr)
+	}
+	loadFactor[i] = weight
+	if err := p.SetLoadFactor(loadFactor); err != nil {
+		return http.StatusBadRequest, err
+	}
+	return http.StatusOK, nil
+}
+
+// healthOverride returns the health an external controller set for the upstream, if any.
+func (f *Fanout) healthOverride(addr string) (healthy, ok bool) {
+	v, ok := f.healthOverrides.Load(addr)
+	if !ok {
+		return false, false
+	}
+	return v.(bool), true
+}
+
+// requireToken rejects the requests without the bearer token.
+func requireToken(token string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || subtle.ConstantTimeCompare([]byte(got), []byte(token)) != 1 {
+			http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
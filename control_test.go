@@ -0,0 +1,83 @@
+// Copyright (c) 2024 MWS and/or its affiliates.
+//
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at:
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fanout
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/coredns/caddy"
+	"github.com/stretchr/testify/require"
+)
+
+func controlRequest(t *testing.T, h http.Handler, method, target, body string) *httptest.ResponseRecorder {
+	t.Helper()
+	req := httptest.NewRequest(method, target, strings.NewReader(body))
+	req.Header.Set("Authorization", "Bearer s3cret")
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	return rec
+}
+
+func TestControlOverridesWeightAndHealth(t *testing.T) {
+	fs, err := parseFanout(caddy.NewTestController("dns", "fanout . 127.0.0.1 127.0.0.2 {\npolicy weighted-random\ndebug-addr 127.0.0.1:0\ncontrol-token s3cret\n}"))
+	require.NoError(t, err)
+	f := fs[0]
+	h := requireToken(f.controlToken, f.ControlHandler())
+
+	rec := controlRequest(t, h, http.MethodPut, "/fanout/upstreams/127.0.0.2:53", `{"weight":10,"healthy":false}`)
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	var u debugUpstream
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &u))
+	require.Equal(t, 10, u.Weight)
+	require.NotNil(t, u.Override)
+	require.False(t, *u.Override)
+	require.Equal(t, []int{100, 10}, weightedStage(f.selectionPolicy()).LoadFactor())
+
+	// an upstream forced down is held back like a blocklisted one
+	s := &activeSelector{f: f}
+	require.True(t, s.held(f.clients[1]))
+	require.False(t, s.held(f.clients[0]))
+
+	rec = controlRequest(t, h, http.MethodDelete, "/fanout/upstreams/127.0.0.2:53", "")
+	require.Equal(t, http.StatusOK, rec.Code)
+	require.False(t, s.held(f.clients[1]))
+
+	require.Equal(t, http.StatusNotFound, controlRequest(t, h, http.MethodPut, "/fanout/upstreams/192.0.2.1:53", `{}`).Code)
+	require.Equal(t, http.StatusBadRequest, controlRequest(t, h, http.MethodPut, "/fanout/upstreams/127.0.0.2:53", `{"weight":0}`).Code)
+}
+
+func TestControlRejectsMissingToken(t *testing.T) {
+	fs, err := parseFanout(caddy.NewTestController("dns", "fanout . 127.0.0.1 {\ndebug-addr 127.0.0.1:0\ncontrol-token s3cret\n}"))
+	require.NoError(t, err)
+	f := fs[0]
+	h := requireToken(f.controlToken, f.ControlHandler())
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodPut, "/fanout/upstreams/127.0.0.1:53", strings.NewReader(`{"healthy":false}`)))
+	require.Equal(t, http.StatusUnauthorized, rec.Code)
+	_, ok := f.healthOverride("127.0.0.1:53")
+	require.False(t, ok)
+
+	// weights can't be set without a weighted policy
+	require.Equal(t, http.StatusConflict, controlRequest(t, h, http.MethodPut, "/fanout/upstreams/127.0.0.1:53", `{"weight":5}`).Code)
+
+	_, err = parseFanout(caddy.NewTestController("dns", "fanout . 127.0.0.1 {\ncontrol-token s3cret\n}"))
+	require.Error(t, err)
+}
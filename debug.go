@@ -0,0 +1,209 @@
+// Copyright (c) 2024 MWS and/or its affiliates.
+//
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at:
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fanout
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+type debugState struct {
+	From      string          `json:"from"`
+	Policy    string          `json:"policy"`
+	Ready     bool            `json:"ready"`
+	Cache     *debugCache     `json:"cache,omitempty"`
+	Upstreams []debugUpstream `json:"upstreams"`
+}
+
+type debugCache struct {
+	Entries int    `json:"entries"`
+	Size    int    `json:"size"`
+	Filling int    `json:"filling"`
+	Shared  bool   `json:"shared"`
+	Hits    uint64 `json:"hits"`
+	Misses  uint64 `json:"misses"`
+}
+
+type debugUpstream struct {
+	Endpoint     string            `json:"endpoint"`
+	Net          string            `json:"net"`
+	Healthy      bool              `json:"healthy"`
+	Draining     bool              `json:"draining"`
+	Requests     uint64            `json:"requests"`
+	Failures     uint64            `json:"failures"`
+	RTTMs        float64           `json:"rtt_avg_ms"`
+	Cold         bool              `json:"cold"`
+	Weight       int               `json:"weight,omitempty"`
+	Override     *bool             `json:"health_override,omitempty"`
+	BlockedZones []string          `json:"servfail_blocked_zones,omitempty"`
+	ErrorBudget  *debugErrorBudget `json:"error_budget,omitempty"`
+}
+
+type debugErrorBudget struct {
+	Attempts uint64 `json:"attempts"`
+	Failures uint64 `json:"failures"`
+	Down     bool   `json:"down"`
+}
+
+// DebugHandler returns an http.Handler reporting the current upstream state as JSON.
+func (f *Fanout) DebugHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		logErrIfNotNil(json.NewEncoder(w).Encode(f.debugState()))
+	})
+}
+
+func (f *Fanout) debugState() *debugState {
+	policyType := f.policyType
+	if policyType == "" {
+		policyType = policySequential
+	}
+	policyType = strings.Join(append([]string{policyType}, f.policyThen...), " "+policyThen+" ")
+	state := &debugState{From: f.From, Policy: policyType, Ready: f.Ready(), Cache: f.cache.debug()}
+	var weights []int
+	if p := weightedStage(f.selectionPolicy()); p != nil {
+		weights = p.LoadFactor()
+	}
+	for i, c := range f.upstreams() {
+		s := f.statsFor(c.Endpoint()).snapshot()
+		u := debugUpstream{
+			Endpoint:     c.Endpoint(),
+			Net:          c.Net(),
+			Healthy:      f.Healthy(c.Endpoint()),
+			Draining:     f.IsDraining(c.Endpoint()),
+			Requests:     s.Requests,
+			Failures:     s.Failures,
+			RTTMs:        float64(s.RTT.Microseconds()) / 1000,
+			Cold:         s.cold(f.clock.Now()),
+			BlockedZones: f.servfails.blockedZones(c.Endpoint(), f.clock.Now()),
+			ErrorBudget:  f.errorBudget.debug(c.Endpoint(), f.clock.Now()),
+		}
+		if i < len(weights) && i < len(f.clients) {
+			u.Weight = weights[i]
+		}
+		if healthy, ok := f.healthOverride(c.Endpoint()); ok {
+			u.Override = &healthy
+		}
+		state.Upstreams = append(state.Upstreams, u)
+	}
+	return state
+}
+
+// debugListener is the debug server on an address, shared between the fanout instances serving it so that
+// the instance started by a reload, before the one it replaces is shut down, keeps its address. The last
+// instance to acquire it answers the requests.
+type debugListener struct {
+	addr      string
+	mutex     sync.RWMutex
+	instances []*Fanout
+	server    *http.Server
+}
+
+// debugListenerRegistry shares the debug listeners between the fanout instances.
+type debugListenerRegistry struct {
+	mutex     sync.Mutex
+	listeners map[string]*debugListener
+}
+
+var debugListeners = &debugListenerRegistry{listeners: map[string]*debugListener{}}
+
+// acquire returns the listener on the debug address of f, listening on it unless another instance already
+// does.
+func (r *debugListenerRegistry) acquire(f *Fanout) (*debugListener, error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if d, ok := r.listeners[f.debugAddr]; ok {
+		d.mutex.Lock()
+		d.instances = append(d.instances, f)
+		d.mutex.Unlock()
+		return d, nil
+	}
+	l, err := net.Listen(TCP, f.debugAddr)
+	if err != nil {
+		return nil, errors.Wrapf(err, "unable to listen on debug address %s", f.debugAddr)
+	}
+	d := &debugListener{addr: f.debugAddr, instances: []*Fanout{f}}
+	d.server = &http.Server{Handler: d, ReadHeaderTimeout: maxTimeout}
+	r.listeners[f.debugAddr] = d
+	go func() {
+		if err := d.server.Serve(l); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Errorf("debug server on %s failed: %v", d.addr, err)
+		}
+	}()
+	return d, nil
+}
+
+// release closes the listener once no instance serves it anymore.
+func (r *debugListenerRegistry) release(d *debugListener, f *Fanout) error {
+	r.mutex.Lock()
+	d.mutex.Lock()
+	d.instances = slices.DeleteFunc(d.instances, func(i *Fanout) bool { return i == f })
+	last := len(d.instances) == 0
+	d.mutex.Unlock()
+	if last {
+		delete(r.listeners, d.addr)
+	}
+	r.mutex.Unlock()
+	if !last {
+		return nil
+	}
+	return d.server.Close()
+}
+
+func (d *debugListener) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	d.mutex.RLock()
+	var f *Fanout
+	if len(d.instances) > 0 {
+		f = d.instances[len(d.instances)-1]
+	}
+	d.mutex.RUnlock()
+	if f == nil {
+		http.NotFound(w, req)
+		return
+	}
+	f.debugMux().ServeHTTP(w, req)
+}
+
+func (f *Fanout) debugMux() http.Handler {
+	mux := http.NewServeMux()
+	mux.Handle("/fanout", f.DebugHandler())
+	if f.controlToken != "" {
+		mux.Handle("/fanout/upstreams/", requireToken(f.controlToken, f.ControlHandler()))
+	}
+	return mux
+}
+
+// startDebugServer serves DebugHandler on the configured debug address.
+func (f *Fanout) startDebugServer() (err error) {
+	f.debugListener, err = debugListeners.acquire(f)
+	return err
+}
+
+func (f *Fanout) stopDebugServer() error {
+	if f.debugListener == nil {
+		return nil
+	}
+	err := debugListeners.release(f.debugListener, f)
+	f.debugListener = nil
+	return err
+}
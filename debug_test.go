@@ -0,0 +1,130 @@
+// Copyright (c) 2024 MWS and/or its affiliates.
+//
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at:
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fanout
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/coredns/caddy"
+	"github.com/coredns/coredns/plugin/test"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDebugHandlerReportsUpstreamState(t *testing.T) {
+	s := newServer(UDP, func(w dns.ResponseWriter, r *dns.Msg) {
+		msg := dns.Msg{Answer: []dns.RR{makeRecordA("example1. 3600 IN A 10.0.0.1")}}
+		msg.SetReply(r)
+		logErrIfNotNil(w.WriteMsg(&msg))
+	})
+	defer s.close()
+
+	f := New()
+	f.From = "."
+	f.AddClient(NewClient(s.addr, UDP))
+	f.AddClient(NewClient("203.0.113.1:53", UDP))
+	require.NoError(t, f.DrainUpstream("203.0.113.1:53"))
+	// the registry outlives the test servers, an earlier one may have had the same address
+	before := f.statsFor(s.addr).snapshot().Requests
+
+	req := new(dns.Msg)
+	req.SetQuestion(testQuery, dns.TypeA)
+	_, err := f.ServeDNS(context.Background(), &test.ResponseWriter{}, req)
+	require.NoError(t, err)
+
+	rec := httptest.NewRecorder()
+	f.DebugHandler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/fanout", http.NoBody))
+	require.Equal(t, http.StatusOK, rec.Code)
+
+	var state debugState
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &state))
+	require.Equal(t, ".", state.From)
+	require.Equal(t, policySequential, state.Policy)
+	require.Len(t, state.Upstreams, 2)
+	require.Equal(t, s.addr, state.Upstreams[0].Endpoint)
+	require.Equal(t, before+1, state.Upstreams[0].Requests)
+	require.Positive(t, state.Upstreams[0].RTTMs)
+	require.True(t, state.Upstreams[1].Draining)
+	require.Zero(t, state.Upstreams[1].Requests)
+}
+
+func TestDebugHandlerReportsCacheState(t *testing.T) {
+	s := newServer(UDP, func(w dns.ResponseWriter, r *dns.Msg) {
+		msg := dns.Msg{Answer: []dns.RR{makeRecordA("example1. 3600 IN A 10.0.0.1")}}
+		msg.SetReply(r)
+		logErrIfNotNil(w.WriteMsg(&msg))
+	})
+	defer s.close()
+	fs, err := parseFanout(caddy.NewTestController("dns", "fanout . "+s.addr+" {\ncache 100\n}"))
+	require.NoError(t, err)
+	f := fs[0]
+	require.Nil(t, New().debugState().Cache)
+
+	req := new(dns.Msg)
+	req.SetQuestion(testQuery, dns.TypeA)
+	_, err = f.ServeDNS(context.Background(), &test.ResponseWriter{}, req)
+	require.NoError(t, err)
+	require.Equal(t, &debugCache{Entries: 1, Size: 100, Misses: 1}, f.debugState().Cache)
+	_, err = f.ServeDNS(context.Background(), &test.ResponseWriter{}, req)
+	require.NoError(t, err)
+	require.Equal(t, &debugCache{Entries: 1, Size: 100, Hits: 1, Misses: 1}, f.debugState().Cache)
+}
+
+func TestDebugServerSurvivesReload(t *testing.T) {
+	l, err := net.Listen(TCP, "127.0.0.1:0")
+	require.NoError(t, err)
+	addr := l.Addr().String()
+	require.NoError(t, l.Close())
+
+	get := func() (*debugState, error) {
+		resp, err := http.Get("http://" + addr + "/fanout")
+		if err != nil {
+			return nil, err
+		}
+		defer func() { logErrIfNotNil(resp.Body.Close()) }()
+		var state debugState
+		return &state, json.NewDecoder(resp.Body).Decode(&state)
+	}
+
+	old := New()
+	old.From = "old.org."
+	old.debugAddr = addr
+	require.NoError(t, old.startDebugServer())
+
+	// a reload starts the new instance before shutting the old one down
+	reloaded := New()
+	reloaded.From = "new.org."
+	reloaded.debugAddr = addr
+	require.NoError(t, reloaded.startDebugServer(), "the new instance shares the address of the old one")
+	state, err := get()
+	require.NoError(t, err)
+	require.Equal(t, "new.org.", state.From, "the new instance answers")
+
+	require.NoError(t, old.stopDebugServer())
+	state, err = get()
+	require.NoError(t, err)
+	require.Equal(t, "new.org.", state.From, "shutting the old instance down keeps the listener")
+
+	require.NoError(t, reloaded.stopDebugServer())
+	_, err = get()
+	require.Error(t, err, "the listener is closed with the last instance")
+}
@@ -0,0 +1,139 @@
+// Copyright (c) 2024 MWS and/or its affiliates.
+//
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at:
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fanout
+
+import (
+	"context"
+	"strings"
+	"sync"
+
+	"github.com/coredns/coredns/request"
+	"github.com/miekg/dns"
+)
+
+// flightKey identifies the queries to an upstream which get the same response.
+type flightKey struct {
+	endpoint string
+	name     string
+	qtype    uint16
+	qclass   uint16
+	flags    uint8
+	udpSize  uint16
+}
+
+const (
+	flightRD uint8 = 1 << iota
+	flightCD
+	flightDO
+)
+
+// flight is a request to an upstream shared by the queries with the same key.
+type flight struct {
+	done     chan struct{}
+	waiters  int
+	shared   *dns.Msg
+	err      error
+	canceled bool
+}
+
+// upstreamFlights shares a single request to an upstream between the concurrent queries asking it the
+// same question, so a burst of identical queries costs one upstream query instead of one per query.
+type upstreamFlights struct {
+	mutex   sync.Mutex
+	flights map[flightKey]*flight
+}
+
+func newUpstreamFlights() *upstreamFlights {
+	return &upstreamFlights{flights: map[flightKey]*flight{}}
+}
+
+// request sends r to c, or waits for the response to an identical request in flight to c. Queries with EDNS
+// options, such as a client subnet or a cookie, are never shared. When the query leading the request is
+// canceled, e.g. because another upstream answered it first, a waiting query sends the request itself.
+func (u *upstreamFlights) request(ctx context.Context, c Client, r *request.Request) (*dns.Msg, error) {
+	key, ok := newFlightKey(c, r.Req)
+	if u == nil || !ok {
+		return c.Request(ctx, r)
+	}
+	for {
+		u.mutex.Lock()
+		fl, inFlight := u.flights[key]
+		if !inFlight {
+			break
+		}
+		fl.waiters++
+		u.mutex.Unlock()
+		select {
+		case <-fl.done:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+		if fl.canceled {
+			continue
+		}
+		UpstreamDedupCount.WithLabelValues(c.Endpoint()).Add(1)
+		if fl.err != nil {
+			return nil, fl.err
+		}
+		ret := fl.shared.Copy()
+		ret.Id = r.Req.Id
+		ret.Question = append([]dns.Question(nil), r.Req.Question...)
+		return ret, nil
+	}
+	fl := &flight{done: make(chan struct{})}
+	u.flights[key] = fl
+	u.mutex.Unlock()
+
+	ret, err := c.Request(ctx, r)
+	u.mutex.Lock()
+	delete(u.flights, key)
+	waiters := fl.waiters
+	u.mutex.Unlock()
+	if waiters > 0 {
+		// the response is copied before the caller modifies it
+		fl.err, fl.canceled = err, err != nil && ctx.Err() != nil
+		if err == nil {
+			fl.shared = ret.Copy()
+		}
+	}
+	close(fl.done)
+	return ret, err
+}
+
+func newFlightKey(c Client, m *dns.Msg) (flightKey, bool) {
+	if len(m.Question) != 1 {
+		return flightKey{}, false
+	}
+	q := m.Question[0]
+	key := flightKey{endpoint: c.Endpoint(), name: strings.ToLower(q.Name), qtype: q.Qtype, qclass: q.Qclass}
+	if m.RecursionDesired {
+		key.flags |= flightRD
+	}
+	if m.CheckingDisabled {
+		key.flags |= flightCD
+	}
+	if opt := m.IsEdns0(); opt != nil {
+		if len(opt.Option) > 0 {
+			return flightKey{}, false
+		}
+		if opt.Do() {
+			key.flags |= flightDO
+		}
+		key.udpSize = opt.UDPSize()
+	}
+	return key, true
+}
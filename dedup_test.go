@@ -0,0 +1,136 @@
+// Copyright (c) 2024 MWS and/or its affiliates.
+//
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at:
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fanout
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/coredns/caddy"
+	"github.com/coredns/coredns/plugin/pkg/dnstest"
+	"github.com/coredns/coredns/plugin/test"
+	"github.com/coredns/coredns/request"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+)
+
+func TestUpstreamDedup(t *testing.T) {
+	var requests atomic.Int32
+	release := make(chan struct{})
+	s := newServer(UDP, func(w dns.ResponseWriter, r *dns.Msg) {
+		requests.Add(1)
+		<-release
+		msg := dns.Msg{Answer: []dns.RR{makeRecordA("example1. 3600 IN A 10.0.0.1")}}
+		msg.SetReply(r)
+		logErrIfNotNil(w.WriteMsg(&msg))
+	})
+	defer s.close()
+	fs, err := parseFanout(caddy.NewTestController("dns", "fanout . "+s.addr+" {\nupstream-dedup\n}"))
+	require.NoError(t, err)
+	f := fs[0]
+
+	const queries = 10
+	var wg sync.WaitGroup
+	for i := range queries {
+		wg.Go(func() {
+			req := new(dns.Msg)
+			req.SetQuestion(testQuery, dns.TypeA)
+			req.Id = uint16(i)
+			rec := dnstest.NewRecorder(&test.ResponseWriter{})
+			_, err := f.ServeDNS(context.Background(), rec, req)
+			require.NoError(t, err)
+			require.Equal(t, uint16(i), rec.Msg.Id)
+			require.Len(t, rec.Msg.Answer, 1)
+		})
+	}
+	require.Eventually(t, func() bool {
+		return waiters(f.flights) == queries-1
+	}, time.Second, time.Millisecond)
+	close(release)
+	wg.Wait()
+	require.Equal(t, int32(1), requests.Load(), "identical queries share an upstream request")
+
+	edns := new(dns.Msg)
+	edns.SetQuestion(testQuery, dns.TypeA)
+	edns.SetEdns0(dns.DefaultMsgSize, false)
+	edns.IsEdns0().Option = append(edns.IsEdns0().Option, &dns.EDNS0_SUBNET{Code: dns.EDNS0SUBNET, Family: 1})
+	_, ok := newFlightKey(f.clients[0], edns)
+	require.False(t, ok, "queries with EDNS options are not shared")
+}
+
+func TestUpstreamDedupCanceledLeader(t *testing.T) {
+	s := newServer(UDP, func(w dns.ResponseWriter, r *dns.Msg) {
+		msg := dns.Msg{Answer: []dns.RR{makeRecordA("example1. 3600 IN A 10.0.0.1")}}
+		msg.SetReply(r)
+		logErrIfNotNil(w.WriteMsg(&msg))
+	})
+	defer s.close()
+	u := newUpstreamFlights()
+	blocking := &blockingClient{Client: NewClient(s.addr, UDP), started: make(chan struct{})}
+	req := new(dns.Msg)
+	req.SetQuestion(testQuery, dns.TypeA)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	leaderDone := make(chan error)
+	go func() {
+		_, err := u.request(ctx, blocking, &request.Request{W: &test.ResponseWriter{}, Req: req})
+		leaderDone <- err
+	}()
+	<-blocking.started
+	followerDone := make(chan *dns.Msg)
+	go func() {
+		ret, err := u.request(context.Background(), blocking, &request.Request{W: &test.ResponseWriter{}, Req: req})
+		require.NoError(t, err)
+		followerDone <- ret
+	}()
+	require.Eventually(t, func() bool { return waiters(u) == 1 }, time.Second, time.Millisecond)
+	cancel()
+	require.ErrorIs(t, <-leaderDone, context.Canceled)
+	ret := <-followerDone
+	require.Len(t, ret.Answer, 1, "the follower sends its own request once the leader is canceled")
+}
+
+// blockingClient blocks the first request until its context is done.
+type blockingClient struct {
+	Client
+	started chan struct{}
+	once    sync.Once
+}
+
+func (c *blockingClient) Request(ctx context.Context, r *request.Request) (*dns.Msg, error) {
+	first := false
+	c.once.Do(func() { first = true })
+	if first {
+		close(c.started)
+		<-ctx.Done()
+		return nil, ctx.Err()
+	}
+	return c.Client.Request(ctx, r)
+}
+
+func waiters(u *upstreamFlights) int {
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+	n := 0
+	for _, fl := range u.flights {
+		n += fl.waiters
+	}
+	return n
+}
@@ -0,0 +1,78 @@
+// Copyright (c) 2024 MWS and/or its affiliates.
+//
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at:
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fanout
+
+import (
+	"context"
+	"time"
+
+	"github.com/coredns/coredns/request"
+	"github.com/miekg/dns"
+	"github.com/pkg/errors"
+)
+
+// delayedClient holds back the responses of an upstream by a fixed delay, to test how clients cope with a
+// slow upstream. The delay is counted from the response, so it adds up to the latency of the upstream and
+// counts against the request timeout like it.
+type delayedClient struct {
+	Client
+	delay time.Duration
+}
+
+// setDelay parses the delay of `upstream ADDR delay DURATION`.
+func (o *upstreamOptions) setDelay(value string) error {
+	d, err := time.ParseDuration(value)
+	if err != nil || d <= 0 {
+		return errors.Errorf("delay must be a positive duration, got %q", value)
+	}
+	o.delay = d
+	return nil
+}
+
+// Request sends the request to the upstream and returns its outcome after the delay, or the error of the
+// context if it is done first.
+func (c *delayedClient) Request(ctx context.Context, r *request.Request) (*dns.Msg, error) {
+	ret, err := c.Client.Request(ctx, r)
+	t := time.NewTimer(c.delay)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return ret, err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// Prewarm establishes a connection to the upstream, without delay.
+func (c *delayedClient) Prewarm(ctx context.Context) error {
+	if p, ok := c.Client.(prewarmer); ok {
+		return p.Prewarm(ctx)
+	}
+	return nil
+}
+
+func (c *delayedClient) pingIdle(idle time.Duration) {
+	if p, ok := c.Client.(idlePinger); ok {
+		p.pingIdle(idle)
+	}
+}
+
+func (c *delayedClient) closeIdle() {
+	if ic, ok := c.Client.(idleCloser); ok {
+		ic.closeIdle()
+	}
+}
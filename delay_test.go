@@ -0,0 +1,63 @@
+// Copyright (c) 2024 MWS and/or its affiliates.
+//
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at:
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fanout
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/coredns/caddy"
+	"github.com/coredns/coredns/plugin/pkg/dnstest"
+	"github.com/coredns/coredns/plugin/test"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDelayedUpstream(t *testing.T) {
+	s := newServer(UDP, func(w dns.ResponseWriter, r *dns.Msg) {
+		msg := dns.Msg{Answer: []dns.RR{makeRecordA("example1. 3600 IN A 10.0.0.1")}}
+		msg.SetReply(r)
+		logErrIfNotNil(w.WriteMsg(&msg))
+	})
+	defer s.close()
+
+	fs, err := parseFanout(caddy.NewTestController("dns", "fanout . "+s.addr+" {\nupstream "+s.addr+" delay 100ms\n}"))
+	require.NoError(t, err)
+	f := fs[0]
+	require.IsType(t, &delayedClient{}, f.clients[0])
+
+	req := new(dns.Msg)
+	req.SetQuestion(testQuery, dns.TypeA)
+	rec := dnstest.NewRecorder(&test.ResponseWriter{})
+	start := time.Now()
+	_, err = f.ServeDNS(context.Background(), rec, req)
+	require.NoError(t, err)
+	require.GreaterOrEqual(t, time.Since(start), 100*time.Millisecond)
+	require.Equal(t, dns.RcodeSuccess, rec.Msg.Rcode)
+	require.Len(t, rec.Msg.Answer, 1)
+
+	// a delay beyond the timeout makes the upstream time out
+	fs, err = parseFanout(caddy.NewTestController("dns", "fanout . "+s.addr+" {\nupstream "+s.addr+" delay 1s\ntimeout 100ms\nattempt-count 1\n}"))
+	require.NoError(t, err)
+	rec = dnstest.NewRecorder(&test.ResponseWriter{})
+	_, err = fs[0].ServeDNS(context.Background(), rec, req)
+	require.Error(t, err)
+
+	_, err = parseFanout(caddy.NewTestController("dns", "fanout . 127.0.0.1 {\nupstream 127.0.0.1 delay 0s\n}"))
+	require.ErrorContains(t, err, "delay must be a positive duration")
+}
@@ -0,0 +1,264 @@
+// Copyright (c) 2024 MWS and/or its affiliates.
+//
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at:
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fanout
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/coredns/caddy/caddyfile"
+	"github.com/coredns/coredns/plugin/dnstap/msg"
+	"github.com/coredns/coredns/request"
+	tap "github.com/dnstap/golang-dnstap"
+	"github.com/miekg/dns"
+	"github.com/pkg/errors"
+	"google.golang.org/protobuf/proto"
+)
+
+// dnstapFileConfig is the configuration of the dnstap-file option.
+type dnstapFileConfig struct {
+	path    string
+	maxSize int64
+	keep    int
+}
+
+// parseDnstapFile parses `dnstap-file PATH [SIZE [KEEP]]`, SIZE being in megabytes.
+func parseDnstapFile(f *Fanout, c *caddyfile.Dispenser) error {
+	args := c.RemainingArgs()
+	if len(args) == 0 || len(args) > 3 {
+		return c.ArgErr()
+	}
+	cfg := &dnstapFileConfig{path: filepath.Clean(args[0]), maxSize: defaultDnstapFileSize << 20, keep: defaultDnstapFileKeep}
+	if len(args) > 1 {
+		n, err := strconv.Atoi(args[1])
+		if err != nil || n < 1 {
+			return errors.Errorf("invalid dnstap-file size %q", args[1])
+		}
+		cfg.maxSize = int64(n) << 20
+	}
+	if len(args) > 2 {
+		n, err := strconv.Atoi(args[2])
+		if err != nil || n < 0 {
+			return errors.Errorf("invalid dnstap-file count %q", args[2])
+		}
+		cfg.keep = n
+	}
+	f.dnstapFile = cfg
+	return nil
+}
+
+// dnstapFile records the upstream traffic as a dnstap frame stream in a file, rotated once it reaches its
+// maximum size. Frames are written in the background, and dropped when the writer falls behind.
+type dnstapFile struct {
+	cfg    dnstapFileConfig
+	refs   int
+	mutex  sync.RWMutex
+	closed bool
+	frames chan []byte
+	done   chan struct{}
+	file   *os.File
+	writer tap.Writer
+	size   int64
+}
+
+// dnstapFileRegistry shares the files between the fanout instances writing to the same path, so that the
+// instance started by a reload keeps writing to the file of the one it replaces.
+type dnstapFileRegistry struct {
+	mutex sync.Mutex
+	files map[string]*dnstapFile
+}
+
+var dnstapFiles = &dnstapFileRegistry{files: map[string]*dnstapFile{}}
+
+// acquire returns the file at the path of cfg, opening it unless another instance already did.
+func (r *dnstapFileRegistry) acquire(cfg dnstapFileConfig) (*dnstapFile, error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if t, ok := r.files[cfg.path]; ok {
+		t.refs++
+		return t, nil
+	}
+	t := &dnstapFile{cfg: cfg, refs: 1, frames: make(chan []byte, dnstapFileQueue), done: make(chan struct{})}
+	if err := t.open(); err != nil {
+		return nil, err
+	}
+	r.files[cfg.path] = t
+	go t.run()
+	return t, nil
+}
+
+// release closes the file once no instance writes to it anymore.
+func (r *dnstapFileRegistry) release(t *dnstapFile) {
+	r.mutex.Lock()
+	t.refs--
+	last := t.refs == 0
+	if last {
+		delete(r.files, t.cfg.path)
+	}
+	r.mutex.Unlock()
+	if !last {
+		return
+	}
+	t.mutex.Lock()
+	t.closed = true
+	close(t.frames)
+	t.mutex.Unlock()
+	<-t.done
+}
+
+// record queues the query sent to c over proto and the response it got, if any, started at start and
+// finished at end.
+func (t *dnstapFile) record(c Client, proto string, r *request.Request, reply *dns.Msg, start, end time.Time) {
+	if t == nil {
+		return
+	}
+	addr := tapAddr(c, proto)
+	q := new(tap.Message)
+	msg.SetType(q, tap.Message_FORWARDER_QUERY)
+	msg.SetQueryTime(q, start)
+	var _ = msg.SetQueryAddress(q, addr)
+	q.QueryMessage, _ = r.Req.Pack()
+	t.queue(q)
+	if reply == nil {
+		return
+	}
+	m := new(tap.Message)
+	msg.SetType(m, tap.Message_FORWARDER_RESPONSE)
+	msg.SetQueryTime(m, start)
+	msg.SetResponseTime(m, end)
+	var _ = msg.SetQueryAddress(m, addr)
+	m.ResponseMessage, _ = reply.Pack()
+	t.queue(m)
+}
+
+func (t *dnstapFile) queue(m *tap.Message) {
+	frame, err := proto.Marshal(&tap.Dnstap{Type: tap.Dnstap_MESSAGE.Enum(), Message: m})
+	if err != nil {
+		return
+	}
+	t.mutex.RLock()
+	defer t.mutex.RUnlock()
+	if t.closed {
+		return
+	}
+	select {
+	case t.frames <- frame:
+	default:
+		DnstapFileDropCount.Inc()
+	}
+}
+
+// run writes the queued frames until the file is released, flushing them whenever the queue is empty.
+func (t *dnstapFile) run() {
+	defer close(t.done)
+	for frame := range t.frames {
+		if err := t.write(frame); err != nil {
+			log.Warningf("unable to write dnstap file %s: %v", t.cfg.path, err)
+		}
+	}
+	if err := t.close(); err != nil {
+		log.Warningf("unable to close dnstap file %s: %v", t.cfg.path, err)
+	}
+}
+
+func (t *dnstapFile) write(frame []byte) error {
+	if t.writer == nil {
+		// a previous rotation failed, try again
+		if err := t.open(); err != nil {
+			return err
+		}
+	}
+	n, err := t.writer.WriteFrame(frame)
+	t.size += int64(n) + 4
+	if err != nil {
+		return err
+	}
+	if t.size >= t.cfg.maxSize {
+		return t.rotate()
+	}
+	if len(t.frames) == 0 {
+		if fw, ok := t.writer.(interface{ Flush() error }); ok {
+			return fw.Flush()
+		}
+	}
+	return nil
+}
+
+// open rotates the existing file, if any, so that a restart never overwrites a previous capture, and
+// starts a new frame stream.
+func (t *dnstapFile) open() error {
+	if err := t.shift(); err != nil {
+		return err
+	}
+	file, err := os.OpenFile(t.cfg.path, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0o600)
+	if err != nil {
+		return err
+	}
+	writer, err := tap.NewWriter(file, nil)
+	if err != nil {
+		_ = file.Close()
+		return err
+	}
+	t.file, t.writer, t.size = file, writer, 0
+	return nil
+}
+
+func (t *dnstapFile) rotate() error {
+	if err := t.close(); err != nil {
+		return err
+	}
+	return t.open()
+}
+
+// shift renames PATH to PATH.1, PATH.1 to PATH.2 and so on, removing the files beyond the ones to keep.
+func (t *dnstapFile) shift() error {
+	if _, err := os.Stat(t.cfg.path); os.IsNotExist(err) {
+		return nil
+	}
+	name := func(i int) string {
+		if i == 0 {
+			return t.cfg.path
+		}
+		return fmt.Sprintf("%s.%d", t.cfg.path, i)
+	}
+	if err := os.Remove(name(t.cfg.keep)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	for i := t.cfg.keep - 1; i >= 0; i-- {
+		if err := os.Rename(name(i), name(i+1)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// close ends the frame stream and closes the file.
+func (t *dnstapFile) close() error {
+	if t.writer == nil {
+		return nil
+	}
+	err := t.writer.Close()
+	if closeErr := t.file.Close(); err == nil {
+		err = closeErr
+	}
+	t.file, t.writer = nil, nil
+	return err
+}
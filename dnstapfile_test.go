@@ -0,0 +1,117 @@
+// Copyright (c) 2024 MWS and/or its affiliates.
+//
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at:
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fanout
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/coredns/caddy"
+	"github.com/coredns/coredns/plugin/pkg/dnstest"
+	"github.com/coredns/coredns/plugin/test"
+	"github.com/coredns/coredns/request"
+	tap "github.com/dnstap/golang-dnstap"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDnstapFile(t *testing.T) {
+	s := newServer(UDP, func(w dns.ResponseWriter, r *dns.Msg) {
+		msg := dns.Msg{Answer: []dns.RR{makeRecordA("example1. 3600 IN A 10.0.0.1")}}
+		msg.SetReply(r)
+		logErrIfNotNil(w.WriteMsg(&msg))
+	})
+	defer s.close()
+	path := filepath.Join(t.TempDir(), "fanout.dnstap")
+	require.NoError(t, os.WriteFile(path, []byte("previous"), 0o600))
+	fs, err := parseFanout(caddy.NewTestController("dns", "fanout . "+s.addr+" {\ndnstap-file "+path+" 10 2\n}"))
+	require.NoError(t, err)
+	f := fs[0]
+	require.Equal(t, dnstapFileConfig{path: path, maxSize: 10 << 20, keep: 2}, *f.dnstapFile)
+	require.NoError(t, f.OnStartup())
+
+	req := new(dns.Msg)
+	req.SetQuestion(testQuery, dns.TypeA)
+	_, err = f.ServeDNS(context.Background(), dnstest.NewRecorder(&test.ResponseWriter{}), req)
+	require.NoError(t, err)
+	require.NoError(t, f.OnShutdown())
+
+	previous, err := os.ReadFile(path + ".1")
+	require.NoError(t, err)
+	require.Equal(t, "previous", string(previous), "existing captures are rotated, not overwritten")
+	messages := readDnstapFile(t, path)
+	require.Len(t, messages, 2)
+	require.Equal(t, tap.Message_FORWARDER_QUERY, messages[0].GetType())
+	require.Equal(t, tap.Message_FORWARDER_RESPONSE, messages[1].GetType())
+	var m dns.Msg
+	require.NoError(t, m.Unpack(messages[1].GetResponseMessage()))
+	require.Len(t, m.Answer, 1)
+
+	for _, args := range []string{"", "/tmp/x 0", "/tmp/x 1 -1", "/tmp/x 1 2 3"} {
+		_, err = parseFanout(caddy.NewTestController("dns", "fanout . 127.0.0.1 {\ndnstap-file "+args+"\n}"))
+		require.Error(t, err, args)
+	}
+}
+
+func TestDnstapFileRotation(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "fanout.dnstap")
+	cfg := dnstapFileConfig{path: path, maxSize: 200, keep: 2}
+	file, err := dnstapFiles.acquire(cfg)
+	require.NoError(t, err)
+	shared, err := dnstapFiles.acquire(cfg)
+	require.NoError(t, err)
+	require.Same(t, file, shared, "instances writing to the same path share the file")
+
+	c := NewClient("127.0.0.1:53", UDP)
+	req := new(dns.Msg)
+	req.SetQuestion(testQuery, dns.TypeA)
+	r := &request.Request{W: &test.ResponseWriter{}, Req: req}
+	now := time.Now()
+	for range 20 {
+		file.record(c, UDP, r, nil, now, now)
+	}
+	dnstapFiles.release(shared)
+	file.record(c, UDP, r, nil, now, now)
+	dnstapFiles.release(file)
+	file.record(c, UDP, r, nil, now, now)
+
+	for _, name := range []string{path, path + ".1", path + ".2"} {
+		require.FileExists(t, name)
+	}
+	require.NoFileExists(t, path+".3")
+}
+
+// readDnstapFile returns the messages of the frame stream at path.
+func readDnstapFile(t *testing.T, path string) []*tap.Message {
+	file, err := os.Open(path)
+	require.NoError(t, err)
+	defer file.Close()
+	r, err := tap.NewReader(file, nil)
+	require.NoError(t, err)
+	dec := tap.NewDecoder(r, 1<<16)
+	var messages []*tap.Message
+	for {
+		var d tap.Dnstap
+		if err := dec.Decode(&d); err != nil {
+			return messages
+		}
+		messages = append(messages, d.GetMessage())
+	}
+}
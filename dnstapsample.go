@@ -0,0 +1,95 @@
+// Copyright (c) 2024 MWS and/or its affiliates.
+//
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at:
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fanout
+
+import (
+	"math/rand/v2"
+	"strconv"
+	"time"
+
+	"github.com/coredns/caddy/caddyfile"
+	"github.com/coredns/coredns/request"
+	"github.com/miekg/dns"
+	"github.com/pkg/errors"
+)
+
+// dnstapSampler selects the exchanges sent to dnstap, and to the dnstap file, so that high rate
+// deployments can keep them without overwhelming the collectors.
+type dnstapSampler struct {
+	rate       float64
+	failures   bool
+	mismatches bool
+}
+
+// parseDnstapSample parses `dnstap-sample PROBABILITY [failures] [mismatches]`.
+func parseDnstapSample(f *Fanout, c *caddyfile.Dispenser) error {
+	args := c.RemainingArgs()
+	if len(args) == 0 || len(args) > 3 {
+		return c.ArgErr()
+	}
+	rate, err := strconv.ParseFloat(args[0], 64)
+	if err != nil || rate < 0 || rate > 1 {
+		return errors.Errorf("dnstap-sample must be a probability in [0, 1], got %q", args[0])
+	}
+	s := &dnstapSampler{rate: rate}
+	for _, arg := range args[1:] {
+		switch arg {
+		case dnstapSampleFailures:
+			s.failures = true
+		case dnstapSampleMismatches:
+			s.mismatches = true
+		default:
+			return errors.Errorf("unknown dnstap-sample selector %q", arg)
+		}
+	}
+	if rate == 0 && !s.failures && !s.mismatches {
+		return errors.New("dnstap-sample 0 selects nothing without failures or mismatches")
+	}
+	f.dnstapSample = s
+	return nil
+}
+
+// sample returns true if the exchange of req getting reply, or err, is sent to dnstap: failed exchanges
+// with failures, replies not matching the query with mismatches, and the given share of the others.
+// Every exchange is sent without a sampler.
+func (s *dnstapSampler) sample(req *request.Request, reply *dns.Msg, err error) bool {
+	if s == nil {
+		return true
+	}
+	if s.failures && (err != nil || reply == nil || reply.Rcode == dns.RcodeServerFailure || reply.Rcode == dns.RcodeRefused) {
+		return true
+	}
+	if s.mismatches && reply != nil && !req.Match(reply) {
+		return true
+	}
+	//nolint:gosec // sampling does not need cryptographic randomness
+	return rand.Float64() < s.rate
+}
+
+// toDnstap sends the exchange of result to the dnstap plugin if it is sampled.
+func (f *Fanout) toDnstap(result *response, req *request.Request) {
+	if f.TapPlugin != nil && f.dnstapSample.sample(req, result.response, result.err) {
+		toDnstap(f.TapPlugin, result, req)
+	}
+}
+
+// recordTap records the attempt to c in the dnstap file if it is sampled.
+func (f *Fanout) recordTap(c Client, proto string, r *request.Request, reply *dns.Msg, err error, start, end time.Time) {
+	if f.tapFile != nil && f.dnstapSample.sample(r, reply, err) {
+		f.tapFile.record(c, proto, r, reply, start, end)
+	}
+}
@@ -0,0 +1,91 @@
+// Copyright (c) 2024 MWS and/or its affiliates.
+//
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at:
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fanout
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+
+	"github.com/coredns/caddy"
+	"github.com/coredns/coredns/plugin/pkg/dnstest"
+	"github.com/coredns/coredns/plugin/test"
+	"github.com/coredns/coredns/request"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDnstapSampleFailures(t *testing.T) {
+	s := newServer(UDP, func(w dns.ResponseWriter, r *dns.Msg) {
+		msg := new(dns.Msg)
+		msg.SetReply(r)
+		if r.Question[0].Name == "fail." {
+			msg.Rcode = dns.RcodeServerFailure
+		}
+		logErrIfNotNil(w.WriteMsg(msg))
+	})
+	defer s.close()
+	path := filepath.Join(t.TempDir(), "fanout.dnstap")
+	fs, err := parseFanout(caddy.NewTestController("dns", "fanout . "+s.addr+" {\ndnstap-file "+path+"\ndnstap-sample 0 failures\n}"))
+	require.NoError(t, err)
+	f := fs[0]
+	require.NoError(t, f.OnStartup())
+
+	for _, name := range []string{testQuery, "fail.", testQuery} {
+		req := new(dns.Msg)
+		req.SetQuestion(name, dns.TypeA)
+		_, err = f.ServeDNS(context.Background(), dnstest.NewRecorder(&test.ResponseWriter{}), req)
+		require.NoError(t, err)
+	}
+	require.NoError(t, f.OnShutdown())
+
+	messages := readDnstapFile(t, path)
+	require.Len(t, messages, 2, "only the failed exchange is recorded")
+	var m dns.Msg
+	require.NoError(t, m.Unpack(messages[1].GetResponseMessage()))
+	require.Equal(t, "fail.", m.Question[0].Name)
+}
+
+func TestDnstapSampleSelection(t *testing.T) {
+	req := new(dns.Msg)
+	req.SetQuestion(testQuery, dns.TypeA)
+	r := &request.Request{W: &test.ResponseWriter{}, Req: req}
+	ok := new(dns.Msg)
+	ok.SetReply(req)
+	other := new(dns.Msg)
+	other.SetQuestion("other.", dns.TypeA)
+	other.Response = true
+
+	var all *dnstapSampler
+	require.True(t, all.sample(r, ok, nil))
+	none := &dnstapSampler{}
+	require.False(t, none.sample(r, ok, nil))
+	require.False(t, none.sample(r, nil, context.DeadlineExceeded))
+	mismatches := &dnstapSampler{mismatches: true}
+	require.True(t, mismatches.sample(r, other, nil))
+	require.False(t, mismatches.sample(r, ok, nil))
+	every := &dnstapSampler{rate: 1}
+	require.True(t, every.sample(r, ok, nil))
+
+	for _, args := range []string{"", "2", "-0.1", "0", "0.5 all", "0 failures mismatches failures"} {
+		_, err := parseFanout(caddy.NewTestController("dns", "fanout . 127.0.0.1 {\ndnstap-sample "+args+"\n}"))
+		require.Error(t, err, args)
+	}
+	fs, err := parseFanout(caddy.NewTestController("dns", "fanout . 127.0.0.1 {\ndnstap-sample 0.01 mismatches\n}"))
+	require.NoError(t, err)
+	require.Equal(t, &dnstapSampler{rate: 0.01, mismatches: true}, fs[0].dnstapSample)
+}
@@ -0,0 +1,157 @@
+// Copyright (c) 2024 MWS and/or its affiliates.
+//
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at:
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fanout
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"io"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/coredns/coredns/request"
+	"github.com/miekg/dns"
+	"github.com/pkg/errors"
+	"github.com/quic-go/quic-go"
+	"github.com/quic-go/quic-go/http3"
+)
+
+// dohClient is a Client sending DNS-over-HTTPS (RFC 8484) requests to an upstream URL. With HTTP/3, requests
+// fall back to HTTP/2 for dohFallbackInterval when the upstream can't be reached over QUIC.
+type dohClient struct {
+	url           string
+	httpVersion   string
+	h2            *http.Client
+	h3            *http.Client
+	h3Transport   *http3.Transport
+	h3FailedUntil atomic.Int64
+}
+
+func isDoH(host string) bool {
+	return strings.HasPrefix(host, dohScheme)
+}
+
+func newDoHClient(url, httpVersion string) *dohClient {
+	c := &dohClient{url: url, httpVersion: httpVersion}
+	c.SetTLSConfig(nil)
+	return c
+}
+
+// SetTLSConfig sets the TLS configuration of the HTTPS connections.
+func (c *dohClient) SetTLSConfig(cfg *tls.Config) {
+	if cfg == nil {
+		cfg = new(tls.Config)
+	}
+	h2 := &http.Transport{
+		TLSClientConfig:     cfg.Clone(),
+		ForceAttemptHTTP2:   c.httpVersion != httpVersion1,
+		IdleConnTimeout:     connExpire,
+		MaxIdleConnsPerHost: maxPooledConns,
+		TLSHandshakeTimeout: maxTimeout,
+	}
+	if c.httpVersion == httpVersion1 {
+		h2.TLSNextProto = map[string]func(string, *tls.Conn) http.RoundTripper{}
+	}
+	c.h2 = &http.Client{Transport: h2}
+	if c.httpVersion == httpVersion3 {
+		c.h3Transport = &http3.Transport{
+			TLSClientConfig: cfg.Clone(),
+			QUICConfig:      &quic.Config{HandshakeIdleTimeout: dohH3HandshakeTimeout},
+		}
+		c.h3 = &http.Client{Transport: c.h3Transport}
+	}
+}
+
+// Net returns the network type of the client.
+func (c *dohClient) Net() string {
+	return DOH
+}
+
+// Endpoint returns the URL of the upstream.
+func (c *dohClient) Endpoint() string {
+	return c.url
+}
+
+// Request sends the request to the upstream as an HTTP POST.
+func (c *dohClient) Request(ctx context.Context, r *request.Request) (*dns.Msg, error) {
+	start := time.Now()
+	body, err := hopped(ctx, r.Req).Pack()
+	if err != nil {
+		return nil, err
+	}
+	// RFC 8484 recommends ID 0 so that responses are cacheable by HTTP caches
+	body[0], body[1] = 0, 0
+	ret, proto, err := c.roundTrip(ctx, body)
+	observeRequest(ctx, c.url, proto, ret, err, start)
+	if err != nil {
+		return nil, err
+	}
+	ret.Id = r.Req.Id
+	return ret, nil
+}
+
+// roundTrip posts the request over HTTP/3 when enabled and not failing, and HTTP/2 otherwise. It returns
+// the protocol of the exchange for the metrics.
+func (c *dohClient) roundTrip(ctx context.Context, body []byte) (*dns.Msg, string, error) {
+	if c.h3 != nil && time.Now().UnixNano() >= c.h3FailedUntil.Load() {
+		ret, err := c.post(ctx, c.h3, body)
+		if err == nil || ctx.Err() != nil {
+			return ret, protoQUIC, err
+		}
+		log.Debugf("falling back to HTTP/2 for %s for %s: %v", c.url, dohFallbackInterval, err)
+		c.h3FailedUntil.Store(time.Now().Add(dohFallbackInterval).UnixNano())
+	}
+	ret, err := c.post(ctx, c.h2, body)
+	return ret, protoHTTPS, err
+}
+
+func (c *dohClient) post(ctx context.Context, hc *http.Client, body []byte) (*dns.Msg, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.url, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", dohMediaType)
+	req.Header.Set("Accept", dohMediaType)
+	resp, err := hc.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = resp.Body.Close() }()
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.Errorf("unexpected status %q from %s", resp.Status, c.url)
+	}
+	data, err := io.ReadAll(io.LimitReader(resp.Body, dns.MaxMsgSize))
+	if err != nil {
+		return nil, err
+	}
+	ret := new(dns.Msg)
+	if err := ret.Unpack(data); err != nil {
+		return nil, err
+	}
+	return ret, nil
+}
+
+// closeIdle closes the idle HTTPS connections.
+func (c *dohClient) closeIdle() {
+	c.h2.CloseIdleConnections()
+	if c.h3Transport != nil {
+		_ = c.h3Transport.Close()
+	}
+}
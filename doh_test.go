@@ -0,0 +1,114 @@
+// Copyright (c) 2024 MWS and/or its affiliates.
+//
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at:
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fanout
+
+import (
+	"context"
+	"crypto/tls"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/coredns/caddy"
+	"github.com/coredns/coredns/plugin/test"
+	"github.com/coredns/coredns/request"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+)
+
+func newDoHServer(t *testing.T, proto *atomic.Int32) *httptest.Server {
+	s := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		proto.Store(int32(r.ProtoMajor))
+		require.Equal(t, http.MethodPost, r.Method)
+		require.Equal(t, dohMediaType, r.Header.Get("Content-Type"))
+		body, err := io.ReadAll(r.Body)
+		require.NoError(t, err)
+		req := new(dns.Msg)
+		require.NoError(t, req.Unpack(body))
+		require.Zero(t, req.Id)
+		msg := dns.Msg{Answer: []dns.RR{makeRecordA("example1. 3600 IN A 10.0.0.1")}}
+		msg.SetReply(req)
+		out, err := msg.Pack()
+		require.NoError(t, err)
+		w.Header().Set("Content-Type", dohMediaType)
+		_, _ = w.Write(out)
+	}))
+	s.EnableHTTP2 = true
+	s.StartTLS()
+	return s
+}
+
+func dohRequest(t *testing.T, c Client) *dns.Msg {
+	req := new(dns.Msg)
+	req.SetQuestion(testQuery, dns.TypeA)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	resp, err := c.Request(ctx, &request.Request{W: &test.ResponseWriter{}, Req: req})
+	require.NoError(t, err)
+	require.Equal(t, req.Id, resp.Id)
+	require.Len(t, resp.Answer, 1)
+	return resp
+}
+
+func TestDoHClientHTTPVersions(t *testing.T) {
+	var proto atomic.Int32
+	s := newDoHServer(t, &proto)
+	defer s.Close()
+	cfg := &tls.Config{RootCAs: s.Client().Transport.(*http.Transport).TLSClientConfig.RootCAs}
+
+	for version, expected := range map[string]int32{httpVersion1: 1, httpVersion2: 2} {
+		c := newDoHClient(s.URL+"/dns-query", version)
+		c.SetTLSConfig(cfg)
+		dohRequest(t, c)
+		require.Equal(t, expected, proto.Load(), version)
+		c.closeIdle()
+	}
+}
+
+func TestDoHClientFallsBackFromHTTP3(t *testing.T) {
+	var proto atomic.Int32
+	s := newDoHServer(t, &proto)
+	defer s.Close()
+	c := newDoHClient(s.URL+"/dns-query", httpVersion3)
+	c.SetTLSConfig(&tls.Config{RootCAs: s.Client().Transport.(*http.Transport).TLSClientConfig.RootCAs})
+	defer c.closeIdle()
+
+	dohRequest(t, c)
+	require.Equal(t, int32(2), proto.Load())
+	require.Greater(t, c.h3FailedUntil.Load(), time.Now().UnixNano())
+
+	start := time.Now()
+	dohRequest(t, c)
+	require.Less(t, time.Since(start), dohH3HandshakeTimeout, "HTTP/3 is skipped after a failure")
+}
+
+func TestSetupDoHUpstream(t *testing.T) {
+	fs, err := parseFanout(caddy.NewTestController("dns", "fanout . 127.0.0.1 https://dns.example/dns-query {\nhttp-version 3\n}"))
+	require.NoError(t, err)
+	require.Len(t, fs[0].clients, 2)
+	c, ok := fs[0].clients[1].(*dohClient)
+	require.True(t, ok)
+	require.Equal(t, "https://dns.example/dns-query", c.Endpoint())
+	require.Equal(t, DOH, c.Net())
+	require.NotNil(t, c.h3)
+
+	_, err = parseFanout(caddy.NewTestController("dns", "fanout . https://dns.example/dns-query {\nhttp-version 4\n}"))
+	require.ErrorContains(t, err, "unsupported http-version")
+}
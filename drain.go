@@ -0,0 +1,115 @@
+// Copyright (c) 2024 MWS and/or its affiliates.
+//
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at:
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fanout
+
+import (
+	"time"
+
+	"github.com/coredns/coredns/request"
+	"github.com/pkg/errors"
+)
+
+// DrainUpstream marks the upstream with the given endpoint as draining. A draining upstream is not
+// selected for new queries while queries already sent to it are allowed to complete.
+func (f *Fanout) DrainUpstream(addr string) error {
+	if !f.hasUpstream(addr) {
+		return errors.Errorf("unknown upstream %q", addr)
+	}
+	f.draining.Store(addr, struct{}{})
+	return nil
+}
+
+// UndrainUpstream returns a previously drained upstream back to the selection pool.
+func (f *Fanout) UndrainUpstream(addr string) error {
+	if !f.hasUpstream(addr) {
+		return errors.Errorf("unknown upstream %q", addr)
+	}
+	f.draining.Delete(addr)
+	return nil
+}
+
+// IsDraining returns true if the upstream with the given endpoint is draining.
+func (f *Fanout) IsDraining(addr string) bool {
+	_, ok := f.draining.Load(addr)
+	return ok
+}
+
+func (f *Fanout) hasUpstream(addr string) bool {
+	for _, c := range f.upstreams() {
+		if c.Endpoint() == addr {
+			return true
+		}
+	}
+	return false
+}
+
+// activeSelector skips draining upstreams returned by the wrapped selector and upstreams outside of their
+// schedule, as well as upstreams blocked for the zone of the query, down according to the error budget or
+// held back by slow start unless no other upstream is left.
+type activeSelector struct {
+	clientSelector
+	f       *Fanout
+	now     time.Time
+	zone    string
+	picked  bool
+	blocked []Client
+}
+
+func (f *Fanout) newActiveSelector(req *request.Request, clients []Client, p policy) *activeSelector {
+	s := &activeSelector{clientSelector: f.selector(req, clients, p), f: f, now: f.clock.Now()}
+	if f.servfails != nil {
+		s.zone = servfailZone(req.Name())
+	}
+	return s
+}
+
+// Pick returns the next client which is not draining or nil if there are none left.
+func (s *activeSelector) Pick() Client {
+	for {
+		c := s.clientSelector.Pick()
+		if c == nil {
+			break
+		}
+		if s.f.IsDraining(c.Endpoint()) || !s.f.scheduled(c.Endpoint(), s.now) {
+			continue
+		}
+		if s.held(c) {
+			s.blocked = append(s.blocked, c)
+			continue
+		}
+		s.picked = true
+		return c
+	}
+	if s.picked || len(s.blocked) == 0 {
+		return nil
+	}
+	c := s.blocked[0]
+	s.blocked = s.blocked[1:]
+	return c
+}
+
+// held returns true if c is only to be used when no other upstream is left.
+func (s *activeSelector) held(c Client) bool {
+	addr := c.Endpoint()
+	if healthy, ok := s.f.healthOverride(addr); ok {
+		return !healthy
+	}
+	if s.f.servfails != nil && s.f.servfails.blocked(addr, s.zone, s.now) {
+		return true
+	}
+	return !s.f.errorBudget.available(addr, s.now) || !s.f.slowStart.admit(addr, s.now)
+}
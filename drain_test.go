@@ -0,0 +1,80 @@
+// Copyright (c) 2024 MWS and/or its affiliates.
+//
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at:
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fanout
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+
+	"github.com/coredns/coredns/plugin/test"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDrainUpstreamStopsNewQueries(t *testing.T) {
+	var drainedCount, activeCount atomic.Int32
+	handler := func(counter *atomic.Int32) dns.HandlerFunc {
+		return func(w dns.ResponseWriter, r *dns.Msg) {
+			counter.Add(1)
+			msg := dns.Msg{Answer: []dns.RR{makeRecordA("example1. 3600 IN A 10.0.0.1")}}
+			msg.SetReply(r)
+			logErrIfNotNil(w.WriteMsg(&msg))
+		}
+	}
+	drained := newServer(UDP, handler(&drainedCount))
+	defer drained.close()
+	active := newServer(UDP, handler(&activeCount))
+	defer active.close()
+
+	f := New()
+	f.From = "."
+	f.AddClient(NewClient(drained.addr, UDP))
+	f.AddClient(NewClient(active.addr, UDP))
+	require.NoError(t, f.DrainUpstream(drained.addr))
+	require.True(t, f.IsDraining(drained.addr))
+	require.Error(t, f.DrainUpstream("192.0.2.1:53"))
+
+	req := new(dns.Msg)
+	req.SetQuestion(testQuery, dns.TypeA)
+	writer := &cachedDNSWriter{ResponseWriter: new(test.ResponseWriter)}
+	for i := 0; i < 3; i++ {
+		_, err := f.ServeDNS(context.Background(), writer, req)
+		require.NoError(t, err)
+	}
+	require.Len(t, writer.answers, 3)
+	require.Zero(t, drainedCount.Load())
+	require.Equal(t, int32(3), activeCount.Load())
+
+	require.NoError(t, f.UndrainUpstream(drained.addr))
+	require.False(t, f.IsDraining(drained.addr))
+	_, err := f.ServeDNS(context.Background(), writer, req)
+	require.NoError(t, err)
+	require.Len(t, writer.answers, 4)
+}
+
+func TestDrainAllUpstreamsReturnsServfail(t *testing.T) {
+	f := New()
+	f.From = "."
+	f.AddClient(NewClient("192.0.2.1:53", UDP))
+	require.NoError(t, f.DrainUpstream("192.0.2.1:53"))
+
+	req := new(dns.Msg)
+	req.SetQuestion(testQuery, dns.TypeA)
+	rcode, _ := f.ServeDNS(context.Background(), &test.ResponseWriter{}, req)
+	require.Equal(t, dns.RcodeServerFailure, rcode)
+}
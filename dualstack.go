@@ -0,0 +1,124 @@
+// Copyright (c) 2024 MWS and/or its affiliates.
+//
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at:
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fanout
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"net/netip"
+	"sync/atomic"
+	"time"
+
+	"github.com/coredns/coredns/request"
+	"github.com/miekg/dns"
+	"github.com/pkg/errors"
+)
+
+// dualStackClient is an upstream reachable at an IPv4 and an IPv6 address, such as both addresses of the
+// same resolver. It is a single upstream for the selection policy, health and statistics, known by the
+// address of the TO list, and sends requests over the family which last worked, switching to the other
+// one when a request fails.
+type dualStackClient struct {
+	families  [2]Client
+	preferred atomic.Int32
+}
+
+func newDualStackClient(primary, alternate Client) *dualStackClient {
+	return &dualStackClient{families: [2]Client{primary, alternate}}
+}
+
+// Request sends the request over the preferred family, then over the other one if it fails.
+func (c *dualStackClient) Request(ctx context.Context, r *request.Request) (*dns.Msg, error) {
+	first := c.preferred.Load()
+	ret, err := c.families[first].Request(ctx, r)
+	if err == nil || ctx.Err() != nil {
+		return ret, err
+	}
+	ret, err = c.families[1-first].Request(ctx, r)
+	if err != nil {
+		return nil, err
+	}
+	c.preferred.CompareAndSwap(first, 1-first)
+	return ret, nil
+}
+
+// Endpoint returns the address of the upstream in the TO list.
+func (c *dualStackClient) Endpoint() string {
+	return c.families[0].Endpoint()
+}
+
+// Net returns the network type of the upstream.
+func (c *dualStackClient) Net() string {
+	return c.families[0].Net()
+}
+
+// SetTLSConfig sets the tls config of both addresses.
+func (c *dualStackClient) SetTLSConfig(cfg *tls.Config) {
+	for _, f := range c.families {
+		f.SetTLSConfig(cfg)
+	}
+}
+
+// Prewarm establishes a connection over the preferred family.
+func (c *dualStackClient) Prewarm(ctx context.Context) error {
+	if p, ok := c.families[c.preferred.Load()].(prewarmer); ok {
+		return p.Prewarm(ctx)
+	}
+	return nil
+}
+
+func (c *dualStackClient) pingIdle(idle time.Duration) {
+	for _, f := range c.families {
+		if p, ok := f.(idlePinger); ok {
+			p.pingIdle(idle)
+		}
+	}
+}
+
+func (c *dualStackClient) closeIdle() {
+	for _, f := range c.families {
+		if ic, ok := f.(idleCloser); ok {
+			ic.closeIdle()
+		}
+	}
+}
+
+// dualStackAddr returns the alternate address of the upstream at addr, with the port of addr unless it
+// has its own, checking that both are IP addresses of different families.
+func dualStackAddr(addr, alternate string) (string, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return "", err
+	}
+	ip, err := netip.ParseAddr(addrHost(addr))
+	if err != nil {
+		return "", errors.Errorf("dual-stack upstream %s must be an IP address", host)
+	}
+	alt, err := normalizeAddr(alternate, port)
+	if err != nil {
+		return "", err
+	}
+	altIP, err := netip.ParseAddr(addrHost(alt))
+	if err != nil {
+		return "", errors.Errorf("dual-stack address %q must be an IP address", alternate)
+	}
+	if ip.Unmap().Is4() == altIP.Unmap().Is4() {
+		return "", errors.Errorf("dual-stack address %s has the same family as %s", alt, addr)
+	}
+	return alt, nil
+}
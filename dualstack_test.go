@@ -0,0 +1,69 @@
+// Copyright (c) 2024 MWS and/or its affiliates.
+//
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at:
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fanout
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	"github.com/coredns/caddy"
+	"github.com/coredns/coredns/plugin/pkg/dnstest"
+	"github.com/coredns/coredns/plugin/test"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDualStackUpstream(t *testing.T) {
+	s := newServer(UDP, func(w dns.ResponseWriter, r *dns.Msg) {
+		msg := dns.Msg{Answer: []dns.RR{makeRecordA("example1. 3600 IN A 10.0.0.1")}}
+		msg.SetReply(r)
+		logErrIfNotNil(w.WriteMsg(&msg))
+	})
+	defer s.close()
+	_, port, err := net.SplitHostPort(s.addr)
+	require.NoError(t, err)
+
+	// nothing listens on the IPv4 address, the upstream is only reachable over IPv6
+	fs, err := parseFanout(caddy.NewTestController("dns", "fanout . 127.0.0.1:1 {\nupstream 127.0.0.1:1 dual-stack [::1]:"+port+"\n}"))
+	require.NoError(t, err)
+	f := fs[0]
+	require.Len(t, f.clients, 1)
+	c, ok := f.clients[0].(*dualStackClient)
+	require.True(t, ok)
+	require.Equal(t, "127.0.0.1:1", c.Endpoint())
+	require.Equal(t, "[::1]:"+port, c.families[1].Endpoint())
+
+	for range 2 {
+		req := new(dns.Msg)
+		req.SetQuestion(testQuery, dns.TypeA)
+		rec := dnstest.NewRecorder(&test.ResponseWriter{})
+		_, err = f.ServeDNS(context.Background(), rec, req)
+		require.NoError(t, err)
+		require.Len(t, rec.Msg.Answer, 1)
+		require.Equal(t, int32(1), c.preferred.Load(), "the family which works is preferred")
+	}
+
+	fs, err = parseFanout(caddy.NewTestController("dns", "fanout . 192.0.2.1 {\nupstream 192.0.2.1 dual-stack 2001:db8::1\n}"))
+	require.NoError(t, err)
+	require.Equal(t, "[2001:db8::1]:53", fs[0].clients[0].(*dualStackClient).families[1].Endpoint(), "the port of the upstream is kept")
+
+	for _, config := range []string{"upstream 192.0.2.1 dual-stack 192.0.2.2", "upstream 192.0.2.1 dual-stack example.com"} {
+		_, err = parseFanout(caddy.NewTestController("dns", "fanout . 192.0.2.1 {\n"+config+"\n}"))
+		require.Error(t, err, config)
+	}
+}
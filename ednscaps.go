@@ -0,0 +1,158 @@
+// Copyright (c) 2024 MWS and/or its affiliates.
+//
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at:
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fanout
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"net"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/pkg/errors"
+)
+
+// Cookie support of an upstream.
+const (
+	cookiesUnknown int32 = iota
+	cookiesSupported
+	cookiesUnsupported
+)
+
+// ednsCapabilities remembers what an upstream has shown to support, so that queries are shaped for it up
+// front instead of being downgraded again on every query: whether it understands EDNS at all, whether
+// responses larger than minUDPBufferSize reach us over UDP, and whether it answers DNS cookies (RFC 7873).
+// Failures are remembered for ednsCapabilitiesTTL, after which the upstream is given another chance.
+type ednsCapabilities struct {
+	noEDNSUntil      atomic.Int64
+	smallBufferUntil atomic.Int64
+	cookies          atomic.Int32
+	clientCookie     string
+	mutex            sync.Mutex
+	serverCookie     string
+}
+
+func newEDNSCapabilities() *ednsCapabilities {
+	b := make([]byte, 8)
+	_, _ = rand.Read(b)
+	return &ednsCapabilities{clientCookie: hex.EncodeToString(b)}
+}
+
+// withoutEDNS reports whether queries are sent without EDNS, the upstream having rejected it recently.
+func (e *ednsCapabilities) withoutEDNS(now time.Time) bool {
+	return e != nil && now.UnixNano() < e.noEDNSUntil.Load()
+}
+
+// udpSize returns size, capped to minUDPBufferSize while large UDP responses fail to arrive recently.
+func (e *ednsCapabilities) udpSize(size uint16, now time.Time) uint16 {
+	if e != nil && now.UnixNano() < e.smallBufferUntil.Load() {
+		return min(size, minUDPBufferSize)
+	}
+	return size
+}
+
+// addCookie adds the client cookie, with the last server cookie, to a request with EDNS which has none.
+// It reports whether it did.
+func (e *ednsCapabilities) addCookie(m *dns.Msg) bool {
+	opt := m.IsEdns0()
+	if e == nil || opt == nil || e.cookies.Load() == cookiesUnsupported {
+		return false
+	}
+	for _, o := range opt.Option {
+		if o.Option() == dns.EDNS0COOKIE {
+			return false
+		}
+	}
+	e.mutex.Lock()
+	cookie := e.clientCookie + e.serverCookie
+	e.mutex.Unlock()
+	opt.Option = append(opt.Option, &dns.EDNS0_COOKIE{Code: dns.EDNS0COOKIE, Cookie: cookie})
+	return true
+}
+
+// retry reports whether the response shows that the upstream expects req to be sent differently: without
+// EDNS, as a FORMERR or NOTIMP without OPT record tells, or with the new server cookie of a BADCOOKIE.
+func (e *ednsCapabilities) retry(req, ret *dns.Msg, now time.Time) bool {
+	if e == nil || req.IsEdns0() == nil {
+		return false
+	}
+	opt := ret.IsEdns0()
+	if opt == nil && (ret.Rcode == dns.RcodeFormatError || ret.Rcode == dns.RcodeNotImplemented) {
+		e.noEDNSUntil.Store(now.Add(ednsCapabilitiesTTL).UnixNano())
+		return true
+	}
+	return ret.Rcode == dns.RcodeBadCookie && e.learnCookie(ret)
+}
+
+// failed remembers that a UDP request advertising a buffer larger than minUDPBufferSize timed out, as the
+// fragments of large responses are often dropped on the way.
+func (e *ednsCapabilities) failed(req *dns.Msg, network string, err error, now time.Time) {
+	var netErr net.Error
+	if e == nil || network != UDP || !errors.As(err, &netErr) || !netErr.Timeout() {
+		return
+	}
+	if opt := req.IsEdns0(); opt != nil && opt.UDPSize() > minUDPBufferSize {
+		e.smallBufferUntil.Store(now.Add(ednsCapabilitiesTTL).UnixNano())
+	}
+}
+
+// observe learns the server cookie of a response to a request carrying the client cookie, which is
+// removed from the response since the client didn't send it.
+func (e *ednsCapabilities) observe(ret *dns.Msg, cookie bool) {
+	if e == nil || !cookie {
+		return
+	}
+	if !e.learnCookie(ret) {
+		e.cookies.CompareAndSwap(cookiesUnknown, cookiesUnsupported)
+	}
+	if opt := ret.IsEdns0(); opt != nil {
+		opt.Option = slices.DeleteFunc(opt.Option, func(o dns.EDNS0) bool {
+			return o.Option() == dns.EDNS0COOKIE
+		})
+	}
+}
+
+// learnCookie remembers the server cookie of the response if it echoes the client cookie.
+func (e *ednsCapabilities) learnCookie(ret *dns.Msg) bool {
+	opt := ret.IsEdns0()
+	if opt == nil {
+		return false
+	}
+	for _, o := range opt.Option {
+		c, ok := o.(*dns.EDNS0_COOKIE)
+		if !ok || len(c.Cookie) <= len(e.clientCookie) || !strings.EqualFold(c.Cookie[:len(e.clientCookie)], e.clientCookie) {
+			continue
+		}
+		e.mutex.Lock()
+		e.serverCookie = c.Cookie[len(e.clientCookie):]
+		e.mutex.Unlock()
+		e.cookies.Store(cookiesSupported)
+		return true
+	}
+	return false
+}
+
+// stripEDNS removes the OPT record of m.
+func stripEDNS(m *dns.Msg) {
+	m.Extra = slices.DeleteFunc(m.Extra, func(rr dns.RR) bool {
+		return rr.Header().Rrtype == dns.TypeOPT
+	})
+}
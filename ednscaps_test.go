@@ -0,0 +1,133 @@
+// Copyright (c) 2024 MWS and/or its affiliates.
+//
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at:
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fanout
+
+import (
+	"context"
+	"net"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/coredns/caddy"
+	"github.com/coredns/coredns/plugin/test"
+	"github.com/coredns/coredns/request"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+)
+
+const testServerCookie = "0102030405060708"
+
+func cookieOf(m *dns.Msg) string {
+	if opt := m.IsEdns0(); opt != nil {
+		for _, o := range opt.Option {
+			if c, ok := o.(*dns.EDNS0_COOKIE); ok {
+				return c.Cookie
+			}
+		}
+	}
+	return ""
+}
+
+func TestEDNSCapabilitiesWithoutEDNS(t *testing.T) {
+	var mutex sync.Mutex
+	var queries []bool
+	s := newServer(UDP, func(w dns.ResponseWriter, r *dns.Msg) {
+		mutex.Lock()
+		queries = append(queries, r.IsEdns0() != nil)
+		mutex.Unlock()
+		msg := new(dns.Msg)
+		if r.IsEdns0() != nil {
+			msg.SetRcode(r, dns.RcodeFormatError)
+		} else {
+			msg.SetReply(r)
+			msg.Answer = []dns.RR{makeRecordA("example1. 3600 IN A 10.0.0.1")}
+		}
+		logErrIfNotNil(w.WriteMsg(msg))
+	})
+	defer s.close()
+	c := NewClient(s.addr, UDP).(*client)
+	c.caps = newEDNSCapabilities()
+
+	for range 2 {
+		req := new(dns.Msg)
+		req.SetQuestion(testQuery, dns.TypeA)
+		ret, err := c.Request(context.Background(), &request.Request{W: &test.ResponseWriter{}, Req: req})
+		require.NoError(t, err)
+		require.Len(t, ret.Answer, 1)
+	}
+	mutex.Lock()
+	defer mutex.Unlock()
+	require.Equal(t, []bool{true, false, false}, queries, "EDNS is only tried once")
+}
+
+func TestEDNSCapabilitiesCookies(t *testing.T) {
+	var mutex sync.Mutex
+	var cookies []string
+	s := newServer(UDP, func(w dns.ResponseWriter, r *dns.Msg) {
+		cookie := cookieOf(r)
+		mutex.Lock()
+		cookies = append(cookies, cookie)
+		first := len(cookies) == 1
+		mutex.Unlock()
+		msg := new(dns.Msg)
+		msg.SetReply(r)
+		msg.SetEdns0(dns.DefaultMsgSize, false)
+		if first {
+			// the first cookie is rejected, as after a secret rotation of the server
+			msg.Rcode = dns.RcodeBadCookie
+		}
+		msg.IsEdns0().Option = []dns.EDNS0{&dns.EDNS0_COOKIE{Code: dns.EDNS0COOKIE, Cookie: cookie[:16] + testServerCookie}}
+		logErrIfNotNil(w.WriteMsg(msg))
+	})
+	defer s.close()
+	fs, err := parseFanout(caddy.NewTestController("dns", "fanout . "+s.addr+" {\nedns-capabilities\n}"))
+	require.NoError(t, err)
+	c := fs[0].clients[0].(*client)
+
+	for range 2 {
+		req := new(dns.Msg)
+		req.SetQuestion(testQuery, dns.TypeA)
+		ret, err := c.Request(context.Background(), &request.Request{W: &test.ResponseWriter{}, Req: req})
+		require.NoError(t, err)
+		require.Equal(t, dns.RcodeSuccess, ret.Rcode)
+		require.Empty(t, cookieOf(ret), "the cookie is removed from the response")
+	}
+	mutex.Lock()
+	defer mutex.Unlock()
+	require.Len(t, cookies, 3)
+	require.Len(t, cookies[0], 16, "the first query only carries the client cookie")
+	require.Equal(t, cookies[0]+testServerCookie, cookies[1], "the query is resent with the server cookie")
+	require.Equal(t, cookies[1], cookies[2])
+}
+
+func TestEDNSCapabilitiesSmallBuffer(t *testing.T) {
+	e := newEDNSCapabilities()
+	now := time.Now()
+	require.Equal(t, uint16(4096), e.udpSize(4096, now))
+	req := new(dns.Msg)
+	req.SetQuestion(testQuery, dns.TypeA)
+	req.SetEdns0(4096, false)
+	timeout := &net.OpError{Op: "read", Net: UDP, Err: os.ErrDeadlineExceeded}
+	e.failed(req, TCP, timeout, now)
+	require.Equal(t, uint16(4096), e.udpSize(4096, now))
+	e.failed(req, UDP, timeout, now)
+	require.Equal(t, uint16(minUDPBufferSize), e.udpSize(4096, now), "large buffers are no longer advertised")
+	require.Equal(t, uint16(512), e.udpSize(512, now))
+	require.Equal(t, uint16(4096), e.udpSize(4096, now.Add(ednsCapabilitiesTTL)), "large buffers are tried again")
+}
@@ -0,0 +1,175 @@
+// Copyright (c) 2024 MWS and/or its affiliates.
+//
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at:
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fanout
+
+import (
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/coredns/caddy/caddyfile"
+	"github.com/pkg/errors"
+)
+
+// errorBudget marks an upstream down while the share of its attempts which failed over a sliding window
+// exceeds ratio, once it got at least minAttempts attempts in the window. Unlike consecutive failures,
+// the ratio catches upstreams failing often but not always. Down upstreams are held back by the selection
+// until their failures leave the window.
+type errorBudget struct {
+	ratio       float64
+	window      time.Duration
+	minAttempts uint64
+	mutex       sync.Mutex
+	upstreams   map[string]*errorBudgetWindow
+}
+
+// errorBudgetWindow counts the attempts of an upstream in errorBudgetSlots slots of the window.
+type errorBudgetWindow struct {
+	slots [errorBudgetSlots]errorBudgetSlot
+	down  bool
+}
+
+type errorBudgetSlot struct {
+	epoch    int64
+	total    uint64
+	failures uint64
+}
+
+func newErrorBudget(ratio float64, window time.Duration, minAttempts uint64) *errorBudget {
+	return &errorBudget{ratio: ratio, window: window, minAttempts: minAttempts, upstreams: map[string]*errorBudgetWindow{}}
+}
+
+// parseErrorBudget parses `error-budget RATIO [WINDOW [COUNT]]`.
+func parseErrorBudget(f *Fanout, c *caddyfile.Dispenser) error {
+	args := c.RemainingArgs()
+	if len(args) == 0 || len(args) > 3 {
+		return c.ArgErr()
+	}
+	ratio, err := strconv.ParseFloat(args[0], 64)
+	if err != nil || ratio <= 0 || ratio >= 1 {
+		return errors.Errorf("invalid error-budget ratio %q, it must be between 0 and 1", args[0])
+	}
+	window := defaultErrorBudgetWindow
+	if len(args) > 1 {
+		window, err = time.ParseDuration(args[1])
+		if err != nil || window < errorBudgetSlots*time.Second {
+			return errors.Errorf("invalid error-budget window %q, it must be at least %ds", args[1], errorBudgetSlots)
+		}
+	}
+	minAttempts := uint64(defaultBudgetAttempts)
+	if len(args) > 2 {
+		n, err := strconv.ParseUint(args[2], 10, 32)
+		if err != nil || n == 0 {
+			return errors.Errorf("invalid error-budget count %q", args[2])
+		}
+		minAttempts = n
+	}
+	f.errorBudget = newErrorBudget(ratio, window, minAttempts)
+	return nil
+}
+
+// observe records the outcome of an attempt to the upstream finished at now, and returns true if it
+// made the upstream go down.
+func (b *errorBudget) observe(addr string, err error, now time.Time) bool {
+	if b == nil {
+		return false
+	}
+	epoch := b.epoch(now)
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	w, ok := b.upstreams[addr]
+	if !ok {
+		w = &errorBudgetWindow{}
+		b.upstreams[addr] = w
+	}
+	s := &w.slots[epoch%errorBudgetSlots]
+	if s.epoch != epoch {
+		*s = errorBudgetSlot{epoch: epoch}
+	}
+	s.total++
+	if err != nil {
+		s.failures++
+	}
+	wasDown := w.down
+	b.update(addr, w, epoch)
+	return w.down && !wasDown
+}
+
+// available returns false while the upstream is down at now.
+func (b *errorBudget) available(addr string, now time.Time) bool {
+	if b == nil {
+		return true
+	}
+	epoch := b.epoch(now)
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	w, ok := b.upstreams[addr]
+	if !ok {
+		return true
+	}
+	if w.down {
+		b.update(addr, w, epoch)
+	}
+	return !w.down
+}
+
+func (b *errorBudget) epoch(now time.Time) int64 {
+	return now.UnixNano() / int64(b.window/errorBudgetSlots)
+}
+
+// update evaluates the window of the upstream ending at epoch, logging and exporting the transitions.
+func (b *errorBudget) update(addr string, w *errorBudgetWindow, epoch int64) {
+	total, failures := w.count(epoch)
+	down := total >= b.minAttempts && float64(failures) > b.ratio*float64(total)
+	if down == w.down {
+		return
+	}
+	w.down = down
+	if down {
+		log.Warningf("upstream %s failed %d of its last %d attempts, holding it back", addr, failures, total)
+		UpstreamDown.WithLabelValues(addr).Set(1)
+		return
+	}
+	UpstreamDown.WithLabelValues(addr).Set(0)
+}
+
+// count returns the attempts and the failures in the window ending at epoch.
+func (w *errorBudgetWindow) count(epoch int64) (total, failures uint64) {
+	for _, s := range w.slots {
+		if s.epoch > epoch-errorBudgetSlots && s.epoch <= epoch {
+			total += s.total
+			failures += s.failures
+		}
+	}
+	return total, failures
+}
+
+// debug returns the state of the budget of the upstream at now reported by the debug handler, nil
+// without a budget.
+func (b *errorBudget) debug(addr string, now time.Time) *debugErrorBudget {
+	if b == nil {
+		return nil
+	}
+	down := !b.available(addr, now)
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	state := &debugErrorBudget{Down: down}
+	if w, ok := b.upstreams[addr]; ok {
+		state.Attempts, state.Failures = w.count(b.epoch(now))
+	}
+	return state
+}
@@ -0,0 +1,81 @@
+// Copyright (c) 2024 MWS and/or its affiliates.
+//
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at:
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fanout
+
+import (
+	"testing"
+	"time"
+
+	"github.com/coredns/caddy"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/require"
+)
+
+func TestErrorBudget(t *testing.T) {
+	now := time.Now()
+	b := newErrorBudget(0.3, 10*time.Second, 10)
+	failure := errors.New("timeout")
+	for i := range 9 {
+		var err error
+		if i%2 == 0 {
+			err = failure
+		}
+		require.False(t, b.observe("a", err, now))
+	}
+	require.True(t, b.available("a", now), "too few attempts to judge the upstream")
+	require.True(t, b.observe("a", nil, now), "interleaved successes don't hide a high failure ratio")
+	require.False(t, b.available("a", now))
+	require.Equal(t, &debugErrorBudget{Attempts: 10, Failures: 5, Down: true}, b.debug("a", now))
+	require.Equal(t, &debugErrorBudget{}, b.debug("b", now))
+	require.Equal(t, 1.0, testutil.ToFloat64(UpstreamDown.WithLabelValues("a")))
+	require.True(t, b.available("b", now))
+
+	now = now.Add(10 * time.Second)
+	require.True(t, b.available("a", now), "failures leave the window")
+	require.Equal(t, 0.0, testutil.ToFloat64(UpstreamDown.WithLabelValues("a")))
+
+	for range 20 {
+		b.observe("a", nil, now)
+	}
+	for range 5 {
+		b.observe("a", failure, now)
+	}
+	require.True(t, b.available("a", now), "failures within the budget are tolerated")
+
+	var none *errorBudget
+	require.Nil(t, none.debug("a", now))
+}
+
+func TestErrorBudgetSlowStart(t *testing.T) {
+	fs, err := parseFanout(caddy.NewTestController("dns", "fanout . 127.0.0.1 {\nerror-budget 0.5 20s 4\nslow-start 10s 100\n}"))
+	require.NoError(t, err)
+	f := fs[0]
+	require.Equal(t, newErrorBudget(0.5, 20*time.Second, 4), f.errorBudget)
+	now := time.Now()
+	for _, err := range []error{errors.New("timeout"), nil, errors.New("timeout"), errors.New("timeout")} {
+		if f.errorBudget.observe("127.0.0.1:53", err, now) {
+			f.slowStart.markDown("127.0.0.1:53")
+		}
+	}
+	require.False(t, f.slowStart.admit("127.0.0.1:53", now), "an upstream over its error budget goes through slow start")
+
+	for _, args := range []string{"", "1", "0.5 1s", "0.5 20s 0", "0.5 20s 1 2"} {
+		_, err = parseFanout(caddy.NewTestController("dns", "fanout . 127.0.0.1 {\nerror-budget "+args+"\n}"))
+		require.Error(t, err, args)
+	}
+}
@@ -0,0 +1,70 @@
+// Copyright (c) 2024 MWS and/or its affiliates.
+//
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at:
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fanout
+
+import (
+	"fmt"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/coredns/coredns/plugin/pkg/transport"
+)
+
+// ClientFactory creates the client of an upstream with a registered scheme. The endpoint is the upstream
+// as configured, scheme included, e.g. rpc://resolver.internal:9000.
+type ClientFactory func(endpoint string) (Client, error)
+
+var (
+	clientFactoriesMu sync.RWMutex
+	clientFactories   = map[string]ClientFactory{}
+)
+
+// builtinSchemes are the upstream schemes handled by the plugin itself, which can't be registered.
+var builtinSchemes = []string{transport.DNS, transport.TLS, transport.HTTPS, transport.QUIC, transport.GRPC,
+	transport.HTTPS3, transport.UNIX, strings.TrimSuffix(odohScheme, "://")}
+
+var schemePattern = regexp.MustCompile(`^[a-z][a-z0-9+.-]*$`)
+
+// RegisterClientFactory makes the upstreams given as scheme://... be created by factory, letting external
+// packages add transports without modifying the plugin. It is meant to be called from an init function,
+// before any fanout stanza is parsed, and panics if the scheme is invalid, built in, or already registered.
+func RegisterClientFactory(scheme string, factory ClientFactory) {
+	scheme = strings.ToLower(scheme)
+	if !schemePattern.MatchString(scheme) || slices.Contains(builtinSchemes, scheme) || factory == nil {
+		panic(fmt.Sprintf("fanout: can't register a client factory for scheme %q", scheme))
+	}
+	clientFactoriesMu.Lock()
+	defer clientFactoriesMu.Unlock()
+	if _, ok := clientFactories[scheme]; ok {
+		panic(fmt.Sprintf("fanout: client factory for scheme %q registered twice", scheme))
+	}
+	clientFactories[scheme] = factory
+}
+
+// lookupClientFactory returns the factory registered for the scheme of endpoint, if any.
+func lookupClientFactory(endpoint string) (ClientFactory, bool) {
+	scheme, _, ok := strings.Cut(endpoint, "://")
+	if !ok {
+		return nil, false
+	}
+	clientFactoriesMu.RLock()
+	defer clientFactoriesMu.RUnlock()
+	factory, ok := clientFactories[strings.ToLower(scheme)]
+	return factory, ok
+}
@@ -0,0 +1,66 @@
+// Copyright (c) 2024 MWS and/or its affiliates.
+//
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at:
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fanout
+
+import (
+	"context"
+	"testing"
+
+	"github.com/coredns/caddy"
+	"github.com/coredns/coredns/plugin/pkg/dnstest"
+	"github.com/coredns/coredns/plugin/test"
+	"github.com/miekg/dns"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRegisterClientFactory(t *testing.T) {
+	req := new(dns.Msg)
+	req.SetQuestion("example.org.", dns.TypeA)
+	reply := new(dns.Msg)
+	reply.SetReply(req)
+	reply.Answer = []dns.RR{makeRecordA("example.org. 60 IN A 10.0.0.1")}
+	var endpoints []string
+	RegisterClientFactory("test-rpc", func(endpoint string) (Client, error) {
+		if endpoint == "test-rpc://broken" {
+			return nil, errors.New("broken endpoint")
+		}
+		endpoints = append(endpoints, endpoint)
+		return &staticClient{addr: endpoint, reply: reply}, nil
+	})
+
+	fs, err := parseFanout(caddy.NewTestController("dns", "fanout . 127.0.0.1 test-rpc://resolver.internal:9000 {\nupstream test-rpc://resolver.internal:9000 schedule 00:00-23:59\npolicy sequential\n}"))
+	require.NoError(t, err)
+	require.Equal(t, []string{"test-rpc://resolver.internal:9000"}, endpoints)
+	require.Equal(t, "test-rpc://resolver.internal:9000", fs[0].clients[1].Endpoint())
+
+	_, err = parseFanout(caddy.NewTestController("dns", "fanout . test-rpc://broken"))
+	require.ErrorContains(t, err, "broken endpoint")
+
+	f, err := NewBuilder().WithUpstream("test-rpc://other").Build()
+	require.NoError(t, err)
+	rec := dnstest.NewRecorder(&test.ResponseWriter{})
+	_, err = f.ServeDNS(context.Background(), rec, req)
+	require.NoError(t, err)
+	require.Len(t, rec.Msg.Answer, 1)
+
+	factory := func(string) (Client, error) { return nil, nil }
+	for _, scheme := range []string{"test-rpc", "tls", "HTTPS", "odoh", "1rpc", ""} {
+		require.Panics(t, func() { RegisterClientFactory(scheme, factory) }, scheme)
+	}
+	require.Panics(t, func() { RegisterClientFactory("nil-rpc", nil) })
+}
@@ -0,0 +1,57 @@
+// Copyright (c) 2024 MWS and/or its affiliates.
+//
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at:
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fanout
+
+import (
+	"context"
+
+	"github.com/coredns/coredns/request"
+	"github.com/miekg/dns"
+)
+
+// failover queries the selected upstreams one at a time in policy order, giving each upstream
+// failoverTimeout, and stops at the first definitive answer.
+func (f *Fanout) failover(ctx context.Context, req *request.Request) *response {
+	clients, p, serverCount := f.route(req)
+	sel := f.newActiveSelector(req, clients, p)
+	var result *response
+	for i := 0; i < serverCount && ctx.Err() == nil; i++ {
+		c := sel.Pick()
+		if c == nil {
+			break
+		}
+		traceFrom(ctx).picked(c)
+		attemptCtx, cancel := context.WithTimeout(ctx, f.failoverTimeout)
+		r := f.processClient(attemptCtx, c, &request.Request{W: req.W, Req: req.Req})
+		cancel()
+		if r.err == nil && (r.response == nil || !req.Match(r.response)) {
+			continue
+		}
+		if f.better(req, result, r) {
+			result = r
+		}
+		if r.err == nil && isDefinitiveResponse(r.response) {
+			return r
+		}
+	}
+	return result
+}
+
+// isDefinitiveResponse returns true for answers which another upstream is not expected to improve.
+func isDefinitiveResponse(msg *dns.Msg) bool {
+	return msg.Rcode == dns.RcodeSuccess || msg.Rcode == dns.RcodeNameError
+}
@@ -0,0 +1,92 @@
+// Copyright (c) 2024 MWS and/or its affiliates.
+//
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at:
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fanout
+
+import (
+	"context"
+	"fmt"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/coredns/caddy"
+	"github.com/coredns/coredns/plugin/test"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFailoverModeStopsAtFirstDefinitiveAnswer(t *testing.T) {
+	var servfailCount, silentCount, answerCount, unusedCount atomic.Int32
+	servfail := newServer(UDP, func(w dns.ResponseWriter, r *dns.Msg) {
+		servfailCount.Add(1)
+		msg := new(dns.Msg)
+		msg.SetRcode(r, dns.RcodeServerFailure)
+		logErrIfNotNil(w.WriteMsg(msg))
+	})
+	defer servfail.close()
+	silent := newServer(UDP, func(dns.ResponseWriter, *dns.Msg) {
+		silentCount.Add(1)
+	})
+	defer silent.close()
+	answer := newServer(UDP, func(w dns.ResponseWriter, r *dns.Msg) {
+		answerCount.Add(1)
+		msg := dns.Msg{Answer: []dns.RR{makeRecordA("example1. 3600 IN A 10.0.0.1")}}
+		msg.SetReply(r)
+		logErrIfNotNil(w.WriteMsg(&msg))
+	})
+	defer answer.close()
+	unused := newServer(UDP, func(dns.ResponseWriter, *dns.Msg) {
+		unusedCount.Add(1)
+	})
+	defer unused.close()
+
+	input := fmt.Sprintf("fanout . %s %s %s %s {\nmode failover 100ms\nattempt-count 1\n}", servfail.addr, silent.addr, answer.addr, unused.addr)
+	fs, err := parseFanout(caddy.NewTestController("dns", input))
+	require.NoError(t, err)
+	f := fs[0]
+
+	req := new(dns.Msg)
+	req.SetQuestion(testQuery, dns.TypeA)
+	writer := &cachedDNSWriter{ResponseWriter: new(test.ResponseWriter)}
+	start := time.Now()
+	_, err = f.ServeDNS(context.Background(), writer, req)
+	require.NoError(t, err)
+	require.Less(t, time.Since(start), time.Second)
+	require.Len(t, writer.answers, 1)
+	require.Equal(t, dns.RcodeSuccess, writer.answers[0].Rcode)
+	require.Equal(t, int32(1), servfailCount.Load())
+	require.Equal(t, int32(1), silentCount.Load())
+	require.Equal(t, int32(1), answerCount.Load())
+	require.Zero(t, unusedCount.Load())
+}
+
+func TestSetupMode(t *testing.T) {
+	fs, err := parseFanout(caddy.NewTestController("dns", "fanout . 127.0.0.1 {\nmode failover\n}"))
+	require.NoError(t, err)
+	require.Equal(t, modeFailover, fs[0].mode)
+	require.Equal(t, maxTimeout, fs[0].failoverTimeout)
+
+	for input, expectedErr := range map[string]string{
+		"mode broadcast":      "unknown mode",
+		"mode failover never": "invalid failover timeout",
+		"mode parallel 1s":    "Wrong argument count",
+		"mode":                "Wrong argument count",
+	} {
+		_, err = parseFanout(caddy.NewTestController("dns", "fanout . 127.0.0.1 {\n"+input+"\n}"))
+		require.ErrorContains(t, err, expectedErr, input)
+	}
+}
@@ -0,0 +1,73 @@
+// Copyright (c) 2024 MWS and/or its affiliates.
+//
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at:
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build failpoint
+// +build failpoint
+
+package fanout
+
+import (
+	"context"
+	"math/rand"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/pkg/errors"
+
+	"github.com/hurricanehrndz/fanout/v2/failpoint"
+)
+
+// exchangeWithFailpoint exchanges req over conn, injecting the faults of the upstream failpoint.
+func exchangeWithFailpoint(ctx context.Context, addr string, conn *dns.Conn, req *dns.Msg) (*dns.Msg, error) {
+	fp, ok := failpoint.Lookup(addr)
+	if !ok {
+		return exchange(conn, req)
+	}
+	if fp.Latency > 0 {
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(fp.Latency):
+		}
+	}
+	//nolint:gosec // fault injection does not need cryptographic randomness
+	if fp.DropRate > 0 && rand.Float64() < fp.DropRate {
+		return nil, awaitTimeout(ctx, errors.Errorf("failpoint: request to %s dropped", addr))
+	}
+	ret, err := exchange(conn, req)
+	if err != nil {
+		return nil, err
+	}
+	if fp.WrongID {
+		// like exchange, keep waiting for a response with the request ID which never arrives
+		return nil, awaitTimeout(ctx, errors.Errorf("failpoint: response from %s has a wrong ID %d", addr, req.Id+1))
+	}
+	if fp.Truncate {
+		ret.Truncated = true
+		ret.Answer, ret.Ns, ret.Extra = nil, nil, nil
+	}
+	return ret, nil
+}
+
+// awaitTimeout blocks as a read without a response would and returns err after readTimeout.
+func awaitTimeout(ctx context.Context, err error) error {
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-time.After(readTimeout):
+		return err
+	}
+}
@@ -0,0 +1,65 @@
+// Copyright (c) 2024 MWS and/or its affiliates.
+//
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at:
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package failpoint injects faults into the exchanges of fanout with its upstreams, so integration tests
+// and chaos experiments can simulate flaky resolvers. Failpoints only take effect in binaries built with
+// the failpoint build tag, see Enabled.
+package failpoint
+
+import (
+	"sync"
+	"time"
+)
+
+// Failpoint describes the faults injected into the exchanges with an upstream.
+type Failpoint struct {
+	// Latency is added before every request is sent.
+	Latency time.Duration
+	// DropRate is the probability from 0 to 1 that a request is dropped without an answer.
+	DropRate float64
+	// Truncate strips the records of responses and sets their TC bit.
+	Truncate bool
+	// WrongID makes responses carry an ID which doesn't match the request, so they are ignored and the
+	// request times out.
+	WrongID bool
+}
+
+var failpoints sync.Map
+
+// Enable injects fp into the exchanges with the upstream at addr, replacing a previous failpoint.
+// addr is the upstream endpoint as configured in fanout, e.g. 127.0.0.1:53.
+func Enable(addr string, fp Failpoint) {
+	failpoints.Store(addr, fp)
+}
+
+// Disable removes the failpoint of the upstream at addr.
+func Disable(addr string) {
+	failpoints.Delete(addr)
+}
+
+// Reset removes all failpoints.
+func Reset() {
+	failpoints.Clear()
+}
+
+// Lookup returns the failpoint of the upstream at addr.
+func Lookup(addr string) (Failpoint, bool) {
+	fp, ok := failpoints.Load(addr)
+	if !ok {
+		return Failpoint{}, false
+	}
+	return fp.(Failpoint), true
+}
@@ -0,0 +1,50 @@
+// Copyright (c) 2024 MWS and/or its affiliates.
+//
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at:
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package failpoint_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/hurricanehrndz/fanout/v2/failpoint"
+)
+
+func TestRegistry(t *testing.T) {
+	defer failpoint.Reset()
+	_, ok := failpoint.Lookup("127.0.0.1:53")
+	require.False(t, ok)
+
+	failpoint.Enable("127.0.0.1:53", failpoint.Failpoint{Latency: time.Second})
+	failpoint.Enable("127.0.0.2:53", failpoint.Failpoint{DropRate: 0.5})
+	fp, ok := failpoint.Lookup("127.0.0.1:53")
+	require.True(t, ok)
+	require.Equal(t, time.Second, fp.Latency)
+
+	failpoint.Enable("127.0.0.1:53", failpoint.Failpoint{WrongID: true})
+	fp, _ = failpoint.Lookup("127.0.0.1:53")
+	require.Equal(t, failpoint.Failpoint{WrongID: true}, fp)
+
+	failpoint.Disable("127.0.0.1:53")
+	_, ok = failpoint.Lookup("127.0.0.1:53")
+	require.False(t, ok)
+
+	failpoint.Reset()
+	_, ok = failpoint.Lookup("127.0.0.2:53")
+	require.False(t, ok)
+}
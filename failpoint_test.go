@@ -0,0 +1,90 @@
+// Copyright (c) 2024 MWS and/or its affiliates.
+//
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at:
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build failpoint
+// +build failpoint
+
+package fanout
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/coredns/caddy"
+	"github.com/coredns/coredns/plugin/test"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+
+	"github.com/hurricanehrndz/fanout/v2/failpoint"
+)
+
+func answerHandler(w dns.ResponseWriter, r *dns.Msg) {
+	msg := dns.Msg{Answer: []dns.RR{makeRecordA("example1. 3600 IN A 10.0.0.1")}}
+	msg.SetReply(r)
+	logErrIfNotNil(w.WriteMsg(&msg))
+}
+
+func serveWithFailpoint(t *testing.T, input string) *dns.Msg {
+	fs, err := parseFanout(caddy.NewTestController("dns", input))
+	require.NoError(t, err)
+	req := new(dns.Msg)
+	req.SetQuestion(testQuery, dns.TypeA)
+	writer := &cachedDNSWriter{ResponseWriter: new(test.ResponseWriter)}
+	_, _ = fs[0].ServeDNS(context.Background(), writer, req)
+	if len(writer.answers) == 0 {
+		return nil
+	}
+	return writer.answers[0]
+}
+
+func TestFailpointLatencyAndDrop(t *testing.T) {
+	defer failpoint.Reset()
+	slow := newServer(UDP, answerHandler)
+	defer slow.close()
+	dropped := newServer(UDP, answerHandler)
+	defer dropped.close()
+	failpoint.Enable(slow.addr, failpoint.Failpoint{Latency: 200 * time.Millisecond})
+	failpoint.Enable(dropped.addr, failpoint.Failpoint{DropRate: 1})
+
+	start := time.Now()
+	answer := serveWithFailpoint(t, fmt.Sprintf("fanout . %s %s {\nattempt-count 1\n}", slow.addr, dropped.addr))
+	require.GreaterOrEqual(t, time.Since(start), 200*time.Millisecond)
+	require.NotNil(t, answer)
+	require.Len(t, answer.Answer, 1)
+}
+
+func TestFailpointTruncateAndWrongID(t *testing.T) {
+	defer failpoint.Reset()
+	s := newServer(TCP, answerHandler)
+	defer s.close()
+	input := fmt.Sprintf("fanout . %s {\nnetwork tcp\nattempt-count 1\n}", s.addr)
+
+	failpoint.Enable(s.addr, failpoint.Failpoint{Truncate: true})
+	answer := serveWithFailpoint(t, input)
+	require.NotNil(t, answer)
+	require.True(t, answer.Truncated)
+	require.Empty(t, answer.Answer)
+
+	failpoint.Enable(s.addr, failpoint.Failpoint{WrongID: true})
+	require.Nil(t, serveWithFailpoint(t, fmt.Sprintf("fanout . %s {\nnetwork tcp\ntimeout 300ms\n}", s.addr)))
+
+	failpoint.Disable(s.addr)
+	answer = serveWithFailpoint(t, input)
+	require.NotNil(t, answer)
+	require.Len(t, answer.Answer, 1)
+}
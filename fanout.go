@@ -21,8 +21,12 @@ package fanout
 import (
 	"context"
 	"crypto/tls"
+	"hash/fnv"
 	"slices"
+	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/coredns/coredns/plugin"
@@ -31,6 +35,7 @@ import (
 	"github.com/coredns/coredns/plugin/metadata"
 	clog "github.com/coredns/coredns/plugin/pkg/log"
 	"github.com/coredns/coredns/request"
+	"github.com/hurricanehrndz/fanout/v2/clock"
 	"github.com/miekg/dns"
 	"github.com/pkg/errors"
 )
@@ -40,23 +45,104 @@ var log = clog.NewWithPlugin(pluginName)
 // Fanout represents a plugin instance that can do async requests to list of DNS servers.
 type Fanout struct {
 	clients               []Client
+	mirrorTo              []string
+	mirrorClients         []Client
+	shadowTo              []string
+	shadowClients         []Client
+	groups                []*upstreamGroup
 	tlsConfig             *tls.Config
 	ExcludeDomains        Domain
 	tlsServerName         string
+	dialer                DialFunc
+	upstreamOptions       map[string]*upstreamOptions
+	zoneAuthorities       []zoneAuthority
 	Timeout               time.Duration
 	Race                  bool
+	raceWindow            time.Duration
+	preferDNSSEC          bool
+	comparator            ResponseComparator
+	preResolveHook        PreResolveHook
+	postResolveHook       PostResolveHook
+	cache                 *responseCache
+	cacheSnapshot         string
+	adaptiveTimeout       *adaptiveTimeout
+	canaries              []canary
+	canaryInterval        time.Duration
+	refusedSoftFail       bool
+	provenance            *provenance
+	udpBatch              int
+	flights               *upstreamFlights
+	allowFrom             *clientNetworks
+	ednsCapabilities      bool
+	mode                  string
+	failoverTimeout       time.Duration
+	prewarm               bool
+	pairAddressQueries    bool
+	limitResponseSize     bool
+	logSample             float64
+	maxResponseSize       int
 	net                   string
 	From                  string
 	Attempts              int
+	rotateAttempts        bool
+	servfails             *servfailBlocklist
 	WorkerCount           int
 	serverCount           int
 	udpBufferSize         uint16
 	udpBufferSizeOverride uint16
+	randomizeID           bool
+	matchTransport        bool
+	clientPatience        bool
+	clientPatienceLimit   time.Duration
+	dnstapFile            *dnstapFileConfig
+	tapFile               *dnstapFile
+	dnstapSample          *dnstapSampler
+	slowStart             *slowStart
+	errorBudget           *errorBudget
+	expandAny             bool
+	svcbGlue              bool
+	controlToken          string
+	tcpFastOpen           bool
+	hostResolver          *hostResolver
+	servfailCache         *servfailCache
+	loopDetect            string
+	hops                  *hopLimit
+	healthOverrides       sync.Map
+	refusesAny            sync.Map
+	httpVersion           string
+	odohRelay             string
+	allowInsecureFallback bool
+	insecure              *upstreamGroup
+	answerOrder           string
+	clientLimit           *clientLimiter
+	concurrency           *concurrencyLimiter
+	clock                 clock.Clock
+	validator             *responseValidator
+	allowTypes            []uint16
+	poolPing              time.Duration
+	bootstrap             *bootstrapTracker
+	classFilter           *classFilter
+	chaosVersion          string
+	chaosID               string
+	latencySLO            *latencySLO
+	sloWindow             time.Duration
+	slos                  *sloTracker
+	debugSuffix           string
+	opcodes               map[int]*opcodeRoute
+	multiQuestion         string
+	answerRotation        atomic.Uint32
 	loadFactor            []int
 	policyType            string
+	policyThen            []string
+	adaptiveInterval      time.Duration
 	ServerSelectionPolicy policy
+	policyOverride        atomic.Pointer[policy]
 	TapPlugin             *dnstap.Dnstap
 	nextAlternateRcodes   []int
+	draining              sync.Map
+	debugAddr             string
+	debugListener         *debugListener
+	tasks                 *scheduler
 	Next                  plugin.Handler
 }
 
@@ -70,14 +156,34 @@ func New() *Fanout {
 		ExcludeDomains:        NewDomain(),
 		ServerSelectionPolicy: &SequentialPolicy{}, // default policy
 		udpBufferSize:         minUDPBufferSize,
+		sloWindow:             defaultSLOWindow,
+		canaryInterval:        defaultCanaryInterval,
+		httpVersion:           httpVersion2,
+		clock:                 clock.Real(),
 	}
 }
 
-// AddClient is used to add a new DNS server to the fanout
+// ClientOptions controls side effects of adding a client with AddClientWithOptions.
+type ClientOptions struct {
+	// GrowWorkerCount increments WorkerCount so that the new client gets a dedicated worker.
+	GrowWorkerCount bool
+}
+
+// AddClient is used to add a new DNS server to the fanout. It also increments WorkerCount,
+// use AddClientWithOptions to keep the configured concurrency.
 func (f *Fanout) AddClient(p Client) {
+	f.AddClientWithOptions(p, ClientOptions{GrowWorkerCount: true})
+}
+
+// AddClientWithOptions is used to add a new DNS server to the fanout without touching WorkerCount
+// unless requested by opts. WorkerCount acts as a cap on parallel queries; zero means one worker per
+// selected server.
+func (f *Fanout) AddClientWithOptions(p Client, opts ClientOptions) {
 	f.clients = append(f.clients, p)
-	f.WorkerCount++
 	f.serverCount++
+	if opts.GrowWorkerCount {
+		f.WorkerCount++
+	}
 }
 
 // Name implements plugin.Handler.
@@ -88,14 +194,96 @@ func (f *Fanout) Name() string {
 // ServeDNS implements plugin.Handler.
 func (f *Fanout) ServeDNS(ctx context.Context, w dns.ResponseWriter, m *dns.Msg) (int, error) {
 	req := request.Request{W: w, Req: m}
+	if rcode, handled, err := f.serveAllowFrom(ctx, &req); handled {
+		return rcode, err
+	}
+	if rcode, handled, err := f.serveInternal(ctx, &req); handled {
+		return rcode, err
+	}
 	if !f.match(&req) {
 		return plugin.NextOrFailure(f.Name(), f.Next, ctx, w, m)
 	}
+	ctx = f.hops.withHops(withZone(ctx, f.From), &req)
+	if rcode, handled, err := f.serveSpecial(ctx, &req); handled {
+		return rcode, err
+	}
+	hit, cached := f.serveCached(ctx, &req)
+	if hit {
+		return 0, nil
+	}
+	defer cached()
+	if rcode, handled, err := f.serveServfailCached(ctx, &req); handled {
+		return rcode, err
+	}
+	if f.servePreResolve(ctx, &req) {
+		return 0, nil
+	}
+	if f.clientLimit != nil {
+		ip := req.IP()
+		if !f.clientLimit.acquire(ip) {
+			return f.clientLimit.reject(&req)
+		}
+		defer f.clientLimit.release(ip)
+	}
+	if f.concurrency != nil {
+		if err := f.concurrency.acquire(ctx, f.clock, f.Timeout); err != nil {
+			return dns.RcodeRefused, err
+		}
+		defer f.concurrency.release()
+	}
 
-	timeoutContext, cancel := context.WithTimeout(ctx, f.Timeout)
+	f.mirrorQuery(&req)
+	shadows := f.shadowQuery(&req)
+	trace := f.sampleTrace()
+	timeoutContext, cancel := context.WithTimeout(withTrace(ctx, trace), f.queryTimeout(&req))
 	defer cancel()
 
-	result := f.getFanoutResult(timeoutContext, &req, f.runWorkers(timeoutContext, &req))
+	result := f.resolve(withTrace(ctx, trace), timeoutContext, &req)
+	shadows.finish(result)
+	trace.log(&req, result)
+	f.servfailCache.observe(ctx, &req, result, f.clock.Now())
+	return f.reply(ctx, timeoutContext, &req, result)
+}
+
+// serveSpecial answers the queries which aren't forwarded as they are: the ones which did too many hops,
+// and the ones with special opcodes or classes.
+func (f *Fanout) serveSpecial(ctx context.Context, req *request.Request) (rcode int, handled bool, err error) {
+	if rcode, handled, err = f.hops.serveHops(req); handled {
+		return rcode, handled, err
+	}
+	if rcode, handled, err = f.serveOpcode(ctx, req); handled {
+		return rcode, handled, err
+	}
+	return f.serveClass(ctx, req)
+}
+
+// resolve queries the upstreams for req within timeoutContext according to the mode. The plaintext
+// fallback of allow-insecure-fallback gets a fresh timeout derived from ctx.
+func (f *Fanout) resolve(ctx, timeoutContext context.Context, req *request.Request) *response {
+	var result *response
+	switch f.mode {
+	case modeFailover:
+		result = f.failover(timeoutContext, req)
+	case modeMirror:
+		result = f.mirror(timeoutContext, req)
+	default:
+		result = f.queryUpstreams(timeoutContext, req)
+	}
+	if (result == nil || result.err != nil) && f.insecure != nil {
+		result = f.insecureFallback(ctx, req)
+	}
+	return result
+}
+
+// reply writes the result of req, queried within timeoutContext, or delegates to the next plugin for
+// the rcodes configured with next.
+func (f *Fanout) reply(ctx, timeoutContext context.Context, req *request.Request, result *response) (int, error) {
+	if ctx.Err() != nil {
+		// the client is gone, writing to it would only fail
+		ClientGoneCount.Inc()
+		return dns.RcodeSuccess, nil
+	}
+	w, m := req.W, req.Req
 	if result == nil || result.err != nil {
 		rcode := dns.RcodeServerFailure
 		// Check if we should delegate to the next plugin based on RcodeServerFailure
@@ -115,10 +303,17 @@ func (f *Fanout) ServeDNS(ctx context.Context, w dns.ResponseWriter, m *dns.Msg)
 	metadata.SetValueFunc(ctx, "fanout/upstream", func() string {
 		return result.client.Endpoint()
 	})
+	metadata.SetValueFunc(ctx, "fanout/protocol", func() string {
+		return result.proto
+	})
+	metadata.SetValueFunc(ctx, "fanout/attempts", func() string {
+		return strconv.Itoa(result.attempts)
+	})
+	metadata.SetValueFunc(ctx, "fanout/size", func() string {
+		return strconv.Itoa(result.size)
+	})
 
-	if f.TapPlugin != nil {
-		toDnstap(f.TapPlugin, result.client, &req, result.response, result.start)
-	}
+	f.toDnstap(result, req)
 
 	if !req.Match(result.response) {
 		debug.Hexdumpf(result.response, "Wrong reply for id: %d, %s %d", result.response.Id, req.QName(), req.QType())
@@ -133,61 +328,175 @@ func (f *Fanout) ServeDNS(ctx context.Context, w dns.ResponseWriter, m *dns.Msg)
 		return plugin.NextOrFailure(f.Name(), f.Next, ctx, w, m)
 	}
 
+	f.completeCNAME(timeoutContext, req, result.response)
+	f.addSVCBGlue(timeoutContext, req, result.response)
+	f.filterTypes(result.response)
+	f.storeCached(req, result.response, result.client.Endpoint())
+	f.reorderAnswer(result.response)
+	f.postResolve(ctx, req, result.response)
+	f.provenance.tag(req, result.response, result.client.Endpoint())
+	if f.limitResponseSize {
+		f.truncate(req, result.response)
+	}
 	logErrIfNotNil(w.WriteMsg(result.response))
 	return 0, nil
 }
 
+// truncate shrinks a UDP response to the size advertised by the client, capped by maxResponseSize,
+// setting the TC bit when records had to be dropped.
+func (f *Fanout) truncate(req *request.Request, m *dns.Msg) {
+	if req.Proto() != UDP {
+		return
+	}
+	size := req.Size()
+	if f.maxResponseSize > 0 {
+		size = min(size, f.maxResponseSize)
+	}
+	m.Truncate(size)
+}
+
+// fanoutRun is the state shared by the workers of a single query. It is allocated once per query, so
+// the workers need no channel to receive jobs and no goroutine to wait for each other.
+type fanoutRun struct {
+	f          *Fanout
+	ctx        context.Context
+	jobs       []fanoutJob
+	next       atomic.Int32
+	remaining  atomic.Int32
+	responseCh chan *response
+}
+
+type fanoutJob struct {
+	client   Client
+	req      request.Request
+	resp     response
+	rotation *rotation
+}
+
+// rotation spreads the retries of a job over other upstreams: attempt n goes to candidates[start+n*stride].
+type rotation struct {
+	candidates    []Client
+	start, stride int
+}
+
+// client returns the upstream of the given attempt, c for the first one.
+func (r *rotation) client(c Client, attempt int) Client {
+	if r == nil || attempt == 0 {
+		return c
+	}
+	return r.candidates[(r.start+attempt*r.stride)%len(r.candidates)]
+}
+
+// queryUpstreams sends req to the upstreams of its route and returns the selected response. When the route
+// has a single upstream, it is queried inline, without the workers and channel needed to pick among several
+// responses.
+func (f *Fanout) queryUpstreams(ctx context.Context, req *request.Request) *response {
+	clients, p, serverCount := f.route(req)
+	if len(clients) != 1 {
+		return f.getFanoutResult(ctx, req, f.runWorkersOn(ctx, req, clients, p, serverCount))
+	}
+	c := f.newActiveSelector(req, clients, p).Pick()
+	if c == nil {
+		return nil
+	}
+	traceFrom(ctx).picked(c)
+	resp := f.queryClient(ctx, c, req, nil)
+	if resp.err == nil && (resp.response == nil || !req.Match(resp.response)) {
+		return nil
+	}
+	return &resp
+}
+
 func (f *Fanout) runWorkers(ctx context.Context, req *request.Request) chan *response {
-	sel := f.ServerSelectionPolicy.selector(f.clients)
-	workerCh := make(chan Client, f.WorkerCount)
-	responseCh := make(chan *response, f.serverCount)
-	go func() {
-		defer close(workerCh)
-		for i := 0; i < f.serverCount; i++ {
-			select {
-			case <-ctx.Done():
-				return
-			case workerCh <- sel.Pick():
-			}
-		}
-	}()
+	clients, p, serverCount := f.route(req)
+	return f.runWorkersOn(ctx, req, clients, p, serverCount)
+}
 
-	go func() {
-		var wg sync.WaitGroup
-		wg.Add(f.WorkerCount)
-
-		for i := 0; i < f.WorkerCount; i++ {
-			go func() {
-				defer wg.Done()
-				for c := range workerCh {
-					select {
-					case <-ctx.Done():
-						return
-					case responseCh <- f.processClient(ctx, c, &request.Request{W: req.W, Req: req.Req}):
-					}
-				}
-			}()
+// runWorkersOn sends the request to up to serverCount of clients, picked by p.
+func (f *Fanout) runWorkersOn(ctx context.Context, req *request.Request, clients []Client, p policy, serverCount int) chan *response {
+	sel := f.newActiveSelector(req, clients, p)
+	run := &fanoutRun{f: f, ctx: ctx, jobs: make([]fanoutJob, 0, serverCount)}
+	for len(run.jobs) < serverCount {
+		c := sel.Pick()
+		if c == nil {
+			break
 		}
+		traceFrom(ctx).picked(c)
+		run.jobs = append(run.jobs, fanoutJob{client: c, req: request.Request{W: req.W, Req: req.Req}})
+	}
+	if f.rotateAttempts {
+		f.initRotations(run.jobs, sel, len(clients))
+	}
+	run.responseCh = make(chan *response, len(run.jobs))
+	workerCount := f.WorkerCount
+	if workerCount <= 0 || workerCount > len(run.jobs) {
+		workerCount = len(run.jobs)
+	}
+	if workerCount == 0 {
+		close(run.responseCh)
+		return run.responseCh
+	}
+	//nolint:gosec // workerCount is bounded by maxIPCount
+	run.remaining.Store(int32(workerCount))
+	for i := 0; i < workerCount; i++ {
+		go run.work()
+	}
+	return run.responseCh
+}
 
-		wg.Wait()
-		close(responseCh)
+// work processes jobs until there are none left. The last worker to exit closes responseCh, which is
+// buffered for every job so sends never block.
+func (r *fanoutRun) work() {
+	defer func() {
+		if r.remaining.Add(-1) == 0 {
+			close(r.responseCh)
+		}
 	}()
+	for {
+		i := int(r.next.Add(1)) - 1
+		if i >= len(r.jobs) || r.ctx.Err() != nil {
+			return
+		}
+		job := &r.jobs[i]
+		job.resp = r.f.queryClient(r.ctx, job.client, &job.req, job.rotation)
+		r.responseCh <- &job.resp
+	}
+}
 
-	return responseCh
+// selector returns the selector of the request's upstreams. The sticky policy orders them by the
+// downstream client IP. With pairing enabled, A and AAAA queries for the same name within pairWindow
+// get the same upstream order.
+func (f *Fanout) selector(req *request.Request, clients []Client, p policy) clientSelector {
+	sp, ok := p.(seededPolicy)
+	if ok && isSticky(p) && req.W != nil {
+		h := fnv.New64a()
+		_, _ = h.Write([]byte(req.IP()))
+		//nolint:gosec // the hash is only used as a seed, overflow is fine
+		return sp.seededSelector(clients, int64(h.Sum64()))
+	}
+	if !f.pairAddressQueries || !ok || (req.QType() != dns.TypeA && req.QType() != dns.TypeAAAA) {
+		return p.selector(clients)
+	}
+	h := fnv.New64a()
+	_, _ = h.Write([]byte(strings.ToLower(req.Name())))
+	//nolint:gosec // the hash is only used as a seed, overflow is fine
+	seed := int64(h.Sum64()) + f.clock.Now().UnixNano()/int64(pairWindow)
+	return sp.seededSelector(clients, seed)
 }
 
 func (f *Fanout) getFanoutResult(ctx context.Context, req *request.Request, responseCh <-chan *response) *response {
 	var result *response
+	authoritative := f.authoritativeUpstreams(req.Name())
 	for {
 		select {
 		case <-ctx.Done():
-			return result
+			return fallbackResult(ctx, result)
 		case r, ok := <-responseCh:
 			if !ok {
 				return result
 			}
 			if r.err != nil {
-				if isBetter(result, r) {
+				if f.better(req, result, r) {
 					result = r
 				}
 				continue
@@ -195,16 +504,62 @@ func (f *Fanout) getFanoutResult(ctx context.Context, req *request.Request, resp
 			if r.response == nil || !req.Match(r.response) {
 				continue
 			}
-			if isBetter(result, r) {
+			if f.better(req, result, r) {
 				result = r
 			}
-			if f.Race || isPositiveResponse(r.response) {
+			if authoritative != nil {
+				// other answers are kept as a fallback while waiting for an authoritative upstream
+				if r.client != nil && authoritative[r.client.Endpoint()] {
+					return r
+				}
+				continue
+			}
+			if f.Race || f.responseComparator().Final(req.Req, r.response) {
+				return f.settle(ctx, req, r, responseCh)
+			}
+		}
+	}
+}
+
+// settle returns r, the first acceptable response, unless race has a tie-break window: the responses
+// arriving within the window replace r when they are of a better quality.
+func (f *Fanout) settle(ctx context.Context, req *request.Request, r *response, responseCh <-chan *response) *response {
+	if !f.Race || f.raceWindow <= 0 || f.quality(r.response) == f.topQuality() {
+		return r
+	}
+	window := f.clock.After(f.raceWindow)
+	for {
+		select {
+		case <-ctx.Done():
+			return r
+		case <-window:
+			return r
+		case next, ok := <-responseCh:
+			if !ok {
 				return r
 			}
+			if next.err != nil || next.response == nil || !req.Match(next.response) {
+				continue
+			}
+			if q := f.quality(next.response); q > f.quality(r.response) {
+				r = next
+				if q == f.topQuality() {
+					return r
+				}
+			}
 		}
 	}
 }
 
+// fallbackResult returns the best result received before ctx was done, or nil if the client is gone and
+// there is no one left to answer.
+func fallbackResult(ctx context.Context, result *response) *response {
+	if errors.Is(ctx.Err(), context.Canceled) {
+		return nil
+	}
+	return result
+}
+
 func (f *Fanout) shouldDelegateToNextFanout(rcode int) bool {
 	return slices.Contains(f.nextAlternateRcodes, rcode) &&
 		f.Next != nil &&
@@ -223,21 +578,104 @@ func (f *Fanout) match(state *request.Request) bool {
 	return true
 }
 
+// initRotations makes the retries of every job rotate over the upstreams in selection order, preferring
+// the upstreams which are not queried by another job.
+func (f *Fanout) initRotations(jobs []fanoutJob, sel clientSelector, clientCount int) {
+	candidates := make([]Client, 0, clientCount)
+	for i := range jobs {
+		candidates = append(candidates, jobs[i].client)
+	}
+	for len(candidates) < clientCount {
+		c := sel.Pick()
+		if c == nil {
+			break
+		}
+		candidates = append(candidates, c)
+	}
+	stride := 1
+	if len(candidates) > len(jobs) {
+		stride = len(jobs)
+	}
+	rotations := make([]rotation, len(jobs))
+	for i := range jobs {
+		rotations[i] = rotation{candidates: candidates, start: i, stride: stride}
+		jobs[i].rotation = &rotations[i]
+	}
+}
+
 func (f *Fanout) processClient(ctx context.Context, c Client, r *request.Request) *response {
-	start := time.Now()
+	resp := f.queryClient(ctx, c, r, nil)
+	return &resp
+}
+
+// queryClient queries the client until it answers or the attempts are exhausted, moving to the next
+// upstream of rot after each failure if rot is set. The response is returned by value so the hot path
+// can store it without a separate allocation.
+func (f *Fanout) queryClient(ctx context.Context, first Client, r *request.Request, rot *rotation) response {
+	start := f.clock.Now()
+	c := first
 	var err error
-	for j := 0; j < f.Attempts || f.Attempts == 0; <-time.After(attemptDelay) {
+	info := &exchangeInfo{}
+	ctx = withExchangeInfo(ctx, info)
+	attempts := 0
+	result := func(msg *dns.Msg, err error) response {
+		return info.response(c, msg, start, err, attempts)
+	}
+	for j, attempt := 0, 0; j < f.Attempts || f.Attempts == 0; attempt++ {
+		if attempt > 0 {
+			f.waitAttemptDelay(ctx)
+		}
 		if ctx.Err() != nil {
-			return &response{client: c, response: nil, start: start, err: ctx.Err()}
+			return result(nil, ctx.Err())
 		}
+		attempts++
+		c = rot.client(first, attempt)
 		var msg *dns.Msg
-		msg, err = c.Request(ctx, r)
+		attemptStart := f.clock.Now()
+		f.bootstrap.attempt(c.Endpoint(), attemptStart)
+		attemptCtx, done := f.adaptiveTimeout.context(ctx, f.statsFor(c.Endpoint()), f.Timeout)
+		msg, err = f.requestAny(attemptCtx, c, r)
+		done()
+		if ctx.Err() == nil {
+			now := f.clock.Now()
+			f.statsFor(c.Endpoint()).observe(now.Sub(attemptStart), err, now)
+			f.slos.observe(c.Endpoint(), now.Sub(attemptStart), err, now)
+			if f.errorBudget.observe(c.Endpoint(), err, now) {
+				f.slowStart.markDown(c.Endpoint())
+			}
+			f.slowStart.observe(c.Endpoint(), err, now)
+			if err == nil && f.servfails != nil {
+				f.servfails.observe(c.Endpoint(), servfailZone(r.Name()), msg.Rcode, now)
+			}
+			traceFrom(ctx).attempt(c, msg, err, now.Sub(attemptStart))
+			f.recordTap(c, info.protocol(), r, msg, err, attemptStart, now)
+		}
 		if err == nil {
-			return &response{client: c, response: msg, start: start, err: err}
+			if err = f.validator.check(c, r, msg); err != nil {
+				return result(nil, err)
+			}
+			f.bootstrap.success(c.Endpoint(), f.clock.Now())
+			if !f.refusedSoftFail || msg.Rcode != dns.RcodeRefused {
+				return result(msg, nil)
+			}
+			// the upstream doesn't serve the zone, asking it again is pointless
+			err = errors.Errorf("upstream %s refused the query", c.Endpoint())
+			if rot == nil {
+				return result(nil, err)
+			}
 		}
 		if f.Attempts != 0 {
 			j++
 		}
 	}
-	return &response{client: c, response: nil, start: start, err: errors.Wrapf(err, "attempt limit has been reached")}
+	return result(nil, errors.Wrapf(err, "attempt limit has been reached"))
+}
+
+// waitAttemptDelay pauses between attempts, returning early once ctx is done so the remaining
+// time budget is not spent sleeping.
+func (f *Fanout) waitAttemptDelay(ctx context.Context) {
+	select {
+	case <-ctx.Done():
+	case <-f.clock.After(attemptDelay):
+	}
 }
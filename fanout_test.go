@@ -20,6 +20,7 @@ package fanout
 
 import (
 	"context"
+	"crypto/tls"
 	"fmt"
 	"math/rand"
 	"net"
@@ -34,7 +35,9 @@ import (
 	"github.com/coredns/coredns/plugin/pkg/dnstest"
 	"github.com/coredns/coredns/plugin/test"
 	"github.com/coredns/coredns/request"
+	"github.com/hurricanehrndz/fanout/v2/clock"
 	"github.com/miekg/dns"
+	"github.com/prometheus/client_golang/prometheus/testutil"
 	"github.com/stretchr/testify/require"
 	"github.com/stretchr/testify/suite"
 	"go.uber.org/goleak"
@@ -581,6 +584,170 @@ func TestFanoutRaceReturnsFirstValidNODATA(t *testing.T) {
 	}
 }
 
+func TestFanoutRaceTieBreak(t *testing.T) {
+	req := new(dns.Msg)
+	req.SetQuestion(testQuery, dns.TypeA)
+	nodata := new(dns.Msg)
+	nodata.SetReply(req)
+	answer := nodata.Copy()
+	answer.Answer = []dns.RR{makeRecordA("example1. 3600 IN A 10.0.0.1")}
+	authenticated := answer.Copy()
+	authenticated.AuthenticatedData = true
+
+	race := func(f *Fanout, msgs ...*dns.Msg) *dns.Msg {
+		clk := clock.NewManual(time.Now())
+		f.Race, f.raceWindow, f.clock = true, 5*time.Millisecond, clk
+		responses := make(chan *response, len(msgs))
+		results := make(chan *response, 1)
+		go func() {
+			results <- f.getFanoutResult(context.Background(), &request.Request{Req: req}, responses)
+		}()
+		for _, m := range msgs {
+			responses <- &response{response: m}
+		}
+		select {
+		case result := <-results:
+			return result.response
+		case <-time.After(100 * time.Millisecond):
+		}
+		require.Eventually(t, func() bool { return clk.Waiters() > 0 }, time.Second, time.Millisecond)
+		clk.Advance(5 * time.Millisecond)
+		return (<-results).response
+	}
+
+	require.Same(t, answer, race(&Fanout{}, nodata, answer), "answers win the tie-break")
+	require.Same(t, answer, race(&Fanout{}, answer, authenticated), "the first answer can't be beaten")
+	require.Same(t, authenticated, race(&Fanout{preferDNSSEC: true}, answer, authenticated))
+	require.Same(t, nodata, race(&Fanout{}, nodata), "the window closes with the first response")
+
+	fs, err := parseFanout(caddy.NewTestController("dns", "fanout . 127.0.0.1 {\nrace 5ms\nprefer-dnssec\n}"))
+	require.NoError(t, err)
+	require.Equal(t, 5*time.Millisecond, fs[0].raceWindow)
+	require.True(t, fs[0].preferDNSSEC)
+	_, err = parseFanout(caddy.NewTestController("dns", "fanout . 127.0.0.1 {\nrace soon\n}"))
+	require.Error(t, err)
+}
+
+func TestAddClientWithOptionsKeepsWorkerCount(t *testing.T) {
+	var inFlight, maxInFlight atomic.Int32
+	handler := func(w dns.ResponseWriter, r *dns.Msg) {
+		n := inFlight.Add(1)
+		defer inFlight.Add(-1)
+		for {
+			m := maxInFlight.Load()
+			if n <= m || maxInFlight.CompareAndSwap(m, n) {
+				break
+			}
+		}
+		<-time.After(20 * time.Millisecond)
+		msg := nxdomainMsg()
+		msg.SetRcode(r, msg.Rcode)
+		logErrIfNotNil(w.WriteMsg(msg))
+	}
+	f := New()
+	f.From = "."
+	f.WorkerCount = 1
+	for i := 0; i < 3; i++ {
+		s := newServer(UDP, handler)
+		defer s.close()
+		f.AddClientWithOptions(NewClient(s.addr, UDP), ClientOptions{})
+	}
+	require.Equal(t, 1, f.WorkerCount)
+
+	req := new(dns.Msg)
+	req.SetQuestion(testQuery, dns.TypeA)
+	writer := &cachedDNSWriter{ResponseWriter: new(test.ResponseWriter)}
+	_, err := f.ServeDNS(context.Background(), writer, req)
+	require.NoError(t, err)
+	require.Len(t, writer.answers, 1)
+	require.Equal(t, int32(1), maxInFlight.Load())
+
+	f.WorkerCount = 0
+	_, err = f.ServeDNS(context.Background(), writer, req)
+	require.NoError(t, err)
+	require.Len(t, writer.answers, 2)
+}
+
+func TestFanoutTruncatesOversizedUDPResponses(t *testing.T) {
+	s := newServer(TCP, func(w dns.ResponseWriter, r *dns.Msg) {
+		msg := new(dns.Msg)
+		msg.SetReply(r)
+		for i := 0; i < 100; i++ {
+			msg.Answer = append(msg.Answer, makeRecordA(fmt.Sprintf("example1. 3600 IN A 10.0.0.%d", i)))
+		}
+		logErrIfNotNil(w.WriteMsg(msg))
+	})
+	defer s.close()
+
+	tests := map[string]struct {
+		option    string
+		edns      uint16
+		tcp       bool
+		maxSize   int
+		truncated bool
+	}{
+		"client without EDNS":    {option: "max-response-size", maxSize: dns.MinMsgSize, truncated: true},
+		"client EDNS size":       {option: "max-response-size", edns: 1232, maxSize: 1232, truncated: true},
+		"configured cap":         {option: "max-response-size 768", edns: 4096, maxSize: 768, truncated: true},
+		"large enough EDNS size": {option: "max-response-size", edns: 4096, maxSize: 4096},
+		"TCP client":             {option: "max-response-size 768", tcp: true, maxSize: dns.MaxMsgSize},
+		"limit is disabled":      {option: "", maxSize: dns.MaxMsgSize},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			fs, err := parseFanout(caddy.NewTestController("dns", fmt.Sprintf("fanout . %s {\nnetwork tcp\n%s\n}", s.addr, tc.option)))
+			require.NoError(t, err)
+			f := fs[0]
+			defer f.closeIdleClients()
+
+			req := new(dns.Msg)
+			req.SetQuestion(testQuery, dns.TypeA)
+			if tc.edns != 0 {
+				req.SetEdns0(tc.edns, false)
+			}
+			writer := &cachedDNSWriter{ResponseWriter: &test.ResponseWriter{TCP: tc.tcp}}
+			_, err = f.ServeDNS(context.Background(), writer, req)
+			require.NoError(t, err)
+			require.Len(t, writer.answers, 1)
+			resp := writer.answers[0]
+			require.Equal(t, tc.truncated, resp.Truncated)
+			require.LessOrEqual(t, resp.Len(), tc.maxSize)
+			if !tc.truncated {
+				require.Len(t, resp.Answer, 100)
+			}
+		})
+	}
+}
+
+func TestFanoutSkipsWriteWhenClientGone(t *testing.T) {
+	release := make(chan struct{})
+	s := newServer(UDP, func(w dns.ResponseWriter, r *dns.Msg) {
+		<-release
+		msg := new(dns.Msg)
+		msg.SetReply(r)
+		logErrIfNotNil(w.WriteMsg(msg))
+	})
+	defer s.close()
+	defer close(release)
+
+	fs, err := parseFanout(caddy.NewTestController("dns", "fanout . "+s.addr+" {\ntimeout 10s\n}"))
+	require.NoError(t, err)
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+
+	gone := testutil.ToFloat64(ClientGoneCount)
+	req := new(dns.Msg)
+	req.SetQuestion(testQuery, dns.TypeA)
+	writer := &cachedDNSWriter{ResponseWriter: &test.ResponseWriter{}}
+	start := time.Now()
+	rcode, err := fs[0].ServeDNS(ctx, writer, req)
+	require.NoError(t, err)
+	require.Equal(t, dns.RcodeSuccess, rcode)
+	require.Less(t, time.Since(start), 5*time.Second, "the request returns as soon as the client is gone")
+	require.Empty(t, writer.answers)
+	require.Equal(t, gone+1, testutil.ToFloat64(ClientGoneCount))
+}
+
 func TestFanoutUDPSuite(t *testing.T) {
 	suite.Run(t, &fanoutTestSuite{network: UDP})
 }
@@ -594,3 +761,211 @@ func nxdomainMsg() *dns.Msg {
 		Ns:       []dns.RR{test.SOA("example1.	1800	IN	SOA	example1.net. example1.com 1461471181 14400 3600 604800 14400")},
 	}
 }
+
+type staticClient struct {
+	addr     string
+	reply    *dns.Msg
+	err      error
+	requests atomic.Int32
+}
+
+func (c *staticClient) Request(context.Context, *request.Request) (*dns.Msg, error) {
+	c.requests.Add(1)
+	return c.reply, c.err
+}
+
+func (c *staticClient) Endpoint() string { return c.addr }
+
+func (c *staticClient) Net() string { return UDP }
+
+func (c *staticClient) SetTLSConfig(*tls.Config) {}
+
+type discardWriter struct {
+	test.ResponseWriter
+}
+
+func (w *discardWriter) WriteMsg(*dns.Msg) error { return nil }
+
+func BenchmarkServeDNS(b *testing.B) {
+	req := new(dns.Msg)
+	req.SetQuestion(testQuery, dns.TypeA)
+	reply := new(dns.Msg)
+	reply.SetReply(req)
+	reply.Answer = []dns.RR{makeRecordA("example1. 3600 IN A 10.0.0.1")}
+	f := New()
+	f.From = "."
+	for i := 0; i < 4; i++ {
+		f.AddClient(&staticClient{addr: fmt.Sprintf("127.0.0.%d:53", i+1), reply: reply})
+	}
+	w := &discardWriter{}
+	ctx := context.Background()
+	b.ReportAllocs()
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			if _, err := f.ServeDNS(ctx, w, req); err != nil {
+				b.Error(err)
+			}
+		}
+	})
+}
+
+func BenchmarkServeDNSSingleUpstream(b *testing.B) {
+	req := new(dns.Msg)
+	req.SetQuestion(testQuery, dns.TypeA)
+	reply := new(dns.Msg)
+	reply.SetReply(req)
+	reply.Answer = []dns.RR{makeRecordA("example1. 3600 IN A 10.0.0.1")}
+	f := New()
+	f.From = "."
+	f.AddClient(&staticClient{addr: "127.0.0.1:53", reply: reply})
+	w := &discardWriter{}
+	ctx := context.Background()
+	b.ReportAllocs()
+	b.ResetTimer()
+	for b.Loop() {
+		if _, err := f.ServeDNS(ctx, w, req); err != nil {
+			b.Error(err)
+		}
+	}
+}
+
+func TestProcessClientStopsRetryingAtDeadline(t *testing.T) {
+	s := newServer(UDP, func(dns.ResponseWriter, *dns.Msg) {})
+	defer s.close()
+	f := New()
+	f.Attempts = 0
+	ctx, cancel := context.WithTimeout(context.Background(), 250*time.Millisecond)
+	defer cancel()
+
+	req := new(dns.Msg)
+	req.SetQuestion(testQuery, dns.TypeA)
+	start := time.Now()
+	r := f.processClient(ctx, NewClient(s.addr, UDP), &request.Request{W: &test.ResponseWriter{}, Req: req})
+	require.ErrorIs(t, r.err, context.DeadlineExceeded)
+	require.Less(t, time.Since(start), 250*time.Millisecond+attemptDelay/2)
+}
+
+func TestAttemptPolicyRotateRetriesOtherUpstream(t *testing.T) {
+	l, err := net.Listen(TCP, "127.0.0.1:0")
+	require.NoError(t, err)
+	dead := l.Addr().String()
+	require.NoError(t, l.Close())
+	s := newServer(TCP, func(w dns.ResponseWriter, r *dns.Msg) {
+		msg := dns.Msg{Answer: []dns.RR{makeRecordA("example1. 3600 IN A 10.0.0.1")}}
+		msg.SetReply(r)
+		logErrIfNotNil(w.WriteMsg(&msg))
+	})
+	defer s.close()
+
+	for attemptPolicy, expectedRcode := range map[string]int{"same": dns.RcodeServerFailure, "rotate": 0} {
+		input := fmt.Sprintf(`fanout . %s %s {
+network tcp
+policy weighted-random
+weighted-random-server-count 1
+weighted-random-load-factor 1000000 1
+attempt-count 2
+attempt-policy %s
+}`, dead, s.addr, attemptPolicy)
+		fs, err := parseFanout(caddy.NewTestController("dns", input))
+		require.NoError(t, err)
+		req := new(dns.Msg)
+		req.SetQuestion(testQuery, dns.TypeA)
+		rcode, _ := fs[0].ServeDNS(context.Background(), &cachedDNSWriter{ResponseWriter: new(test.ResponseWriter)}, req)
+		require.Equal(t, expectedRcode, rcode, attemptPolicy)
+	}
+
+	_, err = parseFanout(caddy.NewTestController("dns", "fanout . 127.0.0.1 {\nattempt-policy random\n}"))
+	require.ErrorContains(t, err, "unknown attempt-policy")
+}
+
+func TestRefusedIsSoftFail(t *testing.T) {
+	var refusals atomic.Int32
+	refusing := newServer(UDP, func(w dns.ResponseWriter, r *dns.Msg) {
+		refusals.Add(1)
+		msg := new(dns.Msg)
+		msg.SetRcode(r, dns.RcodeRefused)
+		logErrIfNotNil(w.WriteMsg(msg))
+	})
+	defer refusing.close()
+	answering := newServer(UDP, func(w dns.ResponseWriter, r *dns.Msg) {
+		msg := dns.Msg{Answer: []dns.RR{makeRecordA("example1. 3600 IN A 10.0.0.1")}}
+		msg.SetReply(r)
+		logErrIfNotNil(w.WriteMsg(&msg))
+	})
+	defer answering.close()
+
+	serve := func(config string, upstreams ...string) (int, error) {
+		refusals.Store(0)
+		fs, err := parseFanout(caddy.NewTestController("dns", "fanout . "+strings.Join(upstreams, " ")+" {\n"+config+"\n}"))
+		require.NoError(t, err)
+		req := new(dns.Msg)
+		req.SetQuestion(testQuery, dns.TypeA)
+		rec := dnstest.NewRecorder(&test.ResponseWriter{})
+		rcode, err := fs[0].ServeDNS(context.Background(), rec, req)
+		if rec.Msg != nil {
+			rcode = rec.Msg.Rcode
+		}
+		return rcode, err
+	}
+
+	for range 5 {
+		rcode, err := serve("refused-is-soft-fail\npolicy weighted-random\nweighted-random-server-count 1\nattempt-policy rotate", refusing.addr, answering.addr)
+		require.NoError(t, err)
+		require.Equal(t, dns.RcodeSuccess, rcode, "the attempt after a refusal goes to the other upstream")
+		require.LessOrEqual(t, refusals.Load(), int32(1))
+	}
+
+	rcode, err := serve("refused-is-soft-fail", refusing.addr)
+	require.ErrorContains(t, err, "refused the query")
+	require.Equal(t, dns.RcodeServerFailure, rcode)
+	require.Equal(t, int32(1), refusals.Load(), "a refusing upstream isn't asked again")
+	require.Zero(t, registry.get(refusing.addr).stats.snapshot().Failures, "refusals don't count as failures")
+
+	rcode, err = serve("policy sequential", refusing.addr)
+	require.NoError(t, err)
+	require.Equal(t, dns.RcodeRefused, rcode)
+}
+
+func TestResponseReportsExchange(t *testing.T) {
+	handler := dns.HandlerFunc(func(w dns.ResponseWriter, r *dns.Msg) {
+		msg := new(dns.Msg)
+		msg.SetReply(r)
+		if w.RemoteAddr().Network() == UDP {
+			msg.Truncated = true
+		} else {
+			msg.Answer = []dns.RR{makeRecordA("example1. 3600 IN A 10.0.0.1")}
+		}
+		logErrIfNotNil(w.WriteMsg(msg))
+	})
+	tcpListener, err := net.Listen(TCP, "127.0.0.1:0")
+	require.NoError(t, err)
+	defer tcpListener.Close()
+	udpConn, err := net.ListenPacket("udp", tcpListener.Addr().String())
+	require.NoError(t, err)
+	defer udpConn.Close()
+	tcpServer := &dns.Server{Listener: tcpListener, Handler: handler}
+	udpServer := &dns.Server{PacketConn: udpConn, Handler: handler}
+	go func() { _ = tcpServer.ActivateAndServe() }()
+	go func() { _ = udpServer.ActivateAndServe() }()
+	defer tcpServer.Shutdown()
+	defer udpServer.Shutdown()
+
+	f := New()
+	c := NewClient(tcpListener.Addr().String(), UDP)
+	f.AddClient(c)
+	req := new(dns.Msg)
+	req.SetQuestion(testQuery, dns.TypeA)
+	resp := f.processClient(context.Background(), c, &request.Request{W: &test.ResponseWriter{}, Req: req})
+	require.NoError(t, resp.err)
+	require.Equal(t, 1, resp.attempts)
+	require.Equal(t, protoUDPTCP, resp.proto)
+	require.Equal(t, wireSize(resp.response), resp.size)
+	require.Positive(t, resp.size)
+
+	resp = f.processClient(context.Background(), NewClient("127.0.0.1:1", TCP), &request.Request{W: &test.ResponseWriter{}, Req: req})
+	require.Error(t, resp.err)
+	require.Equal(t, f.Attempts, resp.attempts)
+	require.Equal(t, TCP, resp.proto)
+	require.Zero(t, resp.size)
+}
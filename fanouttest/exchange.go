@@ -0,0 +1,149 @@
+// Copyright (c) 2024 MWS and/or its affiliates.
+//
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at:
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fanouttest
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/coredns/coredns/plugin"
+	"github.com/coredns/coredns/plugin/pkg/dnstest"
+	"github.com/coredns/coredns/plugin/test"
+	"github.com/miekg/dns"
+)
+
+// Query returns a recursive query for name and qtype.
+func Query(name string, qtype uint16) *dns.Msg {
+	m := new(dns.Msg)
+	m.SetQuestion(dns.Fqdn(name), qtype)
+	return m
+}
+
+// Exchange runs m through h, from a test client, and returns the response the client gets. When h
+// doesn't write one, the response is made from the rcode it returns, as the CoreDNS server does; a
+// handler returning a written rcode without writing fails the test, and nil is returned. The error
+// returned by h is logged.
+func Exchange(t testing.TB, h plugin.Handler, m *dns.Msg) *dns.Msg {
+	t.Helper()
+	rec := dnstest.NewRecorder(&test.ResponseWriter{})
+	rcode, err := h.ServeDNS(context.Background(), rec, m)
+	if err != nil {
+		t.Logf("%s %s: %v", m.Question[0].Name, dns.TypeToString[m.Question[0].Qtype], err)
+	}
+	if rec.Msg != nil {
+		return rec.Msg
+	}
+	if plugin.ClientWrite(rcode) {
+		t.Errorf("%s wrote no response but returned %s", h.Name(), dns.RcodeToString[rcode])
+		return nil
+	}
+	resp := new(dns.Msg)
+	resp.SetRcode(m, rcode)
+	return resp
+}
+
+// Diff returns the differences between the responses want and got, empty when they are equal: rcode,
+// the AA, TC and RA flags, and the records of every section, in any order and regardless of their TTLs.
+// The OPT record is ignored.
+func Diff(want, got *dns.Msg) []string {
+	if want == nil || got == nil {
+		if want == got {
+			return nil
+		}
+		return []string{fmt.Sprintf("response: want %v, got %v", want != nil, got != nil)}
+	}
+	var diffs []string
+	if want.Rcode != got.Rcode {
+		diffs = append(diffs, fmt.Sprintf("rcode: want %s, got %s", dns.RcodeToString[want.Rcode], dns.RcodeToString[got.Rcode]))
+	}
+	for _, flag := range []struct {
+		name      string
+		want, got bool
+	}{
+		{"aa", want.Authoritative, got.Authoritative},
+		{"tc", want.Truncated, got.Truncated},
+		{"ra", want.RecursionAvailable, got.RecursionAvailable},
+	} {
+		if flag.want != flag.got {
+			diffs = append(diffs, fmt.Sprintf("%s flag: want %t, got %t", flag.name, flag.want, flag.got))
+		}
+	}
+	diffs = append(diffs, diffSection("answer", want.Answer, got.Answer)...)
+	diffs = append(diffs, diffSection("authority", want.Ns, got.Ns)...)
+	return append(diffs, diffSection("additional", want.Extra, got.Extra)...)
+}
+
+// diffSection returns the records missing from got, and the unexpected ones, of a section.
+func diffSection(section string, want, got []dns.RR) []string {
+	w, g := records(want), records(got)
+	var diffs []string
+	for _, rr := range w {
+		if i := slices.Index(g, rr); i >= 0 {
+			g = slices.Delete(g, i, i+1)
+			continue
+		}
+		diffs = append(diffs, fmt.Sprintf("%s: missing %s", section, rr))
+	}
+	for _, rr := range g {
+		diffs = append(diffs, fmt.Sprintf("%s: unexpected %s", section, rr))
+	}
+	return diffs
+}
+
+// records returns the records of a section in zone file format, with a zero TTL, sorted.
+func records(rrs []dns.RR) []string {
+	keys := make([]string, 0, len(rrs))
+	for _, rr := range rrs {
+		if rr.Header().Rrtype == dns.TypeOPT {
+			continue
+		}
+		rr = dns.Copy(rr)
+		rr.Header().Ttl = 0
+		rr.Header().Name = strings.ToLower(rr.Header().Name)
+		keys = append(keys, rr.String())
+	}
+	slices.Sort(keys)
+	return keys
+}
+
+// RequireEqual fails the test if the responses differ, listing the differences.
+func RequireEqual(t testing.TB, want, got *dns.Msg) {
+	t.Helper()
+	if diffs := Diff(want, got); len(diffs) > 0 {
+		t.Fatalf("responses differ:\n%s", strings.Join(diffs, "\n"))
+	}
+}
+
+// DiffHandler returns a handler running every query through both want and got, e.g. a reference
+// configuration and the one under test, reporting their differences as test errors, and answering with
+// the response of got. Served by a Server, it compares the two with real clients such as dig.
+func DiffHandler(t testing.TB, want, got plugin.Handler) dns.HandlerFunc {
+	return func(w dns.ResponseWriter, r *dns.Msg) {
+		expected := Exchange(t, want, r.Copy())
+		actual := Exchange(t, got, r.Copy())
+		if diffs := Diff(expected, actual); len(diffs) > 0 {
+			t.Errorf("%s %s: responses differ:\n%s", r.Question[0].Name, dns.TypeToString[r.Question[0].Qtype],
+				strings.Join(diffs, "\n"))
+		}
+		if actual != nil {
+			_ = w.WriteMsg(actual)
+		}
+	}
+}
@@ -0,0 +1,127 @@
+// Copyright (c) 2024 MWS and/or its affiliates.
+//
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at:
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fanouttest_test
+
+import (
+	"fmt"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/hurricanehrndz/fanout/v2"
+	"github.com/hurricanehrndz/fanout/v2/fanouttest"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+)
+
+// newFanout builds the fanout of a stanza, started for the duration of the test.
+func newFanout(t *testing.T, snippet string) *fanout.Fanout {
+	t.Helper()
+	fs, err := fanout.ParseCorefile(snippet)
+	require.NoError(t, err)
+	require.NoError(t, fs[0].OnStartup())
+	t.Cleanup(func() { require.NoError(t, fs[0].OnShutdown()) })
+	return fs[0]
+}
+
+func TestExchangeThroughFanout(t *testing.T) {
+	answering := fanouttest.NewServer(t, fanouttest.Names(map[string]dns.Handler{
+		"Example.org.": fanouttest.Answer("example.org. 300 IN A 10.0.0.1"),
+	}, nil))
+	failing := fanouttest.NewServer(t, fanouttest.Rcode(dns.RcodeServerFailure))
+	f := newFanout(t, fmt.Sprintf("fanout . %s %s", answering.Addr, failing.Addr))
+
+	got := fanouttest.Exchange(t, f, fanouttest.Query("example.org", dns.TypeA))
+	want := fanouttest.Query("example.org", dns.TypeA)
+	want.SetReply(want)
+	want.RecursionAvailable = got.RecursionAvailable
+	rr, err := dns.NewRR("example.org. 60 IN A 10.0.0.1")
+	require.NoError(t, err)
+	want.Answer = []dns.RR{rr}
+	fanouttest.RequireEqual(t, want, got)
+	queries := answering.Queries()
+	require.True(t, slices.ContainsFunc(queries, func(q *dns.Msg) bool { return q.Question[0].Name == "example.org." }))
+
+	// the fallback of Names answers the other names, asked without the failing upstream racing it
+	got = fanouttest.Exchange(t, newFanout(t, "fanout . "+answering.Addr), fanouttest.Query("other.org", dns.TypeA))
+	require.Equal(t, dns.RcodeNameError, got.Rcode)
+}
+
+func TestExchangeTimeout(t *testing.T) {
+	s := fanouttest.NewServer(t, fanouttest.Drop())
+	delayed := fanouttest.NewServer(t, fanouttest.Delay(50*time.Millisecond, fanouttest.Rcode(dns.RcodeRefused)))
+	f := newFanout(t, fmt.Sprintf("fanout . %s {\ntimeout 200ms\n}", s.Addr))
+	got := fanouttest.Exchange(t, f, fanouttest.Query("example.org", dns.TypeA))
+	require.Equal(t, dns.RcodeServerFailure, got.Rcode)
+
+	f = newFanout(t, "fanout . "+delayed.Addr)
+	got = fanouttest.Exchange(t, f, fanouttest.Query("example.org", dns.TypeA))
+	require.Equal(t, dns.RcodeRefused, got.Rcode)
+}
+
+func TestDiff(t *testing.T) {
+	want := fanouttest.Query("example.org", dns.TypeA)
+	want.SetReply(want)
+	a, _ := dns.NewRR("example.org. 300 IN A 10.0.0.1")
+	b, _ := dns.NewRR("example.org. 300 IN A 10.0.0.2")
+	want.Answer = []dns.RR{a, b}
+
+	got := want.Copy()
+	got.Answer = []dns.RR{dns.Copy(b), dns.Copy(a)}
+	got.Answer[0].Header().Ttl = 10
+	require.Empty(t, fanouttest.Diff(want, got), "order and TTLs are ignored")
+
+	got.Rcode = dns.RcodeServerFailure
+	got.Answer = got.Answer[:1]
+	got.Ns = []dns.RR{&dns.NS{Hdr: dns.RR_Header{Name: "org.", Rrtype: dns.TypeNS, Class: dns.ClassINET}, Ns: "ns.org."}}
+	require.Equal(t, []string{
+		"rcode: want NOERROR, got SERVFAIL",
+		"answer: missing example.org.\t0\tIN\tA\t10.0.0.1",
+		"authority: unexpected org.\t0\tIN\tNS\tns.org.",
+	}, fanouttest.Diff(want, got))
+	require.Len(t, fanouttest.Diff(want, nil), 1)
+}
+
+// recordingTB records the errors reported to it instead of failing the test.
+type recordingTB struct {
+	testing.TB
+	mu     sync.Mutex
+	errors []string
+}
+
+func (r *recordingTB) Errorf(format string, args ...any) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.errors = append(r.errors, fmt.Sprintf(format, args...))
+}
+
+func TestDiffHandler(t *testing.T) {
+	reference := fanouttest.NewServer(t, fanouttest.Answer("example.org. 300 IN A 10.0.0.1"))
+	candidate := fanouttest.NewServer(t, fanouttest.Answer("example.org. 300 IN A 10.0.0.2"))
+	tb := &recordingTB{TB: t}
+	diff := fanouttest.NewServer(t, fanouttest.DiffHandler(tb,
+		newFanout(t, "fanout . "+reference.Addr), newFanout(t, "fanout . "+candidate.Addr)))
+
+	resp, _, err := new(dns.Client).Exchange(fanouttest.Query("example.org", dns.TypeA), diff.Addr)
+	require.NoError(t, err)
+	require.Equal(t, "10.0.0.2", resp.Answer[0].(*dns.A).A.String(), "the candidate response is served")
+	tb.mu.Lock()
+	defer tb.mu.Unlock()
+	require.Len(t, tb.errors, 1)
+	require.Contains(t, tb.errors[0], "missing example.org.\t0\tIN\tA\t10.0.0.1")
+}
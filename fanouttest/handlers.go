@@ -0,0 +1,87 @@
+// Copyright (c) 2024 MWS and/or its affiliates.
+//
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at:
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fanouttest
+
+import (
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// Answer returns a handler answering every query with the records, given in zone file format, e.g.
+// "example.org. 300 IN A 10.0.0.1". It panics if a record doesn't parse.
+func Answer(records ...string) dns.HandlerFunc {
+	rrs := make([]dns.RR, 0, len(records))
+	for _, s := range records {
+		rr, err := dns.NewRR(s)
+		if err != nil {
+			panic("fanouttest: invalid record " + s + ": " + err.Error())
+		}
+		rrs = append(rrs, rr)
+	}
+	return func(w dns.ResponseWriter, r *dns.Msg) {
+		m := new(dns.Msg)
+		m.SetReply(r)
+		for _, rr := range rrs {
+			m.Answer = append(m.Answer, dns.Copy(rr))
+		}
+		_ = w.WriteMsg(m)
+	}
+}
+
+// Rcode returns a handler answering every query with rcode and no records.
+func Rcode(rcode int) dns.HandlerFunc {
+	return func(w dns.ResponseWriter, r *dns.Msg) {
+		m := new(dns.Msg)
+		m.SetRcode(r, rcode)
+		_ = w.WriteMsg(m)
+	}
+}
+
+// Drop returns a handler never answering, to simulate an upstream timing out.
+func Drop() dns.HandlerFunc {
+	return func(dns.ResponseWriter, *dns.Msg) {}
+}
+
+// Delay returns a handler answering with h after d.
+func Delay(d time.Duration, h dns.Handler) dns.HandlerFunc {
+	return func(w dns.ResponseWriter, r *dns.Msg) {
+		time.Sleep(d)
+		h.ServeDNS(w, r)
+	}
+}
+
+// Names returns a handler answering the queries with the handler of their name, and the others with
+// fallback, NXDOMAIN when nil. Names are fully qualified and matched case insensitively.
+func Names(handlers map[string]dns.Handler, fallback dns.Handler) dns.HandlerFunc {
+	byName := make(map[string]dns.Handler, len(handlers))
+	for name, h := range handlers {
+		byName[dns.CanonicalName(name)] = h
+	}
+	if fallback == nil {
+		fallback = Rcode(dns.RcodeNameError)
+	}
+	return func(w dns.ResponseWriter, r *dns.Msg) {
+		if len(r.Question) > 0 {
+			if h, ok := byName[dns.CanonicalName(r.Question[0].Name)]; ok {
+				h.ServeDNS(w, r)
+				return
+			}
+		}
+		fallback.ServeDNS(w, r)
+	}
+}
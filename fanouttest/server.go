@@ -0,0 +1,111 @@
+// Copyright (c) 2024 MWS and/or its affiliates.
+//
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at:
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package fanouttest provides helpers to test fanout configurations end to end: upstream servers with
+// canned behaviors which record the queries they get, an exchange helper running a query through a
+// plugin handler, and assertions reporting the differences between two responses. Downstream users can
+// build a fanout from their own Corefile snippet with fanout.ParseCorefile and point it at these servers.
+package fanouttest
+
+import (
+	"net"
+	"sync"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+// Server is a DNS server listening on UDP and TCP on the same loopback port, for tests.
+type Server struct {
+	// Addr is the address of the server, host and port.
+	Addr string
+
+	mu      sync.Mutex
+	queries []*dns.Msg
+	servers []*dns.Server
+}
+
+// NewServer starts a server answering with h, stopped when the test ends. It fails the test when no
+// port can be bound.
+func NewServer(t testing.TB, h dns.Handler) *Server {
+	t.Helper()
+	s := &Server{}
+	handler := dns.HandlerFunc(func(w dns.ResponseWriter, m *dns.Msg) {
+		s.mu.Lock()
+		s.queries = append(s.queries, m.Copy())
+		s.mu.Unlock()
+		h.ServeDNS(w, m)
+	})
+	var err error
+	for range 10 {
+		if err = s.listen(handler); err == nil {
+			break
+		}
+	}
+	if err != nil {
+		t.Fatalf("unable to start test server: %v", err)
+	}
+	t.Cleanup(s.Close)
+	return s
+}
+
+// listen starts the TCP and UDP servers on a free port.
+func (s *Server) listen(h dns.Handler) error {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return err
+	}
+	pc, err := net.ListenPacket("udp", l.Addr().String())
+	if err != nil {
+		_ = l.Close()
+		return err
+	}
+	s.Addr = l.Addr().String()
+	s.servers = []*dns.Server{{Listener: l, Handler: h}, {PacketConn: pc, Handler: h}}
+	for _, srv := range s.servers {
+		started := make(chan struct{})
+		srv.NotifyStartedFunc = func() { close(started) }
+		go func() { _ = srv.ActivateAndServe() }()
+		<-started
+	}
+	return nil
+}
+
+// Close stops the server. It is called when the test ends, and can be called earlier to simulate an
+// upstream going down.
+func (s *Server) Close() {
+	s.mu.Lock()
+	servers := s.servers
+	s.servers = nil
+	s.mu.Unlock()
+	for _, srv := range servers {
+		_ = srv.Shutdown()
+	}
+}
+
+// Queries returns copies of the queries received so far, in order.
+func (s *Server) Queries() []*dns.Msg {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]*dns.Msg(nil), s.queries...)
+}
+
+// Count returns the number of queries received so far.
+func (s *Server) Count() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.queries)
+}
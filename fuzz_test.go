@@ -0,0 +1,150 @@
+// Copyright (c) 2024 MWS and/or its affiliates.
+//
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at:
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fanout
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/coredns/coredns/plugin/test"
+	"github.com/coredns/coredns/request"
+	"github.com/miekg/dns"
+	"github.com/pkg/errors"
+)
+
+// fuzzSeeds returns well-formed and truncated replies to testQuery, patched by the fuzz targets to carry
+// the expected message ID.
+func fuzzSeeds(f *testing.F) [][]byte {
+	req := new(dns.Msg)
+	req.SetQuestion(testQuery, dns.TypeA)
+	var seeds [][]byte
+	for _, rcode := range []int{dns.RcodeSuccess, dns.RcodeNameError, dns.RcodeServerFailure} {
+		msg := new(dns.Msg)
+		msg.SetRcode(req, rcode)
+		if rcode == dns.RcodeSuccess {
+			msg.Answer = []dns.RR{
+				makeRecordA(testQuery + " 300 IN A 10.0.0.1"),
+				makeRecordA(testQuery + " 300 IN A 10.0.0.2"),
+			}
+		}
+		data, err := msg.Pack()
+		if err != nil {
+			f.Fatal(err)
+		}
+		seeds = append(seeds, data, data[:len(data)/2])
+	}
+	return seeds
+}
+
+func fuzzRequest() *request.Request {
+	req := new(dns.Msg)
+	req.SetQuestion(testQuery, dns.TypeA)
+	return &request.Request{W: &test.ResponseWriter{}, Req: req}
+}
+
+// withID sets the message ID of a raw message, so that fuzzed replies get past the ID check.
+func withID(data []byte, id uint16) []byte {
+	if len(data) < 2 {
+		return data
+	}
+	data = append([]byte(nil), data...)
+	data[0], data[1] = byte(id>>8), byte(id)
+	return data
+}
+
+// FuzzClientRequest feeds arbitrary upstream replies to client.Request.
+func FuzzClientRequest(f *testing.F) {
+	for _, seed := range fuzzSeeds(f) {
+		f.Add(seed)
+	}
+	var reply atomic.Pointer[[]byte]
+	s := newServer(UDP, func(w dns.ResponseWriter, r *dns.Msg) {
+		_, _ = w.Write(withID(*reply.Load(), r.Id))
+	})
+	defer s.close()
+	c := NewClient(s.addr, UDP)
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		reply.Store(&data)
+		ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+		defer cancel()
+		r := fuzzRequest()
+		msg, err := c.Request(ctx, r)
+		if err == nil && msg == nil {
+			t.Fatal("no error and no message")
+		}
+	})
+}
+
+// FuzzIsBetter checks that isBetter never prefers each of two responses over the other.
+func FuzzIsBetter(f *testing.F) {
+	seeds := fuzzSeeds(f)
+	for i := range seeds {
+		f.Add(seeds[i], seeds[(i+1)%len(seeds)])
+	}
+	f.Fuzz(func(t *testing.T, left, right []byte) {
+		a, b := fuzzResponse(left), fuzzResponse(right)
+		if isBetter(a, b) && isBetter(b, a) {
+			t.Fatalf("both responses are better than the other: %v, %v", a, b)
+		}
+	})
+}
+
+// FuzzGetFanoutResult runs the result selection and the post-processing of the winning response over
+// a set of fuzzed upstream replies.
+func FuzzGetFanoutResult(f *testing.F) {
+	seeds := fuzzSeeds(f)
+	for i := range seeds {
+		f.Add(uint8(i), seeds[i], seeds[(i+1)%len(seeds)])
+	}
+	fanout := New()
+	fanout.answerOrder = answerOrderRotate
+	f.Fuzz(func(t *testing.T, flags uint8, first, second []byte) {
+		r := fuzzRequest()
+		responses := make(chan *response, 2)
+		for i, data := range [][]byte{first, second} {
+			if flags&(1<<i) != 0 {
+				data = withID(data, r.Req.Id)
+			}
+			responses <- fuzzResponse(data)
+		}
+		close(responses)
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		result := fanout.getFanoutResult(ctx, r, responses)
+		if result == nil || result.err != nil {
+			return
+		}
+		if !r.Match(result.response) {
+			t.Fatal("the result doesn't match the request")
+		}
+		fanout.reorderAnswer(result.response)
+		_ = danglingCNAME(result.response, r.Name(), r.QType())
+		fanout.truncate(r, result.response)
+	})
+}
+
+func fuzzResponse(data []byte) *response {
+	c := &staticClient{addr: "203.0.113.53:53"}
+	msg := new(dns.Msg)
+	if err := msg.Unpack(data); err != nil {
+		return &response{client: c, err: errors.Wrap(err, "unpack")}
+	}
+	return &response{client: c, response: msg}
+}
@@ -0,0 +1,104 @@
+// Copyright (c) 2024 MWS and/or its affiliates.
+//
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at:
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fanout
+
+import (
+	"slices"
+
+	"github.com/coredns/coredns/request"
+)
+
+// upstreamGroup is a group of upstreams serving the queries of the listed types, or for the listed
+// domains, instead of the TO list.
+type upstreamGroup struct {
+	qtypes  []uint16
+	domains Domain
+	hosts   []string
+	clients []Client
+	policy  policy
+}
+
+func initGroups(f *Fanout) error {
+	for _, g := range f.groups {
+		g.clients = g.clients[:0]
+		for _, host := range g.hosts {
+			c, err := newUpstreamClient(f, host)
+			if err != nil {
+				return err
+			}
+			g.clients = append(g.clients, c)
+		}
+		loadFactor := make([]int, len(g.clients))
+		for i := range loadFactor {
+			loadFactor[i] = defaultLoadFactor
+		}
+		p, err := f.newPolicy(loadFactor, 0)
+		if err != nil {
+			return err
+		}
+		g.policy = p
+	}
+	return nil
+}
+
+func (f *Fanout) domainGroup(name string) *upstreamGroup {
+	for _, g := range f.groups {
+		if g.domains != nil && g.domains.Contains(name) {
+			return g
+		}
+	}
+	return nil
+}
+
+// route returns the upstreams of the request, their selection policy and the number of upstreams to query.
+// Domain redirects take precedence over qtype groups.
+func (f *Fanout) route(req *request.Request) ([]Client, policy, int) {
+	return f.routeName(req.Name(), req.QType())
+}
+
+// routeName returns the upstreams of a query for name and qtype, as route does.
+func (f *Fanout) routeName(name string, qtype uint16) ([]Client, policy, int) {
+	g := f.domainGroup(name)
+	if g == nil {
+		g = f.qtypeGroup(qtype)
+	}
+	if g != nil {
+		return g.clients, g.policy, len(g.clients)
+	}
+	return f.clients, f.selectionPolicy(), f.serverCount
+}
+
+// upstreams returns every upstream answering queries: the TO list followed by the upstreams of groups and
+// the plaintext fallback.
+func (f *Fanout) upstreams() []Client {
+	groups := f.groups
+	if f.insecure != nil {
+		groups = append(slices.Clone(groups), f.insecure)
+	}
+	if len(groups) == 0 {
+		return f.clients
+	}
+	clients := slices.Clone(f.clients)
+	for _, g := range groups {
+		for _, c := range g.clients {
+			if !slices.ContainsFunc(clients, func(other Client) bool { return other.Endpoint() == c.Endpoint() }) {
+				clients = append(clients, c)
+			}
+		}
+	}
+	return clients
+}
@@ -0,0 +1,70 @@
+// Copyright (c) 2024 MWS and/or its affiliates.
+//
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at:
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fanout
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/coredns/caddy"
+	"github.com/coredns/coredns/plugin/test"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+)
+
+func TestExceptRedirectRouting(t *testing.T) {
+	named := func(target string) func(w dns.ResponseWriter, r *dns.Msg) {
+		return func(w dns.ResponseWriter, r *dns.Msg) {
+			rr, err := dns.NewRR(fmt.Sprintf("%s 3600 IN TXT %q", r.Question[0].Name, target))
+			require.NoError(t, err)
+			msg := dns.Msg{Answer: []dns.RR{rr}}
+			msg.SetReply(r)
+			logErrIfNotNil(w.WriteMsg(&msg))
+		}
+	}
+	public := newServer(UDP, named("public"))
+	defer public.close()
+	corp := newServer(UDP, named("corp"))
+	defer corp.close()
+
+	input := fmt.Sprintf("fanout . %s {\nexcept corp.local lab.local -> %s\nexcept skipped.local\n}", public.addr, corp.addr)
+	fs, err := parseFanout(caddy.NewTestController("dns", input))
+	require.NoError(t, err)
+	f := fs[0]
+
+	for name, expected := range map[string]string{"host.corp.local.": "corp", "lab.local.": "corp", "example.com.": "public"} {
+		req := new(dns.Msg)
+		req.SetQuestion(name, dns.TypeTXT)
+		writer := &cachedDNSWriter{ResponseWriter: new(test.ResponseWriter)}
+		_, err = f.ServeDNS(context.Background(), writer, req)
+		require.NoError(t, err)
+		require.Len(t, writer.answers, 1)
+		require.Equal(t, []string{expected}, writer.answers[0].Answer[0].(*dns.TXT).Txt, name)
+	}
+	req := new(dns.Msg)
+	req.SetQuestion("host.skipped.local.", dns.TypeTXT)
+	_, err = f.ServeDNS(context.Background(), &cachedDNSWriter{ResponseWriter: new(test.ResponseWriter)}, req)
+	require.ErrorContains(t, err, "no next plugin found")
+}
+
+func TestSetupExceptRedirect(t *testing.T) {
+	for _, input := range []string{"except -> 127.0.0.2", "except corp.local ->"} {
+		_, err := parseFanout(caddy.NewTestController("dns", "fanout . 127.0.0.1 {\n"+input+"\n}"))
+		require.ErrorContains(t, err, "except redirect requires", input)
+	}
+}
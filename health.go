@@ -0,0 +1,116 @@
+// Copyright (c) 2024 MWS and/or its affiliates.
+//
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at:
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fanout
+
+import (
+	"context"
+	"net"
+	"time"
+
+	"github.com/coredns/coredns/request"
+	"github.com/hurricanehrndz/fanout/v2/clock"
+	"github.com/miekg/dns"
+)
+
+// Ready implements the ready.Readiness interface. It reports true once at least one upstream
+// has answered the initial health probe.
+func (f *Fanout) Ready() bool {
+	for _, c := range f.upstreams() {
+		if f.Healthy(c.Endpoint()) {
+			return true
+		}
+	}
+	return false
+}
+
+// Healthy returns true if the upstream with the given endpoint has answered a health probe, possibly
+// one sent on behalf of another fanout instance.
+func (f *Fanout) Healthy(addr string) bool {
+	return registry.get(addr).healthy.Load()
+}
+
+// probeUpstreams probes every upstream in the background until it answers or releaseProbes is called.
+// Upstreams already probed for another fanout instance are not probed again.
+func (f *Fanout) probeUpstreams() {
+	for _, c := range f.upstreams() {
+		registry.acquireProbe(c, func(c Client, s *upstreamState, stop <-chan struct{}) {
+			probeUntilHealthy(f.clock, c, s, stop)
+		})
+	}
+}
+
+func (f *Fanout) releaseProbes() {
+	for _, c := range f.upstreams() {
+		registry.releaseProbe(c.Endpoint())
+	}
+}
+
+func probeUntilHealthy(clk clock.Clock, c Client, s *upstreamState, stop <-chan struct{}) {
+	t := task{interval: healthProbeInterval, jitter: taskJitter, immediate: true}
+	t.run = func(time.Time) bool {
+		if s.healthy.Load() {
+			return false
+		}
+		if probe(c, stop) {
+			s.healthy.Store(true)
+			UpstreamHealthy.WithLabelValues(c.Endpoint()).Set(1)
+			return false
+		}
+		UpstreamHealthy.WithLabelValues(c.Endpoint()).Set(0)
+		return true
+	}
+	runTask(clk, stop, t)
+}
+
+// probe sends a root NS query to the client. Any well-formed reply means the upstream is reachable.
+func probe(c Client, stop <-chan struct{}) bool {
+	m := new(dns.Msg)
+	m.SetQuestion(".", dns.TypeNS)
+	_, err := probeQuery(c, m, stop)
+	return err == nil
+}
+
+// probeQuery sends a query originated by the plugin to the client, giving up after maxTimeout or once
+// stop is closed.
+func probeQuery(c Client, m *dns.Msg, stop <-chan struct{}) (*dns.Msg, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), maxTimeout)
+	defer cancel()
+	go func() {
+		select {
+		case <-stop:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	return c.Request(ctx, &request.Request{W: probeWriter{}, Req: m})
+}
+
+// probeWriter is a placeholder response writer for requests originated by the plugin itself.
+type probeWriter struct {
+	dns.ResponseWriter
+}
+
+// LocalAddr returns the loopback UDP address.
+func (probeWriter) LocalAddr() net.Addr {
+	return &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 53}
+}
+
+// RemoteAddr returns the loopback UDP address.
+func (probeWriter) RemoteAddr() net.Addr {
+	return &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 0}
+}
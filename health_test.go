@@ -0,0 +1,85 @@
+// Copyright (c) 2024 MWS and/or its affiliates.
+//
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at:
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fanout
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/goleak"
+)
+
+func TestReadyAfterFirstHealthyUpstream(t *testing.T) {
+	defer goleak.VerifyNone(t)
+	s := newServer(UDP, func(w dns.ResponseWriter, r *dns.Msg) {
+		msg := new(dns.Msg)
+		msg.SetReply(r)
+		logErrIfNotNil(w.WriteMsg(msg))
+	})
+	defer s.close()
+
+	f := New()
+	f.From = "."
+	f.AddClient(NewClient("127.0.0.1:1", TCP))
+	f.AddClient(NewClient(s.addr, UDP))
+	require.False(t, f.Ready())
+
+	require.NoError(t, f.OnStartup())
+	defer func() {
+		require.NoError(t, f.OnShutdown())
+	}()
+	require.Eventually(t, f.Ready, time.Second, 10*time.Millisecond)
+	require.True(t, f.Healthy(s.addr))
+	require.False(t, f.Healthy("127.0.0.1:1"))
+}
+
+func TestHealthProbeSharedAcrossInstances(t *testing.T) {
+	defer goleak.VerifyNone(t)
+	var probes atomic.Int32
+	s := newServer(UDP, func(w dns.ResponseWriter, r *dns.Msg) {
+		probes.Add(1)
+		msg := new(dns.Msg)
+		msg.SetReply(r)
+		logErrIfNotNil(w.WriteMsg(msg))
+	})
+	defer s.close()
+
+	var fs []*Fanout
+	for _, zone := range []string{"example.com.", "example.org."} {
+		f := New()
+		f.From = zone
+		f.AddClient(NewClient(s.addr, UDP))
+		require.NoError(t, f.OnStartup())
+		fs = append(fs, f)
+	}
+	defer func() {
+		for _, f := range fs {
+			require.NoError(t, f.OnShutdown())
+		}
+	}()
+	for _, f := range fs {
+		require.Eventually(t, f.Ready, time.Second, 10*time.Millisecond)
+	}
+	require.Equal(t, int32(1), probes.Load())
+
+	before := fs[1].statsFor(s.addr).snapshot().Requests
+	fs[0].statsFor(s.addr).observe(time.Millisecond, nil, time.Now())
+	require.Equal(t, before+1, fs[1].statsFor(s.addr).snapshot().Requests)
+}
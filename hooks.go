@@ -0,0 +1,59 @@
+// Copyright (c) 2024 MWS and/or its affiliates.
+//
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at:
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fanout
+
+import (
+	"context"
+
+	"github.com/coredns/coredns/request"
+	"github.com/miekg/dns"
+)
+
+// PreResolveHook is called before a query is sent to the upstreams, e.g. to look it up in an external cache
+// shared by several instances. A non-nil response is written to the client, with the ID of the query,
+// instead of querying the upstreams; a nil one lets the query proceed.
+type PreResolveHook func(ctx context.Context, req *dns.Msg) *dns.Msg
+
+// PostResolveHook is called with the upstream response about to be written to the client, e.g. to store it
+// in the external cache consulted by a PreResolveHook. resp is a copy the hook may keep.
+type PostResolveHook func(ctx context.Context, req, resp *dns.Msg)
+
+// servePreResolve answers the query with the response of the pre-resolution hook, if any. It returns false
+// if the query is to be sent to the upstreams.
+func (f *Fanout) servePreResolve(ctx context.Context, req *request.Request) bool {
+	if f.preResolveHook == nil {
+		return false
+	}
+	m := f.preResolveHook(ctx, req.Req)
+	if m == nil {
+		return false
+	}
+	m = m.Copy()
+	m.Id = req.Req.Id
+	if f.limitResponseSize {
+		f.truncate(req, m)
+	}
+	logErrIfNotNil(req.W.WriteMsg(m))
+	return true
+}
+
+// postResolve hands a copy of the response to the post-resolution hook, if any.
+func (f *Fanout) postResolve(ctx context.Context, req *request.Request, m *dns.Msg) {
+	if f.postResolveHook != nil {
+		f.postResolveHook(ctx, req.Req, m.Copy())
+	}
+}
@@ -0,0 +1,132 @@
+// Copyright (c) 2024 MWS and/or its affiliates.
+//
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at:
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fanout
+
+import (
+	"context"
+	"slices"
+	"strconv"
+
+	"github.com/coredns/caddy/caddyfile"
+	"github.com/coredns/coredns/request"
+	"github.com/miekg/dns"
+	"github.com/pkg/errors"
+)
+
+// hopLimit configures the hop count carried by the forwarded queries in a local EDNS0 option. Each
+// fanout in a chain increments it, and the one receiving a query which already did max hops fails it,
+// which breaks the forwarding loops missed at startup, e.g. made by a later change of an upstream.
+type hopLimit struct {
+	max  uint8
+	code uint16
+}
+
+// hopCount is the hop count set in the queries to the upstreams.
+type hopCount struct {
+	code  uint16
+	count uint8
+}
+
+type hopsKey struct{}
+
+// parseMaxHops parses `max-hops COUNT [CODE]`.
+func parseMaxHops(f *Fanout, c *caddyfile.Dispenser) error {
+	args := c.RemainingArgs()
+	if len(args) == 0 || len(args) > 2 {
+		return c.ArgErr()
+	}
+	count, err := strconv.ParseUint(args[0], 10, 8)
+	if err != nil || count == 0 {
+		return errors.Errorf("max-hops count must be between 1 and 255, got %q", args[0])
+	}
+	h := &hopLimit{max: uint8(count), code: defaultHopsCode}
+	if len(args) > 1 {
+		code, err := strconv.ParseUint(args[1], 10, 16)
+		if err != nil || code < dns.EDNS0LOCALSTART || code > dns.EDNS0LOCALEND {
+			return errors.Errorf("max-hops EDNS option code must be between %d and %d, got %q",
+				dns.EDNS0LOCALSTART, dns.EDNS0LOCALEND, args[1])
+		}
+		h.code = uint16(code)
+	}
+	f.hops = h
+	return nil
+}
+
+// count returns the hop count of m, 0 when it has none.
+func (h *hopLimit) count(m *dns.Msg) uint8 {
+	opt := m.IsEdns0()
+	if opt == nil {
+		return 0
+	}
+	for _, o := range opt.Option {
+		if l, ok := o.(*dns.EDNS0_LOCAL); ok && l.Code == h.code && len(l.Data) == 1 {
+			return l.Data[0]
+		}
+	}
+	return 0
+}
+
+// serveHops fails the queries which already did the maximum number of hops.
+func (h *hopLimit) serveHops(req *request.Request) (rcode int, handled bool, err error) {
+	if h == nil {
+		return 0, false, nil
+	}
+	if count := h.count(req.Req); count >= h.max {
+		HopLimitCount.Inc()
+		return dns.RcodeServerFailure, true, errors.Errorf("query for %s did %d hops, forwarding loop?", req.Name(), count)
+	}
+	return 0, false, nil
+}
+
+// withHops returns a context setting the hop count of req, incremented, in the queries to the upstreams.
+func (h *hopLimit) withHops(ctx context.Context, req *request.Request) context.Context {
+	if h == nil {
+		return ctx
+	}
+	return context.WithValue(ctx, hopsKey{}, hopCount{code: h.code, count: h.count(req.Req) + 1})
+}
+
+// hasHops returns true if the queries made with ctx carry a hop count.
+func hasHops(ctx context.Context) bool {
+	_, ok := ctx.Value(hopsKey{}).(hopCount)
+	return ok
+}
+
+// setHops sets the hop count of ctx in m, adding an OPT record to m when it has none.
+func setHops(ctx context.Context, m *dns.Msg) {
+	h, ok := ctx.Value(hopsKey{}).(hopCount)
+	if !ok {
+		return
+	}
+	opt := m.IsEdns0()
+	if opt == nil {
+		m.SetEdns0(dns.DefaultMsgSize, false)
+		opt = m.IsEdns0()
+	}
+	opt.Option = slices.DeleteFunc(opt.Option, func(o dns.EDNS0) bool { return o.Option() == h.code })
+	opt.Option = append(opt.Option, &dns.EDNS0_LOCAL{Code: h.code, Data: []byte{h.count}})
+}
+
+// hopped returns m, or a copy of m with the hop count of ctx when it has one.
+func hopped(ctx context.Context, m *dns.Msg) *dns.Msg {
+	if !hasHops(ctx) {
+		return m
+	}
+	m = m.Copy()
+	setHops(ctx, m)
+	return m
+}
@@ -0,0 +1,79 @@
+// Copyright (c) 2024 MWS and/or its affiliates.
+//
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at:
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fanout
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/coredns/caddy"
+	"github.com/coredns/coredns/plugin/pkg/dnstest"
+	"github.com/coredns/coredns/plugin/test"
+	"github.com/miekg/dns"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMaxHopsBreaksForwardingLoop(t *testing.T) {
+	var looped atomic.Pointer[Fanout]
+	var hits atomic.Int32
+	var mu sync.Mutex
+	var counts []uint8
+	s := newServer(UDP, func(w dns.ResponseWriter, r *dns.Msg) {
+		hits.Add(1)
+		f := looped.Load()
+		mu.Lock()
+		counts = append(counts, f.hops.count(r))
+		mu.Unlock()
+		rcode, _ := f.ServeDNS(context.Background(), w, r)
+		msg := new(dns.Msg)
+		msg.SetRcode(r, rcode)
+		logErrIfNotNil(w.WriteMsg(msg))
+	})
+	defer s.close()
+
+	fs, err := parseFanout(caddy.NewTestController("dns", "fanout . "+s.addr+" {\nmax-hops 3\n}"))
+	require.NoError(t, err)
+	f := fs[0]
+	looped.Store(f)
+	before := testutil.ToFloat64(HopLimitCount)
+
+	req := new(dns.Msg)
+	req.SetQuestion(testQuery, dns.TypeA)
+	rec := dnstest.NewRecorder(&test.ResponseWriter{})
+	_, err = f.ServeDNS(context.Background(), rec, req)
+	require.NoError(t, err)
+	require.Equal(t, dns.RcodeServerFailure, rec.Rcode)
+	require.EqualValues(t, 3, hits.Load())
+	mu.Lock()
+	require.Equal(t, []uint8{1, 2, 3}, counts)
+	mu.Unlock()
+	require.InDelta(t, before+1, testutil.ToFloat64(HopLimitCount), 0)
+	require.Nil(t, req.IsEdns0(), "the client query must not be modified")
+}
+
+func TestMaxHopsParse(t *testing.T) {
+	for _, input := range []string{"max-hops", "max-hops 0", "max-hops 256", "max-hops 3 53", "max-hops 3 65002 1"} {
+		_, err := parseFanout(caddy.NewTestController("dns", "fanout . 127.0.0.1 {\n"+input+"\n}"))
+		require.Error(t, err, input)
+	}
+	fs, err := parseFanout(caddy.NewTestController("dns", "fanout . 127.0.0.1 {\nmax-hops 4 65010\n}"))
+	require.NoError(t, err)
+	require.Equal(t, &hopLimit{max: 4, code: 65010}, fs[0].hops)
+}
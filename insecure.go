@@ -0,0 +1,38 @@
+// Copyright (c) 2024 MWS and/or its affiliates.
+//
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at:
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fanout
+
+import (
+	"context"
+
+	"github.com/coredns/coredns/request"
+)
+
+// insecureFallback sends the request to the plaintext upstreams once every encrypted upstream failed. The
+// fallback gets a timeout of its own, since the encrypted attempts may have used up the request timeout.
+func (f *Fanout) insecureFallback(ctx context.Context, req *request.Request) *response {
+	if ctx.Err() != nil {
+		// the client is gone, there is no one left to answer
+		return nil
+	}
+	log.Warningf("every encrypted upstream failed for %s %s, falling back to plaintext upstreams", req.Name(), req.Type())
+	InsecureFallbackCount.Add(1)
+	ctx, cancel := context.WithTimeout(ctx, f.queryTimeout(req))
+	defer cancel()
+	g := f.insecure
+	return f.getFanoutResult(ctx, req, f.runWorkersOn(ctx, req, g.clients, g.policy, len(g.clients)))
+}
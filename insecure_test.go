@@ -0,0 +1,92 @@
+// Copyright (c) 2024 MWS and/or its affiliates.
+//
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at:
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fanout
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net/http"
+	"sync/atomic"
+	"testing"
+
+	"github.com/coredns/caddy"
+	"github.com/coredns/coredns/plugin/test"
+	"github.com/miekg/dns"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/require"
+)
+
+func TestInsecureFallback(t *testing.T) {
+	var proto atomic.Int32
+	doh := newDoHServer(t, &proto)
+	defer doh.Close()
+	var plainCount atomic.Int32
+	plain := newServer(UDP, func(w dns.ResponseWriter, r *dns.Msg) {
+		plainCount.Add(1)
+		msg := dns.Msg{Answer: []dns.RR{makeRecordA("example1. 3600 IN A 10.0.0.2")}}
+		msg.SetReply(r)
+		logErrIfNotNil(w.WriteMsg(&msg))
+	})
+	defer plain.close()
+
+	input := fmt.Sprintf("fanout . %s/dns-query %s {\nallow-insecure-fallback\n}", doh.URL, plain.addr)
+	fs, err := parseFanout(caddy.NewTestController("dns", input))
+	require.NoError(t, err)
+	f := fs[0]
+	require.Len(t, f.clients, 1)
+	require.Len(t, f.insecure.clients, 1)
+	require.Len(t, f.upstreams(), 2)
+	f.clients[0].SetTLSConfig(&tls.Config{RootCAs: doh.Client().Transport.(*http.Transport).TLSClientConfig.RootCAs})
+
+	serve := func() *dns.Msg {
+		req := new(dns.Msg)
+		req.SetQuestion(testQuery, dns.TypeA)
+		writer := &cachedDNSWriter{ResponseWriter: new(test.ResponseWriter)}
+		_, err := f.ServeDNS(context.Background(), writer, req)
+		require.NoError(t, err)
+		require.Len(t, writer.answers, 1)
+		return writer.answers[0]
+	}
+
+	fallbacks := testutil.ToFloat64(InsecureFallbackCount)
+	require.Equal(t, "10.0.0.1", serve().Answer[0].(*dns.A).A.String())
+	require.Zero(t, plainCount.Load(), "plaintext upstreams are not used while encrypted ones answer")
+
+	doh.Close()
+	require.Equal(t, "10.0.0.2", serve().Answer[0].(*dns.A).A.String())
+	require.Equal(t, int32(1), plainCount.Load())
+	require.Equal(t, fallbacks+1, testutil.ToFloat64(InsecureFallbackCount))
+}
+
+func TestSetupInsecureFallback(t *testing.T) {
+	fs, err := parseFanout(caddy.NewTestController("dns", "fanout . tls://127.0.0.1 127.0.0.2 127.0.0.3 {\nallow-insecure-fallback\npolicy weighted-random\nweighted-random-load-factor 50 60 70\n}"))
+	require.NoError(t, err)
+	require.Len(t, fs[0].clients, 1)
+	require.Equal(t, []int{50}, fs[0].loadFactor)
+	require.Len(t, fs[0].insecure.clients, 2)
+
+	fs, err = parseFanout(caddy.NewTestController("dns", "fanout . tls://127.0.0.1 127.0.0.2"))
+	require.NoError(t, err)
+	require.Nil(t, fs[0].insecure)
+	require.Len(t, fs[0].clients, 2)
+
+	_, err = parseFanout(caddy.NewTestController("dns", "fanout . 127.0.0.1 127.0.0.2 {\nallow-insecure-fallback\n}"))
+	require.ErrorContains(t, err, "requires both encrypted and plaintext upstreams")
+	_, err = parseFanout(caddy.NewTestController("dns", "fanout . 127.0.0.1 {\nallow-insecure-fallback yes\n}"))
+	require.Error(t, err)
+}
@@ -0,0 +1,112 @@
+// Copyright (c) 2024 MWS and/or its affiliates.
+//
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at:
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fanout
+
+import (
+	"context"
+	"crypto/rand"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/coredns/caddy/caddyfile"
+	"github.com/coredns/coredns/request"
+	"github.com/miekg/dns"
+	"github.com/pkg/errors"
+)
+
+// loopProbes holds the names of the loop probes in flight, process wide, so that a probe sent by any
+// fanout instance is recognized by the one it comes back to.
+var loopProbes sync.Map
+
+// parseLoopDetect parses `loop-detect [fail|disable]`.
+func parseLoopDetect(f *Fanout, c *caddyfile.Dispenser) error {
+	args := c.RemainingArgs()
+	switch {
+	case len(args) > 1:
+		return c.ArgErr()
+	case len(args) == 0:
+		f.loopDetect = loopDetectFail
+	case args[0] == loopDetectFail, args[0] == loopDetectDisable:
+		f.loopDetect = args[0]
+	default:
+		return errors.Errorf("unsupported loop-detect action %q", args[0])
+	}
+	return nil
+}
+
+// detectLoops sends a query for a unique name under the zone to every upstream. An upstream whose probe
+// comes back to this process forwards it to a server forwarding it back to the upstream, or is this
+// server itself: with fail, startup fails, with disable, the upstream is drained.
+func (f *Fanout) detectLoops() error {
+	looping := make([]bool, len(f.upstreams()))
+	var wg sync.WaitGroup
+	for i, c := range f.upstreams() {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			looping[i] = f.probeLoop(c)
+		}()
+	}
+	wg.Wait()
+	for i, c := range f.upstreams() {
+		if !looping[i] {
+			continue
+		}
+		if f.loopDetect == loopDetectFail {
+			return errors.Errorf("upstream %s forwards the queries for %s back to this server", c.Endpoint(), f.From)
+		}
+		log.Warningf("fanout: upstream %s forwards the queries for %s back to this server, draining it", c.Endpoint(), f.From)
+		logErrIfNotNil(f.DrainUpstream(c.Endpoint()))
+	}
+	return nil
+}
+
+// probeLoop sends the loop probe to c and returns true if it came back.
+func (f *Fanout) probeLoop(c Client) bool {
+	name := dns.Fqdn(strings.ToLower(rand.Text()) + "." + loopProbeLabel + "." + strings.TrimPrefix(f.From, "."))
+	seen := new(atomic.Bool)
+	loopProbes.Store(name, seen)
+	defer loopProbes.Delete(name)
+	m := new(dns.Msg)
+	m.SetQuestion(name, dns.TypeHINFO)
+	_, _ = probeQuery(c, m, f.tasks.done())
+	return seen.Load()
+}
+
+// serveLoopProbe fails a loop probe coming back, so that it isn't forwarded around the loop again.
+func serveLoopProbe(req *request.Request) bool {
+	v, ok := loopProbes.Load(req.Name())
+	if !ok {
+		return false
+	}
+	v.(*atomic.Bool).Store(true)
+	return true
+}
+
+// serveInternal answers the queries meant for the plugin itself rather than the upstreams: the loop
+// probes coming back, and the queries of the debug suffix.
+func (f *Fanout) serveInternal(ctx context.Context, req *request.Request) (rcode int, handled bool, err error) {
+	if serveLoopProbe(req) {
+		return dns.RcodeServerFailure, true, errors.Errorf("loop probe %s came back", req.Name())
+	}
+	if f.debugSuffix != "" && dns.IsSubDomain(f.debugSuffix, req.Name()) {
+		rcode, err = f.serveAudit(ctx, req)
+		return rcode, true, err
+	}
+	return 0, false, nil
+}
@@ -0,0 +1,81 @@
+// Copyright (c) 2024 MWS and/or its affiliates.
+//
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at:
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fanout
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+
+	"github.com/coredns/caddy"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+)
+
+// loopingServer forwards every query it receives to the fanout stored in f.
+func loopingServer(f *atomic.Pointer[Fanout]) *server {
+	return newServer(UDP, func(w dns.ResponseWriter, r *dns.Msg) {
+		rcode, _ := f.Load().ServeDNS(context.Background(), w, r)
+		msg := new(dns.Msg)
+		msg.SetRcode(r, rcode)
+		logErrIfNotNil(w.WriteMsg(msg))
+	})
+}
+
+func TestLoopDetectFailsStartup(t *testing.T) {
+	var looped atomic.Pointer[Fanout]
+	s := loopingServer(&looped)
+	defer s.close()
+
+	fs, err := parseFanout(caddy.NewTestController("dns", "fanout . "+s.addr+" {\nloop-detect\n}"))
+	require.NoError(t, err)
+	f := fs[0]
+	looped.Store(f)
+	require.ErrorContains(t, f.OnStartup(), "back to this server")
+	require.NoError(t, f.OnShutdown())
+}
+
+func TestLoopDetectDisablesUpstream(t *testing.T) {
+	var looped atomic.Pointer[Fanout]
+	looping := loopingServer(&looped)
+	defer looping.close()
+	healthy := newServer(UDP, func(w dns.ResponseWriter, r *dns.Msg) {
+		msg := new(dns.Msg)
+		msg.SetRcode(r, dns.RcodeNameError)
+		logErrIfNotNil(w.WriteMsg(msg))
+	})
+	defer healthy.close()
+
+	fs, err := parseFanout(caddy.NewTestController("dns", "fanout . "+looping.addr+" "+healthy.addr+" {\nloop-detect disable\n}"))
+	require.NoError(t, err)
+	f := fs[0]
+	looped.Store(f)
+	require.NoError(t, f.OnStartup())
+	defer func() { require.NoError(t, f.OnShutdown()) }()
+	require.True(t, f.IsDraining(looping.addr))
+	require.False(t, f.IsDraining(healthy.addr))
+}
+
+func TestLoopDetectParse(t *testing.T) {
+	for _, input := range []string{"loop-detect drop", "loop-detect fail disable"} {
+		_, err := parseFanout(caddy.NewTestController("dns", "fanout . 127.0.0.1 {\n"+input+"\n}"))
+		require.Error(t, err, input)
+	}
+	fs, err := parseFanout(caddy.NewTestController("dns", "fanout . 127.0.0.1 {\nloop-detect disable\n}"))
+	require.NoError(t, err)
+	require.Equal(t, loopDetectDisable, fs[0].loopDetect)
+}
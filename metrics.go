@@ -17,14 +17,28 @@
 package fanout
 
 import (
+	"context"
+	"strconv"
+	"strings"
+	"time"
+
 	"github.com/coredns/coredns/plugin"
+	"github.com/miekg/dns"
+	ot "github.com/opentracing/opentracing-go"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promauto"
 )
 
 const (
+	exemplarTraceID  = "trace_id"
 	metricLabelTo    = "to"
+	metricLabelZone  = "zone"
 	requestCountHelp = "Counter of requests made per upstream."
+	protoUDPTCP      = "udp-tcp"
+	protoTLS         = "tls"
+	protoHTTPS       = "https"
+	protoQUIC        = "quic"
+	rcodeError       = "error"
 )
 
 // Variables declared for monitoring.
@@ -34,18 +48,224 @@ var (
 		Subsystem: pluginName,
 		Name:      "request_count_total",
 		Help:      requestCountHelp,
-	}, []string{metricLabelTo})
+	}, []string{metricLabelTo, metricLabelZone})
 	RcodeCount = promauto.NewCounterVec(prometheus.CounterOpts{
 		Namespace: plugin.Namespace,
 		Subsystem: pluginName,
 		Name:      "response_rcode_count_total",
 		Help:      requestCountHelp,
-	}, []string{"rcode", metricLabelTo})
+	}, []string{"rcode", metricLabelTo, metricLabelZone})
 	RequestDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
 		Namespace: plugin.Namespace,
 		Subsystem: pluginName,
 		Name:      "request_duration_seconds",
 		Buckets:   plugin.TimeBuckets,
-		Help:      "Histogram of the time each request took.",
+		Help:      "Histogram of the time each request took, by protocol and rcode of the response.",
+	}, []string{metricLabelTo, "proto", "rcode", metricLabelZone})
+	UpstreamHealthy = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: pluginName,
+		Name:      "upstream_healthy",
+		Help:      "Gauge set to 1 once the upstream has answered a health probe.",
+	}, []string{metricLabelTo})
+	BufferPoolGets = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: pluginName,
+		Name:      "buffer_pool_gets_total",
+		Help:      "Counter of message buffers taken from the buffer pool.",
+	})
+	BufferPoolMisses = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: pluginName,
+		Name:      "buffer_pool_misses_total",
+		Help:      "Counter of message buffers allocated because the buffer pool was empty.",
+	})
+	InsecureFallbackCount = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: pluginName,
+		Name:      "insecure_fallback_total",
+		Help:      "Counter of requests sent to plaintext upstreams because every encrypted upstream failed.",
+	})
+	ClientLimitedCount = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: pluginName,
+		Name:      "client_limited_total",
+		Help:      "Counter of requests rejected because their client had max-concurrent-per-client requests in flight.",
+	})
+	ValidationFailureCount = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: pluginName,
+		Name:      "validation_failures_total",
+		Help:      "Counter of upstream responses failing a validate check.",
+	}, []string{"check", metricLabelTo})
+	StaleConnCount = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: pluginName,
+		Name:      "stale_connections_total",
+		Help:      "Counter of pooled connections evicted because the upstream closed them or stopped answering pings.",
+	}, []string{metricLabelTo})
+	DnstapFileDropCount = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: pluginName,
+		Name:      "dnstap_file_dropped_total",
+		Help:      "Counter of dnstap messages dropped because the dnstap-file writer was behind.",
+	})
+	CacheHitCount = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: pluginName,
+		Name:      "cache_hits_total",
+		Help:      "Counter of queries answered from the response cache, by tier.",
+	}, []string{"tier"})
+	CacheMissCount = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: pluginName,
+		Name:      "cache_misses_total",
+		Help:      "Counter of queries sent to the upstreams because the response cache had no answer.",
+	})
+	ServfailCacheHitCount = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: pluginName,
+		Name:      "servfail_cache_hits_total",
+		Help:      "Counter of queries failed without querying the upstreams because their question failed recently.",
+	})
+	HopLimitCount = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: pluginName,
+		Name:      "hop_limit_exceeded_total",
+		Help:      "Counter of queries failed because they already did the maximum number of hops.",
+	})
+	ShadowAgreementCount = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: pluginName,
+		Name:      "shadow_responses_total",
+		Help:      "Counter of shadow upstream responses by agreement with the response served to the client.",
+	}, []string{metricLabelTo, "result"})
+	UpstreamDedupCount = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: pluginName,
+		Name:      "upstream_dedup_total",
+		Help:      "Counter of queries answered by an identical request in flight to the same upstream.",
+	}, []string{metricLabelTo})
+	RejectedCount = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: pluginName,
+		Name:      "rejected_total",
+		Help:      "Counter of requests rejected because max-concurrent requests were in flight and the queue was full.",
+	})
+	ClientGoneCount = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: pluginName,
+		Name:      "client_gone_total",
+		Help:      "Counter of requests whose client went away before they could be answered.",
+	})
+	UpstreamCanaryDivergent = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: pluginName,
+		Name:      "upstream_canary_divergent",
+		Help:      "Gauge set to 1 while the upstream answers a canary query with unexpected records.",
+	}, []string{metricLabelTo, "name", "type"})
+	UpstreamDown = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: pluginName,
+		Name:      "upstream_down",
+		Help:      "Gauge set to 1 while the failures of the upstream exceed its error-budget over the sliding window, 0 otherwise.",
+	}, []string{metricLabelTo})
+	UpstreamSLOViolation = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: pluginName,
+		Name:      "upstream_slo_violation",
+		Help:      "Gauge set to 1 while the upstream misses its latency-slo over the sliding window, 0 otherwise.",
+	}, []string{metricLabelTo})
+	UpstreamBootstrapDuration = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: pluginName,
+		Name:      "upstream_bootstrap_seconds",
+		Help:      "Gauge of the time from the first attempt to the first successful response of the upstream after the last startup or reload.",
 	}, []string{metricLabelTo})
 )
+
+// observeRequest records a request to the upstream to over the protocol proto, started at start and
+// answered with ret or failed with err. Requests abandoned because ctx is done are not observed, as they
+// are canceled once another upstream has answered.
+func observeRequest(ctx context.Context, to, proto string, ret *dns.Msg, err error, start time.Time) {
+	recordProto(ctx, proto)
+	rc := rcodeError
+	zone := zoneFrom(ctx)
+	if err == nil {
+		rc = rcodeLabel(ret.Rcode)
+		RequestCount.WithLabelValues(to, zone).Add(1)
+		RcodeCount.WithLabelValues(rc, to, zone).Add(1)
+	} else if ctx.Err() != nil {
+		return
+	}
+	observeWithTrace(ctx, RequestDuration.WithLabelValues(to, proto, rc, zone), time.Since(start).Seconds())
+}
+
+type zoneKey struct{}
+
+// withZone returns a context carrying the zone of the fanout block a request is made for, the `from` of
+// its configuration, which labels the request metrics. The label stays bounded by the configured zones,
+// query names never end up in it.
+func withZone(ctx context.Context, zone string) context.Context {
+	return context.WithValue(ctx, zoneKey{}, zone)
+}
+
+// zoneFrom returns the zone of the request made with ctx, empty for requests originated by the plugin
+// such as health probes.
+func zoneFrom(ctx context.Context) string {
+	zone, _ := ctx.Value(zoneKey{}).(string)
+	return zone
+}
+
+// rcodeLabel returns the name of rcode, or its number when it has none.
+func rcodeLabel(rcode int) string {
+	if rc, ok := dns.RcodeToString[rcode]; ok {
+		return rc
+	}
+	return strconv.Itoa(rcode)
+}
+
+// protoLabel returns the protocol label of a request over network, udp-tcp when a truncated UDP response
+// made it fall back to TCP.
+func protoLabel(network string, fellBack bool) string {
+	switch {
+	case fellBack:
+		return protoUDPTCP
+	case network == TCPTLS:
+		return protoTLS
+	}
+	return network
+}
+
+// observeWithTrace observes v, attaching the trace ID of the span in ctx as an exemplar when tracing is active.
+func observeWithTrace(ctx context.Context, o prometheus.Observer, v float64) {
+	id := traceID(ctx)
+	eo, ok := o.(prometheus.ExemplarObserver)
+	if id == "" || !ok {
+		o.Observe(v)
+		return
+	}
+	eo.ObserveWithExemplar(v, prometheus.Labels{exemplarTraceID: id})
+}
+
+// traceID extracts the trace ID of the span in ctx by injecting its context into a text map carrier.
+// Common tracers use keys like x-b3-traceid, uber-trace-id or x-datadog-trace-id.
+func traceID(ctx context.Context) string {
+	span := ot.SpanFromContext(ctx)
+	if span == nil {
+		return ""
+	}
+	carrier := ot.TextMapCarrier{}
+	if err := span.Tracer().Inject(span.Context(), ot.TextMap, carrier); err != nil {
+		return ""
+	}
+	for k, v := range carrier {
+		k = strings.ToLower(k)
+		if strings.HasSuffix(k, "traceid") || strings.HasSuffix(k, "trace-id") {
+			// uber-trace-id is formatted as trace-id:span-id:parent-id:flags
+			id, _, _ := strings.Cut(v, ":")
+			return id
+		}
+	}
+	return ""
+}
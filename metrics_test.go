@@ -0,0 +1,95 @@
+// Copyright (c) 2024 MWS and/or its affiliates.
+//
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at:
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fanout
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/coredns/caddy"
+	"github.com/coredns/coredns/plugin/test"
+	"github.com/miekg/dns"
+	ot "github.com/opentracing/opentracing-go"
+	"github.com/opentracing/opentracing-go/mocktracer"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/stretchr/testify/require"
+)
+
+func TestObserveWithTraceAttachesExemplar(t *testing.T) {
+	h := prometheus.NewHistogram(prometheus.HistogramOpts{Name: "test_duration_seconds", Buckets: []float64{1}})
+	tracer := mocktracer.New()
+	span := tracer.StartSpan("request")
+	ctx := ot.ContextWithSpan(context.Background(), span)
+
+	observeWithTrace(ctx, h, 0.5)
+	observeWithTrace(context.Background(), h, 2)
+
+	var m dto.Metric
+	require.NoError(t, h.Write(&m))
+	require.Equal(t, uint64(2), m.GetHistogram().GetSampleCount())
+	exemplar := m.GetHistogram().GetBucket()[0].GetExemplar()
+	require.NotNil(t, exemplar)
+	require.Equal(t, exemplarTraceID, exemplar.GetLabel()[0].GetName())
+	require.NotEmpty(t, exemplar.GetLabel()[0].GetValue())
+	require.Equal(t, traceID(ctx), exemplar.GetLabel()[0].GetValue())
+}
+
+func sampleCount(t *testing.T, o prometheus.Observer) uint64 {
+	var m dto.Metric
+	require.NoError(t, o.(prometheus.Histogram).Write(&m))
+	return m.GetHistogram().GetSampleCount()
+}
+
+func TestObserveRequestLabels(t *testing.T) {
+	const to = "203.0.113.9:53"
+	nxdomain := new(dns.Msg)
+	nxdomain.Rcode = dns.RcodeNameError
+	observeRequest(withZone(context.Background(), "example.org."), to, protoLabel(UDP, true), nxdomain, nil, time.Now())
+	observeRequest(context.Background(), to, protoLabel(TCPTLS, false), nil, errors.New("reset"), time.Now())
+	canceled, cancel := context.WithCancel(context.Background())
+	cancel()
+	observeRequest(canceled, to, protoLabel(TCPTLS, false), nil, context.Canceled, time.Now())
+
+	require.Equal(t, uint64(1), sampleCount(t, RequestDuration.WithLabelValues(to, protoUDPTCP, "NXDOMAIN", "example.org.")))
+	require.Equal(t, uint64(1), sampleCount(t, RequestDuration.WithLabelValues(to, protoTLS, rcodeError, "")),
+		"requests abandoned by the fanout aren't observed")
+	require.Equal(t, "4095", rcodeLabel(4095))
+}
+
+func TestRequestMetricsZone(t *testing.T) {
+	s := newServer(UDP, func(w dns.ResponseWriter, r *dns.Msg) {
+		msg := new(dns.Msg)
+		msg.SetReply(r)
+		logErrIfNotNil(w.WriteMsg(msg))
+	})
+	defer s.close()
+	fs, err := parseFanout(caddy.NewTestController("dns", "fanout example.org. "+s.addr+"\nfanout example.com. "+s.addr))
+	require.NoError(t, err)
+	for _, f := range fs {
+		before := testutil.ToFloat64(RequestCount.WithLabelValues(s.addr, f.From))
+		req := new(dns.Msg)
+		req.SetQuestion("www."+f.From, dns.TypeA)
+		_, err = f.ServeDNS(context.Background(), &test.ResponseWriter{}, req)
+		require.NoError(t, err)
+		require.Equal(t, before+1, testutil.ToFloat64(RequestCount.WithLabelValues(s.addr, f.From)),
+			"requests are attributed to the zone of their fanout block")
+	}
+}
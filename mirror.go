@@ -0,0 +1,116 @@
+// Copyright (c) 2024 MWS and/or its affiliates.
+//
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at:
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fanout
+
+import (
+	"context"
+	"net"
+
+	"github.com/coredns/coredns/request"
+	"github.com/miekg/dns"
+)
+
+// mirror sends the request to every upstream of the request and returns the answer of the primary
+// upstream, the first non-draining one in the configured order. The other upstreams are queried in the
+// background, outliving the request, and their responses are only logged and sent to dnstap.
+func (f *Fanout) mirror(ctx context.Context, req *request.Request) *response {
+	clients, _, _ := f.route(req)
+	var primary Client
+	for _, c := range clients {
+		if !f.IsDraining(c.Endpoint()) {
+			primary = c
+			break
+		}
+	}
+	if primary == nil {
+		return nil
+	}
+	mirrorCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), f.Timeout)
+	pending := len(clients) - 1
+	done := make(chan struct{}, pending)
+	mirrored := detach(req)
+	for _, c := range clients {
+		if c == primary {
+			continue
+		}
+		go func() {
+			defer func() { done <- struct{}{} }()
+			f.mirrorClient(mirrorCtx, c, mirrored)
+		}()
+	}
+	go func() {
+		for range pending {
+			<-done
+		}
+		cancel()
+	}()
+
+	return f.processClient(ctx, primary, &request.Request{W: req.W, Req: req.Req})
+}
+
+// mirrorClient queries a mirrored upstream and records its response.
+func (f *Fanout) mirrorClient(ctx context.Context, c Client, req *request.Request) {
+	req = &request.Request{W: req.W, Req: req.Req}
+	r := f.processClient(ctx, c, req)
+	if r.err != nil {
+		log.Debugf("mirror %s %s: %s: %v", req.Name(), req.Type(), c.Endpoint(), r.err)
+		return
+	}
+	log.Debugf("mirror %s %s: %s: %s with %d answers", req.Name(), req.Type(), c.Endpoint(),
+		dns.RcodeToString[r.response.Rcode], len(r.response.Answer))
+	f.toDnstap(r, req)
+}
+
+// mirrorQuery asynchronously sends a copy of the request to every mirror-to upstream. Their responses are
+// never used, they are only logged and sent to dnstap.
+func (f *Fanout) mirrorQuery(req *request.Request) {
+	if len(f.mirrorClients) == 0 {
+		return
+	}
+	mirrored := detach(req)
+	for _, c := range f.mirrorClients {
+		go func() {
+			ctx, cancel := context.WithTimeout(withZone(context.Background(), f.From), f.Timeout)
+			defer cancel()
+			f.mirrorClient(ctx, c, mirrored)
+		}()
+	}
+}
+
+// detach returns a copy of req for the queries outliving it: the server may reuse the message and the
+// writer once the request is served, so the message is copied and the writer only keeps the addresses.
+// The copy is shared, every goroutine using it makes its own request.Request of it.
+func detach(req *request.Request) *request.Request {
+	w := detachedWriter{local: req.W.LocalAddr(), remote: req.W.RemoteAddr()}
+	return &request.Request{W: w, Req: req.Req.Copy()}
+}
+
+// detachedWriter is the response writer of detached requests, which are never answered.
+type detachedWriter struct {
+	dns.ResponseWriter
+	local, remote net.Addr
+}
+
+// LocalAddr returns the local address of the detached request.
+func (w detachedWriter) LocalAddr() net.Addr {
+	return w.local
+}
+
+// RemoteAddr returns the client address of the detached request.
+func (w detachedWriter) RemoteAddr() net.Addr {
+	return w.remote
+}
@@ -0,0 +1,109 @@
+// Copyright (c) 2024 MWS and/or its affiliates.
+//
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at:
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fanout
+
+import (
+	"context"
+	"fmt"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/coredns/caddy"
+	"github.com/coredns/coredns/plugin/test"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMirrorModeReturnsPrimaryAnswer(t *testing.T) {
+	primary := newServer(UDP, func(w dns.ResponseWriter, r *dns.Msg) {
+		msg := new(dns.Msg)
+		msg.SetRcode(r, dns.RcodeNameError)
+		logErrIfNotNil(w.WriteMsg(msg))
+	})
+	defer primary.close()
+	var mirrored atomic.Int32
+	mirror := newServer(UDP, func(w dns.ResponseWriter, r *dns.Msg) {
+		time.Sleep(300 * time.Millisecond)
+		mirrored.Add(1)
+		msg := dns.Msg{Answer: []dns.RR{makeRecordA("example1. 3600 IN A 10.0.0.1")}}
+		msg.SetReply(r)
+		logErrIfNotNil(w.WriteMsg(&msg))
+	})
+	defer mirror.close()
+
+	input := fmt.Sprintf("fanout . %s %s {\nmode mirror\nrace\n}", primary.addr, mirror.addr)
+	fs, err := parseFanout(caddy.NewTestController("dns", input))
+	require.NoError(t, err)
+	f := fs[0]
+
+	req := new(dns.Msg)
+	req.SetQuestion(testQuery, dns.TypeA)
+	writer := &cachedDNSWriter{ResponseWriter: new(test.ResponseWriter)}
+	// the registry outlives the test servers, an earlier one may have had the same address
+	before := f.statsFor(mirror.addr).snapshot().Requests
+	start := time.Now()
+	_, err = f.ServeDNS(context.Background(), writer, req)
+	require.NoError(t, err)
+	require.Less(t, time.Since(start), 300*time.Millisecond)
+	require.Len(t, writer.answers, 1)
+	require.Equal(t, dns.RcodeNameError, writer.answers[0].Rcode)
+	require.Eventually(t, func() bool {
+		return mirrored.Load() == 1 && f.statsFor(mirror.addr).snapshot().Requests == before+1
+	}, time.Second, 10*time.Millisecond)
+}
+
+func TestMirrorToReceivesCopyOfQueries(t *testing.T) {
+	upstream := newServer(UDP, func(w dns.ResponseWriter, r *dns.Msg) {
+		msg := dns.Msg{Answer: []dns.RR{makeRecordA("example1. 3600 IN A 10.0.0.1")}}
+		msg.SetReply(r)
+		logErrIfNotNil(w.WriteMsg(&msg))
+	})
+	defer upstream.close()
+	mirrored := make(chan string, 1)
+	tap := newServer(UDP, func(w dns.ResponseWriter, r *dns.Msg) {
+		mirrored <- r.Question[0].Name
+		msg := new(dns.Msg)
+		msg.SetRcode(r, dns.RcodeRefused)
+		logErrIfNotNil(w.WriteMsg(msg))
+	})
+	defer tap.close()
+
+	input := fmt.Sprintf("fanout . %s {\nmirror-to %s\n}", upstream.addr, tap.addr)
+	fs, err := parseFanout(caddy.NewTestController("dns", input))
+	require.NoError(t, err)
+	f := fs[0]
+	require.Len(t, f.clients, 1)
+	require.Len(t, f.mirrorClients, 1)
+
+	req := new(dns.Msg)
+	req.SetQuestion(testQuery, dns.TypeA)
+	writer := &cachedDNSWriter{ResponseWriter: new(test.ResponseWriter)}
+	_, err = f.ServeDNS(context.Background(), writer, req)
+	require.NoError(t, err)
+	require.Len(t, writer.answers, 1)
+	require.Equal(t, dns.RcodeSuccess, writer.answers[0].Rcode)
+	select {
+	case name := <-mirrored:
+		require.Equal(t, testQuery, name)
+	case <-time.After(time.Second):
+		require.Fail(t, "mirror-to upstream was not queried")
+	}
+
+	_, err = parseFanout(caddy.NewTestController("dns", "fanout . 127.0.0.1 {\nmirror-to\n}"))
+	require.ErrorContains(t, err, "Wrong argument count")
+}
@@ -0,0 +1,398 @@
+// Copyright (c) 2024 MWS and/or its affiliates.
+//
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at:
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fanout
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hkdf"
+	"crypto/hpke"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/tls"
+	"encoding/binary"
+	"hash"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/coredns/coredns/request"
+	"github.com/miekg/dns"
+	"github.com/pkg/errors"
+)
+
+// odohConfig is a target public key configuration as published at /.well-known/odohconfigs (RFC 9230).
+type odohConfig struct {
+	pk      hpke.PublicKey
+	kdf     hpke.KDF
+	aead    hpke.AEAD
+	hash    func() hash.Hash
+	keySize int
+	keyID   []byte
+	fetched time.Time
+}
+
+// odohClient is a Client sending Oblivious DoH (RFC 9230) requests to a target through a relay, so that
+// the relay sees who asks but not what, and the target sees what is asked but not by whom.
+type odohClient struct {
+	target    string
+	relay     string
+	configURL string
+	hc        *http.Client
+
+	mu     sync.Mutex
+	config *odohConfig
+}
+
+func isODoH(host string) bool {
+	return strings.HasPrefix(host, odohScheme)
+}
+
+func newODoHClient(target, relay string) *odohClient {
+	c := &odohClient{
+		target:    target,
+		relay:     relay,
+		configURL: dohScheme + odohTargetHost(target) + odohConfigPath,
+	}
+	c.SetTLSConfig(nil)
+	return c
+}
+
+func odohTargetHost(target string) string {
+	host, _, _ := strings.Cut(strings.TrimPrefix(target, odohScheme), "/")
+	return host
+}
+
+func odohTargetPath(target string) string {
+	_, path, _ := strings.Cut(strings.TrimPrefix(target, odohScheme), "/")
+	return "/" + path
+}
+
+// SetTLSConfig sets the TLS configuration of the connections to the relay and to the target.
+func (c *odohClient) SetTLSConfig(cfg *tls.Config) {
+	if cfg == nil {
+		cfg = new(tls.Config)
+	}
+	cfg = cfg.Clone()
+	// the relay and the target are different hosts, so the name to verify comes from each URL
+	cfg.ServerName = ""
+	c.hc = &http.Client{Transport: &http.Transport{
+		TLSClientConfig:     cfg,
+		ForceAttemptHTTP2:   true,
+		IdleConnTimeout:     connExpire,
+		MaxIdleConnsPerHost: maxPooledConns,
+		TLSHandshakeTimeout: maxTimeout,
+	}}
+}
+
+// Net returns the network type of the client.
+func (c *odohClient) Net() string {
+	return ODOH
+}
+
+// Endpoint returns the URL of the target.
+func (c *odohClient) Endpoint() string {
+	return c.target
+}
+
+// Request encrypts the request to the target key and sends it through the relay. When the target
+// rejects the query or its response can't be decrypted, the target keys are fetched again and the
+// query is retried once, since the target has most likely rotated them.
+func (c *odohClient) Request(ctx context.Context, r *request.Request) (*dns.Msg, error) {
+	start := time.Now()
+	query, err := hopped(ctx, r.Req).Pack()
+	if err != nil {
+		return nil, err
+	}
+	query[0], query[1] = 0, 0
+	config, err := c.targetConfig(ctx, false)
+	if err != nil {
+		return nil, err
+	}
+	ret, err := c.exchange(ctx, config, query)
+	if err != nil && ctx.Err() == nil {
+		log.Debugf("refetching keys of %s: %v", c.target, err)
+		if config, err = c.targetConfig(ctx, true); err != nil {
+			return nil, err
+		}
+		ret, err = c.exchange(ctx, config, query)
+	}
+	observeRequest(ctx, c.target, protoHTTPS, ret, err, start)
+	if err != nil {
+		return nil, err
+	}
+	ret.Id = r.Req.Id
+	return ret, nil
+}
+
+// targetConfig returns the cached target config, fetching it when missing, expired or when refresh is set.
+func (c *odohClient) targetConfig(ctx context.Context, refresh bool) (*odohConfig, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !refresh && c.config != nil && time.Since(c.config.fetched) < odohConfigTTL {
+		return c.config, nil
+	}
+	data, err := c.get(ctx, c.configURL)
+	if err != nil {
+		return nil, err
+	}
+	config, err := parseODoHConfigs(data)
+	if err != nil {
+		return nil, errors.Wrapf(err, "invalid configs from %s", c.configURL)
+	}
+	config.fetched = time.Now()
+	c.config = config
+	return config, nil
+}
+
+func (c *odohClient) exchange(ctx context.Context, config *odohConfig, query []byte) (*dns.Msg, error) {
+	plain := odohAppend(odohAppend(nil, query), make([]byte, odohPadding(len(query))))
+	enc, sender, err := hpke.NewSender(config.pk, config.kdf, config.aead, []byte("odoh query"))
+	if err != nil {
+		return nil, err
+	}
+	aad := odohAppend([]byte{odohQueryType}, config.keyID)
+	ct, err := sender.Seal(aad, plain)
+	if err != nil {
+		return nil, err
+	}
+	data, err := c.post(ctx, odohAppend(aad, append(enc, ct...)))
+	if err != nil {
+		return nil, err
+	}
+	secret, err := sender.Export("odoh response", config.keySize)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := openODoHResponse(config, secret, plain, data)
+	if err != nil {
+		return nil, err
+	}
+	ret := new(dns.Msg)
+	if err := ret.Unpack(resp); err != nil {
+		return nil, err
+	}
+	return ret, nil
+}
+
+func (c *odohClient) post(ctx context.Context, body []byte) ([]byte, error) {
+	u, err := url.Parse(c.relay)
+	if err != nil {
+		return nil, err
+	}
+	q := u.Query()
+	q.Set("targethost", odohTargetHost(c.target))
+	q.Set("targetpath", odohTargetPath(c.target))
+	u.RawQuery = q.Encode()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, u.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", odohMediaType)
+	req.Header.Set("Accept", odohMediaType)
+	return c.do(req)
+}
+
+func (c *odohClient) get(ctx context.Context, u string) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, http.NoBody)
+	if err != nil {
+		return nil, err
+	}
+	return c.do(req)
+}
+
+func (c *odohClient) do(req *http.Request) ([]byte, error) {
+	resp, err := c.hc.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = resp.Body.Close() }()
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.Errorf("unexpected status %q from %s", resp.Status, req.URL.Host)
+	}
+	return io.ReadAll(io.LimitReader(resp.Body, dns.MaxMsgSize))
+}
+
+// closeIdle closes the idle HTTPS connections.
+func (c *odohClient) closeIdle() {
+	c.hc.CloseIdleConnections()
+}
+
+// parseODoHConfigs returns the first config of a supported version and cipher suite.
+func parseODoHConfigs(data []byte) (*odohConfig, error) {
+	configs, ok := odohString(&data)
+	if !ok || len(data) != 0 {
+		return nil, errors.New("malformed config list")
+	}
+	for len(configs) > 0 {
+		if len(configs) < 2 {
+			return nil, errors.New("malformed config")
+		}
+		version := binary.BigEndian.Uint16(configs)
+		configs = configs[2:]
+		contents, ok := odohString(&configs)
+		if !ok {
+			return nil, errors.New("malformed config")
+		}
+		if version != odohVersion {
+			continue
+		}
+		if config, err := newODoHConfig(contents); err == nil {
+			return config, nil
+		}
+	}
+	return nil, errors.New("no supported config")
+}
+
+func newODoHConfig(contents []byte) (*odohConfig, error) {
+	rest := contents
+	if len(rest) < 6 {
+		return nil, errors.New("malformed config contents")
+	}
+	kemID, kdfID, aeadID := binary.BigEndian.Uint16(rest), binary.BigEndian.Uint16(rest[2:]), binary.BigEndian.Uint16(rest[4:])
+	rest = rest[6:]
+	key, ok := odohString(&rest)
+	if !ok || len(rest) != 0 {
+		return nil, errors.New("malformed config contents")
+	}
+	kem, err := hpke.NewKEM(kemID)
+	if err != nil {
+		return nil, err
+	}
+	pk, err := kem.NewPublicKey(key)
+	if err != nil {
+		return nil, err
+	}
+	config := &odohConfig{pk: pk}
+	if config.kdf, err = hpke.NewKDF(kdfID); err != nil {
+		return nil, err
+	}
+	switch kdfID {
+	case 0x0001:
+		config.hash = sha256.New
+	case 0x0002:
+		config.hash = sha512.New384
+	case 0x0003:
+		config.hash = sha512.New
+	default:
+		return nil, errors.Errorf("unsupported KDF %#04x", kdfID)
+	}
+	// the response is sealed outside of HPKE, so only the AEADs the standard library provides are supported
+	switch aeadID {
+	case 0x0001:
+		config.keySize = 16
+	case 0x0002:
+		config.keySize = 32
+	default:
+		return nil, errors.Errorf("unsupported AEAD %#04x", aeadID)
+	}
+	if config.aead, err = hpke.NewAEAD(aeadID); err != nil {
+		return nil, err
+	}
+	prk, err := hkdf.Extract(config.hash, contents, nil)
+	if err != nil {
+		return nil, err
+	}
+	if config.keyID, err = hkdf.Expand(config.hash, prk, "odoh key id", config.hash().Size()); err != nil {
+		return nil, err
+	}
+	return config, nil
+}
+
+// openODoHResponse decrypts an ObliviousDoHMessage response with the keys derived from the query context.
+func openODoHResponse(config *odohConfig, secret, plain, data []byte) ([]byte, error) {
+	if len(data) < 1 || data[0] != odohResponseType {
+		return nil, errors.New("unexpected message type")
+	}
+	rest := data[1:]
+	nonce, ok := odohString(&rest)
+	if !ok {
+		return nil, errors.New("malformed response")
+	}
+	ct, ok := odohString(&rest)
+	if !ok || len(rest) != 0 {
+		return nil, errors.New("malformed response")
+	}
+	gcm, aeadNonce, err := odohResponseCipher(config, secret, plain, nonce)
+	if err != nil {
+		return nil, err
+	}
+	pt, err := gcm.Open(nil, aeadNonce, ct, odohAppend([]byte{odohResponseType}, nonce))
+	if err != nil {
+		return nil, err
+	}
+	resp, ok := odohString(&pt)
+	if !ok {
+		return nil, errors.New("malformed response plaintext")
+	}
+	return resp, nil
+}
+
+// odohResponseCipher derives the response key and nonce from the exported query secret (RFC 9230 section 6.4).
+func odohResponseCipher(config *odohConfig, secret, plain, nonce []byte) (cipher.AEAD, []byte, error) {
+	prk, err := hkdf.Extract(config.hash, secret, odohAppend(plain, nonce))
+	if err != nil {
+		return nil, nil, err
+	}
+	key, err := hkdf.Expand(config.hash, prk, "odoh key", config.keySize)
+	if err != nil {
+		return nil, nil, err
+	}
+	aeadNonce, err := hkdf.Expand(config.hash, prk, "odoh nonce", odohNonceSize)
+	if err != nil {
+		return nil, nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, nil, err
+	}
+	return gcm, aeadNonce, nil
+}
+
+// odohPadding returns the padding length bringing the query to a multiple of odohPaddingBlock bytes.
+func odohPadding(n int) int {
+	return (odohPaddingBlock - n%odohPaddingBlock) % odohPaddingBlock
+}
+
+// odohAppend appends b to dst prefixed with its two byte length.
+func odohAppend(dst, b []byte) []byte {
+	dst = binary.BigEndian.AppendUint16(dst, uint16(len(b)))
+	return append(dst, b...)
+}
+
+// odohString consumes a two byte length prefixed value from data.
+func odohString(data *[]byte) ([]byte, bool) {
+	if len(*data) < 2 {
+		return nil, false
+	}
+	n := int(binary.BigEndian.Uint16(*data))
+	if len(*data) < 2+n {
+		return nil, false
+	}
+	b := (*data)[2 : 2+n]
+	*data = (*data)[2+n:]
+	return b, true
+}
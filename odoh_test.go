@@ -0,0 +1,182 @@
+// Copyright (c) 2024 MWS and/or its affiliates.
+//
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at:
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fanout
+
+import (
+	"bytes"
+	"crypto/ecdh"
+	"crypto/hpke"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/binary"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/coredns/caddy"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+)
+
+// odohTarget is a minimal RFC 9230 target answering every query with an A record.
+type odohTarget struct {
+	t       *testing.T
+	mu      sync.Mutex
+	key     hpke.PrivateKey
+	configs []byte
+	config  *odohConfig
+	fetches atomic.Int32
+}
+
+func (o *odohTarget) rotate() {
+	key, err := hpke.DHKEM(ecdh.X25519()).GenerateKey()
+	require.NoError(o.t, err)
+	pk := key.PublicKey().Bytes()
+	contents := binary.BigEndian.AppendUint16(nil, key.KEM().ID())
+	contents = binary.BigEndian.AppendUint16(contents, hpke.HKDFSHA256().ID())
+	contents = binary.BigEndian.AppendUint16(contents, hpke.AES128GCM().ID())
+	contents = odohAppend(contents, pk)
+	config, err := newODoHConfig(contents)
+	require.NoError(o.t, err)
+	// an unsupported version first, which the client has to skip
+	configs := odohAppend(binary.BigEndian.AppendUint16(nil, 0xff00), []byte{1, 2, 3})
+	configs = append(binary.BigEndian.AppendUint16(configs, odohVersion), odohAppend(nil, contents)...)
+
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.key, o.config, o.configs = key, config, odohAppend(nil, configs)
+}
+
+func (o *odohTarget) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	o.mu.Lock()
+	key, config, configs := o.key, o.config, o.configs
+	o.mu.Unlock()
+	if r.URL.Path == odohConfigPath {
+		o.fetches.Add(1)
+		_, _ = w.Write(configs)
+		return
+	}
+	require.Equal(o.t, odohMediaType, r.Header.Get("Content-Type"))
+	body, err := io.ReadAll(r.Body)
+	require.NoError(o.t, err)
+	require.Equal(o.t, byte(odohQueryType), body[0])
+	rest := body[1:]
+	keyID, _ := odohString(&rest)
+	if !bytes.Equal(keyID, config.keyID) {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	sealed, _ := odohString(&rest)
+	const encSize = 32
+	recipient, err := hpke.NewRecipient(sealed[:encSize], key, config.kdf, config.aead, []byte("odoh query"))
+	require.NoError(o.t, err)
+	plain, err := recipient.Open(odohAppend([]byte{odohQueryType}, keyID), sealed[encSize:])
+	require.NoError(o.t, err)
+	query := plain
+	q, _ := odohString(&query)
+	req := new(dns.Msg)
+	require.NoError(o.t, req.Unpack(q))
+	require.Zero(o.t, req.Id)
+	require.Zero(o.t, (len(plain)-4)%odohPaddingBlock)
+
+	msg := dns.Msg{Answer: []dns.RR{makeRecordA("example1. 3600 IN A 10.0.0.1")}}
+	msg.SetReply(req)
+	out, err := msg.Pack()
+	require.NoError(o.t, err)
+	secret, err := recipient.Export("odoh response", config.keySize)
+	require.NoError(o.t, err)
+	nonce := make([]byte, config.keySize)
+	_, _ = rand.Read(nonce)
+	gcm, aeadNonce, err := odohResponseCipher(config, secret, plain, nonce)
+	require.NoError(o.t, err)
+	ct := gcm.Seal(nil, aeadNonce, odohAppend(odohAppend(nil, out), nil), odohAppend([]byte{odohResponseType}, nonce))
+	w.Header().Set("Content-Type", odohMediaType)
+	_, _ = w.Write(odohAppend(odohAppend([]byte{odohResponseType}, nonce), ct))
+}
+
+// newODoHServers starts a target and a relay forwarding the queries to it.
+func newODoHServers(t *testing.T) (target *odohTarget, targetServer, relay *httptest.Server, relayed *atomic.Int32) {
+	target = &odohTarget{t: t}
+	target.rotate()
+	targetServer = httptest.NewTLSServer(target)
+	relayed = new(atomic.Int32)
+	relay = httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		relayed.Add(1)
+		u := "https://" + r.URL.Query().Get("targethost") + r.URL.Query().Get("targetpath")
+		req, err := http.NewRequestWithContext(r.Context(), http.MethodPost, u, r.Body)
+		require.NoError(t, err)
+		req.Header.Set("Content-Type", r.Header.Get("Content-Type"))
+		resp, err := targetServer.Client().Do(req)
+		require.NoError(t, err)
+		defer func() { _ = resp.Body.Close() }()
+		w.WriteHeader(resp.StatusCode)
+		_, _ = io.Copy(w, resp.Body)
+	}))
+	return target, targetServer, relay, relayed
+}
+
+func TestODoHClient(t *testing.T) {
+	target, targetServer, relay, relayed := newODoHServers(t)
+	defer targetServer.Close()
+	defer relay.Close()
+
+	c := newODoHClient(odohScheme+strings.TrimPrefix(targetServer.URL, dohScheme)+"/dns-query", relay.URL+"/proxy")
+	c.SetTLSConfig(&tls.Config{RootCAs: targetServer.Client().Transport.(*http.Transport).TLSClientConfig.RootCAs})
+	defer c.closeIdle()
+
+	dohRequest(t, c)
+	dohRequest(t, c)
+	require.Equal(t, int32(2), relayed.Load())
+	require.Equal(t, int32(1), target.fetches.Load(), "target keys are cached")
+
+	target.rotate()
+	dohRequest(t, c)
+	require.Equal(t, int32(2), target.fetches.Load(), "target keys are refetched after a rotation")
+	require.Equal(t, int32(4), relayed.Load())
+}
+
+func TestParseODoHConfigs(t *testing.T) {
+	_, err := parseODoHConfigs([]byte{0, 5, 1})
+	require.Error(t, err)
+
+	contents := binary.BigEndian.AppendUint16(nil, 0x0020)
+	contents = binary.BigEndian.AppendUint16(contents, 0x0001)
+	contents = binary.BigEndian.AppendUint16(contents, 0x0003)
+	contents = odohAppend(contents, make([]byte, 32))
+	configs := append(binary.BigEndian.AppendUint16(nil, odohVersion), odohAppend(nil, contents)...)
+	_, err = parseODoHConfigs(odohAppend(nil, configs))
+	require.ErrorContains(t, err, "no supported config")
+}
+
+func TestSetupODoHUpstream(t *testing.T) {
+	fs, err := parseFanout(caddy.NewTestController("dns", "fanout . odoh://odoh.example/dns-query {\nodoh-relay https://relay.example/proxy\n}"))
+	require.NoError(t, err)
+	c, ok := fs[0].clients[0].(*odohClient)
+	require.True(t, ok)
+	require.Equal(t, ODOH, c.Net())
+	require.Equal(t, "odoh://odoh.example/dns-query", c.Endpoint())
+	require.Equal(t, "https://odoh.example/.well-known/odohconfigs", c.configURL)
+
+	_, err = parseFanout(caddy.NewTestController("dns", "fanout . odoh://odoh.example/dns-query"))
+	require.ErrorContains(t, err, "odoh-relay is required")
+	_, err = parseFanout(caddy.NewTestController("dns", "fanout . 127.0.0.1 {\nodoh-relay relay.example\n}"))
+	require.ErrorContains(t, err, "invalid odoh-relay")
+}
@@ -0,0 +1,182 @@
+// Copyright (c) 2024 MWS and/or its affiliates.
+//
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at:
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fanout
+
+import (
+	"context"
+	"strings"
+
+	"github.com/coredns/caddy/caddyfile"
+	"github.com/coredns/coredns/plugin"
+	"github.com/coredns/coredns/plugin/pkg/nonwriter"
+	"github.com/coredns/coredns/plugin/pkg/transport"
+	"github.com/coredns/coredns/request"
+	"github.com/miekg/dns"
+	"github.com/pkg/errors"
+)
+
+// opcodeRoute is how messages of an opcode other than QUERY are handled: answered with rcode, passed to
+// the next plugin, passed through to client, or forwarded to the update primary.
+type opcodeRoute struct {
+	rcode   int
+	next    bool
+	client  Client
+	primary *updatePrimary
+}
+
+// parseOpcode parses `opcode OPCODE... refuse|notimp|next|ADDR`.
+func parseOpcode(f *Fanout, c *caddyfile.Dispenser) error {
+	args := c.RemainingArgs()
+	if len(args) < 2 {
+		return c.ArgErr()
+	}
+	target := args[len(args)-1]
+	route := &opcodeRoute{}
+	switch strings.ToLower(target) {
+	case opcodeRefuse:
+		route.rcode = dns.RcodeRefused
+	case opcodeNotImp:
+		route.rcode = dns.RcodeNotImplemented
+	case opcodeNext:
+		route.next = true
+	default:
+		addr, err := normalizeAddr(target, transport.Port)
+		if err != nil {
+			return errors.Wrapf(err, "invalid opcode upstream %q", target)
+		}
+		route.client = NewClient(addr, TCP)
+	}
+	if f.opcodes == nil {
+		f.opcodes = make(map[int]*opcodeRoute)
+	}
+	for _, name := range args[:len(args)-1] {
+		opcode, ok := dns.StringToOpcode[strings.ToUpper(name)]
+		if !ok {
+			return errors.Errorf("unknown opcode %q", name)
+		}
+		if opcode == dns.OpcodeQuery {
+			return errors.New("opcode can't route the QUERY opcode")
+		}
+		f.opcodes[opcode] = route
+	}
+	return nil
+}
+
+// parseMultiQuestion parses `multi-question formerr|first|split`.
+func parseMultiQuestion(f *Fanout, c *caddyfile.Dispenser) error {
+	if !c.NextArg() {
+		return c.ArgErr()
+	}
+	switch mode := strings.ToLower(c.Val()); mode {
+	case multiQuestionFormErr, multiQuestionFirst, multiQuestionSplit:
+		f.multiQuestion = mode
+	default:
+		return errors.Errorf("unknown multi-question mode %q", c.Val())
+	}
+	if c.NextArg() {
+		return c.ArgErr()
+	}
+	return nil
+}
+
+// serveOpcode routes messages of the opcodes configured with opcode and applies multi-question. It
+// returns false if the message is to be sent to the upstreams, possibly with its extra questions removed.
+func (f *Fanout) serveOpcode(ctx context.Context, req *request.Request) (rcode int, handled bool, err error) {
+	if route, ok := f.opcodes[req.Req.Opcode]; ok {
+		rcode, err = f.routeOpcode(ctx, req, route)
+		return rcode, true, err
+	}
+	if len(req.Req.Question) < 2 {
+		return 0, false, nil
+	}
+	switch f.multiQuestion {
+	case multiQuestionFormErr:
+		return dns.RcodeFormatError, true, nil
+	case multiQuestionFirst:
+		m := req.Req.Copy()
+		m.Question = m.Question[:1]
+		req.Req = m
+	case multiQuestionSplit:
+		rcode, err = f.serveSplit(ctx, req)
+		return rcode, true, err
+	}
+	return 0, false, nil
+}
+
+// routeOpcode handles req as route says.
+func (f *Fanout) routeOpcode(ctx context.Context, req *request.Request, route *opcodeRoute) (int, error) {
+	if route.next {
+		return plugin.NextOrFailure(f.Name(), f.Next, ctx, req.W, req.Req)
+	}
+	if route.client == nil && route.primary == nil {
+		return route.rcode, nil
+	}
+	ctx, cancel := context.WithTimeout(ctx, f.Timeout)
+	defer cancel()
+	if route.primary != nil {
+		if !route.primary.authorized(req) {
+			return dns.RcodeRefused, errors.Errorf("refusing the unauthenticated update from %s", req.IP())
+		}
+		resp, err := route.primary.forward(ctx, req)
+		if err != nil {
+			return dns.RcodeServerFailure, err
+		}
+		logErrIfNotNil(req.W.WriteMsg(resp))
+		return 0, nil
+	}
+	resp, err := route.client.Request(ctx, req)
+	if err != nil {
+		return dns.RcodeServerFailure, errors.Wrapf(err, "passing %s through to %s", dns.OpcodeToString[req.Req.Opcode], route.client.Endpoint())
+	}
+	logErrIfNotNil(req.W.WriteMsg(resp))
+	return 0, nil
+}
+
+// serveSplit resolves each question of req as a query of its own and replies with the merged answers.
+// The rcode of the reply is the first one other than NOERROR.
+func (f *Fanout) serveSplit(ctx context.Context, req *request.Request) (int, error) {
+	reply := new(dns.Msg)
+	reply.SetReply(req.Req)
+	reply.Question = req.Req.Question
+	reply.AuthenticatedData = true
+	for _, q := range req.Req.Question {
+		sub := req.Req.Copy()
+		sub.Question = []dns.Question{q}
+		nw := nonwriter.New(req.W)
+		rcode, err := f.ServeDNS(ctx, nw, sub)
+		if nw.Msg == nil {
+			return rcode, err
+		}
+		if reply.Rcode == dns.RcodeSuccess {
+			reply.Rcode = nw.Msg.Rcode
+		}
+		reply.RecursionAvailable = nw.Msg.RecursionAvailable
+		reply.AuthenticatedData = reply.AuthenticatedData && nw.Msg.AuthenticatedData
+		reply.Answer = append(reply.Answer, nw.Msg.Answer...)
+		reply.Ns = append(reply.Ns, nw.Msg.Ns...)
+		for _, rr := range nw.Msg.Extra {
+			if rr.Header().Rrtype != dns.TypeOPT || reply.IsEdns0() == nil {
+				reply.Extra = append(reply.Extra, rr)
+			}
+		}
+	}
+	if f.limitResponseSize {
+		f.truncate(req, reply)
+	}
+	logErrIfNotNil(req.W.WriteMsg(reply))
+	return 0, nil
+}
@@ -0,0 +1,121 @@
+// Copyright (c) 2024 MWS and/or its affiliates.
+//
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at:
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fanout
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+
+	"github.com/coredns/caddy"
+	"github.com/coredns/coredns/plugin/pkg/dnstest"
+	"github.com/coredns/coredns/plugin/test"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+)
+
+func TestOpcodeRouting(t *testing.T) {
+	var fanned atomic.Int32
+	upstream := newServer(UDP, func(w dns.ResponseWriter, r *dns.Msg) {
+		fanned.Add(1)
+		msg := new(dns.Msg)
+		msg.SetReply(r)
+		logErrIfNotNil(w.WriteMsg(msg))
+	})
+	defer upstream.close()
+	primary := newServer(TCP, func(w dns.ResponseWriter, r *dns.Msg) {
+		msg := new(dns.Msg)
+		msg.SetReply(r)
+		msg.Authoritative = true
+		logErrIfNotNil(w.WriteMsg(msg))
+	})
+	defer primary.close()
+
+	fs, err := parseFanout(caddy.NewTestController("dns", "fanout . "+upstream.addr+" {\nopcode notify "+primary.addr+"\nopcode update STATUS refuse\n}"))
+	require.NoError(t, err)
+	f := fs[0]
+
+	notify := new(dns.Msg)
+	notify.SetNotify("example.org.")
+	rec := dnstest.NewRecorder(&test.ResponseWriter{})
+	_, err = f.ServeDNS(context.Background(), rec, notify)
+	require.NoError(t, err)
+	require.Equal(t, dns.OpcodeNotify, rec.Msg.Opcode)
+	require.True(t, rec.Msg.Authoritative, "NOTIFY is passed through to the primary")
+
+	update := new(dns.Msg)
+	update.SetUpdate("example.org.")
+	rcode, err := f.ServeDNS(context.Background(), dnstest.NewRecorder(&test.ResponseWriter{}), update)
+	require.NoError(t, err)
+	require.Equal(t, dns.RcodeRefused, rcode)
+	require.Zero(t, fanned.Load())
+
+	for _, config := range []string{"opcode notify", "opcode query refuse", "opcode bogus refuse", "opcode notify :99999"} {
+		_, err = parseFanout(caddy.NewTestController("dns", "fanout . 127.0.0.1 {\n"+config+"\n}"))
+		require.Error(t, err, config)
+	}
+}
+
+func TestMultiQuestion(t *testing.T) {
+	var questions atomic.Int32
+	s := newServer(UDP, func(w dns.ResponseWriter, r *dns.Msg) {
+		questions.Add(int32(len(r.Question)))
+		msg := new(dns.Msg)
+		msg.SetReply(r)
+		if len(r.Question) == 1 {
+			rr, err := dns.NewRR(r.Question[0].Name + " 60 IN A 10.0.0.1")
+			require.NoError(t, err)
+			msg.Answer = append(msg.Answer, rr)
+		} else {
+			msg.Rcode = dns.RcodeFormatError
+		}
+		logErrIfNotNil(w.WriteMsg(msg))
+	})
+	defer s.close()
+
+	serve := func(mode string) (*dnstest.Recorder, int) {
+		questions.Store(0)
+		fs, err := parseFanout(caddy.NewTestController("dns", "fanout . "+s.addr+" {\nmulti-question "+mode+"\n}"))
+		require.NoError(t, err)
+		req := new(dns.Msg)
+		req.SetQuestion("a.example.org.", dns.TypeA)
+		req.Question = append(req.Question, dns.Question{Name: "b.example.org.", Qtype: dns.TypeA, Qclass: dns.ClassINET})
+		rec := dnstest.NewRecorder(&test.ResponseWriter{})
+		rcode, err := fs[0].ServeDNS(context.Background(), rec, req)
+		require.NoError(t, err)
+		return rec, rcode
+	}
+
+	_, rcode := serve("formerr")
+	require.Equal(t, dns.RcodeFormatError, rcode)
+	require.Zero(t, questions.Load())
+
+	rec, _ := serve("first")
+	require.Len(t, rec.Msg.Answer, 1)
+	require.Equal(t, "a.example.org.", rec.Msg.Answer[0].Header().Name)
+	require.Equal(t, int32(1), questions.Load())
+
+	rec, _ = serve("split")
+	require.Equal(t, dns.RcodeSuccess, rec.Msg.Rcode)
+	require.Len(t, rec.Msg.Question, 2)
+	require.Len(t, rec.Msg.Answer, 2)
+	require.Equal(t, "b.example.org.", rec.Msg.Answer[1].Header().Name)
+	require.Equal(t, int32(2), questions.Load())
+
+	_, err := parseFanout(caddy.NewTestController("dns", "fanout . 127.0.0.1 {\nmulti-question merge\n}"))
+	require.Error(t, err)
+}
@@ -0,0 +1,67 @@
+// Copyright (c) 2024 MWS and/or its affiliates.
+//
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at:
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fanout
+
+import (
+	"time"
+
+	"github.com/coredns/caddy/caddyfile"
+	"github.com/coredns/coredns/request"
+	"github.com/miekg/dns"
+	"github.com/pkg/errors"
+)
+
+// parseClientPatience parses `client-patience [DURATION]`.
+func parseClientPatience(f *Fanout, c *caddyfile.Dispenser) error {
+	args := c.RemainingArgs()
+	if len(args) > 1 {
+		return c.ArgErr()
+	}
+	f.clientPatience = true
+	if len(args) == 1 {
+		d, err := time.ParseDuration(args[0])
+		if err != nil || d <= 0 {
+			return errors.Errorf("invalid client-patience %q", args[0])
+		}
+		f.clientPatienceLimit = d
+	}
+	return nil
+}
+
+// queryTimeout returns the time the upstreams get to answer req: the timeout, capped with client-patience
+// by the time clients are known to wait for an answer, and by the idle timeout of the TCP connection the
+// client sent in an EDNS TCP keepalive option (RFC 7828), past which it may have closed the connection.
+func (f *Fanout) queryTimeout(req *request.Request) time.Duration {
+	timeout := f.Timeout
+	if !f.clientPatience {
+		return timeout
+	}
+	if f.clientPatienceLimit > 0 {
+		timeout = min(timeout, f.clientPatienceLimit)
+	}
+	if req.Proto() != TCP {
+		return timeout
+	}
+	if opt := req.Req.IsEdns0(); opt != nil {
+		for _, o := range opt.Option {
+			if ka, ok := o.(*dns.EDNS0_TCP_KEEPALIVE); ok && ka.Timeout > 0 {
+				timeout = min(timeout, time.Duration(ka.Timeout)*keepaliveUnit)
+			}
+		}
+	}
+	return timeout
+}
@@ -0,0 +1,77 @@
+// Copyright (c) 2024 MWS and/or its affiliates.
+//
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at:
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fanout
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/coredns/caddy"
+	"github.com/coredns/coredns/plugin/pkg/dnstest"
+	"github.com/coredns/coredns/plugin/test"
+	"github.com/coredns/coredns/request"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+)
+
+func TestClientPatience(t *testing.T) {
+	fs, err := parseFanout(caddy.NewTestController("dns", "fanout . 127.0.0.1 {\ntimeout 5s\nclient-patience 2s\n}"))
+	require.NoError(t, err)
+	f := fs[0]
+	keepalive := func(timeout uint16) *dns.Msg {
+		m := new(dns.Msg)
+		m.SetQuestion(testQuery, dns.TypeA)
+		m.SetEdns0(dns.DefaultMsgSize, false)
+		m.IsEdns0().Option = append(m.IsEdns0().Option, &dns.EDNS0_TCP_KEEPALIVE{Code: dns.EDNS0TCPKEEPALIVE, Timeout: timeout})
+		return m
+	}
+	for name, tc := range map[string]struct {
+		w       dns.ResponseWriter
+		m       *dns.Msg
+		timeout time.Duration
+	}{
+		"udp":            {&test.ResponseWriter{}, keepalive(5), 2 * time.Second},
+		"tcp keepalive":  {&test.ResponseWriter{TCP: true}, keepalive(5), 500 * time.Millisecond},
+		"tcp no timeout": {&test.ResponseWriter{TCP: true}, keepalive(0), 2 * time.Second},
+		"tcp long idle":  {&test.ResponseWriter{TCP: true}, keepalive(600), 2 * time.Second},
+	} {
+		require.Equal(t, tc.timeout, f.queryTimeout(&request.Request{W: tc.w, Req: tc.m}), name)
+	}
+
+	fs, err = parseFanout(caddy.NewTestController("dns", "fanout . 127.0.0.1 {\ntimeout 5s\n}"))
+	require.NoError(t, err)
+	require.Equal(t, 5*time.Second, fs[0].queryTimeout(&request.Request{W: &test.ResponseWriter{TCP: true}, Req: keepalive(5)}))
+
+	for _, arg := range []string{"0s", "later", "1s 2s"} {
+		_, err = parseFanout(caddy.NewTestController("dns", "fanout . 127.0.0.1 {\nclient-patience "+arg+"\n}"))
+		require.Error(t, err, arg)
+	}
+}
+
+func TestClientPatienceCapsQueries(t *testing.T) {
+	s := newServer(UDP, func(w dns.ResponseWriter, r *dns.Msg) {})
+	defer s.close()
+	fs, err := parseFanout(caddy.NewTestController("dns", "fanout . "+s.addr+" {\nattempt-count 0\nclient-patience 200ms\n}"))
+	require.NoError(t, err)
+	req := new(dns.Msg)
+	req.SetQuestion(testQuery, dns.TypeA)
+	start := time.Now()
+	_, err = fs[0].ServeDNS(context.Background(), dnstest.NewRecorder(&test.ResponseWriter{}), req)
+	require.Error(t, err)
+	require.Less(t, time.Since(start), time.Second, "queries stop once clients have given up")
+}
@@ -17,8 +17,16 @@
 package fanout
 
 import (
+	"cmp"
+	"encoding/binary"
+	"hash/fnv"
+	"math"
 	"math/rand"
+	"slices"
 	"sync"
+	"time"
+
+	"github.com/pkg/errors"
 
 	"github.com/hurricanehrndz/fanout/v2/internal/selector"
 )
@@ -31,6 +39,11 @@ type clientSelector interface {
 	Pick() Client
 }
 
+// seededPolicy is implemented by policies whose selection order is fully determined by a seed.
+type seededPolicy interface {
+	seededSelector(clients []Client, seed int64) clientSelector
+}
+
 // SequentialPolicy is used to select clients based on its sequential order
 type SequentialPolicy struct {
 }
@@ -40,20 +53,253 @@ func (p *SequentialPolicy) selector(clients []Client) clientSelector {
 	return selector.NewSequentialSelector(clients)
 }
 
-// WeightedPolicy is used to select clients randomly based on its loadFactor (weights)
+// WeightedPolicy is used to select clients randomly based on its loadFactor (weights).
+// Weights are relative: a client is picked with probability weight/sum of weights.
 type WeightedPolicy struct {
 	loadFactor []int
 	r          *rand.Rand
 	mutex      sync.Mutex
 }
 
+// NewWeightedPolicy creates a weighted random policy with the given weight per client.
+func NewWeightedPolicy(loadFactor []int) (*WeightedPolicy, error) {
+	if err := validateLoadFactor(loadFactor); err != nil {
+		return nil, err
+	}
+	return &WeightedPolicy{
+		loadFactor: slices.Clone(loadFactor),
+		//nolint:gosec // it's overhead to use crypto/rand here
+		r: rand.New(rand.NewSource(time.Now().UnixNano())),
+	}, nil
+}
+
+// LoadFactor returns a copy of the current weights.
+func (p *WeightedPolicy) LoadFactor() []int {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	return slices.Clone(p.loadFactor)
+}
+
+// SetLoadFactor replaces the weights at runtime, e.g. from health or latency feedback.
+// Queries in flight keep using the weights they started with.
+func (p *WeightedPolicy) SetLoadFactor(loadFactor []int) error {
+	if err := validateLoadFactor(loadFactor); err != nil {
+		return err
+	}
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if len(loadFactor) != len(p.loadFactor) {
+		return errors.Errorf("load-factor params count must be the same as the number of hosts: got %d load factors for %d hosts",
+			len(loadFactor), len(p.loadFactor))
+	}
+	p.loadFactor = slices.Clone(loadFactor)
+	return nil
+}
+
 // creates new weighted random selector of provided clients based on loadFactor
 func (p *WeightedPolicy) selector(clients []Client) clientSelector {
 	p.mutex.Lock()
 	seed := p.r.Int63()
+	loadFactor := p.loadFactor
 	p.mutex.Unlock()
 
 	// Each request owns its RNG; only deterministic seed generation is shared.
 	//nolint:gosec // weighted selection does not need cryptographic randomness
-	return selector.NewWeightedRandSelector(clients, p.loadFactor, rand.New(rand.NewSource(seed)))
+	return selector.NewWeightedRandSelector(clients, loadFactor, rand.New(rand.NewSource(seed)))
+}
+
+// creates new weighted random selector of provided clients whose order is determined by seed
+func (p *WeightedPolicy) seededSelector(clients []Client, seed int64) clientSelector {
+	p.mutex.Lock()
+	loadFactor := p.loadFactor
+	p.mutex.Unlock()
+
+	//nolint:gosec // weighted selection does not need cryptographic randomness
+	return selector.NewWeightedRandSelector(clients, loadFactor, rand.New(rand.NewSource(seed)))
+}
+
+// LatencyPolicy is used to select clients in order of their average response time. Clients without
+// samples come first so that they get measured, while clients which have only failed come last.
+type LatencyPolicy struct {
+}
+
+// creates new sequential selector of provided clients ordered by latency
+func (p *LatencyPolicy) selector(clients []Client) clientSelector {
+	ranks := make(map[Client]time.Duration, len(clients))
+	for _, c := range clients {
+		s := registry.get(c.Endpoint()).stats.snapshot()
+		switch {
+		case s.RTT > 0:
+			ranks[c] = s.RTT
+		case s.Failures > 0:
+			ranks[c] = time.Duration(math.MaxInt64)
+		}
+	}
+	ordered := slices.Clone(clients)
+	slices.SortStableFunc(ordered, func(a, b Client) int {
+		return cmp.Compare(ranks[a], ranks[b])
+	})
+	return selector.NewSequentialSelector(ordered)
+}
+
+// StickyPolicy is used to select clients in an order determined by the downstream client IP, so that
+// each downstream client consistently hits the same upstreams. The order is derived by rendezvous
+// hashing, so adding or removing an upstream only moves the downstream clients that hashed to it.
+type StickyPolicy struct {
+}
+
+// creates new sequential selector of provided clients, used when the downstream client is unknown
+func (p *StickyPolicy) selector(clients []Client) clientSelector {
+	return selector.NewSequentialSelector(clients)
+}
+
+// creates new sequential selector of provided clients ordered by their hash with seed
+func (p *StickyPolicy) seededSelector(clients []Client, seed int64) clientSelector {
+	scores := make(map[Client]uint64, len(clients))
+	for _, c := range clients {
+		h := fnv.New64a()
+		_, _ = h.Write(binary.BigEndian.AppendUint64(nil, uint64(seed)))
+		_, _ = h.Write([]byte(c.Endpoint()))
+		scores[c] = h.Sum64()
+	}
+	ordered := slices.Clone(clients)
+	slices.SortStableFunc(ordered, func(a, b Client) int {
+		return cmp.Compare(scores[b], scores[a])
+	})
+	return selector.NewSequentialSelector(ordered)
+}
+
+// ChainPolicy composes policies: the first stage shortlists clients, and each further stage reorders
+// the shortlist picked by the previous one.
+type ChainPolicy struct {
+	stages    []policy
+	shortlist int
+}
+
+// NewChainPolicy creates a policy picking up to shortlist clients with the first of stages and ordering
+// them with the others in turn. A shortlist of 0 keeps every client.
+func NewChainPolicy(shortlist int, stages ...policy) (*ChainPolicy, error) {
+	if len(stages) == 0 {
+		return nil, errors.New("a policy chain needs at least one policy")
+	}
+	return &ChainPolicy{stages: stages, shortlist: shortlist}, nil
+}
+
+// creates new sequential selector of the clients shortlisted and ordered by the stages
+func (p *ChainPolicy) selector(clients []Client) clientSelector {
+	return p.reorder(p.stages[0].selector(clients), len(clients))
+}
+
+// creates new chained selector whose first stage order is determined by seed, if it supports seeding
+func (p *ChainPolicy) seededSelector(clients []Client, seed int64) clientSelector {
+	if sp, ok := p.stages[0].(seededPolicy); ok {
+		return p.reorder(sp.seededSelector(clients, seed), len(clients))
+	}
+	return p.selector(clients)
+}
+
+func (p *ChainPolicy) reorder(first clientSelector, count int) clientSelector {
+	if p.shortlist > 0 && p.shortlist < count {
+		count = p.shortlist
+	}
+	shortlist := pickClients(first, count)
+	for _, stage := range p.stages[1:] {
+		shortlist = pickClients(stage.selector(shortlist), len(shortlist))
+	}
+	return selector.NewSequentialSelector(shortlist)
+}
+
+// pickClients returns up to count clients in the order sel picks them.
+func pickClients(sel clientSelector, count int) []Client {
+	picked := make([]Client, 0, count)
+	for len(picked) < count {
+		c := sel.Pick()
+		if c == nil {
+			break
+		}
+		picked = append(picked, c)
+	}
+	return picked
+}
+
+// isSticky returns true if p is or starts with the sticky policy.
+func isSticky(p policy) bool {
+	if chain, ok := p.(*ChainPolicy); ok {
+		p = chain.stages[0]
+	}
+	_, ok := p.(*StickyPolicy)
+	return ok
+}
+
+// SetPolicy replaces the server selection policy of the TO list while queries are in flight: queries
+// already selecting upstreams keep the previous policy, the next ones use p. A nil p restores the policy
+// of the configuration. Upstream statistics and health are kept, being shared by all policies.
+func (f *Fanout) SetPolicy(p policy) {
+	if p == nil {
+		f.policyOverride.Store(nil)
+		return
+	}
+	f.policyOverride.Store(&p)
+}
+
+// selectionPolicy returns the policy set by SetPolicy, or the configured one.
+func (f *Fanout) selectionPolicy() policy {
+	if p := f.policyOverride.Load(); p != nil {
+		return *p
+	}
+	return f.ServerSelectionPolicy
+}
+
+// weightedStage returns the weighted random policy p is or starts with, if any.
+func weightedStage(p policy) *WeightedPolicy {
+	if chain, ok := p.(*ChainPolicy); ok {
+		p = chain.stages[0]
+	}
+	w, _ := p.(*WeightedPolicy)
+	return w
+}
+
+// newPolicy creates the configured policy, or policy chain shortlisting up to shortlist clients, for
+// clients with the given weights.
+func (f *Fanout) newPolicy(loadFactor []int, shortlist int) (policy, error) {
+	first, err := newStagePolicy(f.policyType, loadFactor)
+	if err != nil || len(f.policyThen) == 0 {
+		return first, err
+	}
+	stages := []policy{first}
+	for _, name := range f.policyThen {
+		p, err := newStagePolicy(name, nil)
+		if err != nil {
+			return nil, err
+		}
+		stages = append(stages, p)
+	}
+	return NewChainPolicy(shortlist, stages...)
+}
+
+func newStagePolicy(name string, loadFactor []int) (policy, error) {
+	switch name {
+	case policyWeightedRandom:
+		return NewWeightedPolicy(loadFactor)
+	case policyLatency:
+		return &LatencyPolicy{}, nil
+	case policySticky:
+		return &StickyPolicy{}, nil
+	}
+	return &SequentialPolicy{}, nil
+}
+
+// validateLoadFactor checks that every weight is positive and the total fits the selector range.
+func validateLoadFactor(loadFactor []int) error {
+	sum := 0
+	for _, lf := range loadFactor {
+		if lf < minLoadFactor {
+			return errors.New("load-factor should be more or equal 1")
+		}
+		if lf > maxLoadFactorSum-sum {
+			return errors.Errorf("sum of load-factor params must not exceed %d", maxLoadFactorSum)
+		}
+		sum += lf
+	}
+	return nil
 }
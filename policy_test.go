@@ -0,0 +1,258 @@
+// Copyright (c) 2024 MWS and/or its affiliates.
+//
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at:
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fanout
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/coredns/caddy"
+	"github.com/coredns/coredns/plugin/pkg/dnstest"
+	"github.com/coredns/coredns/plugin/test"
+	"github.com/coredns/coredns/request"
+	"github.com/hurricanehrndz/fanout/v2/clock"
+	"github.com/miekg/dns"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWeightedPolicySetLoadFactor(t *testing.T) {
+	clients := []Client{NewClient("192.0.2.1:53", UDP), NewClient("192.0.2.2:53", UDP)}
+	p, err := NewWeightedPolicy([]int{1, 1})
+	require.NoError(t, err)
+
+	require.NoError(t, p.SetLoadFactor([]int{1, 1_000_000}))
+	require.Equal(t, []int{1, 1_000_000}, p.LoadFactor())
+	picked := map[string]int{}
+	for i := 0; i < 100; i++ {
+		picked[p.selector(clients).Pick().Endpoint()]++
+	}
+	require.Greater(t, picked["192.0.2.2:53"], 90)
+
+	require.ErrorContains(t, p.SetLoadFactor([]int{1}), "got 1 load factors for 2 hosts")
+	require.ErrorContains(t, p.SetLoadFactor([]int{1, 0}), "load-factor should be more or equal 1")
+	require.Equal(t, []int{1, 1_000_000}, p.LoadFactor())
+
+	_, err = NewWeightedPolicy([]int{-1})
+	require.Error(t, err)
+}
+
+func TestPairAddressQueriesShareUpstreamOrder(t *testing.T) {
+	f := New()
+	for i := 1; i <= 8; i++ {
+		f.AddClient(NewClient(fmt.Sprintf("192.0.2.%d:53", i), UDP))
+	}
+	p, err := NewWeightedPolicy([]int{1, 2, 3, 4, 5, 6, 7, 8})
+	require.NoError(t, err)
+	f.ServerSelectionPolicy = p
+	f.pairAddressQueries = true
+	clk := clock.NewManual(time.Unix(0, 0))
+	f.clock = clk
+
+	order := func(name string, qtype uint16) []string {
+		req := new(dns.Msg)
+		req.SetQuestion(name, qtype)
+		sel := f.selector(&request.Request{Req: req}, f.clients, f.ServerSelectionPolicy)
+		var endpoints []string
+		for c := sel.Pick(); c != nil; c = sel.Pick() {
+			endpoints = append(endpoints, c.Endpoint())
+		}
+		return endpoints
+	}
+	changed := 0
+	for i := 0; i < 20; i++ {
+		name := fmt.Sprintf("host%d.example.", i)
+		first := order(name, dns.TypeA)
+		require.Equal(t, first, order(name, dns.TypeAAAA), name)
+		clk.Advance(pairWindow)
+		if !slices.Equal(first, order(name, dns.TypeAAAA)) {
+			changed++
+		}
+	}
+	require.Positive(t, changed, "the order changes with the pairing window")
+}
+
+func TestLatencyPolicy(t *testing.T) {
+	fast, slow, failing, fresh := "198.18.0.1:53", "198.18.0.2:53", "198.18.0.3:53", "198.18.0.4:53"
+	now := time.Now()
+	registry.get(fast).stats.observe(time.Millisecond, nil, now)
+	registry.get(slow).stats.observe(50*time.Millisecond, nil, now)
+	registry.get(failing).stats.observe(0, errors.New("timeout"), now)
+
+	var clients []Client
+	for _, addr := range []string{failing, slow, fast, fresh} {
+		clients = append(clients, NewClient(addr, UDP))
+	}
+	require.Equal(t, []string{fresh, fast, slow, failing}, endpoints(pickClients((&LatencyPolicy{}).selector(clients), len(clients))))
+}
+
+func TestChainPolicy(t *testing.T) {
+	first, second, third := "198.18.1.1:53", "198.18.1.2:53", "198.18.1.3:53"
+	now := time.Now()
+	registry.get(first).stats.observe(30*time.Millisecond, nil, now)
+	registry.get(second).stats.observe(20*time.Millisecond, nil, now)
+	registry.get(third).stats.observe(10*time.Millisecond, nil, now)
+	clients := []Client{NewClient(first, UDP), NewClient(second, UDP), NewClient(third, UDP)}
+
+	p, err := NewChainPolicy(2, &SequentialPolicy{}, &LatencyPolicy{})
+	require.NoError(t, err)
+	require.Equal(t, []string{second, first}, endpoints(pickClients(p.selector(clients), len(clients))),
+		"the latency stage only orders the shortlist")
+
+	w, err := NewWeightedPolicy([]int{1, 1_000_000, 1})
+	require.NoError(t, err)
+	p, err = NewChainPolicy(1, w, &LatencyPolicy{})
+	require.NoError(t, err)
+	require.Same(t, w, weightedStage(p))
+	picked := map[string]int{}
+	for i := 0; i < 100; i++ {
+		picked[p.selector(clients).Pick().Endpoint()]++
+	}
+	require.Greater(t, picked[second], 90)
+
+	_, err = NewChainPolicy(0)
+	require.Error(t, err)
+}
+
+func TestPolicyChainSetup(t *testing.T) {
+	fs, err := parseFanout(caddy.NewTestController("dns", `fanout . 127.0.0.1 127.0.0.2 127.0.0.3 {
+policy weighted-random then latency
+weighted-random-server-count 2
+}`))
+	require.NoError(t, err)
+	p, ok := fs[0].ServerSelectionPolicy.(*ChainPolicy)
+	require.True(t, ok)
+	require.Equal(t, 2, p.shortlist)
+	require.Len(t, pickClients(p.selector(fs[0].clients), 3), 2)
+	require.Equal(t, "weighted-random then latency", fs[0].debugState().Policy)
+
+	for _, policy := range []string{"latency then", "sequential latency", "latency then weighted-random", "latency then sticky", "latency then fastest"} {
+		_, err = parseFanout(caddy.NewTestController("dns", "fanout . 127.0.0.1 {\npolicy "+policy+"\n}"))
+		require.Error(t, err, policy)
+	}
+}
+
+func endpoints(clients []Client) []string {
+	var s []string
+	for _, c := range clients {
+		s = append(s, c.Endpoint())
+	}
+	return s
+}
+
+func TestStickyPolicy(t *testing.T) {
+	f := New()
+	for i := 1; i <= 8; i++ {
+		f.AddClient(NewClient(fmt.Sprintf("192.0.2.%d:53", i), UDP))
+	}
+	f.ServerSelectionPolicy = &StickyPolicy{}
+
+	order := func(clients []Client, ip, name string) []string {
+		req := new(dns.Msg)
+		req.SetQuestion(name, dns.TypeA)
+		sel := f.selector(&request.Request{W: &test.ResponseWriter{RemoteIP: ip}, Req: req}, clients, f.ServerSelectionPolicy)
+		return endpoints(pickClients(sel, len(clients)))
+	}
+	first := order(f.clients, "10.0.0.1", "a.example.")
+	require.Len(t, first, 8)
+	require.Equal(t, first, order(f.clients, "10.0.0.1", "b.example."), "the order only depends on the client")
+
+	firsts := map[string]bool{}
+	for i := 0; i < 32; i++ {
+		firsts[order(f.clients, fmt.Sprintf("10.0.1.%d", i), "a.example.")[0]] = true
+	}
+	require.Greater(t, len(firsts), 1, "clients are spread over upstreams")
+
+	removed := slices.DeleteFunc(slices.Clone(f.clients), func(c Client) bool { return c.Endpoint() == first[3] })
+	require.Equal(t, slices.Delete(slices.Clone(first), 3, 4), order(removed, "10.0.0.1", "a.example."),
+		"removing an upstream keeps the relative order of the others")
+}
+
+func TestSetPolicy(t *testing.T) {
+	s := newServer(UDP, func(w dns.ResponseWriter, r *dns.Msg) {
+		msg := dns.Msg{Answer: []dns.RR{makeRecordA("example1. 3600 IN A 10.0.0.1")}}
+		msg.SetReply(r)
+		logErrIfNotNil(w.WriteMsg(&msg))
+	})
+	defer s.close()
+	fs, err := parseFanout(caddy.NewTestController("dns", "fanout . "+s.addr+" 127.0.0.1:1 {\npolicy sequential\n}"))
+	require.NoError(t, err)
+	f := fs[0]
+	req := &request.Request{W: &test.ResponseWriter{}, Req: new(dns.Msg)}
+	req.Req.SetQuestion(testQuery, dns.TypeA)
+
+	latency := &LatencyPolicy{}
+	f.SetPolicy(latency)
+	_, p, _ := f.route(req)
+	require.Same(t, latency, p)
+	f.SetPolicy(nil)
+	_, p, _ = f.route(req)
+	require.Same(t, f.ServerSelectionPolicy, p, "a nil policy restores the configured one")
+
+	var wg sync.WaitGroup
+	wg.Go(func() {
+		for i := range 100 {
+			if i%2 == 0 {
+				f.SetPolicy(&StickyPolicy{})
+			} else {
+				f.SetPolicy(nil)
+			}
+		}
+	})
+	for range 4 {
+		wg.Go(func() {
+			for range 25 {
+				rec := dnstest.NewRecorder(&test.ResponseWriter{})
+				_, err := f.ServeDNS(context.Background(), rec, req.Req.Copy())
+				require.NoError(t, err)
+				require.Len(t, rec.Msg.Answer, 1)
+			}
+		})
+	}
+	wg.Wait()
+}
+
+func TestPolicyChangeOnReloadKeepsUpstreamState(t *testing.T) {
+	s := newServer(UDP, func(w dns.ResponseWriter, r *dns.Msg) {
+		msg := new(dns.Msg)
+		msg.SetReply(r)
+		logErrIfNotNil(w.WriteMsg(msg))
+	})
+	defer s.close()
+	old, err := parseFanout(caddy.NewTestController("dns", "fanout . "+s.addr+" {\npolicy sequential\n}"))
+	require.NoError(t, err)
+	require.NoError(t, old[0].OnStartup())
+	require.Eventually(t, func() bool { return old[0].Healthy(s.addr) }, time.Second, time.Millisecond)
+	req := new(dns.Msg)
+	req.SetQuestion(testQuery, dns.TypeA)
+	_, err = old[0].ServeDNS(context.Background(), dnstest.NewRecorder(&test.ResponseWriter{}), req)
+	require.NoError(t, err)
+	requests := registry.get(s.addr).stats.snapshot().Requests
+
+	// on reload, the new instance starts before the old one shuts down
+	reloaded, err := parseFanout(caddy.NewTestController("dns", "fanout . "+s.addr+" {\npolicy latency\n}"))
+	require.NoError(t, err)
+	require.NoError(t, reloaded[0].OnStartup())
+	require.NoError(t, old[0].OnShutdown())
+	defer func() { require.NoError(t, reloaded[0].OnShutdown()) }()
+	require.True(t, reloaded[0].Healthy(s.addr), "the health of the upstream survives the reload")
+	require.Equal(t, requests, registry.get(s.addr).stats.snapshot().Requests, "so do its statistics")
+}
@@ -0,0 +1,85 @@
+// Copyright (c) 2024 MWS and/or its affiliates.
+//
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at:
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fanout
+
+import (
+	"context"
+	"slices"
+	"sync"
+	"time"
+)
+
+// prewarmer is implemented by clients able to establish upstream connections ahead of the first query.
+type prewarmer interface {
+	Prewarm(ctx context.Context) error
+}
+
+// idleCloser is implemented by clients keeping idle upstream connections for reuse.
+type idleCloser interface {
+	closeIdle()
+}
+
+// prewarmClients establishes connections to all upstreams in parallel. Failures are logged and
+// don't prevent the server from starting.
+func (f *Fanout) prewarmClients() {
+	var wg sync.WaitGroup
+	for _, c := range f.upstreams() {
+		p, ok := c.(prewarmer)
+		if !ok {
+			continue
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ctx, cancel := context.WithTimeout(context.Background(), maxTimeout)
+			defer cancel()
+			if err := p.Prewarm(ctx); err != nil {
+				log.Warningf("unable to prewarm connection to %s: %v", c.Endpoint(), err)
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+// idlePinger is implemented by clients able to check their idle upstream connections.
+type idlePinger interface {
+	pingIdle(idle time.Duration)
+}
+
+// pingPooledConns checks the pooled connections idle for at least interval, about every interval, so
+// that connections which have gone silent are evicted before a query is sent over them.
+func (f *Fanout) pingPooledConns(interval time.Duration) task {
+	return task{interval: interval, jitter: taskJitter, run: func(time.Time) bool {
+		for _, c := range f.upstreams() {
+			if p, ok := c.(idlePinger); ok {
+				p.pingIdle(interval)
+			}
+		}
+		return true
+	}}
+}
+
+func (f *Fanout) closeIdleClients() {
+	for _, c := range slices.Concat(f.upstreams(), f.mirrorClients, f.shadowClients) {
+		if ic, ok := c.(idleCloser); ok {
+			ic.closeIdle()
+		}
+	}
+	if f.cache != nil && f.cache.shared != nil {
+		f.cache.shared.close()
+	}
+}
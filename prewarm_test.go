@@ -0,0 +1,80 @@
+// Copyright (c) 2024 MWS and/or its affiliates.
+//
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at:
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fanout
+
+import (
+	"context"
+	"net"
+	"sync/atomic"
+	"testing"
+
+	"github.com/coredns/caddy"
+	"github.com/coredns/coredns/plugin/test"
+	"github.com/coredns/coredns/request"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+)
+
+type countingListener struct {
+	net.Listener
+	accepted atomic.Int32
+}
+
+func (l *countingListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err == nil {
+		l.accepted.Add(1)
+	}
+	return conn, err
+}
+
+func TestPrewarmedConnectionIsReused(t *testing.T) {
+	inner, err := net.Listen(TCP, "127.0.0.1:0")
+	require.NoError(t, err)
+	listener := &countingListener{Listener: inner}
+	started := make(chan struct{})
+	s := &dns.Server{Listener: listener, NotifyStartedFunc: func() { close(started) }, Handler: dns.HandlerFunc(func(w dns.ResponseWriter, r *dns.Msg) {
+		msg := new(dns.Msg)
+		msg.SetReply(r)
+		logErrIfNotNil(w.WriteMsg(msg))
+	})}
+	go func() { logErrIfNotNil(s.ActivateAndServe()) }()
+	<-started
+	defer func() { logErrIfNotNil(s.Shutdown()) }()
+
+	c := NewClient(inner.Addr().String(), TCP)
+	defer c.(*client).closeIdle()
+	require.NoError(t, c.(prewarmer).Prewarm(context.Background()))
+	require.Eventually(t, func() bool { return listener.accepted.Load() == 1 }, maxTimeout, attemptDelay)
+
+	req := new(dns.Msg)
+	req.SetQuestion(testQuery, dns.TypeA)
+	for i := 0; i < 3; i++ {
+		_, err = c.Request(context.Background(), &request.Request{W: &test.ResponseWriter{}, Req: req})
+		require.NoError(t, err)
+	}
+	require.Equal(t, int32(1), listener.accepted.Load())
+}
+
+func TestSetupPrewarm(t *testing.T) {
+	fs, err := parseFanout(caddy.NewTestController("dns", "fanout . 127.0.0.1 {\nprewarm\n}"))
+	require.NoError(t, err)
+	require.True(t, fs[0].prewarm)
+
+	_, err = parseFanout(caddy.NewTestController("dns", "fanout . 127.0.0.1 {\nprewarm yes\n}"))
+	require.Error(t, err)
+}
@@ -0,0 +1,83 @@
+// Copyright (c) 2024 MWS and/or its affiliates.
+//
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at:
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fanout
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/coredns/caddy/caddyfile"
+	"github.com/coredns/coredns/request"
+	"github.com/miekg/dns"
+	"github.com/pkg/errors"
+)
+
+// provenance configures how responses are tagged with the upstream which produced them.
+type provenance struct {
+	txt  bool
+	code uint16
+}
+
+// parseProvenance parses `provenance edns [CODE]|txt`.
+func parseProvenance(f *Fanout, c *caddyfile.Dispenser) error {
+	args := c.RemainingArgs()
+	if len(args) == 0 || len(args) > 2 {
+		return c.ArgErr()
+	}
+	p := &provenance{code: defaultProvenanceCode}
+	switch strings.ToLower(args[0]) {
+	case provenanceTXT:
+		if len(args) > 1 {
+			return c.ArgErr()
+		}
+		p.txt = true
+	case provenanceEDNS:
+		if len(args) > 1 {
+			code, err := strconv.ParseUint(args[1], 10, 16)
+			if err != nil || code < dns.EDNS0LOCALSTART || code > dns.EDNS0LOCALEND {
+				return errors.Errorf("provenance EDNS option code must be between %d and %d, got %q",
+					dns.EDNS0LOCALSTART, dns.EDNS0LOCALEND, args[1])
+			}
+			p.code = uint16(code)
+		}
+	default:
+		return errors.Errorf("unknown provenance format %q", args[0])
+	}
+	f.provenance = p
+	return nil
+}
+
+// tag adds the endpoint of the upstream which produced m to the response, as a local EDNS0 option when
+// both the client and the upstream use EDNS, or as a TXT record named fanout-upstream. in the additional
+// section. Options added by upstream fanouts are kept, so in multi-hop setups the response lists every hop.
+func (p *provenance) tag(req *request.Request, m *dns.Msg, upstream string) {
+	if p == nil {
+		return
+	}
+	if p.txt {
+		m.Extra = append(m.Extra, &dns.TXT{
+			Hdr: dns.RR_Header{Name: provenanceTXTName, Rrtype: dns.TypeTXT, Class: dns.ClassINET},
+			Txt: []string{upstream},
+		})
+		return
+	}
+	opt := m.IsEdns0()
+	if opt == nil || req.Req.IsEdns0() == nil {
+		return
+	}
+	opt.Option = append(opt.Option, &dns.EDNS0_LOCAL{Code: p.code, Data: []byte(upstream)})
+}
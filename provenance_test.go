@@ -0,0 +1,77 @@
+// Copyright (c) 2024 MWS and/or its affiliates.
+//
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at:
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fanout
+
+import (
+	"context"
+	"testing"
+
+	"github.com/coredns/caddy"
+	"github.com/coredns/coredns/plugin/pkg/dnstest"
+	"github.com/coredns/coredns/plugin/test"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+)
+
+func TestProvenance(t *testing.T) {
+	s := newServer(UDP, func(w dns.ResponseWriter, r *dns.Msg) {
+		msg := dns.Msg{Answer: []dns.RR{makeRecordA("example1. 3600 IN A 10.0.0.1")}}
+		msg.SetReply(r)
+		if opt := r.IsEdns0(); opt != nil {
+			msg.SetEdns0(opt.UDPSize(), false)
+		}
+		logErrIfNotNil(w.WriteMsg(&msg))
+	})
+	defer s.close()
+
+	serve := func(config string, edns bool) *dns.Msg {
+		fs, err := parseFanout(caddy.NewTestController("dns", "fanout . "+s.addr+" {\n"+config+"\n}"))
+		require.NoError(t, err)
+		req := new(dns.Msg)
+		req.SetQuestion(testQuery, dns.TypeA)
+		if edns {
+			req.SetEdns0(dns.DefaultMsgSize, false)
+		}
+		rec := dnstest.NewRecorder(&test.ResponseWriter{})
+		_, err = fs[0].ServeDNS(context.Background(), rec, req)
+		require.NoError(t, err)
+		return rec.Msg
+	}
+
+	m := serve("provenance edns 65100", true)
+	require.Len(t, m.IsEdns0().Option, 1)
+	local := m.IsEdns0().Option[0].(*dns.EDNS0_LOCAL)
+	require.Equal(t, uint16(65100), local.Code)
+	require.Equal(t, s.addr, string(local.Data))
+
+	m = serve("provenance edns", false)
+	if opt := m.IsEdns0(); opt != nil {
+		require.Empty(t, opt.Option, "a client without EDNS gets no option")
+	}
+
+	m = serve("provenance txt", false)
+	require.NotEmpty(t, m.Extra)
+	txt, ok := m.Extra[len(m.Extra)-1].(*dns.TXT)
+	require.True(t, ok)
+	require.Equal(t, provenanceTXTName, txt.Hdr.Name)
+	require.Equal(t, []string{s.addr}, txt.Txt)
+
+	for _, config := range []string{"provenance", "provenance edns 53", "provenance txt 65001", "provenance json"} {
+		_, err := parseFanout(caddy.NewTestController("dns", "fanout . "+s.addr+" {\n"+config+"\n}"))
+		require.Error(t, err, config)
+	}
+}
@@ -0,0 +1,162 @@
+// Copyright (c) 2024 MWS and/or its affiliates.
+//
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at:
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fanout
+
+import (
+	"context"
+	"encoding/hex"
+	"slices"
+	"strings"
+
+	"github.com/coredns/caddy/caddyfile"
+	"github.com/coredns/coredns/plugin"
+	"github.com/coredns/coredns/request"
+	"github.com/miekg/dns"
+	"github.com/pkg/errors"
+)
+
+// classFilter keeps queries of the listed classes away from the upstreams.
+type classFilter struct {
+	classes []uint16
+	action  string
+}
+
+// defaultFilteredClasses are the classes filtered by qclass-filter when none is listed.
+var defaultFilteredClasses = []uint16{dns.ClassCHAOS, dns.ClassHESIOD, dns.ClassANY}
+
+// parseClassFilter parses `qclass-filter refuse|drop|next [CLASS...]`.
+func parseClassFilter(f *Fanout, c *caddyfile.Dispenser) error {
+	args := c.RemainingArgs()
+	if len(args) == 0 {
+		return c.ArgErr()
+	}
+	cf := &classFilter{action: strings.ToLower(args[0]), classes: defaultFilteredClasses}
+	switch cf.action {
+	case classFilterRefuse, classFilterDrop, classFilterNext:
+	default:
+		return errors.Errorf("unknown qclass-filter action %q", args[0])
+	}
+	if len(args) > 1 {
+		cf.classes = nil
+	}
+	for _, name := range args[1:] {
+		class, ok := dns.StringToClass[strings.ToUpper(name)]
+		if !ok {
+			return errors.Errorf("unknown class %q", name)
+		}
+		if class == dns.ClassINET {
+			return errors.New("qclass-filter can't filter the IN class")
+		}
+		cf.classes = append(cf.classes, class)
+	}
+	f.classFilter = cf
+	return nil
+}
+
+// parseChaosVersion parses `chaos-version TEXT`.
+func parseChaosVersion(f *Fanout, c *caddyfile.Dispenser) error {
+	args := c.RemainingArgs()
+	if len(args) == 0 {
+		return c.ArgErr()
+	}
+	f.chaosVersion = strings.Join(args, " ")
+	return nil
+}
+
+// parseChaosID parses `chaos-id TEXT|nsid`.
+func parseChaosID(f *Fanout, c *caddyfile.Dispenser) error {
+	args := c.RemainingArgs()
+	if len(args) == 0 {
+		return c.ArgErr()
+	}
+	f.chaosID = strings.Join(args, " ")
+	return nil
+}
+
+// serveClass answers CH TXT queries configured with chaos-version and chaos-id locally, and applies
+// qclass-filter. It returns false if the query is to be sent to the upstreams.
+func (f *Fanout) serveClass(ctx context.Context, req *request.Request) (rcode int, handled bool, err error) {
+	class := req.QClass()
+	if class == dns.ClassINET {
+		return 0, false, nil
+	}
+	if txt, ok := f.chaosAnswer(ctx, req); ok {
+		m := new(dns.Msg)
+		m.SetReply(req.Req)
+		m.Authoritative = true
+		m.Answer = []dns.RR{&dns.TXT{
+			Hdr: dns.RR_Header{Name: req.QName(), Rrtype: dns.TypeTXT, Class: dns.ClassCHAOS},
+			Txt: []string{txt},
+		}}
+		logErrIfNotNil(req.W.WriteMsg(m))
+		return dns.RcodeSuccess, true, nil
+	}
+	if f.classFilter == nil || !slices.Contains(f.classFilter.classes, class) {
+		return 0, false, nil
+	}
+	switch f.classFilter.action {
+	case classFilterDrop:
+		return dns.RcodeSuccess, true, nil
+	case classFilterNext:
+		rcode, err = plugin.NextOrFailure(f.Name(), f.Next, ctx, req.W, req.Req)
+		return rcode, true, err
+	}
+	return dns.RcodeRefused, true, nil
+}
+
+// chaosAnswer returns the text of the local answer to a CH TXT query, if one is configured for its name.
+func (f *Fanout) chaosAnswer(ctx context.Context, req *request.Request) (string, bool) {
+	if req.QClass() != dns.ClassCHAOS || req.QType() != dns.TypeTXT {
+		return "", false
+	}
+	switch req.Name() {
+	case "version.bind.", "version.server.":
+		return f.chaosVersion, f.chaosVersion != ""
+	case "id.server.", "hostname.bind.":
+		if f.chaosID == chaosIDNSID {
+			return f.upstreamNSID(ctx, req), true
+		}
+		return f.chaosID, f.chaosID != ""
+	}
+	return "", false
+}
+
+// upstreamNSID returns the NSID (RFC 5001) of the upstream winning a root NS query, or an empty string if
+// it has none.
+func (f *Fanout) upstreamNSID(ctx context.Context, req *request.Request) string {
+	probe := new(dns.Msg)
+	probe.SetQuestion(".", dns.TypeNS)
+	probe.SetEdns0(minUDPBufferSize, false)
+	opt := probe.IsEdns0()
+	opt.Option = append(opt.Option, &dns.EDNS0_NSID{Code: dns.EDNS0NSID})
+	probeReq := &request.Request{W: req.W, Req: probe}
+
+	ctx, cancel := context.WithTimeout(ctx, f.Timeout)
+	defer cancel()
+	result := f.getFanoutResult(ctx, probeReq, f.runWorkers(ctx, probeReq))
+	if result == nil || result.err != nil || result.response.IsEdns0() == nil {
+		return ""
+	}
+	for _, o := range result.response.IsEdns0().Option {
+		if nsid, ok := o.(*dns.EDNS0_NSID); ok {
+			if b, err := hex.DecodeString(nsid.Nsid); err == nil {
+				return string(b)
+			}
+		}
+	}
+	return ""
+}
@@ -0,0 +1,134 @@
+// Copyright (c) 2024 MWS and/or its affiliates.
+//
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at:
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fanout
+
+import (
+	"context"
+	"encoding/hex"
+	"sync/atomic"
+	"testing"
+
+	"github.com/coredns/caddy"
+	"github.com/coredns/coredns/plugin/pkg/dnstest"
+	"github.com/coredns/coredns/plugin/test"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+)
+
+func TestClassFilter(t *testing.T) {
+	var upstream atomic.Int32
+	s := newServer(UDP, func(w dns.ResponseWriter, r *dns.Msg) {
+		upstream.Add(1)
+		msg := new(dns.Msg)
+		msg.SetReply(r)
+		logErrIfNotNil(w.WriteMsg(msg))
+	})
+	defer s.close()
+
+	serve := func(config string, class uint16) (*dnstest.Recorder, int) {
+		fs, err := parseFanout(caddy.NewTestController("dns", "fanout . "+s.addr+" {\n"+config+"\n}"))
+		require.NoError(t, err)
+		fs[0].Next = test.HandlerFunc(func(_ context.Context, w dns.ResponseWriter, r *dns.Msg) (int, error) {
+			msg := new(dns.Msg)
+			msg.SetRcode(r, dns.RcodeNameError)
+			logErrIfNotNil(w.WriteMsg(msg))
+			return dns.RcodeNameError, nil
+		})
+		req := new(dns.Msg)
+		req.SetQuestion("hostname.bind.", dns.TypeTXT)
+		req.Question[0].Qclass = class
+		rec := dnstest.NewRecorder(&test.ResponseWriter{})
+		rcode, err := fs[0].ServeDNS(context.Background(), rec, req)
+		require.NoError(t, err)
+		return rec, rcode
+	}
+
+	_, rcode := serve("qclass-filter refuse", dns.ClassCHAOS)
+	require.Equal(t, dns.RcodeRefused, rcode)
+	rec, _ := serve("qclass-filter drop", dns.ClassANY)
+	require.Nil(t, rec.Msg)
+	rec, _ = serve("qclass-filter next", dns.ClassHESIOD)
+	require.Equal(t, dns.RcodeNameError, rec.Msg.Rcode)
+	require.Zero(t, upstream.Load())
+
+	_, rcode = serve("qclass-filter refuse HS", dns.ClassCHAOS)
+	require.Equal(t, dns.RcodeSuccess, rcode)
+	require.Equal(t, int32(1), upstream.Load(), "unlisted classes go to the upstreams")
+	rec, _ = serve("qclass-filter refuse", dns.ClassINET)
+	require.Equal(t, dns.RcodeSuccess, rec.Msg.Rcode)
+	require.Equal(t, int32(2), upstream.Load())
+}
+
+func TestChaosVersion(t *testing.T) {
+	fs, err := parseFanout(caddy.NewTestController("dns", "fanout . 127.0.0.1 {\nchaos-version fanout 2.0\nqclass-filter refuse\n}"))
+	require.NoError(t, err)
+	for _, name := range []string{"version.bind.", "VERSION.server."} {
+		req := new(dns.Msg)
+		req.SetQuestion(name, dns.TypeTXT)
+		req.Question[0].Qclass = dns.ClassCHAOS
+		rec := dnstest.NewRecorder(&test.ResponseWriter{})
+		_, err := fs[0].ServeDNS(context.Background(), rec, req)
+		require.NoError(t, err)
+		require.Len(t, rec.Msg.Answer, 1)
+		require.Equal(t, []string{"fanout 2.0"}, rec.Msg.Answer[0].(*dns.TXT).Txt)
+		require.Equal(t, uint16(dns.ClassCHAOS), rec.Msg.Answer[0].Header().Class)
+	}
+
+	tests := map[string]string{
+		"qclass-filter":              "Wrong argument count",
+		"qclass-filter ignore":       "unknown qclass-filter action",
+		"qclass-filter refuse BOGUS": "unknown class",
+		"qclass-filter refuse IN":    "can't filter the IN class",
+		"chaos-version":              "Wrong argument count",
+	}
+	for option, expectedErr := range tests {
+		_, err := parseFanout(caddy.NewTestController("dns", "fanout . 127.0.0.1 {\n"+option+"\n}"))
+		require.ErrorContains(t, err, expectedErr, option)
+	}
+}
+
+func TestChaosID(t *testing.T) {
+	s := newServer(UDP, func(w dns.ResponseWriter, r *dns.Msg) {
+		msg := new(dns.Msg)
+		msg.SetReply(r)
+		if r.Question[0].Qclass != dns.ClassINET || r.IsEdns0() == nil {
+			msg.Rcode = dns.RcodeRefused
+		} else {
+			msg.SetEdns0(minUDPBufferSize, false)
+			opt := msg.IsEdns0()
+			opt.Option = append(opt.Option, &dns.EDNS0_NSID{Code: dns.EDNS0NSID, Nsid: hex.EncodeToString([]byte("pop-ams1"))})
+		}
+		logErrIfNotNil(w.WriteMsg(msg))
+	})
+	defer s.close()
+
+	chaosTXT := func(option, name string) []string {
+		fs, err := parseFanout(caddy.NewTestController("dns", "fanout . "+s.addr+" {\n"+option+"\n}"))
+		require.NoError(t, err)
+		req := new(dns.Msg)
+		req.SetQuestion(name, dns.TypeTXT)
+		req.Question[0].Qclass = dns.ClassCHAOS
+		rec := dnstest.NewRecorder(&test.ResponseWriter{})
+		_, err = fs[0].ServeDNS(context.Background(), rec, req)
+		require.NoError(t, err)
+		require.Len(t, rec.Msg.Answer, 1)
+		return rec.Msg.Answer[0].(*dns.TXT).Txt
+	}
+	require.Equal(t, []string{"edge-1"}, chaosTXT("chaos-id edge-1", "id.server."))
+	require.Equal(t, []string{"edge-1"}, chaosTXT("chaos-id edge-1", "hostname.bind."))
+	require.Equal(t, []string{"pop-ams1"}, chaosTXT("chaos-id nsid", "id.server."))
+}
@@ -0,0 +1,73 @@
+// Copyright (c) 2024 MWS and/or its affiliates.
+//
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at:
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fanout
+
+import (
+	"slices"
+	"strings"
+
+	"github.com/coredns/caddy/caddyfile"
+	"github.com/miekg/dns"
+	"github.com/pkg/errors"
+)
+
+// parseQtypeGroup parses `qtype TYPE... { to ADDR... }` blocks.
+func parseQtypeGroup(f *Fanout, c *caddyfile.Dispenser) error {
+	args := c.RemainingArgs()
+	if len(args) == 0 {
+		return c.ArgErr()
+	}
+	g := &upstreamGroup{}
+	for _, arg := range args {
+		qtype, ok := dns.StringToType[strings.ToUpper(arg)]
+		if !ok {
+			return errors.Errorf("unknown qtype %q", arg)
+		}
+		if f.qtypeGroup(qtype) != nil || slices.Contains(g.qtypes, qtype) {
+			return errors.Errorf("qtype %s is routed to more than one group", arg)
+		}
+		g.qtypes = append(g.qtypes, qtype)
+	}
+	for c.NextBlock() {
+		if strings.ToLower(c.Val()) != "to" {
+			return errors.Errorf("unknown qtype property %v", c.Val())
+		}
+		to := c.RemainingArgs()
+		if len(to) == 0 {
+			return c.ArgErr()
+		}
+		hosts, err := parseHosts(to)
+		if err != nil {
+			return err
+		}
+		g.hosts = append(g.hosts, hosts...)
+	}
+	if len(g.hosts) == 0 {
+		return errors.Errorf("qtype %s has no upstreams", strings.Join(args, " "))
+	}
+	f.groups = append(f.groups, g)
+	return nil
+}
+
+func (f *Fanout) qtypeGroup(qtype uint16) *upstreamGroup {
+	for _, g := range f.groups {
+		if slices.Contains(g.qtypes, qtype) {
+			return g
+		}
+	}
+	return nil
+}
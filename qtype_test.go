@@ -0,0 +1,74 @@
+// Copyright (c) 2024 MWS and/or its affiliates.
+//
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at:
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fanout
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/coredns/caddy"
+	"github.com/coredns/coredns/plugin/test"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+)
+
+func TestQtypeGroupRouting(t *testing.T) {
+	named := func(target string) func(w dns.ResponseWriter, r *dns.Msg) {
+		return func(w dns.ResponseWriter, r *dns.Msg) {
+			rr, err := dns.NewRR(fmt.Sprintf("%s 3600 IN TXT %q", r.Question[0].Name, target))
+			require.NoError(t, err)
+			msg := dns.Msg{Answer: []dns.RR{rr}}
+			msg.SetReply(r)
+			logErrIfNotNil(w.WriteMsg(&msg))
+		}
+	}
+	forward := newServer(UDP, named("forward"))
+	defer forward.close()
+	reverse := newServer(UDP, named("reverse"))
+	defer reverse.close()
+
+	input := fmt.Sprintf("fanout . %s {\nqtype PTR {\nto %s\n}\npolicy weighted-random\n}", forward.addr, reverse.addr)
+	fs, err := parseFanout(caddy.NewTestController("dns", input))
+	require.NoError(t, err)
+	f := fs[0]
+	require.Len(t, f.upstreams(), 2)
+
+	for qtype, expected := range map[uint16]string{dns.TypePTR: "reverse", dns.TypeA: "forward", dns.TypeTXT: "forward"} {
+		req := new(dns.Msg)
+		req.SetQuestion("1.0.0.10.in-addr.arpa.", qtype)
+		writer := &cachedDNSWriter{ResponseWriter: new(test.ResponseWriter)}
+		_, err = f.ServeDNS(context.Background(), writer, req)
+		require.NoError(t, err)
+		require.Len(t, writer.answers, 1)
+		require.Equal(t, []string{expected}, writer.answers[0].Answer[0].(*dns.TXT).Txt, dns.TypeToString[qtype])
+	}
+}
+
+func TestSetupQtypeGroup(t *testing.T) {
+	for input, expectedErr := range map[string]string{
+		"qtype {\nto 127.0.0.2\n}":                                   "Wrong argument count",
+		"qtype BOGUS {\nto 127.0.0.2\n}":                             "unknown qtype",
+		"qtype PTR {\n}":                                             "has no upstreams",
+		"qtype PTR {\nto\n}":                                         "Wrong argument count",
+		"qtype PTR {\nfrom 127.0.0.2\n}":                             "unknown qtype property",
+		"qtype PTR {\nto 127.0.0.2\n}\nqtype ptr {\nto 127.0.0.3\n}": "more than one group",
+	} {
+		_, err := parseFanout(caddy.NewTestController("dns", "fanout . 127.0.0.1 {\n"+input+"\n}"))
+		require.ErrorContains(t, err, expectedErr, input)
+	}
+}
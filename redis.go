@@ -0,0 +1,186 @@
+// Copyright (c) 2024 MWS and/or its affiliates.
+//
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at:
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fanout
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// errRedisNil is returned for the nil reply of a missing key.
+var errRedisNil = errors.New("redis: nil")
+
+// redisConn is a connection to a Redis server with its reply reader.
+type redisConn struct {
+	conn net.Conn
+	r    *bufio.Reader
+}
+
+// redisBackend is the shared tier of the response cache: a Redis server, or any server speaking its protocol,
+// spoken to with the GET and SET commands over a pool of connections.
+type redisBackend struct {
+	addr   string
+	prefix string
+	dial   DialFunc
+	mutex  sync.Mutex
+	idle   []*redisConn
+}
+
+func newRedisBackend(addr, prefix string) *redisBackend {
+	return &redisBackend{addr: addr, prefix: prefix, dial: (&net.Dialer{Timeout: redisTimeout}).DialContext}
+}
+
+// get returns the value of key, or errRedisNil if it is missing.
+func (b *redisBackend) get(ctx context.Context, key string) ([]byte, error) {
+	return b.do(ctx, []byte("GET"), []byte(b.prefix+key))
+}
+
+// set stores value at key, expiring after ttl.
+func (b *redisBackend) set(ctx context.Context, key string, value []byte, ttl time.Duration) error {
+	_, err := b.do(ctx, []byte("SET"), []byte(b.prefix+key), value, []byte("PX"), []byte(strconv.FormatInt(ttl.Milliseconds(), 10)))
+	return err
+}
+
+// do sends a command and returns its reply, within redisTimeout. Connections failing are closed, the others
+// are kept for the next commands.
+func (b *redisBackend) do(ctx context.Context, args ...[]byte) ([]byte, error) {
+	c, err := b.conn(ctx)
+	if err != nil {
+		return nil, err
+	}
+	deadline := time.Now().Add(redisTimeout)
+	if d, ok := ctx.Deadline(); ok {
+		deadline = minTime(deadline, d)
+	}
+	if err = c.conn.SetDeadline(deadline); err != nil {
+		_ = c.conn.Close()
+		return nil, err
+	}
+	if _, err = c.conn.Write(appendRedisCommand(nil, args)); err != nil {
+		_ = c.conn.Close()
+		return nil, err
+	}
+	reply, err := readRedisReply(c.r)
+	if err != nil && !errors.Is(err, errRedisNil) && !isRedisError(err) {
+		_ = c.conn.Close()
+		return nil, err
+	}
+	b.yield(c)
+	return reply, err
+}
+
+func (b *redisBackend) conn(ctx context.Context) (*redisConn, error) {
+	b.mutex.Lock()
+	if n := len(b.idle); n > 0 {
+		c := b.idle[n-1]
+		b.idle = b.idle[:n-1]
+		b.mutex.Unlock()
+		return c, nil
+	}
+	b.mutex.Unlock()
+	conn, err := b.dial(ctx, TCP, b.addr)
+	if err != nil {
+		return nil, err
+	}
+	return &redisConn{conn: conn, r: bufio.NewReader(conn)}, nil
+}
+
+func (b *redisBackend) yield(c *redisConn) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if len(b.idle) >= maxPooledConns {
+		_ = c.conn.Close()
+		return
+	}
+	b.idle = append(b.idle, c)
+}
+
+// close closes the idle connections.
+func (b *redisBackend) close() {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	for _, c := range b.idle {
+		_ = c.conn.Close()
+	}
+	b.idle = nil
+}
+
+// redisError is an error reply of the server.
+type redisError string
+
+func (e redisError) Error() string {
+	return "redis: " + string(e)
+}
+
+func isRedisError(err error) bool {
+	var re redisError
+	return errors.As(err, &re)
+}
+
+// appendRedisCommand appends the command made of args, as an array of bulk strings, to buf.
+func appendRedisCommand(buf []byte, args [][]byte) []byte {
+	buf = append(buf, '*')
+	buf = strconv.AppendInt(buf, int64(len(args)), 10)
+	buf = append(buf, '\r', '\n')
+	for _, arg := range args {
+		buf = append(buf, '$')
+		buf = strconv.AppendInt(buf, int64(len(arg)), 10)
+		buf = append(buf, '\r', '\n')
+		buf = append(buf, arg...)
+		buf = append(buf, '\r', '\n')
+	}
+	return buf
+}
+
+// readRedisReply reads a simple string, error, integer or bulk string reply.
+func readRedisReply(r *bufio.Reader) ([]byte, error) {
+	line, err := r.ReadSlice('\n')
+	if err != nil {
+		return nil, err
+	}
+	if len(line) < 3 || line[len(line)-2] != '\r' {
+		return nil, errors.New("redis: malformed reply")
+	}
+	kind, line := line[0], line[1:len(line)-2]
+	switch kind {
+	case '+', ':':
+		return append([]byte(nil), line...), nil
+	case '-':
+		return nil, redisError(line)
+	case '$':
+		n, err := strconv.Atoi(string(line))
+		if err != nil || n > maxCacheEntrySize {
+			return nil, errors.New("redis: malformed bulk reply")
+		}
+		if n < 0 {
+			return nil, errRedisNil
+		}
+		value := make([]byte, n+2)
+		if _, err = io.ReadFull(r, value); err != nil {
+			return nil, err
+		}
+		return value[:n], nil
+	}
+	return nil, errors.Errorf("redis: unsupported reply type %q", kind)
+}
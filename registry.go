@@ -0,0 +1,81 @@
+// Copyright (c) 2024 MWS and/or its affiliates.
+//
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at:
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fanout
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+// upstreamState is the state of an upstream shared by all fanout instances referencing its endpoint,
+// so several blocks forwarding to the same upstream share its statistics and a single health probe.
+type upstreamState struct {
+	stats   upstreamStats
+	healthy atomic.Bool
+	probers int
+	stop    chan struct{}
+}
+
+// upstreamRegistry is the process-wide registry of upstream states keyed by endpoint.
+type upstreamRegistry struct {
+	mutex     sync.Mutex
+	upstreams map[string]*upstreamState
+}
+
+var registry = &upstreamRegistry{upstreams: map[string]*upstreamState{}}
+
+func (r *upstreamRegistry) get(addr string) *upstreamState {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return r.getLocked(addr)
+}
+
+func (r *upstreamRegistry) getLocked(addr string) *upstreamState {
+	s, ok := r.upstreams[addr]
+	if !ok {
+		s = &upstreamState{}
+		r.upstreams[addr] = s
+	}
+	return s
+}
+
+// acquireProbe registers an instance interested in the health of the upstream of c. The first instance
+// starts the probe, the others share it.
+func (r *upstreamRegistry) acquireProbe(c Client, run func(c Client, s *upstreamState, stop <-chan struct{})) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	s := r.getLocked(c.Endpoint())
+	s.probers++
+	if s.probers == 1 {
+		s.stop = make(chan struct{})
+		go run(c, s, s.stop)
+	}
+}
+
+// releaseProbe unregisters an instance, stopping the probe of the upstream once no instance is left.
+func (r *upstreamRegistry) releaseProbe(addr string) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	s, ok := r.upstreams[addr]
+	if !ok || s.probers == 0 {
+		return
+	}
+	s.probers--
+	if s.probers == 0 {
+		close(s.stop)
+	}
+}
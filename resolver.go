@@ -0,0 +1,278 @@
+// Copyright (c) 2024 MWS and/or its affiliates.
+//
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at:
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fanout
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"net/netip"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/coredns/caddy/caddyfile"
+	"github.com/coredns/coredns/plugin/pkg/parse"
+	"github.com/coredns/coredns/plugin/pkg/transport"
+	"github.com/miekg/dns"
+	"github.com/pkg/errors"
+)
+
+// hostResolver resolves the hostnames of upstreams, racing the system resolver and the bootstrap servers,
+// and keeps the addresses for their TTL. Addresses are refreshed in the background once they expire, and
+// kept as they are while the hostname can't be resolved.
+type hostResolver struct {
+	servers []string
+	now     func() time.Time
+	// system resolves with the resolver of the OS, which doesn't report TTLs.
+	system func(ctx context.Context, host string) ([]netip.Addr, error)
+	mutex  sync.Mutex
+	hosts  map[string]*resolvedHost
+}
+
+type resolvedHost struct {
+	addrs  []netip.Addr
+	expiry time.Time
+}
+
+func newHostResolver(f *Fanout, servers []string) *hostResolver {
+	return &hostResolver{
+		servers: servers,
+		now:     func() time.Time { return f.clock.Now() },
+		system: func(ctx context.Context, host string) ([]netip.Addr, error) {
+			return net.DefaultResolver.LookupNetIP(ctx, "ip", host)
+		},
+		hosts: map[string]*resolvedHost{},
+	}
+}
+
+// parseBootstrap parses `bootstrap [ADDRESS...]`.
+func parseBootstrap(f *Fanout, c *caddyfile.Dispenser) error {
+	var servers []string
+	for _, arg := range c.RemainingArgs() {
+		addr, err := normalizeAddr(arg, transport.Port)
+		if err != nil {
+			return errors.Wrapf(err, "invalid bootstrap server %q", arg)
+		}
+		if _, err := netip.ParseAddr(addrHost(addr)); err != nil {
+			return errors.Errorf("bootstrap server %q must be an IP address", arg)
+		}
+		servers = append(servers, addr)
+	}
+	f.hostResolver = newHostResolver(f, servers)
+	return nil
+}
+
+// hostnameUpstream normalizes an upstream of the TO list with a hostname to host:port, prefixed with its
+// scheme unless it is plain DNS.
+func hostnameUpstream(addr string) (string, error) {
+	scheme, host := transport.DNS, addr
+	if s, h, ok := strings.Cut(addr, "://"); ok {
+		scheme, host = strings.ToLower(s), h
+	}
+	port, ok := defaultPorts[scheme]
+	if !ok {
+		return "", errors.Errorf("unsupported upstream scheme in %q", addr)
+	}
+	hostPort, err := normalizeAddr(host, port)
+	if err != nil {
+		return "", err
+	}
+	name := addrHost(hostPort)
+	if _, ok := dns.IsDomainName(name); !ok || strings.ContainsAny(name, `/\`) {
+		return "", errors.Errorf("invalid hostname %q", name)
+	}
+	if scheme == transport.DNS {
+		return hostPort, nil
+	}
+	return scheme + "://" + hostPort, nil
+}
+
+// upstreamHostname returns the hostname of a plain DNS or DNS-over-TLS upstream, empty if it is an IP
+// address.
+func upstreamHostname(host string) string {
+	if _, ok := lookupClientFactory(host); ok || isDoH(host) || isODoH(host) {
+		return ""
+	}
+	_, h := parse.Transport(host)
+	name := addrHost(h)
+	if _, err := netip.ParseAddr(name); err == nil {
+		return ""
+	}
+	return name
+}
+
+// checkHostnames makes sure upstreams given by hostname can be resolved.
+func checkHostnames(f *Fanout, hosts []string) error {
+	if f.hostResolver != nil {
+		return nil
+	}
+	all := slices.Concat(hosts, f.mirrorTo, f.shadowTo)
+	for _, g := range f.groups {
+		all = append(all, g.hosts...)
+	}
+	for _, host := range all {
+		if upstreamHostname(host) != "" {
+			return errors.Errorf("not an IP address or file %q, upstream hostnames require bootstrap", host)
+		}
+	}
+	return nil
+}
+
+// upstreamTLSConfig returns the TLS configuration of the upstream at addr, verifying the certificate of an
+// upstream given by hostname against it unless tls-server is set.
+func (f *Fanout) upstreamTLSConfig(addr string) *tls.Config {
+	host := upstreamHostname(addr)
+	if host == "" || f.tlsConfig.ServerName != "" {
+		return f.tlsConfig
+	}
+	cfg := f.tlsConfig.Clone()
+	cfg.ServerName = host
+	return cfg
+}
+
+// dialer returns a DialFunc resolving host and dialing its addresses with dial, one after the other until
+// one accepts the connection.
+func (r *hostResolver) dialer(host string, dial DialFunc) DialFunc {
+	r.mutex.Lock()
+	if _, ok := r.hosts[host]; !ok {
+		r.hosts[host] = &resolvedHost{}
+	}
+	r.mutex.Unlock()
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		_, port, err := net.SplitHostPort(addr)
+		if err != nil {
+			return nil, err
+		}
+		addrs, err := r.lookup(ctx, host)
+		if err != nil {
+			return nil, err
+		}
+		for _, ip := range addrs {
+			var conn net.Conn
+			if conn, err = dial(ctx, network, net.JoinHostPort(ip.String(), port)); err == nil {
+				return conn, nil
+			}
+		}
+		return nil, err
+	}
+}
+
+// lookup returns the addresses of host, resolving it if it hasn't been yet. Expired addresses are
+// returned as they are, the refresh task renews them.
+func (r *hostResolver) lookup(ctx context.Context, host string) ([]netip.Addr, error) {
+	r.mutex.Lock()
+	h, ok := r.hosts[host]
+	r.mutex.Unlock()
+	if ok && len(h.addrs) > 0 {
+		return h.addrs, nil
+	}
+	return r.resolve(ctx, host)
+}
+
+// resolve races the resolvers for the addresses of host and caches the first answer.
+func (r *hostResolver) resolve(ctx context.Context, host string) ([]netip.Addr, error) {
+	type answer struct {
+		addrs []netip.Addr
+		ttl   time.Duration
+		err   error
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	answers := make(chan answer, len(r.servers)+1)
+	go func() {
+		addrs, err := r.system(ctx, host)
+		answers <- answer{addrs: addrs, ttl: defaultHostTTL, err: err}
+	}()
+	for _, server := range r.servers {
+		go func() {
+			addrs, ttl, err := queryAddrs(ctx, server, host)
+			answers <- answer{addrs: addrs, ttl: ttl, err: err}
+		}()
+	}
+	var err error
+	for range len(r.servers) + 1 {
+		a := <-answers
+		if a.err == nil && len(a.addrs) == 0 {
+			a.err = errors.Errorf("no addresses for %s", host)
+		}
+		if a.err != nil {
+			err = a.err
+			continue
+		}
+		ttl := min(max(a.ttl, minHostTTL), maxHostTTL)
+		r.mutex.Lock()
+		r.hosts[host] = &resolvedHost{addrs: a.addrs, expiry: r.now().Add(ttl)}
+		r.mutex.Unlock()
+		return a.addrs, nil
+	}
+	return nil, errors.Wrapf(err, "resolving upstream %s", host)
+}
+
+// queryAddrs queries server for the A and AAAA records of host, returning the addresses and their
+// smallest TTL.
+func queryAddrs(ctx context.Context, server, host string) ([]netip.Addr, time.Duration, error) {
+	var addrs []netip.Addr
+	ttl := maxHostTTL
+	for _, qtype := range []uint16{dns.TypeA, dns.TypeAAAA} {
+		m := new(dns.Msg)
+		m.SetQuestion(dns.Fqdn(host), qtype)
+		resp, err := dns.ExchangeContext(ctx, m, server)
+		if err != nil {
+			return nil, 0, err
+		}
+		for _, rr := range resp.Answer {
+			var ip net.IP
+			switch rr := rr.(type) {
+			case *dns.A:
+				ip = rr.A
+			case *dns.AAAA:
+				ip = rr.AAAA
+			default:
+				continue
+			}
+			if a, ok := netip.AddrFromSlice(ip); ok {
+				addrs = append(addrs, a.Unmap())
+				ttl = min(ttl, time.Duration(rr.Header().Ttl)*time.Second)
+			}
+		}
+	}
+	return addrs, ttl, nil
+}
+
+// task resolves the hostnames on startup, then again once their addresses expire.
+func (r *hostResolver) task() task {
+	return task{interval: minHostTTL, jitter: taskJitter, immediate: true, run: func(now time.Time) bool {
+		r.mutex.Lock()
+		var expired []string
+		for host, h := range r.hosts {
+			if !now.Before(h.expiry) {
+				expired = append(expired, host)
+			}
+		}
+		r.mutex.Unlock()
+		for _, host := range expired {
+			ctx, cancel := context.WithTimeout(context.Background(), maxTimeout)
+			if _, err := r.resolve(ctx, host); err != nil {
+				log.Warningf("fanout: %v", err)
+			}
+			cancel()
+		}
+		return true
+	}}
+}
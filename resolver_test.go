@@ -0,0 +1,131 @@
+// Copyright (c) 2024 MWS and/or its affiliates.
+//
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at:
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fanout
+
+import (
+	"context"
+	"net"
+	"net/netip"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/coredns/caddy"
+	"github.com/coredns/coredns/plugin/pkg/dnstest"
+	"github.com/coredns/coredns/plugin/test"
+	"github.com/hurricanehrndz/fanout/v2/clock"
+	"github.com/miekg/dns"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+)
+
+// newBootstrapServer returns a server resolving upstream.test. to 127.0.0.1 with a TTL of one minute,
+// counting its A queries.
+func newBootstrapServer(queries *atomic.Int32) *server {
+	return newServer(UDP, func(w dns.ResponseWriter, r *dns.Msg) {
+		msg := new(dns.Msg)
+		msg.SetReply(r)
+		if r.Question[0].Qtype == dns.TypeA && r.Question[0].Name == "upstream.test." {
+			queries.Add(1)
+			msg.Answer = []dns.RR{makeRecordA("upstream.test. 60 IN A 127.0.0.1")}
+		}
+		logErrIfNotNil(w.WriteMsg(msg))
+	})
+}
+
+func TestHostnameUpstreamResolvedThroughBootstrap(t *testing.T) {
+	upstream := newServer(UDP, func(w dns.ResponseWriter, r *dns.Msg) {
+		msg := dns.Msg{Answer: []dns.RR{makeRecordA("example1. 3600 IN A 10.0.0.1")}}
+		msg.SetReply(r)
+		logErrIfNotNil(w.WriteMsg(&msg))
+	})
+	defer upstream.close()
+	var queries atomic.Int32
+	bootstrap := newBootstrapServer(&queries)
+	defer bootstrap.close()
+	_, port, err := net.SplitHostPort(upstream.addr)
+	require.NoError(t, err)
+
+	fs, err := parseFanout(caddy.NewTestController("dns", "fanout . upstream.test:"+port+" {\nbootstrap "+bootstrap.addr+"\n}"))
+	require.NoError(t, err)
+	f := fs[0]
+	f.hostResolver.system = func(context.Context, string) ([]netip.Addr, error) {
+		return nil, errors.New("no such host")
+	}
+	require.Equal(t, "upstream.test:"+port, f.clients[0].Endpoint())
+
+	req := new(dns.Msg)
+	req.SetQuestion(testQuery, dns.TypeA)
+	rec := dnstest.NewRecorder(&test.ResponseWriter{})
+	_, err = f.ServeDNS(context.Background(), rec, req)
+	require.NoError(t, err)
+	require.Equal(t, dns.RcodeSuccess, rec.Msg.Rcode)
+	require.Len(t, rec.Msg.Answer, 1)
+	require.Equal(t, int32(1), queries.Load())
+
+	_, err = parseFanout(caddy.NewTestController("dns", "fanout . upstream.test"))
+	require.ErrorContains(t, err, "upstream hostnames require bootstrap")
+	_, err = parseFanout(caddy.NewTestController("dns", "fanout . upstream.test {\nbootstrap upstream.test\n}"))
+	require.ErrorContains(t, err, "must be an IP address")
+}
+
+func TestHostResolverRefreshesExpiredAddresses(t *testing.T) {
+	var queries atomic.Int32
+	bootstrap := newBootstrapServer(&queries)
+	defer bootstrap.close()
+
+	clk := clock.NewManual(time.Now())
+	f := New()
+	f.clock = clk
+	r := newHostResolver(f, []string{bootstrap.addr})
+	var system atomic.Int32
+	r.system = func(ctx context.Context, _ string) ([]netip.Addr, error) {
+		system.Add(1)
+		<-ctx.Done()
+		return nil, ctx.Err()
+	}
+	r.dialer("upstream.test", nil)
+
+	refresh := r.task().run
+	refresh(clk.Now())
+	require.Equal(t, int32(1), queries.Load(), "hostnames are resolved on startup")
+	addrs, err := r.lookup(context.Background(), "upstream.test")
+	require.NoError(t, err)
+	require.Equal(t, []netip.Addr{netip.MustParseAddr("127.0.0.1")}, addrs)
+
+	clk.Advance(59 * time.Second)
+	refresh(clk.Now())
+	require.Equal(t, int32(1), queries.Load(), "addresses are kept for their TTL")
+	clk.Advance(time.Second)
+	refresh(clk.Now())
+	require.Equal(t, int32(2), queries.Load())
+	require.Eventually(t, func() bool { return system.Load() == 2 }, time.Second, time.Millisecond, "the system resolver races the bootstrap servers")
+}
+
+func TestHostResolverFallsBackToSystem(t *testing.T) {
+	f := New()
+	r := newHostResolver(f, []string{"127.0.0.1:1"})
+	r.system = func(context.Context, string) ([]netip.Addr, error) {
+		return []netip.Addr{netip.MustParseAddr("192.0.2.1")}, nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	addrs, err := r.lookup(ctx, "upstream.test")
+	require.NoError(t, err)
+	require.Equal(t, []netip.Addr{netip.MustParseAddr("192.0.2.1")}, addrs)
+	require.WithinDuration(t, f.clock.Now().Add(defaultHostTTL), r.hosts["upstream.test"].expiry, time.Second)
+}
@@ -0,0 +1,64 @@
+// Copyright (c) 2024 MWS and/or its affiliates.
+//
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at:
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fanout
+
+import (
+	"slices"
+	"strings"
+
+	"github.com/coredns/caddy/caddyfile"
+	"github.com/miekg/dns"
+	"github.com/pkg/errors"
+)
+
+// parseAllowTypes parses `allow-types TYPE...`.
+func parseAllowTypes(f *Fanout, c *caddyfile.Dispenser) error {
+	args := c.RemainingArgs()
+	if len(args) == 0 {
+		return c.ArgErr()
+	}
+	for _, arg := range args {
+		rrtype, ok := dns.StringToType[strings.ToUpper(arg)]
+		if !ok {
+			return errors.Errorf("unknown type %q", arg)
+		}
+		f.allowTypes = append(f.allowTypes, rrtype)
+	}
+	return nil
+}
+
+// filterTypes strips the records whose type isn't allowed from the answer and additional sections of m,
+// for stub resolvers which can't cope with them. Signatures are kept when they cover an allowed type. The
+// authority section is left alone, as negative answers need its SOA record.
+func (f *Fanout) filterTypes(m *dns.Msg) {
+	if len(f.allowTypes) == 0 {
+		return
+	}
+	m.Answer = slices.DeleteFunc(m.Answer, f.disallowedType)
+	m.Extra = slices.DeleteFunc(m.Extra, f.disallowedType)
+}
+
+func (f *Fanout) disallowedType(rr dns.RR) bool {
+	rrtype := rr.Header().Rrtype
+	switch rr := rr.(type) {
+	case *dns.OPT:
+		return false
+	case *dns.RRSIG:
+		rrtype = rr.TypeCovered
+	}
+	return !slices.Contains(f.allowTypes, rrtype)
+}
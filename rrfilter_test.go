@@ -0,0 +1,80 @@
+// Copyright (c) 2024 MWS and/or its affiliates.
+//
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at:
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fanout
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/coredns/caddy"
+	"github.com/coredns/coredns/plugin/test"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFilterTypes(t *testing.T) {
+	f := New()
+	f.allowTypes = []uint16{dns.TypeA, dns.TypeCNAME}
+	m := answerMsg(t,
+		"a.example. 300 IN CNAME b.example.",
+		"b.example. 300 IN A 198.51.100.1",
+		"b.example. 300 IN HTTPS 1 . alpn=h2",
+		"b.example. 300 IN RRSIG A 8 2 300 20300101000000 20200101000000 1 example. AAAA",
+		"b.example. 300 IN RRSIG HTTPS 8 2 300 20300101000000 20200101000000 1 example. AAAA",
+	)
+	m.Ns = answerMsg(t, "example. 300 IN SOA ns.example. admin.example. 1 2 3 4 5").Answer
+	m.Extra = answerMsg(t, "b.example. 300 IN SVCB 1 . alpn=h2").Answer
+	m.SetEdns0(1232, false)
+	f.filterTypes(m)
+
+	var types []string
+	for _, rr := range m.Answer {
+		types = append(types, dns.TypeToString[rr.Header().Rrtype])
+	}
+	require.Equal(t, []string{"CNAME", "A", "RRSIG"}, types)
+	require.Len(t, m.Ns, 1, "the authority section is kept")
+	require.Len(t, m.Extra, 1)
+	require.NotNil(t, m.IsEdns0())
+}
+
+func TestAllowTypes(t *testing.T) {
+	s := newServer(UDP, func(w dns.ResponseWriter, r *dns.Msg) {
+		msg := answerMsg(t, testQuery+" 300 IN A 198.51.100.1", testQuery+" 300 IN TXT \"grab-bag\"")
+		msg.SetReply(r)
+		logErrIfNotNil(w.WriteMsg(msg))
+	})
+	defer s.close()
+
+	fs, err := parseFanout(caddy.NewTestController("dns", fmt.Sprintf("fanout . %s {\nallow-types a aaaa\n}", s.addr)))
+	require.NoError(t, err)
+	require.Equal(t, []uint16{dns.TypeA, dns.TypeAAAA}, fs[0].allowTypes)
+
+	req := new(dns.Msg)
+	req.SetQuestion(testQuery, dns.TypeANY)
+	writer := &cachedDNSWriter{ResponseWriter: new(test.ResponseWriter)}
+	_, err = fs[0].ServeDNS(context.Background(), writer, req)
+	require.NoError(t, err)
+	require.Len(t, writer.answers, 1)
+	require.Len(t, writer.answers[0].Answer, 1)
+	require.Equal(t, dns.TypeA, writer.answers[0].Answer[0].Header().Rrtype)
+
+	_, err = parseFanout(caddy.NewTestController("dns", "fanout . 127.0.0.1 {\nallow-types BOGUS\n}"))
+	require.ErrorContains(t, err, "unknown type")
+	_, err = parseFanout(caddy.NewTestController("dns", "fanout . 127.0.0.1 {\nallow-types\n}"))
+	require.Error(t, err)
+}
@@ -0,0 +1,141 @@
+// Copyright (c) 2024 MWS and/or its affiliates.
+//
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at:
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fanout
+
+import (
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// scheduleWindow is a daily time window, optionally limited to some days of the week. A window ending
+// before it starts spans midnight and belongs to the day it starts on.
+type scheduleWindow struct {
+	days  uint8
+	start time.Duration
+	end   time.Duration
+}
+
+// schedule lists the windows during which an upstream is active.
+type schedule []scheduleWindow
+
+var weekdays = map[string]time.Weekday{
+	"sun": time.Sunday, "mon": time.Monday, "tue": time.Tuesday, "wed": time.Wednesday,
+	"thu": time.Thursday, "fri": time.Friday, "sat": time.Saturday,
+}
+
+// parseSchedule parses comma-separated windows formatted as [DAY[-DAY]@]HH:MM-HH:MM, e.g.
+// "mon-fri@08:00-18:00,sat@09:00-12:00".
+func parseSchedule(value string) (schedule, error) {
+	var s schedule
+	for _, spec := range strings.Split(value, ",") {
+		w, err := parseScheduleWindow(strings.ToLower(spec))
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid schedule window %q", spec)
+		}
+		s = append(s, w)
+	}
+	return s, nil
+}
+
+func parseScheduleWindow(spec string) (scheduleWindow, error) {
+	w := scheduleWindow{days: everyDay}
+	if days, hours, ok := strings.Cut(spec, "@"); ok {
+		var err error
+		if w.days, err = parseDays(days); err != nil {
+			return w, err
+		}
+		spec = hours
+	}
+	start, end, ok := strings.Cut(spec, "-")
+	if !ok {
+		return w, errors.New("expected HH:MM-HH:MM")
+	}
+	var err error
+	if w.start, err = parseTimeOfDay(start); err != nil {
+		return w, err
+	}
+	if w.end, err = parseTimeOfDay(end); err != nil {
+		return w, err
+	}
+	if w.start == w.end {
+		return w, errors.New("the window is empty")
+	}
+	return w, nil
+}
+
+// parseDays parses a day of the week or a range of days, which may wrap around the week, e.g. "fri-mon".
+func parseDays(spec string) (uint8, error) {
+	from, to, _ := strings.Cut(spec, "-")
+	if to == "" {
+		to = from
+	}
+	first, ok := weekdays[from]
+	last, ok2 := weekdays[to]
+	if !ok || !ok2 {
+		return 0, errors.Errorf("unknown days %q", spec)
+	}
+	var days uint8
+	for d := first; ; d = (d + 1) % 7 {
+		days |= 1 << d
+		if d == last {
+			return days, nil
+		}
+	}
+}
+
+// parseTimeOfDay parses HH:MM as the duration since midnight. 24:00 is accepted as the end of the day.
+func parseTimeOfDay(spec string) (time.Duration, error) {
+	h, m, ok := strings.Cut(spec, ":")
+	hours, err := strconv.Atoi(h)
+	if err != nil || !ok {
+		return 0, errors.Errorf("invalid time %q", spec)
+	}
+	minutes, err := strconv.Atoi(m)
+	if err != nil || len(m) != 2 || hours < 0 || minutes < 0 || minutes > 59 || hours*60+minutes > 24*60 {
+		return 0, errors.Errorf("invalid time %q", spec)
+	}
+	return time.Duration(hours)*time.Hour + time.Duration(minutes)*time.Minute, nil
+}
+
+// active returns true if t, in its own location, falls within one of the windows.
+func (s schedule) active(t time.Time) bool {
+	y, m, d := t.Date()
+	sinceMidnight := t.Sub(time.Date(y, m, d, 0, 0, 0, 0, t.Location()))
+	today := t.Weekday()
+	yesterday := (today + 6) % 7
+	for _, w := range s {
+		if w.start < w.end {
+			if w.days&(1<<today) != 0 && sinceMidnight >= w.start && sinceMidnight < w.end {
+				return true
+			}
+			continue
+		}
+		if w.days&(1<<today) != 0 && sinceMidnight >= w.start || w.days&(1<<yesterday) != 0 && sinceMidnight < w.end {
+			return true
+		}
+	}
+	return false
+}
+
+// scheduled returns true unless the upstream with the given endpoint has a schedule inactive at now.
+func (f *Fanout) scheduled(addr string, now time.Time) bool {
+	opts, ok := f.upstreamOptions[addr]
+	return !ok || opts.schedule == nil || opts.schedule.active(now)
+}
@@ -0,0 +1,82 @@
+// Copyright (c) 2024 MWS and/or its affiliates.
+//
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at:
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fanout
+
+import (
+	"testing"
+	"time"
+
+	"github.com/coredns/caddy"
+	"github.com/coredns/coredns/plugin/test"
+	"github.com/coredns/coredns/request"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+
+	"github.com/hurricanehrndz/fanout/v2/clock"
+)
+
+func TestScheduleActive(t *testing.T) {
+	s, err := parseSchedule("mon-fri@08:00-18:00,sat@22:00-02:00")
+	require.NoError(t, err)
+	at := func(day int, hhmm string) time.Time {
+		d, err := parseTimeOfDay(hhmm)
+		require.NoError(t, err)
+		// 2026-10-11 is a Sunday
+		return time.Date(2026, 10, 11+day, 0, 0, 0, 0, time.UTC).Add(d)
+	}
+	require.True(t, s.active(at(1, "08:00")))
+	require.True(t, s.active(at(5, "17:59")))
+	require.False(t, s.active(at(5, "18:00")))
+	require.False(t, s.active(at(0, "12:00")))
+	require.True(t, s.active(at(6, "23:00")))
+	require.True(t, s.active(at(7, "01:00")), "the saturday window spans midnight")
+	require.False(t, s.active(at(1, "01:00")))
+
+	s, err = parseSchedule("fri-mon@00:00-24:00")
+	require.NoError(t, err)
+	require.True(t, s.active(at(0, "12:00")))
+	require.False(t, s.active(at(3, "12:00")))
+
+	for _, bad := range []string{"08:00", "8-18", "mon-fri", "funday@08:00-18:00", "08:00-08:00", "08:60-09:00", "23:00-25:00"} {
+		_, err := parseSchedule(bad)
+		require.Error(t, err, bad)
+	}
+}
+
+func TestScheduledUpstreams(t *testing.T) {
+	fs, err := parseFanout(caddy.NewTestController("dns", `fanout . 127.0.0.1 127.0.0.2 {
+upstream 127.0.0.2 schedule mon-fri@08:00-18:00
+}`))
+	require.NoError(t, err)
+	f := fs[0]
+	// 2026-10-12 is a Monday
+	clk := clock.NewManual(time.Date(2026, 10, 12, 7, 0, 0, 0, time.Local))
+	f.clock = clk
+
+	picked := func() []string {
+		req := new(dns.Msg)
+		req.SetQuestion(testQuery, dns.TypeA)
+		sel := f.newActiveSelector(&request.Request{W: &test.ResponseWriter{}, Req: req}, f.clients, f.ServerSelectionPolicy)
+		return endpoints(pickClients(sel, len(f.clients)))
+	}
+	require.Equal(t, []string{"127.0.0.1:53"}, picked())
+	clk.Advance(time.Hour)
+	require.Equal(t, []string{"127.0.0.1:53", "127.0.0.2:53"}, picked())
+
+	_, err = parseFanout(caddy.NewTestController("dns", "fanout . 127.0.0.1 {\nupstream 127.0.0.1 schedule always\n}"))
+	require.ErrorContains(t, err, "invalid schedule window")
+}
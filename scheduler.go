@@ -0,0 +1,91 @@
+// Copyright (c) 2024 MWS and/or its affiliates.
+//
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at:
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fanout
+
+import (
+	"math/rand/v2"
+	"sync"
+	"time"
+
+	"github.com/hurricanehrndz/fanout/v2/clock"
+)
+
+// task is a function run periodically in the background, such as health probes or canary queries.
+type task struct {
+	// interval is the time between two runs.
+	interval time.Duration
+	// jitter is the largest fraction of interval randomly taken off each wait, so that the tasks started
+	// together, e.g. the probes of many upstreams, don't all run at once.
+	jitter float64
+	// immediate runs the task when it is started rather than after the first interval.
+	immediate bool
+	// run runs once per interval with the time of the clock. The task stops once it returns false.
+	run func(now time.Time) bool
+}
+
+// wait returns the time until the next run.
+func (t task) wait() time.Duration {
+	return t.interval - time.Duration(rand.Float64()*t.jitter*float64(t.interval))
+}
+
+// scheduler runs the background tasks of an instance, from OnStartup until OnShutdown.
+type scheduler struct {
+	clk  clock.Clock
+	stop chan struct{}
+	wg   sync.WaitGroup
+}
+
+func newScheduler(clk clock.Clock) *scheduler {
+	return &scheduler{clk: clk, stop: make(chan struct{})}
+}
+
+// start runs t in the background until it returns false or the scheduler is shut down.
+func (s *scheduler) start(t task) {
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		runTask(s.clk, s.stop, t)
+	}()
+}
+
+// done returns a channel closed by shutdown, for the tasks to cut their queries short.
+func (s *scheduler) done() <-chan struct{} {
+	return s.stop
+}
+
+// shutdown stops the tasks and waits for the running ones to return.
+func (s *scheduler) shutdown() {
+	close(s.stop)
+	s.wg.Wait()
+}
+
+// runTask runs t in the calling goroutine until it returns false or stop is closed.
+func runTask(clk clock.Clock, stop <-chan struct{}, t task) {
+	if t.immediate && !t.run(clk.Now()) {
+		return
+	}
+	for {
+		select {
+		case <-stop:
+			return
+		case now := <-clk.After(t.wait()):
+			if !t.run(now) {
+				return
+			}
+		}
+	}
+}
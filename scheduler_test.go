@@ -0,0 +1,62 @@
+// Copyright (c) 2024 MWS and/or its affiliates.
+//
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at:
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fanout
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/hurricanehrndz/fanout/v2/clock"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSchedulerRunsTasksUntilShutdown(t *testing.T) {
+	clk := clock.NewManual(time.Now())
+	s := newScheduler(clk)
+	var periodic, once atomic.Int32
+	s.start(task{interval: time.Minute, run: func(time.Time) bool {
+		periodic.Add(1)
+		return true
+	}})
+	s.start(task{interval: time.Minute, immediate: true, run: func(time.Time) bool {
+		return once.Add(1) < 2
+	}})
+
+	require.Eventually(t, func() bool { return clk.Waiters() == 2 && once.Load() == 1 }, time.Second, time.Millisecond)
+	require.Zero(t, periodic.Load(), "tasks which aren't immediate wait for the first interval")
+	for i := int32(1); i <= 3; i++ {
+		require.Eventually(t, func() bool { return clk.Waiters() > 0 }, time.Second, time.Millisecond)
+		clk.Advance(time.Minute)
+		require.Eventually(t, func() bool { return periodic.Load() == i }, time.Second, time.Millisecond)
+	}
+	require.Equal(t, int32(2), once.Load(), "a task returning false isn't run again")
+
+	s.shutdown()
+	clk.Advance(time.Minute)
+	require.Equal(t, int32(3), periodic.Load())
+}
+
+func TestTaskJitter(t *testing.T) {
+	tk := task{interval: time.Second, jitter: taskJitter}
+	for range 100 {
+		wait := tk.wait()
+		require.LessOrEqual(t, wait, time.Second)
+		require.GreaterOrEqual(t, wait, 900*time.Millisecond)
+	}
+	require.Equal(t, time.Second, task{interval: time.Second}.wait())
+}
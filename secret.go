@@ -0,0 +1,119 @@
+// Copyright (c) 2024 MWS and/or its affiliates.
+//
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at:
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fanout
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"os"
+	"path/filepath"
+	"strings"
+
+	ctls "github.com/coredns/coredns/plugin/pkg/tls"
+	"github.com/pkg/errors"
+)
+
+// resolveSecret resolves an env:VAR or file:/path reference to the value it points to. Other values are
+// returned unchanged.
+func resolveSecret(value string) (string, error) {
+	switch {
+	case strings.HasPrefix(value, secretEnvPrefix):
+		name := strings.TrimPrefix(value, secretEnvPrefix)
+		v, ok := os.LookupEnv(name)
+		if !ok || v == "" {
+			return "", errors.Errorf("environment variable %s is not set", name)
+		}
+		return v, nil
+	case strings.HasPrefix(value, secretFilePrefix):
+		path := strings.TrimPrefix(value, secretFilePrefix)
+		b, err := os.ReadFile(filepath.Clean(path))
+		if err != nil {
+			return "", errors.Wrapf(err, "unable to read secret file %s", path)
+		}
+		v := strings.TrimSpace(string(b))
+		if v == "" {
+			return "", errors.Errorf("secret file %s is empty", path)
+		}
+		return v, nil
+	}
+	return value, nil
+}
+
+// tlsConfigFromArgs builds the client TLS config from the tls option arguments. Each argument is a path or a
+// secret reference resolving either to a path or to the PEM data itself.
+func tlsConfigFromArgs(args ...string) (*tls.Config, error) {
+	resolved := make([]string, len(args))
+	inline := false
+	for i, arg := range args {
+		v, err := resolveSecret(arg)
+		if err != nil {
+			return nil, err
+		}
+		resolved[i] = v
+		inline = inline || isPEM(v)
+	}
+	if !inline {
+		return ctls.NewTLSConfigFromArgs(resolved...)
+	}
+
+	cfg, err := ctls.NewTLSConfigFromArgs()
+	if err != nil {
+		return nil, err
+	}
+	if len(resolved) >= 2 {
+		cert, err := loadPEM(resolved[0])
+		if err != nil {
+			return nil, err
+		}
+		key, err := loadPEM(resolved[1])
+		if err != nil {
+			return nil, err
+		}
+		pair, err := tls.X509KeyPair(cert, key)
+		if err != nil {
+			return nil, errors.Wrap(err, "could not load TLS cert")
+		}
+		cfg.Certificates = []tls.Certificate{pair}
+	}
+	if len(resolved) == 1 || len(resolved) == 3 {
+		ca, err := loadPEM(resolved[len(resolved)-1])
+		if err != nil {
+			return nil, err
+		}
+		cfg.RootCAs = x509.NewCertPool()
+		if !cfg.RootCAs.AppendCertsFromPEM(ca) {
+			return nil, errors.New("could not read root certs")
+		}
+	}
+	return cfg, nil
+}
+
+func isPEM(v string) bool {
+	return strings.HasPrefix(v, "-----BEGIN ")
+}
+
+// loadPEM returns v itself when it holds PEM data, or the content of the file at v otherwise.
+func loadPEM(v string) ([]byte, error) {
+	if isPEM(v) {
+		return []byte(v), nil
+	}
+	b, err := os.ReadFile(filepath.Clean(v))
+	if err != nil {
+		return nil, errors.Wrapf(err, "error reading %s", v)
+	}
+	return b, nil
+}
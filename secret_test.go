@@ -0,0 +1,101 @@
+// Copyright (c) 2024 MWS and/or its affiliates.
+//
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at:
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fanout
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/coredns/caddy"
+	"github.com/stretchr/testify/require"
+)
+
+func TestResolveSecret(t *testing.T) {
+	t.Setenv("FANOUT_TEST_SECRET", "inline")
+	path := filepath.Join(t.TempDir(), "secret")
+	require.NoError(t, os.WriteFile(path, []byte("from-file\n"), 0o600))
+
+	v, err := resolveSecret("env:FANOUT_TEST_SECRET")
+	require.NoError(t, err)
+	require.Equal(t, "inline", v)
+	v, err = resolveSecret("file:" + path)
+	require.NoError(t, err)
+	require.Equal(t, "from-file", v)
+	v, err = resolveSecret("/etc/ssl/ca.pem")
+	require.NoError(t, err)
+	require.Equal(t, "/etc/ssl/ca.pem", v, "plain values are kept")
+
+	_, err = resolveSecret("env:FANOUT_TEST_UNSET")
+	require.Error(t, err)
+	_, err = resolveSecret("file:" + filepath.Join(t.TempDir(), "missing"))
+	require.Error(t, err)
+}
+
+func TestTLSSecrets(t *testing.T) {
+	cert, key := testCertificate(t)
+	ca := filepath.Join(t.TempDir(), "ca.pem")
+	require.NoError(t, os.WriteFile(ca, cert, 0o600))
+	t.Setenv("FANOUT_TEST_CERT", string(cert))
+	t.Setenv("FANOUT_TEST_KEY", string(key))
+
+	c := caddy.NewTestController("dns", "fanout . tls://127.0.0.1 {\ntls env:FANOUT_TEST_CERT env:FANOUT_TEST_KEY file:"+ca+"\n}")
+	fs, err := parseFanout(c)
+	require.NoError(t, err)
+	f := fs[0]
+	require.Len(t, f.tlsConfig.Certificates, 1)
+	require.NotNil(t, f.tlsConfig.RootCAs)
+	require.NotZero(t, f.tlsConfig.MinVersion, "the CoreDNS TLS defaults apply")
+
+	t.Setenv("FANOUT_TEST_CA_PATH", ca)
+	c = caddy.NewTestController("dns", "fanout . tls://127.0.0.1 {\ntls env:FANOUT_TEST_CA_PATH\n}")
+	fs, err = parseFanout(c)
+	require.NoError(t, err)
+	require.NotNil(t, fs[0].tlsConfig.RootCAs)
+
+	c = caddy.NewTestController("dns", "fanout . tls://127.0.0.1 {\ntls env:FANOUT_TEST_CERT env:FANOUT_TEST_UNSET\n}")
+	_, err = parseFanout(c)
+	require.ErrorContains(t, err, "FANOUT_TEST_UNSET")
+}
+
+// testCertificate returns a self-signed certificate and its key in PEM form.
+func testCertificate(t *testing.T) (cert, key []byte) {
+	priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "fanout.test"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &priv.PublicKey, priv)
+	require.NoError(t, err)
+	keyDER, err := x509.MarshalECPrivateKey(priv)
+	require.NoError(t, err)
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+}
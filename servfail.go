@@ -0,0 +1,116 @@
+// Copyright (c) 2024 MWS and/or its affiliates.
+//
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at:
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fanout
+
+import (
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+	"golang.org/x/net/publicsuffix"
+)
+
+// servfailKey identifies an upstream answering queries for a zone.
+type servfailKey struct {
+	addr string
+	zone string
+}
+
+type servfailEntry struct {
+	count        int
+	blockedUntil time.Time
+}
+
+// servfailBlocklist stops asking an upstream about a zone for a while once it has answered threshold
+// consecutive queries for the zone with SERVFAIL, while the upstream is still used for other names.
+type servfailBlocklist struct {
+	threshold int
+	duration  time.Duration
+	mutex     sync.Mutex
+	entries   map[servfailKey]*servfailEntry
+}
+
+func newServfailBlocklist(threshold int, duration time.Duration) *servfailBlocklist {
+	return &servfailBlocklist{threshold: threshold, duration: duration, entries: map[servfailKey]*servfailEntry{}}
+}
+
+// observe records the rcode an upstream answered a query for the zone with at now.
+func (b *servfailBlocklist) observe(addr, zone string, rcode int, now time.Time) {
+	key := servfailKey{addr: addr, zone: zone}
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if rcode != dns.RcodeServerFailure {
+		delete(b.entries, key)
+		return
+	}
+	e, ok := b.entries[key]
+	if !ok {
+		if len(b.entries) >= maxServfailEntries {
+			b.entries = map[servfailKey]*servfailEntry{}
+		}
+		e = &servfailEntry{}
+		b.entries[key] = e
+	}
+	e.count++
+	if e.count >= b.threshold {
+		e.count = 0
+		e.blockedUntil = now.Add(b.duration)
+		log.Infof("not asking %s about %s for %s after %d consecutive SERVFAIL answers", addr, zone, b.duration, b.threshold)
+	}
+}
+
+// blocked returns true if the upstream is not to be asked about the zone at now.
+func (b *servfailBlocklist) blocked(addr, zone string, now time.Time) bool {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	e, ok := b.entries[servfailKey{addr: addr, zone: zone}]
+	return ok && now.Before(e.blockedUntil)
+}
+
+// blockedZones returns the zones the upstream is not asked about at now, sorted.
+func (b *servfailBlocklist) blockedZones(addr string, now time.Time) []string {
+	if b == nil {
+		return nil
+	}
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	var zones []string
+	for key, e := range b.entries {
+		if key.addr == addr && now.Before(e.blockedUntil) {
+			zones = append(zones, key.zone)
+		}
+	}
+	slices.Sort(zones)
+	return zones
+}
+
+// servfailZone returns the zone tracked for the name: its registrable domain, the public suffix and one
+// more label, so that the domains under suffixes such as co.uk are tracked separately. Public suffixes
+// themselves are tracked as they are.
+func servfailZone(name string) string {
+	name = strings.ToLower(dns.Fqdn(name))
+	if name == "." {
+		return name
+	}
+	zone, err := publicsuffix.EffectiveTLDPlusOne(strings.TrimSuffix(name, "."))
+	if err != nil {
+		return name
+	}
+	return dns.Fqdn(zone)
+}
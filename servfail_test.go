@@ -0,0 +1,123 @@
+// Copyright (c) 2024 MWS and/or its affiliates.
+//
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at:
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fanout
+
+import (
+	"context"
+	"fmt"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/coredns/caddy"
+	"github.com/coredns/coredns/plugin/test"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+)
+
+func TestServfailZone(t *testing.T) {
+	require.Equal(t, "example.com.", servfailZone("www.Example.com."))
+	require.Equal(t, "example.com.", servfailZone("example.com"))
+	require.Equal(t, "com.", servfailZone("com."))
+	require.Equal(t, "example.co.uk.", servfailZone("www.example.co.uk."))
+	require.Equal(t, "example.com.au.", servfailZone("a.b.example.com.au."))
+	require.Equal(t, "co.uk.", servfailZone("co.uk."))
+	require.Equal(t, ".", servfailZone("."))
+}
+
+func TestServfailBlocklist(t *testing.T) {
+	b := newServfailBlocklist(2, time.Minute)
+	now := time.Now()
+	b.observe("127.0.0.1:53", "example.com.", dns.RcodeServerFailure, now)
+	require.False(t, b.blocked("127.0.0.1:53", "example.com.", now))
+	b.observe("127.0.0.1:53", "example.com.", dns.RcodeSuccess, now)
+	b.observe("127.0.0.1:53", "example.com.", dns.RcodeServerFailure, now)
+	require.False(t, b.blocked("127.0.0.1:53", "example.com.", now), "a successful answer resets the count")
+	b.observe("127.0.0.1:53", "example.com.", dns.RcodeServerFailure, now)
+	require.True(t, b.blocked("127.0.0.1:53", "example.com.", now))
+	require.False(t, b.blocked("127.0.0.1:53", "example.org.", now))
+	require.False(t, b.blocked("127.0.0.2:53", "example.com.", now))
+	require.True(t, b.blocked("127.0.0.1:53", "example.com.", now.Add(time.Minute-time.Second)))
+	require.False(t, b.blocked("127.0.0.1:53", "example.com.", now.Add(time.Minute)), "the block expires")
+	require.Equal(t, []string{"example.com."}, b.blockedZones("127.0.0.1:53", now))
+	require.Empty(t, b.blockedZones("127.0.0.1:53", now.Add(time.Minute)))
+	require.Empty(t, b.blockedZones("127.0.0.2:53", now))
+}
+
+func TestServfailBlocklistSkipsUpstreamForZone(t *testing.T) {
+	var filtering atomic.Int32
+	filter := newServer(UDP, func(w dns.ResponseWriter, r *dns.Msg) {
+		filtering.Add(1)
+		msg := new(dns.Msg)
+		if r.Question[0].Name == "blocked.example.com." {
+			msg.SetRcode(r, dns.RcodeServerFailure)
+		} else {
+			msg.SetReply(r)
+			msg.Answer = []dns.RR{makeRecordA(r.Question[0].Name + " 3600 IN A 10.0.0.1")}
+		}
+		logErrIfNotNil(w.WriteMsg(msg))
+	})
+	defer filter.close()
+	other := newServer(UDP, func(w dns.ResponseWriter, r *dns.Msg) {
+		if r.Question[0].Name == "blocked.example.com." {
+			// answer after the filtering upstream, whose SERVFAIL isn't counted once the query is served
+			time.Sleep(20 * time.Millisecond)
+		}
+		msg := dns.Msg{Answer: []dns.RR{makeRecordA(r.Question[0].Name + " 3600 IN A 10.0.0.2")}}
+		msg.SetReply(r)
+		logErrIfNotNil(w.WriteMsg(&msg))
+	})
+	defer other.close()
+
+	input := fmt.Sprintf("fanout . %s %s {\nservfail-blocklist 2 1m\n}", filter.addr, other.addr)
+	fs, err := parseFanout(caddy.NewTestController("dns", input))
+	require.NoError(t, err)
+	f := fs[0]
+	serve := func(name string) {
+		req := new(dns.Msg)
+		req.SetQuestion(name, dns.TypeA)
+		_, err := f.ServeDNS(context.Background(), &cachedDNSWriter{ResponseWriter: new(test.ResponseWriter)}, req)
+		require.NoError(t, err)
+	}
+	serve("blocked.example.com.")
+	serve("blocked.example.com.")
+	require.Eventually(t, func() bool { return f.servfails.blocked(filter.addr, "example.com.", time.Now()) }, time.Second, 10*time.Millisecond)
+
+	// the whole zone is asked from the other upstream only, other zones from both
+	serve("www.example.com.")
+	serve("blocked.example.com.")
+	serve("www.example.org.")
+	require.Eventually(t, func() bool { return filtering.Load() == 3 }, time.Second, 10*time.Millisecond)
+	time.Sleep(50 * time.Millisecond)
+	require.Equal(t, int32(3), filtering.Load())
+}
+
+func TestSetupServfailBlocklist(t *testing.T) {
+	fs, err := parseFanout(caddy.NewTestController("dns", "fanout . 127.0.0.1 {\nservfail-blocklist\n}"))
+	require.NoError(t, err)
+	require.Equal(t, defaultServfailThreshold, fs[0].servfails.threshold)
+	require.Equal(t, defaultServfailDuration, fs[0].servfails.duration)
+
+	for input, expectedErr := range map[string]string{
+		"servfail-blocklist 0":         "invalid servfail-blocklist count",
+		"servfail-blocklist 3 forever": "invalid servfail-blocklist duration",
+		"servfail-blocklist 3 1m 2":    "Wrong argument count",
+	} {
+		_, err = parseFanout(caddy.NewTestController("dns", "fanout . 127.0.0.1 {\n"+input+"\n}"))
+		require.ErrorContains(t, err, expectedErr, input)
+	}
+}
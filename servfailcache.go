@@ -0,0 +1,112 @@
+// Copyright (c) 2024 MWS and/or its affiliates.
+//
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at:
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fanout
+
+import (
+	"context"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/coredns/caddy/caddyfile"
+	"github.com/coredns/coredns/request"
+	lru "github.com/hashicorp/golang-lru/v2"
+	"github.com/miekg/dns"
+	"github.com/pkg/errors"
+)
+
+// servfailCache remembers the questions the upstreams failed to answer, with SERVFAIL or no response at
+// all, for a few seconds, so that clients retrying them don't send every retry to all the upstreams
+// (RFC 2308 section 7.1).
+type servfailCache struct {
+	ttl     time.Duration
+	entries *lru.Cache[failedKey, time.Time]
+}
+
+// failedKey is the key of a failed question. The failures with and without the CD bit are remembered apart
+// (RFC 9520 section 3.2): a query failing DNSSEC validation may well be answered with checking disabled.
+type failedKey struct {
+	question         dns.Question
+	checkingDisabled bool
+}
+
+// parseServfailCache parses `servfail-cache [DURATION [SIZE]]`.
+func parseServfailCache(f *Fanout, c *caddyfile.Dispenser) error {
+	args := c.RemainingArgs()
+	if len(args) > 2 {
+		return c.ArgErr()
+	}
+	ttl, size := defaultServfailTTL, defaultCacheSize
+	if len(args) > 0 {
+		d, err := time.ParseDuration(args[0])
+		if err != nil || d <= 0 || d > maxServfailTTL {
+			return errors.Errorf("servfail-cache duration must be positive and at most %s, got %q", maxServfailTTL, args[0])
+		}
+		ttl = d
+	}
+	if len(args) > 1 {
+		n, err := strconv.Atoi(args[1])
+		if err != nil || n <= 0 {
+			return errors.Errorf("invalid servfail-cache size %q", args[1])
+		}
+		size = n
+	}
+	entries, err := lru.New[failedKey, time.Time](size)
+	if err != nil {
+		return err
+	}
+	f.servfailCache = &servfailCache{ttl: ttl, entries: entries}
+	return nil
+}
+
+// failedQuestion returns the key of the question of req, the name being case insensitive.
+func failedQuestion(req *request.Request) failedKey {
+	q := req.Req.Question[0]
+	q.Name = strings.ToLower(q.Name)
+	return failedKey{question: q, checkingDisabled: req.Req.CheckingDisabled}
+}
+
+// failed returns true if the question of req failed less than the TTL before now.
+func (s *servfailCache) failed(req *request.Request, now time.Time) bool {
+	if s == nil {
+		return false
+	}
+	expiry, ok := s.entries.Get(failedQuestion(req))
+	return ok && now.Before(expiry)
+}
+
+// observe remembers the question of req if result is a failure or a SERVFAIL response, unless the
+// client gave up on it as told by ctx.
+func (s *servfailCache) observe(ctx context.Context, req *request.Request, result *response, now time.Time) {
+	if s == nil || ctx.Err() != nil {
+		return
+	}
+	if result == nil || result.err != nil || result.response.Rcode == dns.RcodeServerFailure {
+		s.entries.Add(failedQuestion(req), now.Add(s.ttl))
+	}
+}
+
+// serveServfailCached fails the queries whose question failed recently, like the upstreams did, without
+// querying them.
+func (f *Fanout) serveServfailCached(ctx context.Context, req *request.Request) (rcode int, handled bool, err error) {
+	if !f.servfailCache.failed(req, f.clock.Now()) {
+		return 0, false, nil
+	}
+	ServfailCacheHitCount.Inc()
+	rcode, err = f.reply(ctx, ctx, req, &response{err: errors.Errorf("%s %s failed recently", req.Name(), req.Type())})
+	return rcode, true, err
+}
@@ -0,0 +1,85 @@
+// Copyright (c) 2024 MWS and/or its affiliates.
+//
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at:
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fanout
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/coredns/caddy"
+	"github.com/coredns/coredns/plugin/test"
+	"github.com/hurricanehrndz/fanout/v2/clock"
+	"github.com/miekg/dns"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/require"
+)
+
+func TestServfailCache(t *testing.T) {
+	var queries atomic.Int32
+	s := newServer(UDP, func(w dns.ResponseWriter, r *dns.Msg) {
+		if r.Question[0].Qtype == dns.TypeA {
+			queries.Add(1)
+		}
+		msg := new(dns.Msg)
+		msg.SetRcode(r, dns.RcodeServerFailure)
+		logErrIfNotNil(w.WriteMsg(msg))
+	})
+	defer s.close()
+
+	fs, err := parseFanout(caddy.NewTestController("dns", "fanout . "+s.addr+" {\nservfail-cache 10s\nattempt-count 1\n}"))
+	require.NoError(t, err)
+	f := fs[0]
+	clk := clock.NewManual(time.Now())
+	f.clock = clk
+	serve := func(name string, qtype uint16) (int, error) {
+		req := new(dns.Msg)
+		req.SetQuestion(name, qtype)
+		return f.ServeDNS(context.Background(), &test.ResponseWriter{}, req)
+	}
+	hits := testutil.ToFloat64(ServfailCacheHitCount)
+
+	_, err = serve("example1.", dns.TypeA)
+	require.NoError(t, err)
+	require.Equal(t, int32(1), queries.Load())
+	rcode, err := serve("EXAMPLE1.", dns.TypeA)
+	require.Error(t, err)
+	require.Equal(t, dns.RcodeServerFailure, rcode)
+	require.Equal(t, int32(1), queries.Load(), "the failed question isn't asked again")
+	require.Equal(t, hits+1, testutil.ToFloat64(ServfailCacheHitCount))
+
+	_, err = serve("example2.", dns.TypeA)
+	require.NoError(t, err)
+	require.Equal(t, int32(2), queries.Load(), "other questions are asked")
+	cd := new(dns.Msg)
+	cd.SetQuestion("example1.", dns.TypeA)
+	cd.CheckingDisabled = true
+	_, err = f.ServeDNS(context.Background(), &test.ResponseWriter{}, cd)
+	require.NoError(t, err)
+	require.Equal(t, int32(3), queries.Load(), "the failure without the CD bit doesn't fail the query with it")
+
+	clk.Advance(10 * time.Second)
+	_, err = serve("example1.", dns.TypeA)
+	require.NoError(t, err)
+	require.Equal(t, int32(4), queries.Load(), "the question is asked again once the entry expired")
+
+	for _, input := range []string{"servfail-cache 0s", "servfail-cache 6m", "servfail-cache 5s 0", "servfail-cache 5s 10 1"} {
+		_, err = parseFanout(caddy.NewTestController("dns", "fanout . 127.0.0.1 {\n"+input+"\n}"))
+		require.Error(t, err, input)
+	}
+}
@@ -20,9 +20,11 @@ package fanout
 
 import (
 	"math"
-	"math/rand"
+	"net"
+	"net/url"
 	"os"
 	"path/filepath"
+	"slices"
 	"strconv"
 	"strings"
 	"time"
@@ -33,7 +35,6 @@ import (
 	"github.com/coredns/coredns/plugin"
 	"github.com/coredns/coredns/plugin/dnstap"
 	"github.com/coredns/coredns/plugin/pkg/parse"
-	"github.com/coredns/coredns/plugin/pkg/tls"
 	"github.com/coredns/coredns/plugin/pkg/transport"
 	"github.com/miekg/dns"
 	"github.com/pkg/errors"
@@ -75,6 +76,7 @@ func setup(c *caddy.Controller) error {
 		}
 
 		c.OnStartup(func() error {
+			f.setServerKeys(dnsserver.GetConfig(c).TsigSecret)
 			if taph := dnsserver.GetConfig(c).Handler("dnstap"); taph != nil {
 				if tapPlugin, ok := taph.(*dnstap.Dnstap); ok {
 					f.TapPlugin = tapPlugin
@@ -93,12 +95,60 @@ func setup(c *caddy.Controller) error {
 
 // OnStartup starts a goroutines for all clients.
 func (f *Fanout) OnStartup() (err error) {
+	if f.prewarm {
+		f.prewarmClients()
+	}
+	if f.debugAddr != "" {
+		if err = f.startDebugServer(); err != nil {
+			return err
+		}
+	}
+	if f.dnstapFile != nil {
+		if f.tapFile, err = dnstapFiles.acquire(*f.dnstapFile); err != nil {
+			return errors.Wrap(err, "unable to open dnstap file")
+		}
+	}
+	f.loadCacheSnapshot()
+	f.tasks = newScheduler(f.clock)
+	f.bootstrap = &bootstrapTracker{}
+	if f.loopDetect != "" {
+		if err = f.detectLoops(); err != nil {
+			return err
+		}
+	}
+	f.probeUpstreams()
+	if p := weightedStage(f.ServerSelectionPolicy); p != nil && f.adaptiveInterval > 0 {
+		f.tasks.start(newWeightAdapter(p).task(f, f.adaptiveInterval))
+	}
+	if f.poolPing > 0 {
+		f.tasks.start(f.pingPooledConns(f.poolPing))
+	}
+	if f.slos != nil {
+		f.tasks.start(f.slos.task())
+	}
+	if len(f.canaries) > 0 {
+		f.tasks.start(f.canaryTask())
+	}
+	if f.hostResolver != nil {
+		f.tasks.start(f.hostResolver.task())
+	}
 	return nil
 }
 
 // OnShutdown stops all configured clients.
 func (f *Fanout) OnShutdown() error {
-	return nil
+	if f.tasks != nil {
+		f.tasks.shutdown()
+		f.tasks = nil
+		f.releaseProbes()
+	}
+	f.saveCacheSnapshot()
+	if f.tapFile != nil {
+		dnstapFiles.release(f.tapFile)
+		f.tapFile = nil
+	}
+	f.closeIdleClients()
+	return f.stopDebugServer()
 }
 
 func parseFanout(c *caddy.Controller) ([]*Fanout, error) {
@@ -115,6 +165,21 @@ func parseFanout(c *caddy.Controller) ([]*Fanout, error) {
 	return fs, nil
 }
 
+// ParseCorefile parses the fanout stanzas of a Corefile snippet, such as `fanout . 10.0.0.10:53`, with the
+// validation of the plugin setup, e.g. to test a configuration with the fanouttest package. The stanzas are
+// chained like in a server block, the Next of the last one is left to the caller, and their OnStartup and
+// OnShutdown are the caller's to call.
+func ParseCorefile(snippet string) ([]*Fanout, error) {
+	fs, err := parseFanout(caddy.NewTestController("dns", snippet))
+	if err != nil {
+		return nil, err
+	}
+	for i := 1; i < len(fs); i++ {
+		fs[i-1].Next = fs[i]
+	}
+	return fs, nil
+}
+
 func parsefanoutStanza(c *caddyfile.Dispenser) (*Fanout, error) {
 	f := New()
 	if !c.Args(&f.From) {
@@ -131,7 +196,7 @@ func parsefanoutStanza(c *caddyfile.Dispenser) (*Fanout, error) {
 	if len(to) == 0 {
 		return f, c.ArgErr()
 	}
-	toHosts, err := parse.HostPortOrFile(to...)
+	toHosts, err := parseHosts(to)
 	log.Infof("fanout: using following servers: %#v", toHosts)
 	if err != nil {
 		return f, err
@@ -142,35 +207,210 @@ func parsefanoutStanza(c *caddyfile.Dispenser) (*Fanout, error) {
 			return nil, err
 		}
 	}
-	initClients(f, toHosts)
-	err = initServerSelectionPolicy(f)
-	if err != nil {
+	if err = initFanout(f, toHosts); err != nil {
 		return nil, err
 	}
+	return f, nil
+}
+
+// initFanout creates clients for hosts and derives settings depending on the final client list.
+func initFanout(f *Fanout, hosts []string) error {
+	if err := checkUpstreamOptions(f, hosts); err != nil {
+		return err
+	}
+	if err := checkDuplicateUpstreams(f, hosts); err != nil {
+		return err
+	}
+	if err := checkODoHRelay(f, hosts); err != nil {
+		return err
+	}
+	if err := checkControlToken(f); err != nil {
+		return err
+	}
+	if err := checkHostnames(f, hosts); err != nil {
+		return err
+	}
+	if err := initClients(f, hosts); err != nil {
+		return err
+	}
+	if err := initInsecureFallback(f); err != nil {
+		return err
+	}
+	initZoneAuthorities(f)
+	initSLOs(f)
+	if err := initServerSelectionPolicy(f); err != nil {
+		return err
+	}
+	if err := initGroups(f); err != nil {
+		return err
+	}
 
 	if f.WorkerCount > len(f.clients) || f.WorkerCount == 0 {
 		f.WorkerCount = len(f.clients)
 	}
-
-	return f, nil
+	return nil
 }
 
-func initClients(f *Fanout, hosts []string) {
-	transports := make([]string, len(hosts))
-	for i, host := range hosts {
-		trans, h := parse.Transport(host)
-		c := NewClientWithUDPBufferSize(h, f.net, f.udpBufferSize)
-		c.(*client).udpBufferSizeOverride = f.udpBufferSizeOverride
+func initClients(f *Fanout, hosts []string) error {
+	f.tlsConfig.ServerName = f.tlsServerName
+	for _, host := range hosts {
+		c, err := newUpstreamClient(f, host)
+		if err != nil {
+			return err
+		}
 		f.clients = append(f.clients, c)
-		transports[i] = trans
 	}
+	for _, host := range f.mirrorTo {
+		c, err := newUpstreamClient(f, host)
+		if err != nil {
+			return err
+		}
+		f.mirrorClients = append(f.mirrorClients, c)
+	}
+	for _, host := range f.shadowTo {
+		c, err := newUpstreamClient(f, host)
+		if err != nil {
+			return err
+		}
+		f.shadowClients = append(f.shadowClients, c)
+	}
+	return nil
+}
 
-	f.tlsConfig.ServerName = f.tlsServerName
-	for i := range f.clients {
-		if transports[i] == transport.TLS || f.net == TCPTLS {
-			f.clients[i].SetTLSConfig(f.tlsConfig)
+// checkODoHRelay makes sure a relay is configured when any of the upstreams is an Oblivious DoH target.
+func checkODoHRelay(f *Fanout, hosts []string) error {
+	all := slices.Concat(hosts, f.mirrorTo, f.shadowTo)
+	for _, g := range f.groups {
+		all = append(all, g.hosts...)
+	}
+	if f.odohRelay == "" && slices.ContainsFunc(all, isODoH) {
+		return errors.New("odoh-relay is required for Oblivious DoH upstreams")
+	}
+	return nil
+}
+
+// newUpstreamClient creates the client of the upstream host, delaying its responses if configured to.
+func newUpstreamClient(f *Fanout, host string) (Client, error) {
+	c, err := newTransportClient(f, host)
+	if err != nil {
+		return nil, err
+	}
+	_, h := parse.Transport(host)
+	if _, ok := lookupClientFactory(host); ok {
+		h = host
+	}
+	if opts := f.upstreamOptions[h]; opts != nil && opts.delay > 0 {
+		return &delayedClient{Client: c, delay: opts.delay}, nil
+	}
+	return c, nil
+}
+
+func newTransportClient(f *Fanout, host string) (Client, error) {
+	if factory, ok := lookupClientFactory(host); ok {
+		c, err := factory(host)
+		return c, errors.Wrapf(err, "creating client of upstream %s", host)
+	}
+	if isODoH(host) {
+		c := newODoHClient(host, f.odohRelay)
+		c.SetTLSConfig(f.tlsConfig)
+		return c, nil
+	}
+	if isDoH(host) {
+		c := newDoHClient(host, f.httpVersion)
+		c.SetTLSConfig(f.tlsConfig)
+		return c, nil
+	}
+	trans, h := parse.Transport(host)
+	opts := f.upstreamOptions[h]
+	c := newDNSClient(f, trans, h, opts)
+	if opts != nil && opts.dualStack != "" {
+		alt, err := dualStackAddr(c.Endpoint(), opts.dualStack)
+		if err != nil {
+			return nil, errors.Wrapf(err, "upstream %s", h)
+		}
+		return newDualStackClient(c, newDNSClient(f, trans, alt, opts)), nil
+	}
+	return c, nil
+}
+
+// newDNSClient creates the client of a plain DNS or DNS-over-TLS upstream at addr, with the options opts of
+// the upstream, if any.
+func newDNSClient(f *Fanout, trans, addr string, opts *upstreamOptions) Client {
+	c := NewClientWithUDPBufferSize(addr, f.net, f.udpBufferSize)
+	c.(*client).udpBufferSizeOverride = f.udpBufferSizeOverride
+	c.(*client).randomizeID = f.randomizeID
+	c.(*client).matchTransport = f.matchTransport
+	if dial := f.dialFunc(addr, opts); dial != nil {
+		c.(*client).transport = NewTransportWithDialer(addr, dial)
+	}
+	if t, ok := c.(*client).transport.(*transportImpl); ok {
+		t.udpBatch = f.udpBatch
+	}
+	if opts != nil && opts.minSizeTCP > 0 {
+		c.(*client).answerSizes = newAnswerSizes(opts.minSizeTCP)
+	}
+	if f.ednsCapabilities {
+		c.(*client).caps = newEDNSCapabilities()
+		c.(*client).clock = f.clock
+	}
+	if trans == transport.TLS || f.net == TCPTLS {
+		c.SetTLSConfig(f.upstreamTLSConfig(addr))
+	}
+	return c
+}
+
+// dialFunc returns the function opening connections to the upstream at addr with the options opts, nil
+// for the default one.
+func (f *Fanout) dialFunc(addr string, opts *upstreamOptions) DialFunc {
+	dial := f.dialer
+	if socket := f.socketOptions(opts); dial == nil && socket.isSet() {
+		dial = socket.dialer().DialContext
+	}
+	if host := upstreamHostname(addr); host != "" && f.hostResolver != nil {
+		if dial == nil {
+			dial = (&net.Dialer{Timeout: maxTimeout}).DialContext
+		}
+		dial = f.hostResolver.dialer(host, dial)
+	}
+	return dial
+}
+
+// initInsecureFallback moves the plaintext upstreams of the TO list out of f.clients, to be used only when
+// every encrypted upstream failed. Load factors given for the whole list keep applying to the encrypted ones.
+func initInsecureFallback(f *Fanout) error {
+	if !f.allowInsecureFallback {
+		return nil
+	}
+	g := &upstreamGroup{policy: &SequentialPolicy{}}
+	var encrypted []Client
+	var loadFactor []int
+	for i, c := range f.clients {
+		if !isEncrypted(c) {
+			g.clients = append(g.clients, c)
+			continue
 		}
+		encrypted = append(encrypted, c)
+		if len(f.loadFactor) == len(f.clients) {
+			loadFactor = append(loadFactor, f.loadFactor[i])
+		}
+	}
+	if len(encrypted) == 0 || len(g.clients) == 0 {
+		return errors.New("allow-insecure-fallback requires both encrypted and plaintext upstreams")
+	}
+	if loadFactor != nil {
+		f.loadFactor = loadFactor
 	}
+	f.clients = encrypted
+	f.insecure = g
+	return nil
+}
+
+func isEncrypted(c Client) bool {
+	switch c.Net() {
+	case TCPTLS, DOH, ODOH:
+		return true
+	}
+	return false
 }
 
 func initServerSelectionPolicy(f *Fanout) error {
@@ -181,21 +421,22 @@ func initServerSelectionPolicy(f *Fanout) error {
 	loadFactor := f.loadFactor
 	if len(loadFactor) == 0 {
 		for i := 0; i < len(f.clients); i++ {
-			loadFactor = append(loadFactor, maxLoadFactor)
+			loadFactor = append(loadFactor, defaultLoadFactor)
 		}
 	}
 	if len(loadFactor) != len(f.clients) {
-		return errors.New("load-factor params count must be the same as the number of hosts")
+		return errors.Errorf("load-factor params count must be the same as the number of hosts: got %d load factors for %d hosts",
+			len(loadFactor), len(f.clients))
 	}
 
-	f.ServerSelectionPolicy = &SequentialPolicy{}
-	if f.policyType == policyWeightedRandom {
-		f.ServerSelectionPolicy = &WeightedPolicy{
-			loadFactor: loadFactor,
-			//nolint:gosec // it's overhead to use crypto/rand here
-			r: rand.New(rand.NewSource(time.Now().UnixNano())),
-		}
+	if f.policyType != policyWeightedRandom && f.adaptiveInterval > 0 {
+		return errors.New("adaptive-weights requires the weighted-random policy")
+	}
+	p, err := f.newPolicy(loadFactor, f.serverCount)
+	if err != nil {
+		return err
 	}
+	f.ServerSelectionPolicy = p
 
 	return nil
 }
@@ -222,6 +463,74 @@ func parseValue(v string, f *Fanout, c *caddyfile.Dispenser) error {
 		return parseTimeout(f, c)
 	case "race":
 		return parseRace(f, c)
+	case "adaptive-timeout":
+		return parseAdaptiveTimeout(f, c)
+	case "cache":
+		return parseCache(f, c)
+	case "cache-redis":
+		return parseCacheRedis(f, c)
+	case "cache-snapshot":
+		return parseCacheSnapshot(f, c)
+	case "edns-capabilities":
+		if c.NextArg() {
+			return c.ArgErr()
+		}
+		f.ednsCapabilities = true
+		return nil
+	case "allow-from":
+		return parseAllowFrom(f, c)
+	case "upstream-dedup":
+		if c.NextArg() {
+			return c.ArgErr()
+		}
+		f.flights = newUpstreamFlights()
+		return nil
+	case "udp-batch":
+		return parseUDPBatch(f, c)
+	case "provenance":
+		return parseProvenance(f, c)
+	case "refused-is-soft-fail":
+		return parseRefusedSoftFail(f, c)
+	case "prefer-dnssec":
+		return parsePreferDNSSEC(f, c)
+	case "mode":
+		return parseMode(f, c)
+	case "prewarm":
+		return parsePrewarm(f, c)
+	case "tcp-fast-open":
+		return parseTCPFastOpen(f, c)
+	case "bootstrap":
+		return parseBootstrap(f, c)
+	case "servfail-cache":
+		return parseServfailCache(f, c)
+	case "loop-detect":
+		return parseLoopDetect(f, c)
+	case "max-hops":
+		return parseMaxHops(f, c)
+	case "pair-address-queries":
+		if c.NextArg() {
+			return c.ArgErr()
+		}
+		f.pairAddressQueries = true
+		return nil
+	case "control-token":
+		return parseControlToken(f, c)
+	case "debug-addr":
+		return parseDebugAddr(f, c)
+	case "upstream":
+		return parseUpstream(f, c)
+	case "qtype":
+		return parseQtypeGroup(f, c)
+	case "mirror-to":
+		return parseMirrorTo(f, c)
+	case "shadow":
+		return parseShadow(f, c)
+	case "max-response-size":
+		return parseMaxResponseSize(f, c)
+	case "log-sample":
+		return parseLogSample(f, c)
+	case "adaptive-weights":
+		return parseAdaptiveWeights(f, c)
 	case "except":
 		return parseIgnored(f, c)
 	case "except-file":
@@ -230,6 +539,88 @@ func parseValue(v string, f *Fanout, c *caddyfile.Dispenser) error {
 		num, err := parsePositiveInt(c)
 		f.Attempts = num
 		return err
+	case "error-budget":
+		return parseErrorBudget(f, c)
+	case "slow-start":
+		return parseSlowStart(f, c)
+	case "servfail-blocklist":
+		return parseServfailBlocklist(f, c)
+	case "dnstap-sample":
+		return parseDnstapSample(f, c)
+	case "dnstap-file":
+		return parseDnstapFile(f, c)
+	case "client-patience":
+		return parseClientPatience(f, c)
+	case "svcb-glue":
+		if c.NextArg() {
+			return c.ArgErr()
+		}
+		f.svcbGlue = true
+		return nil
+	case "expand-any":
+		if c.NextArg() {
+			return c.ArgErr()
+		}
+		f.expandAny = true
+		return nil
+	case "match-transport":
+		if c.NextArg() {
+			return c.ArgErr()
+		}
+		f.matchTransport = true
+		return nil
+	case "randomize-id":
+		if c.NextArg() {
+			return c.ArgErr()
+		}
+		f.randomizeID = true
+		return nil
+	case "allow-insecure-fallback":
+		if c.NextArg() {
+			return c.ArgErr()
+		}
+		f.allowInsecureFallback = true
+		return nil
+	case "answer-order":
+		return parseAnswerOrder(f, c)
+	case "validate":
+		return parseValidate(f, c)
+	case "pool-ping":
+		return parsePoolPing(f, c)
+	case "qclass-filter":
+		return parseClassFilter(f, c)
+	case "chaos-version":
+		return parseChaosVersion(f, c)
+	case "chaos-id":
+		return parseChaosID(f, c)
+	case "latency-slo":
+		return parseLatencySLO(f, c)
+	case "canary":
+		return parseCanary(f, c)
+	case "canary-interval":
+		return parseCanaryInterval(f, c)
+	case "opcode":
+		return parseOpcode(f, c)
+	case "update-primary":
+		return parseUpdatePrimary(f, c)
+	case "multi-question":
+		return parseMultiQuestion(f, c)
+	case "debug-suffix":
+		return parseDebugSuffix(f, c)
+	case "allow-types":
+		return parseAllowTypes(f, c)
+	case "deny-private-answers":
+		return parseDenyPrivateAnswers(f, c)
+	case "max-concurrent":
+		return parseConcurrencyLimit(f, c)
+	case "max-concurrent-per-client":
+		return parseClientLimit(f, c)
+	case "odoh-relay":
+		return parseODoHRelay(f, c)
+	case "http-version":
+		return parseHTTPVersion(f, c)
+	case "attempt-policy":
+		return parseAttemptPolicy(f, c)
 	case "udp-buffer-size":
 		num, err := parsePositiveInt(c)
 		if err != nil {
@@ -270,16 +661,70 @@ func parseNext(f *Fanout, c *caddyfile.Dispenser) error {
 }
 
 func parsePolicy(f *Fanout, c *caddyfile.Dispenser) error {
-	if !c.NextArg() {
+	args := c.RemainingArgs()
+	if len(args) == 0 {
 		return c.ArgErr()
 	}
+	stages, err := parsePolicyChain(args)
+	if err != nil {
+		return err
+	}
+	f.policyType, f.policyThen = stages[0], stages[1:]
+	return nil
+}
 
-	policyType := strings.ToLower(c.Val())
-	if policyType != policyWeightedRandom && policyType != policySequential {
-		return errors.Errorf("unknown policy %q", c.Val())
+// parsePolicyChain parses policy names joined by "then", e.g. "weighted-random then latency".
+func parsePolicyChain(args []string) ([]string, error) {
+	var stages []string
+	for i, arg := range args {
+		name := strings.ToLower(arg)
+		if i%2 == 1 {
+			if name != policyThen || i == len(args)-1 {
+				return nil, errors.Errorf("policies must be chained with %q", policyThen)
+			}
+			continue
+		}
+		switch name {
+		case policyWeightedRandom, policySticky:
+			if i > 0 {
+				return nil, errors.Errorf("%s can only be the first policy of a chain", name)
+			}
+		case policySequential, policyLatency:
+		default:
+			return nil, errors.Errorf("unknown policy %q", arg)
+		}
+		stages = append(stages, name)
 	}
-	f.policyType = policyType
+	return stages, nil
+}
 
+func parseMode(f *Fanout, c *caddyfile.Dispenser) error {
+	args := c.RemainingArgs()
+	if len(args) == 0 {
+		return c.ArgErr()
+	}
+	mode := strings.ToLower(args[0])
+	switch mode {
+	case modeParallel, modeMirror:
+		if len(args) != 1 {
+			return c.ArgErr()
+		}
+	case modeFailover:
+		if len(args) > 2 {
+			return c.ArgErr()
+		}
+		f.failoverTimeout = maxTimeout
+		if len(args) == 2 {
+			d, err := time.ParseDuration(args[1])
+			if err != nil || d <= 0 {
+				return errors.Errorf("invalid failover timeout %q", args[1])
+			}
+			f.failoverTimeout = d
+		}
+	default:
+		return errors.Errorf("unknown mode %q", args[0])
+	}
+	f.mode = mode
 	return nil
 }
 
@@ -294,13 +739,349 @@ func parseTimeout(f *Fanout, c *caddyfile.Dispenser) error {
 }
 
 func parseRace(f *Fanout, c *caddyfile.Dispenser) error {
-	if c.NextArg() {
+	args := c.RemainingArgs()
+	if len(args) > 1 {
 		return c.ArgErr()
 	}
+	if len(args) == 1 {
+		d, err := time.ParseDuration(args[0])
+		if err != nil || d <= 0 {
+			return errors.Errorf("invalid race tie-break window %q", args[0])
+		}
+		f.raceWindow = d
+	}
 	f.Race = true
 	return nil
 }
 
+func parseRefusedSoftFail(f *Fanout, c *caddyfile.Dispenser) error {
+	if c.NextArg() {
+		return c.ArgErr()
+	}
+	f.refusedSoftFail = true
+	return nil
+}
+
+func parsePreferDNSSEC(f *Fanout, c *caddyfile.Dispenser) error {
+	if c.NextArg() {
+		return c.ArgErr()
+	}
+	f.preferDNSSEC = true
+	return nil
+}
+
+func parsePrewarm(f *Fanout, c *caddyfile.Dispenser) error {
+	if c.NextArg() {
+		return c.ArgErr()
+	}
+	f.prewarm = true
+	return nil
+}
+
+func parseDebugAddr(f *Fanout, c *caddyfile.Dispenser) error {
+	args := c.RemainingArgs()
+	if len(args) != 1 {
+		return c.ArgErr()
+	}
+	if _, _, err := net.SplitHostPort(args[0]); err != nil {
+		return errors.Wrapf(err, "invalid debug-addr %q", args[0])
+	}
+	f.debugAddr = args[0]
+	return nil
+}
+
+func parsePoolPing(f *Fanout, c *caddyfile.Dispenser) error {
+	if !c.NextArg() {
+		return c.ArgErr()
+	}
+	d, err := time.ParseDuration(c.Val())
+	if err != nil || d <= 0 {
+		return errors.Errorf("invalid pool-ping interval %q", c.Val())
+	}
+	if c.NextArg() {
+		return c.ArgErr()
+	}
+	f.poolPing = d
+	return nil
+}
+
+func parseValidate(f *Fanout, c *caddyfile.Dispenser) error {
+	args := c.RemainingArgs()
+	v := f.responseValidator()
+	if len(args) > 0 && (args[len(args)-1] == validateReject || args[len(args)-1] == validateLog) {
+		v.logOnly = args[len(args)-1] == validateLog
+		args = args[:len(args)-1]
+	}
+	if len(args) == 0 {
+		return c.ArgErr()
+	}
+	for _, check := range args {
+		switch check {
+		case validateQuestion, validateRebind, validateTTL:
+			v.addCheck(check)
+		default:
+			return errors.Errorf("unsupported validate check %q", check)
+		}
+	}
+	return nil
+}
+
+// parseDenyPrivateAnswers parses `deny-private-answers [DOMAIN...]`, enabling the rebind check with the
+// given domains allowed to resolve to private addresses.
+func parseDenyPrivateAnswers(f *Fanout, c *caddyfile.Dispenser) error {
+	v := f.responseValidator()
+	for _, name := range c.RemainingArgs() {
+		normalized := plugin.Host(name).NormalizeExact()
+		if len(normalized) == 0 {
+			return errors.Errorf("unable to normalize '%s'", name)
+		}
+		v.privateZones.AddString(normalized[0])
+	}
+	v.addCheck(validateRebind)
+	return nil
+}
+
+// responseValidator returns the validator of f, creating it on first use by validate or deny-private-answers.
+func (f *Fanout) responseValidator() *responseValidator {
+	if f.validator == nil {
+		f.validator = newResponseValidator()
+	}
+	return f.validator
+}
+
+func parseConcurrencyLimit(f *Fanout, c *caddyfile.Dispenser) error {
+	args := c.RemainingArgs()
+	if len(args) == 0 || len(args) > 2 {
+		return c.ArgErr()
+	}
+	n, err := strconv.Atoi(args[0])
+	if err != nil || n <= 0 {
+		return errors.Errorf("invalid max-concurrent count %q", args[0])
+	}
+	queue := 0
+	if len(args) > 1 {
+		if queue, err = strconv.Atoi(args[1]); err != nil || queue < 0 || queue > maxConcurrentQueue {
+			return errors.Errorf("invalid max-concurrent queue size %q", args[1])
+		}
+	}
+	f.concurrency = newConcurrencyLimiter(n, queue)
+	return nil
+}
+
+func parseClientLimit(f *Fanout, c *caddyfile.Dispenser) error {
+	args := c.RemainingArgs()
+	if len(args) == 0 || len(args) > 2 {
+		return c.ArgErr()
+	}
+	n, err := strconv.Atoi(args[0])
+	if err != nil || n <= 0 {
+		return errors.Errorf("invalid max-concurrent-per-client count %q", args[0])
+	}
+	truncate := false
+	if len(args) > 1 {
+		switch args[1] {
+		case clientLimitRefused:
+		case clientLimitTruncate:
+			truncate = true
+		default:
+			return errors.Errorf("unsupported max-concurrent-per-client response %q", args[1])
+		}
+	}
+	f.clientLimit = newClientLimiter(n, truncate)
+	return nil
+}
+
+func parseServfailBlocklist(f *Fanout, c *caddyfile.Dispenser) error {
+	args := c.RemainingArgs()
+	if len(args) > 2 {
+		return c.ArgErr()
+	}
+	threshold, duration := defaultServfailThreshold, defaultServfailDuration
+	if len(args) > 0 {
+		n, err := strconv.Atoi(args[0])
+		if err != nil || n <= 0 {
+			return errors.Errorf("invalid servfail-blocklist count %q", args[0])
+		}
+		threshold = n
+	}
+	if len(args) > 1 {
+		d, err := time.ParseDuration(args[1])
+		if err != nil || d <= 0 {
+			return errors.Errorf("invalid servfail-blocklist duration %q", args[1])
+		}
+		duration = d
+	}
+	f.servfails = newServfailBlocklist(threshold, duration)
+	return nil
+}
+
+// parseHosts parses upstream addresses, keeping DNS-over-HTTPS and Oblivious DoH URLs as they are.
+func parseHosts(to []string) ([]string, error) {
+	var hosts []string
+	for _, addr := range to {
+		if _, ok := lookupClientFactory(addr); ok {
+			hosts = append(hosts, addr)
+			continue
+		}
+		if isODoH(addr) {
+			if u, err := url.Parse(addr); err != nil || u.Host == "" {
+				return nil, errors.Errorf("invalid Oblivious DoH upstream %q", addr)
+			}
+			hosts = append(hosts, addr)
+			continue
+		}
+		if isDoH(addr) {
+			u, err := url.Parse(addr)
+			if err != nil {
+				return nil, errors.Wrapf(err, "invalid DNS-over-HTTPS upstream %q", addr)
+			}
+			if _, err := normalizeAddr(u.Host, defaultPorts[transport.HTTPS]); err != nil {
+				return nil, errors.Wrapf(err, "invalid DNS-over-HTTPS upstream %q", addr)
+			}
+			hosts = append(hosts, addr)
+			continue
+		}
+		h, err := normalizeUpstream(addr)
+		if errors.Is(err, errNotIPAddress) {
+			// resolv.conf style files, or hostnames
+			files, fileErr := parse.HostPortOrFile(addr)
+			if fileErr == nil {
+				hosts = append(hosts, files...)
+				continue
+			}
+			if h, err = hostnameUpstream(addr); err != nil {
+				return nil, fileErr
+			}
+		}
+		switch {
+		case err != nil:
+			return nil, err
+		case strings.HasPrefix(h, transport.QUIC+"://"):
+			return nil, errors.Errorf("DNS-over-QUIC upstream %q is not supported", addr)
+		}
+		hosts = append(hosts, h)
+	}
+	return hosts, nil
+}
+
+func parseAnswerOrder(f *Fanout, c *caddyfile.Dispenser) error {
+	args := c.RemainingArgs()
+	if len(args) != 1 {
+		return c.ArgErr()
+	}
+	switch args[0] {
+	case answerOrderRotate, answerOrderShuffle:
+		f.answerOrder = args[0]
+	default:
+		return errors.Errorf("unsupported answer-order %q", args[0])
+	}
+	return nil
+}
+
+func parseODoHRelay(f *Fanout, c *caddyfile.Dispenser) error {
+	args := c.RemainingArgs()
+	if len(args) != 1 {
+		return c.ArgErr()
+	}
+	if u, err := url.Parse(args[0]); err != nil || !isDoH(args[0]) || u.Host == "" {
+		return errors.Errorf("invalid odoh-relay %q", args[0])
+	}
+	f.odohRelay = args[0]
+	return nil
+}
+
+func parseHTTPVersion(f *Fanout, c *caddyfile.Dispenser) error {
+	args := c.RemainingArgs()
+	if len(args) != 1 {
+		return c.ArgErr()
+	}
+	switch args[0] {
+	case httpVersion1, httpVersion2, httpVersion3:
+		f.httpVersion = args[0]
+	default:
+		return errors.Errorf("unsupported http-version %q", args[0])
+	}
+	return nil
+}
+
+func parseAttemptPolicy(f *Fanout, c *caddyfile.Dispenser) error {
+	if !c.NextArg() {
+		return c.ArgErr()
+	}
+	switch strings.ToLower(c.Val()) {
+	case attemptPolicySame:
+		f.rotateAttempts = false
+	case attemptPolicyRotate:
+		f.rotateAttempts = true
+	default:
+		return errors.Errorf("unknown attempt-policy %q", c.Val())
+	}
+	if c.NextArg() {
+		return c.ArgErr()
+	}
+	return nil
+}
+
+func parseMirrorTo(f *Fanout, c *caddyfile.Dispenser) error {
+	args := c.RemainingArgs()
+	if len(args) == 0 {
+		return c.ArgErr()
+	}
+	hosts, err := parseHosts(args)
+	if err != nil {
+		return err
+	}
+	f.mirrorTo = append(f.mirrorTo, hosts...)
+	return nil
+}
+
+func parseAdaptiveWeights(f *Fanout, c *caddyfile.Dispenser) error {
+	args := c.RemainingArgs()
+	switch len(args) {
+	case 0:
+		f.adaptiveInterval = defaultAdaptiveInterval
+	case 1:
+		d, err := time.ParseDuration(args[0])
+		if err != nil || d <= 0 {
+			return errors.Errorf("invalid adaptive-weights interval %q", args[0])
+		}
+		f.adaptiveInterval = d
+	default:
+		return c.ArgErr()
+	}
+	return nil
+}
+
+func parseMaxResponseSize(f *Fanout, c *caddyfile.Dispenser) error {
+	args := c.RemainingArgs()
+	if len(args) > 1 {
+		return c.ArgErr()
+	}
+	f.limitResponseSize = true
+	if len(args) == 0 {
+		return nil
+	}
+	size, err := strconv.Atoi(args[0])
+	if err != nil || size < dns.MinMsgSize || size > dns.MaxMsgSize {
+		return errors.Errorf("max-response-size must be between %d and %d", dns.MinMsgSize, dns.MaxMsgSize)
+	}
+	f.maxResponseSize = size
+	return nil
+}
+
+func parseLogSample(f *Fanout, c *caddyfile.Dispenser) error {
+	args := c.RemainingArgs()
+	if len(args) != 1 {
+		return c.ArgErr()
+	}
+	p, err := strconv.ParseFloat(args[0], 64)
+	if err != nil || p <= 0 || p > 1 {
+		return errors.Errorf("log-sample must be a probability in (0, 1], got %q", args[0])
+	}
+	f.logSample = p
+	return nil
+}
+
 func parseIgnoredFromFile(f *Fanout, c *caddyfile.Dispenser) error {
 	args := c.RemainingArgs()
 	if len(args) != 1 {
@@ -331,6 +1112,9 @@ func parseIgnored(f *Fanout, c *caddyfile.Dispenser) error {
 	if len(ignore) == 0 {
 		return c.ArgErr()
 	}
+	if i := slices.Index(ignore, exceptRedirect); i != -1 {
+		return parseExceptRedirect(f, ignore[:i], ignore[i+1:])
+	}
 	for i := 0; i < len(ignore); i++ {
 		normalized := plugin.Host(ignore[i]).NormalizeExact()
 		if len(normalized) == 0 {
@@ -341,6 +1125,29 @@ func parseIgnored(f *Fanout, c *caddyfile.Dispenser) error {
 	return nil
 }
 
+// parseExceptRedirect parses `except DOMAIN... -> ADDR...`, sending the queries for the domains to a
+// separate group of upstreams instead of excluding them.
+func parseExceptRedirect(f *Fanout, names, to []string) error {
+	if len(names) == 0 || len(to) == 0 {
+		return errors.Errorf("except redirect requires domains before and upstreams after %s", exceptRedirect)
+	}
+	g := &upstreamGroup{domains: NewDomain()}
+	for _, name := range names {
+		normalized := plugin.Host(name).NormalizeExact()
+		if len(normalized) == 0 {
+			return errors.Errorf("unable to normalize '%s'", name)
+		}
+		g.domains.AddString(normalized[0])
+	}
+	hosts, err := parseHosts(to)
+	if err != nil {
+		return err
+	}
+	g.hosts = hosts
+	f.groups = append(f.groups, g)
+	return nil
+}
+
 func parseWorkerCount(f *Fanout, c *caddyfile.Dispenser) error {
 	var err error
 	f.WorkerCount, err = parsePositiveInt(c)
@@ -366,13 +1173,9 @@ func parseLoadFactor(f *Fanout, c *caddyfile.Dispenser) error {
 		if err != nil {
 			return c.ArgErr()
 		}
-
 		if loadFactor < minLoadFactor {
 			return errors.New("load-factor should be more or equal 1")
 		}
-		if loadFactor > maxLoadFactor {
-			return errors.Errorf("load-factor %d should be less than %d", loadFactor, maxLoadFactor)
-		}
 
 		f.loadFactor = append(f.loadFactor, loadFactor)
 	}
@@ -421,7 +1224,7 @@ func parseTLS(f *Fanout, c *caddyfile.Dispenser) error {
 		return c.ArgErr()
 	}
 
-	tlsConfig, err := tls.NewTLSConfigFromArgs(args...)
+	tlsConfig, err := tlsConfigFromArgs(args...)
 	if err != nil {
 		return err
 	}
@@ -57,6 +57,7 @@ func TestSetup(t *testing.T) {
 		{input: "fanout . 127.0.0.1 127.0.0.2 127.0.0.3 127.0.0.4 {\nattempt-count 2\n}", expectedTimeout: defaultTimeout, expectedFrom: ".", expectedAttempts: 2, expectedWorkers: 4, expectedNetwork: "udp", expectedServerCount: 4, expectedLoadFactor: nil, expectedPolicy: ""},
 		{input: "fanout . 127.0.0.1 127.0.0.2 127.0.0.3 {\npolicy weighted-random \n}", expectedFrom: ".", expectedAttempts: 3, expectedWorkers: 3, expectedTimeout: defaultTimeout, expectedNetwork: "udp", expectedServerCount: 3, expectedLoadFactor: []int{100, 100, 100}, expectedPolicy: policyWeightedRandom},
 		{input: "fanout . 127.0.0.1 127.0.0.2 127.0.0.3 {\npolicy sequential\nworker-count 3\n}", expectedFrom: ".", expectedAttempts: 3, expectedWorkers: 3, expectedTimeout: defaultTimeout, expectedNetwork: "udp", expectedServerCount: 3, expectedLoadFactor: nil, expectedPolicy: policySequential},
+		{input: "fanout . 127.0.0.1 127.0.0.2 {\npolicy weighted-random \nweighted-random-load-factor 150 1000\n}", expectedFrom: ".", expectedAttempts: 3, expectedWorkers: 2, expectedTimeout: defaultTimeout, expectedNetwork: "udp", expectedServerCount: 2, expectedLoadFactor: []int{150, 1000}, expectedPolicy: policyWeightedRandom},
 		{input: "fanout . 127.0.0.1 {\nudp-buffer-size 65535\n}", expectedFrom: ".", expectedAttempts: 3, expectedWorkers: 1, expectedTimeout: defaultTimeout, expectedNetwork: "udp", expectedServerCount: 1, expectedPolicy: "", expectedUDPBufferSize: 65535, expectedUDPBufferSizeOverride: 65535},
 
 		// negative
@@ -67,10 +68,10 @@ func TestSetup(t *testing.T) {
 		{input: "fanout . 127.0.0.1 {\nexcept a:\nworker-count ten\n}", expectedErr: "unable to normalize 'a:'"},
 		{input: "fanout . 127.0.0.1 127.0.0.2 {\nnetwork XXX\n}", expectedErr: "unknown network protocol"},
 		{input: "fanout . 127.0.0.1 {\npolicy weighted-random \nweighted-random-server-count -100\n}", expectedErr: "Wrong argument count or unexpected line ending"},
-		{input: "fanout . 127.0.0.1 {\npolicy weighted-random \nweighted-random-load-factor 150\n}", expectedErr: "load-factor 150 should be less than 100"},
 		{input: "fanout . 127.0.0.1 {\npolicy weighted-random \nweighted-random-load-factor 0\n}", expectedErr: "load-factor should be more or equal 1"},
 		{input: "fanout . 127.0.0.1 {\npolicy weighted-random \nweighted-random-load-factor 50 100\n}", expectedErr: "load-factor params count must be the same as the number of hosts"},
-		{input: "fanout . 127.0.0.1 127.0.0.2 {\npolicy weighted-random \nweighted-random-load-factor 50\n}", expectedErr: "load-factor params count must be the same as the number of hosts"},
+		{input: "fanout . 127.0.0.1 127.0.0.2 {\npolicy weighted-random \nweighted-random-load-factor 50\n}", expectedErr: "got 1 load factors for 2 hosts"},
+		{input: "fanout . 127.0.0.1 127.0.0.2 {\npolicy weighted-random \nweighted-random-load-factor 2147483647 1\n}", expectedErr: "sum of load-factor params must not exceed"},
 		{input: "fanout . 127.0.0.1 127.0.0.2 {\npolicy weighted-random \nweighted-random-load-factor \n}", expectedErr: "Wrong argument count or unexpected line ending"},
 		{input: "fanout . 127.0.0.1 {\nudp-buffer-size 65536\n}", expectedErr: "udp-buffer-size must not exceed 65535"},
 	}
@@ -182,7 +183,9 @@ func TestInitClientsAppliesTLSConfigForGlobalTCPTLS(t *testing.T) {
 			f.tlsServerName = "dns.example"
 			f.tlsConfig = &tls.Config{RootCAs: roots, Certificates: []tls.Certificate{certificate}}
 
-			initClients(f, []string{test.host})
+			if err := initClients(f, []string{test.host}); err != nil {
+				t.Fatal(err)
+			}
 
 			client, ok := f.clients[0].(*client)
 			if !ok {
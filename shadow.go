@@ -0,0 +1,126 @@
+// Copyright (c) 2024 MWS and/or its affiliates.
+//
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at:
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fanout
+
+import (
+	"context"
+	"slices"
+	"strings"
+
+	"github.com/coredns/caddy/caddyfile"
+	"github.com/coredns/coredns/request"
+	"github.com/miekg/dns"
+)
+
+// Results of the comparison of a shadow response with the served one.
+const (
+	shadowAgree    = "agree"
+	shadowDisagree = "disagree"
+	shadowError    = "error"
+)
+
+func parseShadow(f *Fanout, c *caddyfile.Dispenser) error {
+	args := c.RemainingArgs()
+	if len(args) == 0 {
+		return c.ArgErr()
+	}
+	hosts, err := parseHosts(args)
+	if err != nil {
+		return err
+	}
+	f.shadowTo = append(f.shadowTo, hosts...)
+	return nil
+}
+
+// shadowRun is the comparison of the responses of the shadow upstreams to a query with the response served
+// to the client, which is known once done is closed.
+type shadowRun struct {
+	done   chan struct{}
+	served *dns.Msg
+}
+
+// shadowQuery sends a copy of the request to every shadow upstream in the background, alongside the
+// serving upstreams. Their responses are never returned to the client; once the response served to the
+// client is known, each one is scored as agreeing with it or not.
+func (f *Fanout) shadowQuery(req *request.Request) *shadowRun {
+	if len(f.shadowClients) == 0 {
+		return nil
+	}
+	run := &shadowRun{done: make(chan struct{})}
+	w := detachedWriter{local: req.W.LocalAddr(), remote: req.W.RemoteAddr()}
+	for _, c := range f.shadowClients {
+		// request.Request caches its fields lazily, every goroutine needs its own
+		shadowed := &request.Request{W: w, Req: req.Req.Copy()}
+		go func() {
+			ctx, cancel := context.WithTimeout(withZone(context.Background(), f.From), f.Timeout)
+			defer cancel()
+			ret, err := c.Request(ctx, shadowed)
+			<-run.done
+			run.score(c, shadowed, ret, err)
+		}()
+	}
+	return run
+}
+
+// finish records the result served to the client, before the reply modifies it.
+func (s *shadowRun) finish(result *response) {
+	if s == nil {
+		return
+	}
+	if result != nil && result.err == nil && result.response != nil {
+		s.served = result.response.Copy()
+	}
+	close(s.done)
+}
+
+// score counts the response of the shadow upstream c as agreeing with the served one or not. Nothing is
+// counted when the query couldn't be served.
+func (s *shadowRun) score(c Client, req *request.Request, ret *dns.Msg, err error) {
+	if s.served == nil {
+		return
+	}
+	result := shadowAgree
+	switch {
+	case err != nil:
+		result = shadowError
+		log.Debugf("shadow %s %s: %s: %v", req.Name(), req.Type(), c.Endpoint(), err)
+	case !sameAnswer(s.served, ret):
+		result = shadowDisagree
+		log.Debugf("shadow %s %s: %s: %s with %d answers, served %s with %d answers", req.Name(), req.Type(),
+			c.Endpoint(), dns.RcodeToString[ret.Rcode], len(ret.Answer), dns.RcodeToString[s.served.Rcode], len(s.served.Answer))
+	}
+	ShadowAgreementCount.WithLabelValues(c.Endpoint(), result).Add(1)
+}
+
+// sameAnswer reports whether two responses have the same rcode and answer records, in any order and
+// regardless of their TTLs.
+func sameAnswer(a, b *dns.Msg) bool {
+	if a.Rcode != b.Rcode || len(a.Answer) != len(b.Answer) {
+		return false
+	}
+	return slices.Equal(answerKeys(a), answerKeys(b))
+}
+
+func answerKeys(m *dns.Msg) []string {
+	keys := make([]string, 0, len(m.Answer))
+	for _, rr := range m.Answer {
+		h := rr.Header()
+		keys = append(keys, strings.ToLower(h.Name)+" "+dns.TypeToString[h.Rrtype]+rdata(rr))
+	}
+	slices.Sort(keys)
+	return keys
+}
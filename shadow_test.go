@@ -0,0 +1,67 @@
+// Copyright (c) 2024 MWS and/or its affiliates.
+//
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at:
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fanout
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/coredns/caddy"
+	"github.com/coredns/coredns/plugin/pkg/dnstest"
+	"github.com/coredns/coredns/plugin/test"
+	"github.com/miekg/dns"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/require"
+)
+
+func TestShadowUpstreams(t *testing.T) {
+	answering := func(records ...string) *server {
+		return newServer(UDP, func(w dns.ResponseWriter, r *dns.Msg) {
+			msg := new(dns.Msg)
+			msg.SetReply(r)
+			for _, record := range records {
+				msg.Answer = append(msg.Answer, makeRecordA(record))
+			}
+			logErrIfNotNil(w.WriteMsg(msg))
+		})
+	}
+	serving := answering("example1. 3600 IN A 10.0.0.1", "example1. 3600 IN A 10.0.0.2")
+	defer serving.close()
+	agreeing := answering("example1. 60 IN A 10.0.0.2", "example1. 60 IN A 10.0.0.1")
+	defer agreeing.close()
+	disagreeing := answering("example1. 3600 IN A 192.0.2.1")
+	defer disagreeing.close()
+
+	fs, err := parseFanout(caddy.NewTestController("dns", "fanout . "+serving.addr+" {\nshadow "+agreeing.addr+" "+disagreeing.addr+"\n}"))
+	require.NoError(t, err)
+	require.Len(t, fs[0].clients, 1, "shadow upstreams don't serve")
+	req := new(dns.Msg)
+	req.SetQuestion(testQuery, dns.TypeA)
+	rec := dnstest.NewRecorder(&test.ResponseWriter{})
+	_, err = fs[0].ServeDNS(context.Background(), rec, req)
+	require.NoError(t, err)
+	require.Len(t, rec.Msg.Answer, 2)
+
+	count := func(s *server, result string) float64 {
+		return testutil.ToFloat64(ShadowAgreementCount.WithLabelValues(s.addr, result))
+	}
+	require.Eventually(t, func() bool {
+		return count(agreeing, shadowAgree) == 1 && count(disagreeing, shadowDisagree) == 1
+	}, time.Second, time.Millisecond)
+	require.Zero(t, count(agreeing, shadowDisagree), "the order and TTLs of the records don't matter")
+}
@@ -0,0 +1,195 @@
+// Copyright (c) 2024 MWS and/or its affiliates.
+//
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at:
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fanout
+
+import (
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/coredns/caddy/caddyfile"
+	"github.com/pkg/errors"
+)
+
+// latencySLO is a latency objective: the given quantile of the attempt latencies of an upstream must
+// stay below threshold.
+type latencySLO struct {
+	quantile  float64
+	threshold time.Duration
+}
+
+// setSLO parses the objective of `upstream ADDR slo QUANTILE:THRESHOLD`.
+func (o *upstreamOptions) setSLO(value string) error {
+	q, threshold, ok := strings.Cut(value, ":")
+	if !ok {
+		return errors.Errorf("slo must be formatted as QUANTILE:THRESHOLD, got %q", value)
+	}
+	slo, err := parseSLO(q, threshold)
+	if err != nil {
+		return err
+	}
+	o.slo = &slo
+	return nil
+}
+
+// parseSLO parses a quantile such as p99 or p99.9 and a latency threshold such as 100ms.
+func parseSLO(quantile, threshold string) (latencySLO, error) {
+	q, ok := parseQuantile(quantile)
+	if !ok {
+		return latencySLO{}, errors.Errorf("invalid slo quantile %q", quantile)
+	}
+	d, err := time.ParseDuration(threshold)
+	if err != nil || d <= 0 {
+		return latencySLO{}, errors.Errorf("invalid slo threshold %q", threshold)
+	}
+	return latencySLO{quantile: q, threshold: d}, nil
+}
+
+// parseQuantile parses a quantile such as p99 or p99.9 into a fraction.
+func parseQuantile(quantile string) (float64, bool) {
+	q, err := strconv.ParseFloat(strings.TrimPrefix(strings.ToLower(quantile), "p"), 64)
+	if err != nil || !strings.HasPrefix(strings.ToLower(quantile), "p") || q <= 0 || q >= 100 {
+		return 0, false
+	}
+	return q / 100, true
+}
+
+// parseLatencySLO parses `latency-slo QUANTILE THRESHOLD [WINDOW]`.
+func parseLatencySLO(f *Fanout, c *caddyfile.Dispenser) error {
+	args := c.RemainingArgs()
+	if len(args) != 2 && len(args) != 3 {
+		return c.ArgErr()
+	}
+	slo, err := parseSLO(args[0], args[1])
+	if err != nil {
+		return err
+	}
+	f.latencySLO = &slo
+	if len(args) == 3 {
+		d, err := time.ParseDuration(args[2])
+		if err != nil || d < sloSlots*time.Second {
+			return errors.Errorf("invalid slo window %q, it must be at least %ds", args[2], sloSlots)
+		}
+		f.sloWindow = d
+	}
+	return nil
+}
+
+// sloWindow tracks the share of slow attempts of an upstream over a sliding window made of sloSlots slots.
+// The quantile objective holds as long as at most 1-quantile of the attempts are slower than the threshold.
+type sloWindow struct {
+	slo   latencySLO
+	width time.Duration
+	mutex sync.Mutex
+	slots [sloSlots]sloSlot
+}
+
+type sloSlot struct {
+	epoch int64
+	total uint64
+	slow  uint64
+}
+
+// observe records an attempt finished at now. Failed attempts count as slow.
+func (w *sloWindow) observe(rtt time.Duration, err error, now time.Time) {
+	epoch := now.UnixNano() / int64(w.width)
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	s := &w.slots[epoch%sloSlots]
+	if s.epoch != epoch {
+		*s = sloSlot{epoch: epoch}
+	}
+	s.total++
+	if err != nil || rtt > w.slo.threshold {
+		s.slow++
+	}
+}
+
+// violated returns true if the objective is missed over the window ending at now.
+func (w *sloWindow) violated(now time.Time) bool {
+	epoch := now.UnixNano() / int64(w.width)
+	var total, slow uint64
+	w.mutex.Lock()
+	for _, s := range w.slots {
+		if s.epoch > epoch-sloSlots && s.epoch <= epoch {
+			total += s.total
+			slow += s.slow
+		}
+	}
+	w.mutex.Unlock()
+	return total > 0 && float64(total-slow) < w.slo.quantile*float64(total)
+}
+
+// sloTracker evaluates the latency objectives of the upstreams of a fanout instance, exporting them as the
+// UpstreamSLOViolation gauges.
+type sloTracker struct {
+	windows map[string]*sloWindow
+	width   time.Duration
+}
+
+// initSLOs sets up the latency objective of each upstream, given with the upstream directive or else
+// with latency-slo.
+func initSLOs(f *Fanout) {
+	f.slos = nil
+	width := f.sloWindow / sloSlots
+	windows := map[string]*sloWindow{}
+	for _, c := range f.upstreams() {
+		slo := f.latencySLO
+		if opts, ok := f.upstreamOptions[c.Endpoint()]; ok && opts.slo != nil {
+			slo = opts.slo
+		}
+		if slo != nil {
+			windows[c.Endpoint()] = &sloWindow{slo: *slo, width: width}
+		}
+	}
+	if len(windows) > 0 {
+		f.slos = &sloTracker{windows: windows, width: width}
+	}
+}
+
+// observe records an attempt of the upstream with the given endpoint and updates its gauge.
+func (t *sloTracker) observe(addr string, rtt time.Duration, err error, now time.Time) {
+	if t == nil {
+		return
+	}
+	w, ok := t.windows[addr]
+	if !ok {
+		return
+	}
+	w.observe(rtt, err, now)
+	t.export(addr, w, now)
+}
+
+func (t *sloTracker) export(addr string, w *sloWindow, now time.Time) {
+	violated := 0.0
+	if w.violated(now) {
+		violated = 1
+	}
+	UpstreamSLOViolation.WithLabelValues(addr).Set(violated)
+}
+
+// task updates the gauges once per slot, so that they recover once slow attempts leave the window even
+// without new traffic.
+func (t *sloTracker) task() task {
+	return task{interval: t.width, run: func(now time.Time) bool {
+		for addr, w := range t.windows {
+			t.export(addr, w, now)
+		}
+		return true
+	}}
+}
@@ -0,0 +1,99 @@
+// Copyright (c) 2024 MWS and/or its affiliates.
+//
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at:
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fanout
+
+import (
+	"testing"
+	"time"
+
+	"github.com/coredns/caddy"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/require"
+
+	"github.com/hurricanehrndz/fanout/v2/clock"
+)
+
+func TestSLOWindow(t *testing.T) {
+	slo, err := parseSLO("p90", "100ms")
+	require.NoError(t, err)
+	require.Equal(t, latencySLO{quantile: 0.9, threshold: 100 * time.Millisecond}, slo)
+	w := &sloWindow{slo: slo, width: time.Minute}
+	now := time.Unix(0, 0)
+	require.False(t, w.violated(now), "no traffic is no violation")
+
+	for i := 0; i < 9; i++ {
+		w.observe(10*time.Millisecond, nil, now)
+	}
+	w.observe(time.Second, nil, now)
+	require.False(t, w.violated(now), "10% of slow attempts meet p90")
+	w.observe(0, errors.New("timeout"), now.Add(time.Minute))
+	require.True(t, w.violated(now.Add(time.Minute)), "failed attempts count as slow")
+	require.True(t, w.violated(now.Add(10*time.Minute)))
+	require.False(t, w.violated(now.Add(11*time.Minute)), "slow attempts leave the window")
+
+	for _, bad := range [][2]string{{"99", "100ms"}, {"p100", "100ms"}, {"p0", "100ms"}, {"px", "100ms"}, {"p99", "-1s"}} {
+		_, err := parseSLO(bad[0], bad[1])
+		require.Error(t, err, bad)
+	}
+}
+
+func TestLatencySLOSetup(t *testing.T) {
+	fs, err := parseFanout(caddy.NewTestController("dns", `fanout . 198.18.3.1 198.18.3.2 198.18.3.3 {
+latency-slo p99 100ms 1m
+upstream 198.18.3.2 slo p50:10ms
+}`))
+	require.NoError(t, err)
+	f := fs[0]
+	require.Len(t, f.slos.windows, 3)
+	require.Equal(t, 6*time.Second, f.slos.width)
+	require.Equal(t, latencySLO{quantile: 0.99, threshold: 100 * time.Millisecond}, f.slos.windows["198.18.3.1:53"].slo)
+	require.Equal(t, latencySLO{quantile: 0.5, threshold: 10 * time.Millisecond}, f.slos.windows["198.18.3.2:53"].slo)
+
+	clk := clock.NewManual(time.Now())
+	addr := "198.18.3.2:53"
+	f.slos.observe(addr, 50*time.Millisecond, nil, clk.Now())
+	require.Equal(t, 1.0, testutil.ToFloat64(UpstreamSLOViolation.WithLabelValues(addr)))
+
+	stop := make(chan struct{})
+	defer close(stop)
+	go runTask(clk, stop, f.slos.task())
+	require.Eventually(t, func() bool {
+		if clk.Waiters() > 0 {
+			clk.Advance(f.slos.width)
+		}
+		return testutil.ToFloat64(UpstreamSLOViolation.WithLabelValues(addr)) == 0
+	}, 5*time.Second, time.Millisecond, "the violation clears once the window is past")
+
+	fs, err = parseFanout(caddy.NewTestController("dns", "fanout . 198.18.3.1 {\nupstream 198.18.3.1 slo p99:5ms\n}"))
+	require.NoError(t, err)
+	require.Len(t, fs[0].slos.windows, 1)
+	fs, err = parseFanout(caddy.NewTestController("dns", "fanout . 198.18.3.1"))
+	require.NoError(t, err)
+	require.Nil(t, fs[0].slos)
+
+	tests := map[string]string{
+		"latency-slo p99":             "Wrong argument count",
+		"latency-slo p99 100ms 1s":    "invalid slo window",
+		"latency-slo 99 100ms":        "invalid slo quantile",
+		"upstream 198.18.3.1 slo p99": "slo must be formatted as QUANTILE:THRESHOLD",
+	}
+	for option, expectedErr := range tests {
+		_, err := parseFanout(caddy.NewTestController("dns", "fanout . 198.18.3.1 {\n"+option+"\n}"))
+		require.ErrorContains(t, err, expectedErr, option)
+	}
+}
@@ -0,0 +1,147 @@
+// Copyright (c) 2024 MWS and/or its affiliates.
+//
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at:
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fanout
+
+import (
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/coredns/caddy/caddyfile"
+	"github.com/pkg/errors"
+)
+
+// slowStartEntry is the state of an upstream for slow start. credit accumulates the share of each query
+// offered to the upstream, and the upstream is picked whenever a whole token is available.
+type slowStartEntry struct {
+	failures  int
+	down      bool
+	recovered time.Time
+	credit    float64
+}
+
+// slowStart keeps an upstream which has failed threshold consecutive attempts to a minimal share of the
+// queries, and ramps its share back up linearly over window once it answers again, so that the queries
+// retried against it don't knock a recovering resolver over again.
+type slowStart struct {
+	threshold int
+	window    time.Duration
+	mutex     sync.Mutex
+	entries   map[string]*slowStartEntry
+}
+
+func newSlowStart(threshold int, window time.Duration) *slowStart {
+	return &slowStart{threshold: threshold, window: window, entries: map[string]*slowStartEntry{}}
+}
+
+// parseSlowStart parses `slow-start DURATION [COUNT]`.
+func parseSlowStart(f *Fanout, c *caddyfile.Dispenser) error {
+	args := c.RemainingArgs()
+	if len(args) == 0 || len(args) > 2 {
+		return c.ArgErr()
+	}
+	d, err := time.ParseDuration(args[0])
+	if err != nil || d <= 0 {
+		return errors.Errorf("invalid slow-start duration %q", args[0])
+	}
+	threshold := defaultSlowStartFailures
+	if len(args) > 1 {
+		n, err := strconv.Atoi(args[1])
+		if err != nil || n <= 0 {
+			return errors.Errorf("invalid slow-start count %q", args[1])
+		}
+		threshold = n
+	}
+	f.slowStart = newSlowStart(threshold, d)
+	return nil
+}
+
+// observe records the outcome of an attempt to the upstream finished at now.
+func (s *slowStart) observe(addr string, err error, now time.Time) {
+	if s == nil {
+		return
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	e, ok := s.entries[addr]
+	if !ok {
+		e = &slowStartEntry{}
+		s.entries[addr] = e
+	}
+	switch {
+	case err == nil && e.down:
+		log.Infof("upstream %s answers again, ramping its traffic up over %s", addr, s.window)
+		*e = slowStartEntry{recovered: now}
+	case err == nil:
+		e.failures = 0
+	case !e.down:
+		e.failures++
+		if e.failures >= s.threshold {
+			*e = slowStartEntry{down: true}
+		}
+	}
+}
+
+// markDown marks the upstream down, as if it had failed threshold consecutive attempts.
+func (s *slowStart) markDown(addr string) {
+	if s == nil {
+		return
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.entries[addr] = &slowStartEntry{down: true}
+}
+
+// share returns the share of the queries the upstream gets at now: minSlowStartShare while it is down,
+// growing linearly to 1 over the window after it recovered.
+func (s *slowStart) share(e *slowStartEntry, now time.Time) float64 {
+	if e.down {
+		return minSlowStartShare
+	}
+	if e.recovered.IsZero() {
+		return 1
+	}
+	elapsed := now.Sub(e.recovered)
+	if elapsed >= s.window {
+		e.recovered = time.Time{}
+		return 1
+	}
+	return max(minSlowStartShare, float64(elapsed)/float64(s.window))
+}
+
+// admit returns true if a query offered to the upstream at now may be sent to it.
+func (s *slowStart) admit(addr string, now time.Time) bool {
+	if s == nil {
+		return true
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	e, ok := s.entries[addr]
+	if !ok {
+		return true
+	}
+	share := s.share(e, now)
+	if share >= 1 {
+		return true
+	}
+	e.credit += share
+	if e.credit < 1 {
+		return false
+	}
+	e.credit--
+	return true
+}
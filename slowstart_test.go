@@ -0,0 +1,99 @@
+// Copyright (c) 2024 MWS and/or its affiliates.
+//
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at:
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fanout
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/coredns/caddy"
+	"github.com/coredns/coredns/plugin/pkg/dnstest"
+	"github.com/coredns/coredns/plugin/test"
+	"github.com/coredns/coredns/request"
+	"github.com/miekg/dns"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+
+	"github.com/hurricanehrndz/fanout/v2/clock"
+)
+
+func TestSlowStart(t *testing.T) {
+	now := time.Now()
+	s := newSlowStart(3, 10*time.Second)
+	admitted := func(n int) int {
+		count := 0
+		for range n {
+			if s.admit("a", now) {
+				count++
+			}
+		}
+		return count
+	}
+	require.Equal(t, 100, admitted(100), "unknown upstreams get every query")
+
+	failure := errors.New("timeout")
+	s.observe("a", failure, now)
+	s.observe("a", failure, now)
+	require.Equal(t, 100, admitted(100))
+	s.observe("a", failure, now)
+	require.Equal(t, 5, admitted(100), "a down upstream gets a minimal share")
+
+	s.observe("a", nil, now)
+	require.Equal(t, 5, admitted(100), "a recovered upstream starts from the minimal share")
+	now = now.Add(5 * time.Second)
+	require.Equal(t, 50, admitted(100))
+	now = now.Add(5 * time.Second)
+	require.Equal(t, 100, admitted(100), "the share is back to all queries after the window")
+
+	s.observe("a", failure, now)
+	s.observe("a", nil, now)
+	s.observe("a", failure, now)
+	s.observe("a", failure, now)
+	require.Equal(t, 100, admitted(100), "only consecutive failures mark an upstream down")
+}
+
+func TestSlowStartSelection(t *testing.T) {
+	s := newServer(UDP, func(w dns.ResponseWriter, r *dns.Msg) {
+		msg := dns.Msg{Answer: []dns.RR{makeRecordA("example1. 3600 IN A 10.0.0.1")}}
+		msg.SetReply(r)
+		logErrIfNotNil(w.WriteMsg(&msg))
+	})
+	defer s.close()
+	fs, err := parseFanout(caddy.NewTestController("dns", "fanout . 203.0.113.1 "+s.addr+" {\nslow-start 10s 1\n}"))
+	require.NoError(t, err)
+	f := fs[0]
+	f.clock = clock.NewManual(time.Now())
+	f.slowStart.observe("203.0.113.1:53", errors.New("timeout"), f.clock.Now())
+
+	req := new(dns.Msg)
+	req.SetQuestion(testQuery, dns.TypeA)
+	for range 10 {
+		sel := f.newActiveSelector(&request.Request{W: &test.ResponseWriter{}, Req: req}, f.clients, f.ServerSelectionPolicy)
+		require.Equal(t, s.addr, sel.Pick().Endpoint(), "a down upstream is held back")
+		require.Nil(t, sel.Pick())
+	}
+	require.NoError(t, f.DrainUpstream(s.addr))
+	sel := f.newActiveSelector(&request.Request{W: &test.ResponseWriter{}, Req: req}, f.clients, f.ServerSelectionPolicy)
+	require.Equal(t, "203.0.113.1:53", sel.Pick().Endpoint(), "held back upstreams are used when no other one is left")
+	require.NoError(t, f.UndrainUpstream(s.addr))
+
+	rec := dnstest.NewRecorder(&test.ResponseWriter{})
+	_, err = f.ServeDNS(context.Background(), rec, req)
+	require.NoError(t, err)
+	require.Len(t, rec.Msg.Answer, 1)
+}
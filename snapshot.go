@@ -0,0 +1,171 @@
+// Copyright (c) 2024 MWS and/or its affiliates.
+//
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at:
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fanout
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/coredns/caddy/caddyfile"
+	"github.com/pkg/errors"
+)
+
+// snapshotMagic starts the cache snapshot files, followed by the entries, each made of the length of its
+// key and the key, then the length of the encoded entry and the entry, lengths being big endian uint32.
+var snapshotMagic = []byte("fanout-cache-2\n")
+
+// parseCacheSnapshot parses `cache-snapshot FILE`.
+func parseCacheSnapshot(f *Fanout, c *caddyfile.Dispenser) error {
+	args := c.RemainingArgs()
+	if len(args) != 1 {
+		return c.ArgErr()
+	}
+	if f.cache == nil {
+		cache, err := newResponseCache(defaultCacheSize)
+		if err != nil {
+			return err
+		}
+		f.cache = cache
+	}
+	f.cacheSnapshot = filepath.Clean(args[0])
+	return nil
+}
+
+// loadCacheSnapshot fills the cache with the entries saved by the previous instance which haven't expired
+// yet. Their TTLs decrease from the time they were stored at, so the time spent down counts too.
+func (f *Fanout) loadCacheSnapshot() {
+	if f.cacheSnapshot == "" {
+		return
+	}
+	file, err := os.Open(f.cacheSnapshot)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Warningf("unable to load cache snapshot: %v", err)
+		}
+		return
+	}
+	defer file.Close()
+	n, err := f.cache.load(bufio.NewReader(file), f.clock.Now())
+	if err != nil {
+		log.Warningf("unable to load cache snapshot %s after %d responses: %v", f.cacheSnapshot, n, err)
+		return
+	}
+	log.Infof("loaded %d cached responses from %s", n, f.cacheSnapshot)
+}
+
+// saveCacheSnapshot writes the entries of the cache to a temporary file renamed over the snapshot, so a
+// crash while saving leaves the previous snapshot intact.
+func (f *Fanout) saveCacheSnapshot() {
+	if f.cacheSnapshot == "" {
+		return
+	}
+	if err := f.cache.saveFile(f.cacheSnapshot, f.clock.Now()); err != nil {
+		log.Warningf("unable to save cache snapshot: %v", err)
+	}
+}
+
+func (c *responseCache) saveFile(path string, now time.Time) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	w := bufio.NewWriter(tmp)
+	err = c.save(w, now)
+	if err == nil {
+		err = w.Flush()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// save writes the entries of the local tier which haven't expired at now, from the least recently used.
+func (c *responseCache) save(w io.Writer, now time.Time) error {
+	if _, err := w.Write(snapshotMagic); err != nil {
+		return err
+	}
+	for _, key := range c.local.Keys() {
+		e, ok := c.local.Peek(key)
+		if !ok || !now.Before(e.expiry) {
+			continue
+		}
+		for _, b := range [][]byte{[]byte(key), e.encode()} {
+			if _, err := w.Write(binary.BigEndian.AppendUint32(nil, uint32(len(b)))); err != nil {
+				return err
+			}
+			if _, err := w.Write(b); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// load adds the entries read from r which haven't expired at now, and returns how many were added.
+func (c *responseCache) load(r io.Reader, now time.Time) (int, error) {
+	magic := make([]byte, len(snapshotMagic))
+	if _, err := io.ReadFull(r, magic); err != nil || string(magic) != string(snapshotMagic) {
+		return 0, errors.New("not a cache snapshot")
+	}
+	n := 0
+	for {
+		key, err := readSnapshotField(r)
+		if err == io.EOF {
+			return n, nil
+		}
+		if err != nil {
+			return n, err
+		}
+		value, err := readSnapshotField(r)
+		if err != nil {
+			return n, err
+		}
+		e, ok := decodeCacheEntry(value)
+		if !ok {
+			return n, errors.Errorf("invalid entry for %s", key)
+		}
+		if now.Before(e.expiry) {
+			c.local.Add(string(key), e)
+			n++
+		}
+	}
+}
+
+func readSnapshotField(r io.Reader) ([]byte, error) {
+	var size [4]byte
+	if _, err := io.ReadFull(r, size[:]); err != nil {
+		return nil, err
+	}
+	n := binary.BigEndian.Uint32(size[:])
+	if n > maxCacheEntrySize {
+		return nil, errors.New("entry too large")
+	}
+	b := make([]byte, n)
+	if _, err := io.ReadFull(r, b); err != nil {
+		return nil, io.ErrUnexpectedEOF
+	}
+	return b, nil
+}
@@ -0,0 +1,95 @@
+// Copyright (c) 2024 MWS and/or its affiliates.
+//
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at:
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fanout
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/coredns/caddy"
+	"github.com/coredns/coredns/plugin/pkg/dnstest"
+	"github.com/coredns/coredns/plugin/test"
+	"github.com/hurricanehrndz/fanout/v2/clock"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCacheSnapshot(t *testing.T) {
+	var requests atomic.Int32
+	s := newServer(UDP, func(w dns.ResponseWriter, r *dns.Msg) {
+		if r.Question[0].Qtype == dns.TypeA {
+			requests.Add(1)
+		}
+		msg := dns.Msg{Answer: []dns.RR{makeRecordA(r.Question[0].Name + " 300 IN A 10.0.0.1")}}
+		if r.Question[0].Name == "example2." {
+			msg.Answer[0].Header().Ttl = 10
+		}
+		msg.SetReply(r)
+		logErrIfNotNil(w.WriteMsg(&msg))
+	})
+	defer s.close()
+	path := filepath.Join(t.TempDir(), "cache")
+	manual := clock.NewManual(time.Now())
+	newInstance := func() *Fanout {
+		fs, err := parseFanout(caddy.NewTestController("dns", "fanout . "+s.addr+" {\ncache-snapshot "+path+"\n}"))
+		require.NoError(t, err)
+		fs[0].clock = manual
+		require.NoError(t, fs[0].OnStartup())
+		return fs[0]
+	}
+	query := func(f *Fanout, name string) *dns.Msg {
+		req := new(dns.Msg)
+		req.SetQuestion(name, dns.TypeA)
+		rec := dnstest.NewRecorder(&test.ResponseWriter{})
+		_, err := f.ServeDNS(context.Background(), rec, req)
+		require.NoError(t, err)
+		return rec.Msg
+	}
+
+	f := newInstance()
+	query(f, "example1.")
+	query(f, "example2.")
+	require.NoError(t, f.OnShutdown())
+	require.FileExists(t, path)
+
+	manual.Advance(60 * time.Second)
+	f = newInstance()
+	defer func() { require.NoError(t, f.OnShutdown()) }()
+	m := query(f, "example1.")
+	require.Equal(t, int32(2), requests.Load(), "the snapshot is loaded on startup")
+	require.Equal(t, uint32(240), m.Answer[0].Header().Ttl, "TTLs count the time spent down")
+	query(f, "example2.")
+	require.Equal(t, int32(3), requests.Load(), "expired entries are not loaded")
+}
+
+func TestCacheSnapshotInvalid(t *testing.T) {
+	cache, err := newResponseCache(10)
+	require.NoError(t, err)
+	path := filepath.Join(t.TempDir(), "cache")
+	require.NoError(t, os.WriteFile(path, []byte("garbage"), 0o600))
+	f := &Fanout{cache: cache, cacheSnapshot: path, clock: clock.Real()}
+	f.loadCacheSnapshot()
+	require.Zero(t, cache.local.Len())
+
+	f.cacheSnapshot = filepath.Join(t.TempDir(), "missing")
+	f.loadCacheSnapshot()
+	require.Zero(t, cache.local.Len())
+}
@@ -0,0 +1,153 @@
+// Copyright (c) 2024 MWS and/or its affiliates.
+//
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at:
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fanout
+
+import (
+	"net"
+	"runtime"
+	"strconv"
+	"syscall"
+	"time"
+
+	"github.com/coredns/caddy/caddyfile"
+	"github.com/pkg/errors"
+)
+
+// sockopt applies a socket option of o to the socket fd of network before it connects. Each OS lists
+// the options it supports in platformSockopts; the others are ignored with a warning when configured,
+// so that the options of a Corefile don't break the builds or the startup of other platforms.
+type sockopt func(fd uintptr, network string, o *socketOptions) error
+
+// socketOptions are applied to sockets opened towards an upstream.
+type socketOptions struct {
+	// dscp is the differentiated services code point, -1 if unset.
+	dscp      int
+	mark      uint32
+	device    string
+	keepalive time.Duration
+	// fastOpen enables TCP Fast Open on TCP sockets, sending the first query with the SYN to
+	// upstreams which have sent a cookie before.
+	fastOpen bool
+}
+
+// set parses the socket option key of the upstream directive.
+func (o *socketOptions) set(key, value string) error {
+	switch key {
+	case "dscp":
+		dscp, err := strconv.Atoi(value)
+		if err != nil || dscp < 0 || dscp > maxDSCP {
+			return errors.Errorf("dscp must be between 0 and %d, got %q", maxDSCP, value)
+		}
+		o.dscp = dscp
+	case "mark":
+		mark, err := strconv.ParseUint(value, 0, 32)
+		if err != nil {
+			return errors.Errorf("invalid mark %q", value)
+		}
+		o.mark = uint32(mark)
+	case "device":
+		o.device = value
+	case "keepalive":
+		d, err := time.ParseDuration(value)
+		if err != nil || d <= 0 {
+			return errors.Errorf("invalid keepalive %q", value)
+		}
+		o.keepalive = d
+		return nil
+	}
+	warnUnsupportedSockopt(key)
+	return nil
+}
+
+// warnUnsupportedSockopt warns that the socket option key is ignored if the OS doesn't support it.
+func warnUnsupportedSockopt(key string) {
+	if _, ok := platformSockopts[key]; !ok {
+		log.Warningf("fanout: socket option %s is not supported on %s, ignoring it", key, runtime.GOOS)
+	}
+}
+
+// parseTCPFastOpen parses `tcp-fast-open`.
+func parseTCPFastOpen(f *Fanout, c *caddyfile.Dispenser) error {
+	if c.NextArg() {
+		return c.ArgErr()
+	}
+	f.tcpFastOpen = true
+	warnUnsupportedSockopt(sockoptFastOpen)
+	return nil
+}
+
+func (o *socketOptions) isSet() bool {
+	return o.dscp >= 0 || o.mark != 0 || o.device != "" || o.keepalive != 0 || o.fastOpen
+}
+
+// enabled returns the keys of the socket options set through control.
+func (o *socketOptions) enabled() []string {
+	var keys []string
+	if o.dscp >= 0 {
+		keys = append(keys, "dscp")
+	}
+	if o.mark != 0 {
+		keys = append(keys, "mark")
+	}
+	if o.device != "" {
+		keys = append(keys, "device")
+	}
+	if o.fastOpen {
+		keys = append(keys, sockoptFastOpen)
+	}
+	return keys
+}
+
+// control applies the options supported on the OS to a new socket.
+func (o *socketOptions) control(network, _ string, c syscall.RawConn) error {
+	var sockErr error
+	err := c.Control(func(fd uintptr) {
+		for _, key := range o.enabled() {
+			if set, ok := platformSockopts[key]; ok {
+				if sockErr = set(fd, network, o); sockErr != nil {
+					sockErr = errors.Wrapf(sockErr, "setting socket option %s", key)
+					return
+				}
+			}
+		}
+	})
+	if err != nil {
+		return err
+	}
+	return sockErr
+}
+
+// socketOptions returns the socket options of an upstream, from its options opts if any, combined with
+// the ones of the stanza.
+func (f *Fanout) socketOptions(opts *upstreamOptions) *socketOptions {
+	socket := newUpstreamOptions().socket
+	if opts != nil {
+		socket = opts.socket
+	}
+	socket.fastOpen = f.tcpFastOpen
+	return &socket
+}
+
+// dialer returns a net.Dialer applying the socket options to new connections.
+func (o *socketOptions) dialer() *net.Dialer {
+	opts := *o
+	return &net.Dialer{
+		Timeout:   maxTimeout,
+		KeepAlive: opts.keepalive,
+		Control:   opts.control,
+	}
+}
@@ -0,0 +1,50 @@
+// Copyright (c) 2024 MWS and/or its affiliates.
+//
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at:
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build linux
+
+package fanout
+
+import (
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+var platformSockopts = map[string]sockopt{
+	"dscp":          setDSCP,
+	"mark":          setMark,
+	"device":        bindToDevice,
+	sockoptFastOpen: setFastOpen,
+}
+
+func setMark(fd uintptr, _ string, o *socketOptions) error {
+	return unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_MARK, int(o.mark))
+}
+
+// setFastOpen enables TCP Fast Open for connect with TCP_FASTOPEN_CONNECT, which defers the SYN to the
+// first write. UDP sockets are left alone.
+func setFastOpen(fd uintptr, network string, _ *socketOptions) error {
+	if !strings.HasPrefix(network, TCP) {
+		return nil
+	}
+	return unix.SetsockoptInt(int(fd), unix.IPPROTO_TCP, unix.TCP_FASTOPEN_CONNECT, 1)
+}
+
+// bindToDevice binds the socket to the network interface, e.g. of a VRF, with SO_BINDTODEVICE.
+func bindToDevice(fd uintptr, _ string, o *socketOptions) error {
+	return unix.BindToDevice(int(fd), o.device)
+}
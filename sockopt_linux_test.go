@@ -0,0 +1,100 @@
+// Copyright (c) 2024 MWS and/or its affiliates.
+//
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at:
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build linux
+
+package fanout
+
+import (
+	"context"
+	"net"
+	"syscall"
+	"testing"
+
+	"github.com/coredns/caddy"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/sys/unix"
+)
+
+func TestSocketOptionsSetDSCP(t *testing.T) {
+	l, err := net.Listen(TCP, "127.0.0.1:0")
+	require.NoError(t, err)
+	defer l.Close()
+
+	opts := &socketOptions{dscp: 46}
+	conn, err := opts.dialer().DialContext(context.Background(), TCP, l.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+
+	raw, err := conn.(*net.TCPConn).SyscallConn()
+	require.NoError(t, err)
+	var tos int
+	require.NoError(t, raw.Control(func(fd uintptr) {
+		tos, err = syscall.GetsockoptInt(int(fd), syscall.IPPROTO_IP, syscall.IP_TOS)
+	}))
+	require.NoError(t, err)
+	require.Equal(t, 46<<2, tos)
+}
+
+func TestSocketOptionsBindToDevice(t *testing.T) {
+	l, err := net.Listen(TCP, "127.0.0.1:0")
+	require.NoError(t, err)
+	defer l.Close()
+
+	opts := &socketOptions{dscp: -1, device: "lo"}
+	conn, err := opts.dialer().DialContext(context.Background(), TCP, l.Addr().String())
+	if errors.Is(err, syscall.EPERM) {
+		t.Skip("binding to a device requires CAP_NET_RAW")
+	}
+	require.NoError(t, err)
+	defer conn.Close()
+
+	raw, err := conn.(*net.TCPConn).SyscallConn()
+	require.NoError(t, err)
+	var device string
+	require.NoError(t, raw.Control(func(fd uintptr) {
+		device, err = unix.GetsockoptString(int(fd), unix.SOL_SOCKET, unix.SO_BINDTODEVICE)
+	}))
+	require.NoError(t, err)
+	require.Equal(t, "lo", device)
+}
+
+func TestSocketOptionsFastOpen(t *testing.T) {
+	l, err := net.Listen(TCP, "127.0.0.1:0")
+	require.NoError(t, err)
+	defer l.Close()
+
+	fs, err := parseFanout(caddy.NewTestController("dns", "fanout . "+l.Addr().String()+" {\nnetwork tcp\ntcp-fast-open\n}"))
+	require.NoError(t, err)
+	opts := fs[0].socketOptions(nil)
+	require.True(t, opts.fastOpen)
+	conn, err := opts.dialer().DialContext(context.Background(), TCP, l.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+
+	raw, err := conn.(*net.TCPConn).SyscallConn()
+	require.NoError(t, err)
+	var enabled int
+	require.NoError(t, raw.Control(func(fd uintptr) {
+		enabled, err = unix.GetsockoptInt(int(fd), unix.IPPROTO_TCP, unix.TCP_FASTOPEN_CONNECT)
+	}))
+	require.NoError(t, err)
+	require.Equal(t, 1, enabled)
+
+	_, err = parseFanout(caddy.NewTestController("dns", "fanout . 127.0.0.1 {\ntcp-fast-open yes\n}"))
+	require.Error(t, err)
+}
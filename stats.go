@@ -0,0 +1,122 @@
+// Copyright (c) 2024 MWS and/or its affiliates.
+//
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at:
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fanout
+
+import (
+	"slices"
+	"sync"
+	"time"
+)
+
+// rttSmoothing is the weight of a new sample in the RTT moving average.
+const rttSmoothing = 0.2
+
+// upstreamStats accumulates request outcomes observed for a single upstream.
+type upstreamStats struct {
+	mutex    sync.Mutex
+	requests uint64
+	failures uint64
+	rtt      time.Duration
+	last     time.Time
+	samples  [rttSamples]time.Duration
+	sampled  int
+	quantile rttQuantile
+}
+
+// rttQuantile caches a quantile of the RTT samples, computed again every rttQuantileRefresh samples.
+type rttQuantile struct {
+	q       float64
+	value   time.Duration
+	sampled int
+}
+
+type statsSnapshot struct {
+	Requests uint64
+	Failures uint64
+	RTT      time.Duration
+	Last     time.Time
+}
+
+// cold returns true if the upstream has been idle for at least coldIdleInterval at now, so that its
+// connections have likely been torn down and its next attempt pays for a new handshake.
+func (s statsSnapshot) cold(now time.Time) bool {
+	return !s.Last.IsZero() && now.Sub(s.Last) >= coldIdleInterval
+}
+
+// observe records the outcome of a single attempt finished at now. The latency of the first attempt to
+// a cold upstream is left out of the RTT average, so that rarely used upstreams aren't penalized for the
+// handshakes their idle periods cause.
+func (s *upstreamStats) observe(rtt time.Duration, err error, now time.Time) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	cold := statsSnapshot{Last: s.last}.cold(now)
+	s.requests++
+	s.last = now
+	if err != nil {
+		s.failures++
+		return
+	}
+	if cold {
+		return
+	}
+	s.sampleLocked(rtt)
+	if s.rtt == 0 {
+		s.rtt = rtt
+		return
+	}
+	s.rtt += time.Duration(rttSmoothing * float64(rtt-s.rtt))
+}
+
+// sample records rtt in the samples of the RTT quantiles only.
+func (s *upstreamStats) sample(rtt time.Duration) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.sampleLocked(rtt)
+}
+
+func (s *upstreamStats) sampleLocked(rtt time.Duration) {
+	s.samples[s.sampled%rttSamples] = rtt
+	s.sampled++
+}
+
+// rttQuantile returns the quantile q of the last rttSamples RTTs, or false until minRTTSamples were observed.
+func (s *upstreamStats) rttQuantile(q float64) (time.Duration, bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.sampled < minRTTSamples {
+		return 0, false
+	}
+	if s.quantile.q == q && s.sampled-s.quantile.sampled < rttQuantileRefresh {
+		return s.quantile.value, true
+	}
+	samples := slices.Clone(s.samples[:min(s.sampled, rttSamples)])
+	slices.Sort(samples)
+	value := samples[min(int(q*float64(len(samples))), len(samples)-1)]
+	s.quantile = rttQuantile{q: q, value: value, sampled: s.sampled}
+	return value, true
+}
+
+func (s *upstreamStats) snapshot() statsSnapshot {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return statsSnapshot{Requests: s.requests, Failures: s.failures, RTT: s.rtt, Last: s.last}
+}
+
+// statsFor returns statistics of the upstream with the given endpoint, shared by all fanout instances.
+func (f *Fanout) statsFor(addr string) *upstreamStats {
+	return &registry.get(addr).stats
+}
@@ -0,0 +1,119 @@
+// Copyright (c) 2024 MWS and/or its affiliates.
+//
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at:
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fanout
+
+import (
+	"context"
+	"strings"
+	"sync"
+
+	"github.com/coredns/coredns/request"
+	"github.com/miekg/dns"
+)
+
+// svcbTarget is an address lookup adding glue for the target of SVCB or HTTPS records.
+type svcbTarget struct {
+	name  string
+	qtype uint16
+}
+
+// svcbHints pairs the address types with the SVCB keys hinting at them.
+var svcbHints = []struct {
+	qtype uint16
+	hint  dns.SVCBKey
+}{{dns.TypeA, dns.SVCB_IPV4HINT}, {dns.TypeAAAA, dns.SVCB_IPV6HINT}}
+
+// addSVCBGlue resolves, through the fanout, the addresses of the targets of the SVCB and HTTPS records of
+// m which come without the matching ipv4hint or ipv6hint, and adds them to the additional section, saving
+// clients a lookup before connecting.
+func (f *Fanout) addSVCBGlue(ctx context.Context, req *request.Request, m *dns.Msg) {
+	if !f.svcbGlue || m.Rcode != dns.RcodeSuccess {
+		return
+	}
+	targets := svcbTargets(m)
+	if len(targets) == 0 {
+		return
+	}
+	glue := make([][]dns.RR, len(targets))
+	var wg sync.WaitGroup
+	for i, t := range targets {
+		wg.Go(func() {
+			sub := new(dns.Msg)
+			sub.SetQuestion(t.name, t.qtype)
+			sub.RecursionDesired = req.Req.RecursionDesired
+			if opt := req.Req.IsEdns0(); opt != nil {
+				sub.SetEdns0(opt.UDPSize(), opt.Do())
+			}
+			subReq := &request.Request{W: req.W, Req: sub}
+			clients, p, serverCount := f.routeName(t.name, t.qtype)
+			r := f.getFanoutResult(ctx, subReq, f.runWorkersOn(ctx, subReq, clients, p, serverCount))
+			if r == nil || r.err != nil || r.response.Rcode != dns.RcodeSuccess {
+				return
+			}
+			for _, rr := range r.response.Answer {
+				if rr.Header().Rrtype == t.qtype && strings.EqualFold(rr.Header().Name, t.name) {
+					glue[i] = append(glue[i], rr)
+				}
+			}
+		})
+	}
+	wg.Wait()
+	for _, rrs := range glue {
+		m.Extra = append(m.Extra, rrs...)
+	}
+}
+
+// svcbTargets returns the address lookups missing for the targets of the SVCB and HTTPS records of m: A
+// without an ipv4hint, AAAA without an ipv6hint, unless the additional section has them already. At most
+// maxSVCBTargets lookups are returned.
+func svcbTargets(m *dns.Msg) []svcbTarget {
+	var targets []svcbTarget
+	seen := map[svcbTarget]bool{}
+	for _, rr := range m.Extra {
+		if t := rr.Header().Rrtype; t == dns.TypeA || t == dns.TypeAAAA {
+			seen[svcbTarget{name: strings.ToLower(rr.Header().Name), qtype: t}] = true
+		}
+	}
+	for _, rr := range m.Answer {
+		var svcb *dns.SVCB
+		switch v := rr.(type) {
+		case *dns.SVCB:
+			svcb = v
+		case *dns.HTTPS:
+			svcb = &v.SVCB
+		default:
+			continue
+		}
+		name := strings.ToLower(svcb.Target)
+		if name == "." {
+			name = strings.ToLower(svcb.Hdr.Name)
+		}
+		hints := map[dns.SVCBKey]bool{}
+		for _, kv := range svcb.Value {
+			hints[kv.Key()] = true
+		}
+		for _, lookup := range svcbHints {
+			t := svcbTarget{name: name, qtype: lookup.qtype}
+			if hints[lookup.hint] || seen[t] || len(targets) >= maxSVCBTargets {
+				continue
+			}
+			seen[t] = true
+			targets = append(targets, t)
+		}
+	}
+	return targets
+}
@@ -0,0 +1,89 @@
+// Copyright (c) 2024 MWS and/or its affiliates.
+//
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at:
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fanout
+
+import (
+	"context"
+	"testing"
+
+	"github.com/coredns/caddy"
+	"github.com/coredns/coredns/plugin/pkg/dnstest"
+	"github.com/coredns/coredns/plugin/test"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSVCBGlue(t *testing.T) {
+	s := newServer(UDP, func(w dns.ResponseWriter, r *dns.Msg) {
+		msg := new(dns.Msg)
+		msg.SetReply(r)
+		var records []string
+		switch r.Question[0].Qtype {
+		case dns.TypeHTTPS:
+			records = []string{
+				`example1. 300 IN HTTPS 1 svc.example1. alpn="h2"`,
+				`example1. 300 IN HTTPS 2 . ipv6hint="2001:db8::1"`,
+			}
+		case dns.TypeA:
+			records = []string{r.Question[0].Name + " 300 IN A 10.0.0.1"}
+		case dns.TypeAAAA:
+			records = []string{r.Question[0].Name + " 300 IN AAAA 2001:db8::2"}
+		}
+		for _, record := range records {
+			rr, err := dns.NewRR(record)
+			require.NoError(t, err)
+			msg.Answer = append(msg.Answer, rr)
+		}
+		logErrIfNotNil(w.WriteMsg(msg))
+	})
+	defer s.close()
+	fs, err := parseFanout(caddy.NewTestController("dns", "fanout . "+s.addr+" {\nsvcb-glue\n}"))
+	require.NoError(t, err)
+
+	req := new(dns.Msg)
+	req.SetQuestion(testQuery, dns.TypeHTTPS)
+	rec := dnstest.NewRecorder(&test.ResponseWriter{})
+	_, err = fs[0].ServeDNS(context.Background(), rec, req)
+	require.NoError(t, err)
+	require.Len(t, rec.Msg.Answer, 2)
+	var glue []string
+	for _, rr := range rec.Msg.Extra {
+		if rr.Header().Rrtype != dns.TypeOPT {
+			glue = append(glue, rr.Header().Name+" "+dns.TypeToString[rr.Header().Rrtype])
+		}
+	}
+	require.ElementsMatch(t, []string{"svc.example1. A", "svc.example1. AAAA", "example1. A"}, glue,
+		"addresses are added for the targets without hints only")
+}
+
+func TestSVCBTargets(t *testing.T) {
+	m := new(dns.Msg)
+	for _, record := range []string{
+		`example1. 300 IN HTTPS 1 a.example1. ipv4hint="10.0.0.1"`,
+		`example1. 300 IN SVCB 1 b.example1.`,
+		`example1. 300 IN SVCB 1 c.example1.`,
+		`example1. 300 IN SVCB 1 d.example1.`,
+	} {
+		rr, err := dns.NewRR(record)
+		require.NoError(t, err)
+		m.Answer = append(m.Answer, rr)
+	}
+	m.Extra = []dns.RR{makeRecordA("b.example1. 300 IN A 10.0.0.2")}
+	require.Equal(t, []svcbTarget{
+		{"a.example1.", dns.TypeAAAA}, {"b.example1.", dns.TypeAAAA}, {"c.example1.", dns.TypeA}, {"c.example1.", dns.TypeAAAA},
+	}, svcbTargets(m), "lookups are skipped for hinted or glued addresses, and capped")
+}
@@ -0,0 +1,70 @@
+// Copyright (c) 2024 MWS and/or its affiliates.
+//
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at:
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fanout
+
+import (
+	"strconv"
+	"sync"
+
+	"github.com/miekg/dns"
+	"github.com/pkg/errors"
+)
+
+// answerSizes remembers the size of the last answer of an upstream for each query type, so that queries
+// expected to get an answer of at least min bytes are sent straight over TCP instead of being truncated
+// over UDP first.
+type answerSizes struct {
+	min   int
+	sizes sync.Map // uint16 -> int
+}
+
+func newAnswerSizes(minSize int) *answerSizes {
+	return &answerSizes{min: minSize}
+}
+
+// setMinSizeTCP parses the answer size of `upstream ADDR min-size-tcp SIZE`.
+func (o *upstreamOptions) setMinSizeTCP(value string) error {
+	size, err := strconv.Atoi(value)
+	if err != nil || size < dns.MinMsgSize || size > dns.MaxMsgSize {
+		return errors.Errorf("min-size-tcp must be between %d and %d, got %q", dns.MinMsgSize, dns.MaxMsgSize, value)
+	}
+	o.minSizeTCP = size
+	return nil
+}
+
+// preferTCP reports whether the last answer to a query of type qtype reached the minimum size. It is safe
+// to call on a nil receiver.
+func (s *answerSizes) preferTCP(qtype uint16) bool {
+	if s == nil {
+		return false
+	}
+	size, ok := s.sizes.Load(qtype)
+	return ok && size.(int) >= s.min
+}
+
+// observe records the size of the answer m to a query of type qtype. A truncated answer counts as
+// reaching the minimum size. It is safe to call on a nil receiver.
+func (s *answerSizes) observe(qtype uint16, m *dns.Msg) {
+	if s == nil {
+		return
+	}
+	size := s.min
+	if !m.Truncated {
+		size = m.Len()
+	}
+	s.sizes.Store(qtype, size)
+}
@@ -0,0 +1,145 @@
+// Copyright (c) 2024 MWS and/or its affiliates.
+//
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at:
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fanout
+
+import (
+	"context"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/coredns/caddy"
+	"github.com/coredns/coredns/plugin/test"
+	"github.com/coredns/coredns/request"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMinSizeTCP(t *testing.T) {
+	var mu sync.Mutex
+	var networks []string
+	big := true
+	handler := func(w dns.ResponseWriter, r *dns.Msg) {
+		mu.Lock()
+		defer mu.Unlock()
+		network := w.RemoteAddr().Network()
+		networks = append(networks, network)
+		msg := new(dns.Msg)
+		msg.SetReply(r)
+		if big && network == UDP {
+			msg.Truncated = true
+		} else if big {
+			rr, err := dns.NewRR(r.Question[0].Name + ` 60 IN TXT "` + strings.Repeat("x", 250) + `"`)
+			require.NoError(t, err)
+			for range 8 {
+				msg.Answer = append(msg.Answer, rr)
+			}
+		}
+		logErrIfNotNil(w.WriteMsg(msg))
+	}
+
+	tcpListener, err := net.Listen(TCP, "127.0.0.1:0")
+	require.NoError(t, err)
+	defer tcpListener.Close()
+	udpConn, err := net.ListenPacket("udp", tcpListener.Addr().String())
+	require.NoError(t, err)
+	defer udpConn.Close()
+	tcpServer := &dns.Server{Listener: tcpListener, Handler: dns.HandlerFunc(handler)}
+	udpServer := &dns.Server{PacketConn: udpConn, Handler: dns.HandlerFunc(handler)}
+	go func() { _ = tcpServer.ActivateAndServe() }()
+	go func() { _ = udpServer.ActivateAndServe() }()
+	defer tcpServer.Shutdown()
+	defer udpServer.Shutdown()
+
+	addr := tcpListener.Addr().String()
+	fs, err := parseFanout(caddy.NewTestController("dns", "fanout . "+addr+" {\nnetwork udp\nupstream "+addr+" min-size-tcp 1500\n}"))
+	require.NoError(t, err)
+	c := fs[0].clients[0]
+	query := func(qtype uint16) []string {
+		mu.Lock()
+		networks = nil
+		mu.Unlock()
+		req := new(dns.Msg)
+		req.SetQuestion("example.org.", qtype)
+		_, err := c.Request(context.Background(), &request.Request{W: &test.ResponseWriter{}, Req: req})
+		require.NoError(t, err)
+		mu.Lock()
+		defer mu.Unlock()
+		return networks
+	}
+
+	require.Equal(t, []string{UDP, TCP}, query(dns.TypeTXT), "the first query is truncated over UDP")
+	require.Equal(t, []string{TCP}, query(dns.TypeTXT), "the next query goes straight over TCP")
+	require.Equal(t, []string{UDP, TCP}, query(dns.TypeDNSKEY), "sizes are remembered per query type")
+	mu.Lock()
+	big = false
+	mu.Unlock()
+	require.Equal(t, []string{TCP}, query(dns.TypeTXT))
+	require.Equal(t, []string{UDP}, query(dns.TypeTXT), "a small answer sends queries back to UDP")
+
+	for _, size := range []string{"100", "70000", "big"} {
+		_, err = parseFanout(caddy.NewTestController("dns", "fanout . 127.0.0.1 {\nupstream 127.0.0.1 min-size-tcp "+size+"\n}"))
+		require.Error(t, err, size)
+	}
+}
+
+func TestMatchTransport(t *testing.T) {
+	var mu sync.Mutex
+	var networks []string
+	handler := func(w dns.ResponseWriter, r *dns.Msg) {
+		mu.Lock()
+		networks = append(networks, w.RemoteAddr().Network())
+		mu.Unlock()
+		msg := new(dns.Msg)
+		msg.SetReply(r)
+		logErrIfNotNil(w.WriteMsg(msg))
+	}
+
+	tcpListener, err := net.Listen(TCP, "127.0.0.1:0")
+	require.NoError(t, err)
+	defer tcpListener.Close()
+	udpConn, err := net.ListenPacket("udp", tcpListener.Addr().String())
+	require.NoError(t, err)
+	defer udpConn.Close()
+	tcpServer := &dns.Server{Listener: tcpListener, Handler: dns.HandlerFunc(handler)}
+	udpServer := &dns.Server{PacketConn: udpConn, Handler: dns.HandlerFunc(handler)}
+	go func() { _ = tcpServer.ActivateAndServe() }()
+	go func() { _ = udpServer.ActivateAndServe() }()
+	defer tcpServer.Shutdown()
+	defer udpServer.Shutdown()
+
+	addr := tcpListener.Addr().String()
+	fs, err := parseFanout(caddy.NewTestController("dns", "fanout . "+addr+" {\nnetwork udp\nmatch-transport\n}"))
+	require.NoError(t, err)
+	c := fs[0].clients[0]
+	query := func(tcp bool) []string {
+		mu.Lock()
+		networks = nil
+		mu.Unlock()
+		req := new(dns.Msg)
+		req.SetQuestion("example.org.", dns.TypeA)
+		_, err := c.Request(context.Background(), &request.Request{W: &test.ResponseWriter{TCP: tcp}, Req: req})
+		require.NoError(t, err)
+		mu.Lock()
+		defer mu.Unlock()
+		return networks
+	}
+
+	require.Equal(t, []string{TCP}, query(true), "TCP clients are answered over TCP only")
+	require.Equal(t, []string{UDP}, query(false))
+}
@@ -0,0 +1,89 @@
+// Copyright (c) 2024 MWS and/or its affiliates.
+//
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at:
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fanout
+
+import (
+	"context"
+	"strconv"
+	"time"
+
+	"github.com/coredns/caddy/caddyfile"
+	"github.com/pkg/errors"
+)
+
+// adaptiveTimeout bounds each attempt to an upstream by a multiple of a quantile of its recent RTTs, so
+// that slow but working upstreams get the time they need while dead ones fail fast.
+type adaptiveTimeout struct {
+	quantile float64
+	factor   float64
+}
+
+// parseAdaptiveTimeout parses `adaptive-timeout [QUANTILE [FACTOR]]`.
+func parseAdaptiveTimeout(f *Fanout, c *caddyfile.Dispenser) error {
+	args := c.RemainingArgs()
+	if len(args) > 2 {
+		return c.ArgErr()
+	}
+	t := &adaptiveTimeout{quantile: defaultTimeoutQuantile, factor: defaultTimeoutFactor}
+	if len(args) > 0 {
+		q, ok := parseQuantile(args[0])
+		if !ok {
+			return errors.Errorf("invalid adaptive-timeout quantile %q", args[0])
+		}
+		t.quantile = q
+	}
+	if len(args) > 1 {
+		factor, err := strconv.ParseFloat(args[1], 64)
+		if err != nil || factor < 1 {
+			return errors.Errorf("invalid adaptive-timeout factor %q, it must be at least 1", args[1])
+		}
+		t.factor = factor
+	}
+	f.adaptiveTimeout = t
+	return nil
+}
+
+// timeout returns the time an attempt to the upstream with the given stats may take, between
+// minAdaptiveTimeout and limit, or false while too few RTTs were observed.
+func (t *adaptiveTimeout) timeout(s *upstreamStats, limit time.Duration) (time.Duration, bool) {
+	rtt, ok := s.rttQuantile(t.quantile)
+	if !ok {
+		return 0, false
+	}
+	return min(max(time.Duration(float64(rtt)*t.factor), minAdaptiveTimeout), limit), true
+}
+
+// context returns the context of an attempt to the upstream with the given stats, ctx itself if t is nil
+// or the upstream has no timeout yet. done must be called once the attempt is over. An attempt running
+// out of its own timeout counts as an RTT of that timeout, so the timeouts of an upstream which became
+// slower grow back instead of cutting all its attempts short.
+func (t *adaptiveTimeout) context(ctx context.Context, s *upstreamStats, limit time.Duration) (attemptCtx context.Context, done func()) {
+	if t == nil {
+		return ctx, func() {}
+	}
+	d, ok := t.timeout(s, limit)
+	if !ok {
+		return ctx, func() {}
+	}
+	attemptCtx, cancel := context.WithTimeout(ctx, d)
+	return attemptCtx, func() {
+		if errors.Is(attemptCtx.Err(), context.DeadlineExceeded) && ctx.Err() == nil {
+			s.sample(d)
+		}
+		cancel()
+	}
+}
@@ -0,0 +1,89 @@
+// Copyright (c) 2024 MWS and/or its affiliates.
+//
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at:
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fanout
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/coredns/caddy"
+	"github.com/coredns/coredns/plugin/pkg/dnstest"
+	"github.com/coredns/coredns/plugin/test"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAdaptiveTimeout(t *testing.T) {
+	var delay atomic.Int64
+	s := newServer(UDP, func(w dns.ResponseWriter, r *dns.Msg) {
+		time.Sleep(time.Duration(delay.Load()))
+		msg := dns.Msg{Answer: []dns.RR{makeRecordA("example1. 3600 IN A 10.0.0.1")}}
+		msg.SetReply(r)
+		logErrIfNotNil(w.WriteMsg(&msg))
+	})
+	defer s.close()
+	fs, err := parseFanout(caddy.NewTestController("dns", "fanout . "+s.addr+" {\nadaptive-timeout p90 2\nattempt-count 1\n}"))
+	require.NoError(t, err)
+	f := fs[0]
+	require.InDelta(t, 0.9, f.adaptiveTimeout.quantile, 1e-9)
+	stats := f.statsFor(s.addr)
+	_, ok := f.adaptiveTimeout.timeout(stats, f.Timeout)
+	require.False(t, ok, "no timeout until enough RTTs were observed")
+
+	query := func() error {
+		req := new(dns.Msg)
+		req.SetQuestion(testQuery, dns.TypeA)
+		_, err := f.ServeDNS(context.Background(), dnstest.NewRecorder(&test.ResponseWriter{}), req)
+		return err
+	}
+	for range minRTTSamples {
+		require.NoError(t, query())
+	}
+	d, ok := f.adaptiveTimeout.timeout(stats, f.Timeout)
+	require.True(t, ok)
+	require.Equal(t, minAdaptiveTimeout, d, "timeouts are at least minAdaptiveTimeout")
+
+	delay.Store(int64(time.Second))
+	start := time.Now()
+	require.Error(t, query())
+	require.Less(t, time.Since(start), 500*time.Millisecond, "an upstream slower than usual fails fast")
+}
+
+func TestAdaptiveTimeoutGrows(t *testing.T) {
+	var stats upstreamStats
+	now := time.Now()
+	for range minRTTSamples {
+		stats.observe(30*time.Millisecond, nil, now)
+	}
+	timeouts := &adaptiveTimeout{quantile: 0.9, factor: 2}
+	d, ok := timeouts.timeout(&stats, time.Second)
+	require.True(t, ok)
+	require.Equal(t, 60*time.Millisecond, d)
+	d, _ = timeouts.timeout(&stats, 55*time.Millisecond)
+	require.Equal(t, 55*time.Millisecond, d, "timeouts are capped by the limit")
+
+	limit := 100 * time.Millisecond
+	for range 2 * rttQuantileRefresh {
+		ctx, done := timeouts.context(context.Background(), &stats, limit)
+		<-ctx.Done()
+		done()
+	}
+	d, _ = timeouts.timeout(&stats, limit)
+	require.Equal(t, limit, d, "attempts running out of time raise the timeout")
+}
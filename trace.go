@@ -0,0 +1,112 @@
+// Copyright (c) 2024 MWS and/or its affiliates.
+//
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at:
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fanout
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/coredns/coredns/request"
+	"github.com/hurricanehrndz/fanout/v2/clock"
+	"github.com/miekg/dns"
+)
+
+type traceKey struct{}
+
+// decisionTrace records how a sampled query was resolved, the entries timed with clock from start.
+type decisionTrace struct {
+	mutex   sync.Mutex
+	clock   clock.Clock
+	start   time.Time
+	entries []string
+}
+
+func newDecisionTrace(clk clock.Clock) *decisionTrace {
+	return &decisionTrace{clock: clk, start: clk.Now()}
+}
+
+// sampleTrace returns a new trace if the query is selected by the log sampler, nil otherwise.
+func (f *Fanout) sampleTrace() *decisionTrace {
+	//nolint:gosec // sampling does not need cryptographic randomness
+	if f.logSample <= 0 || rand.Float64() >= f.logSample {
+		return nil
+	}
+	return newDecisionTrace(f.clock)
+}
+
+func withTrace(ctx context.Context, t *decisionTrace) context.Context {
+	if t == nil {
+		return ctx
+	}
+	return context.WithValue(ctx, traceKey{}, t)
+}
+
+func traceFrom(ctx context.Context) *decisionTrace {
+	t, _ := ctx.Value(traceKey{}).(*decisionTrace)
+	return t
+}
+
+// addf appends an entry to the trace, it is a no-op for a nil trace.
+func (t *decisionTrace) addf(format string, args ...any) {
+	if t == nil {
+		return
+	}
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	offset := t.clock.Now().Sub(t.start).Round(time.Microsecond)
+	t.entries = append(t.entries, fmt.Sprintf("+%s ", offset)+fmt.Sprintf(format, args...))
+}
+
+// picked records that the upstream has been selected for the query.
+func (t *decisionTrace) picked(c Client) {
+	if t == nil {
+		return
+	}
+	t.addf("picked %s", c.Endpoint())
+}
+
+// attempt records the outcome of a single upstream attempt.
+func (t *decisionTrace) attempt(c Client, msg *dns.Msg, err error, took time.Duration) {
+	if t == nil {
+		return
+	}
+	if err != nil {
+		t.addf("%s: error after %s: %v", c.Endpoint(), took, err)
+		return
+	}
+	t.addf("%s: %s with %d answers after %s", c.Endpoint(), dns.RcodeToString[msg.Rcode], len(msg.Answer), took)
+}
+
+func (t *decisionTrace) log(req *request.Request, result *response) {
+	if t == nil {
+		return
+	}
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	outcome := "no result"
+	if result != nil && result.client != nil {
+		outcome = fmt.Sprintf("selected %s after %d attempts", result.client.Endpoint(), result.attempts)
+		if result.response != nil {
+			outcome += fmt.Sprintf(", %d bytes over %s", result.size, result.proto)
+		}
+	}
+	log.Infof("trace %s %s: %s; %s", req.Name(), req.Type(), strings.Join(t.entries, "; "), outcome)
+}
@@ -0,0 +1,74 @@
+// Copyright (c) 2024 MWS and/or its affiliates.
+//
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at:
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fanout
+
+import (
+	"bytes"
+	"context"
+	golog "log"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/coredns/caddy"
+	"github.com/coredns/coredns/plugin/test"
+	"github.com/hurricanehrndz/fanout/v2/clock"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLogSampleTracesDecision(t *testing.T) {
+	s := newServer(UDP, func(w dns.ResponseWriter, r *dns.Msg) {
+		msg := dns.Msg{Answer: []dns.RR{makeRecordA("example1. 3600 IN A 10.0.0.1")}}
+		msg.SetReply(r)
+		logErrIfNotNil(w.WriteMsg(&msg))
+	})
+	defer s.close()
+
+	var buf bytes.Buffer
+	golog.SetOutput(&buf)
+	defer golog.SetOutput(os.Stderr)
+
+	fs, err := parseFanout(caddy.NewTestController("dns", "fanout . "+s.addr+" {\nlog-sample 1\n}"))
+	require.NoError(t, err)
+	req := new(dns.Msg)
+	req.SetQuestion(testQuery, dns.TypeA)
+	_, err = fs[0].ServeDNS(context.Background(), &test.ResponseWriter{}, req)
+	require.NoError(t, err)
+
+	out := buf.String()
+	require.Contains(t, out, "trace example1. A:")
+	require.Contains(t, out, "picked "+s.addr)
+	require.Contains(t, out, s.addr+": NOERROR with 1 answers")
+	require.Contains(t, out, "selected "+s.addr+" after 1 attempts, ")
+	require.Contains(t, out, " bytes over udp")
+}
+
+func TestDecisionTraceTimesEntriesWithClock(t *testing.T) {
+	manual := clock.NewManual(time.Now())
+	trace := newDecisionTrace(manual)
+	manual.Advance(1500 * time.Millisecond)
+	trace.addf("picked %s", "10.0.0.1:53")
+	require.Equal(t, []string{"+1.5s picked 10.0.0.1:53"}, trace.entries)
+}
+
+func TestSetupLogSample(t *testing.T) {
+	for _, input := range []string{"log-sample 0", "log-sample 1.5", "log-sample often", "log-sample"} {
+		_, err := parseFanout(caddy.NewTestController("dns", "fanout . 127.0.0.1 {\n"+input+"\n}"))
+		require.Error(t, err, input)
+	}
+}
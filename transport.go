@@ -20,6 +20,8 @@ import (
 	"context"
 	"crypto/tls"
 	"net"
+	"sync"
+	"time"
 
 	"github.com/miekg/dns"
 	ot "github.com/opentracing/opentracing-go"
@@ -28,19 +30,45 @@ import (
 // Transport represent a solution to connect to remote DNS endpoint with specific network
 type Transport interface {
 	Dial(ctx context.Context, net string) (*dns.Conn, error)
+	Yield(*dns.Conn)
 	SetTLSConfig(*tls.Config)
 }
 
+// DialFunc dials a connection to addr, it has the signature of net.Dialer.DialContext.
+type DialFunc func(ctx context.Context, network, addr string) (net.Conn, error)
+
 // NewTransport creates new transport with address
 func NewTransport(addr string) Transport {
+	return NewTransportWithDialer(addr, nil)
+}
+
+// NewTransportWithDialer creates new transport with address which opens connections using dial,
+// e.g. to route DNS traffic through a tunnel or another network namespace. TLS is negotiated on
+// top of the dialed connection. A nil dial uses net.Dialer.
+func NewTransportWithDialer(addr string, dial DialFunc) Transport {
+	if dial == nil {
+		dial = (&net.Dialer{Timeout: maxTimeout}).DialContext
+	}
 	return &transportImpl{
-		addr: addr,
+		addr:        addr,
+		dialContext: dial,
+		conns:       map[string][]*persistConn{},
 	}
 }
 
+type persistConn struct {
+	conn *dns.Conn
+	used time.Time
+}
+
 type transportImpl struct {
-	tlsConfig *tls.Config
-	addr      string
+	tlsConfig   *tls.Config
+	addr        string
+	dialContext DialFunc
+	mutex       sync.Mutex
+	conns       map[string][]*persistConn
+	udpBatch    int
+	batch       *udpBatcher
 }
 
 // SetTLSConfig sets tls config for transport
@@ -50,41 +78,191 @@ func (t *transportImpl) SetTLSConfig(c *tls.Config) {
 
 // Dial dials the address configured in transportImpl, potentially reusing a connection or creating a new one.
 func (t *transportImpl) Dial(ctx context.Context, network string) (*dns.Conn, error) {
+	conn, _, err := t.dialPooled(ctx, network, true)
+	return conn, err
+}
+
+// dialPooled dials like Dial, reusing a pooled connection only if reuse is set, and reports whether the
+// connection was reused.
+func (t *transportImpl) dialPooled(ctx context.Context, network string, reuse bool) (*dns.Conn, bool, error) {
 	if t.tlsConfig != nil {
 		network = TCPTLS
 	}
-	if network == TCPTLS {
-		return t.dial(ctx, &dns.Client{Net: network, Dialer: &net.Dialer{Timeout: maxTimeout}, TLSConfig: t.tlsConfig})
+	if reuse {
+		if conn := t.pooled(network); conn != nil {
+			return conn, true, nil
+		}
 	}
-	return t.dial(ctx, &dns.Client{Net: network, Dialer: &net.Dialer{Timeout: maxTimeout}})
+	conn, err := t.dial(ctx, network)
+	return conn, false, err
 }
 
-func (t *transportImpl) dial(ctx context.Context, c *dns.Client) (*dns.Conn, error) {
+func (t *transportImpl) dial(ctx context.Context, network string) (*dns.Conn, error) {
 	span := ot.SpanFromContext(ctx)
 	if span != nil {
 		childSpan := span.Tracer().StartSpan("connect", ot.ChildOf(span.Context()))
 		ctx = ot.ContextWithSpan(ctx, childSpan)
 		defer childSpan.Finish()
 	}
-	var d net.Dialer
-	if c.Dialer == nil {
-		d = net.Dialer{Timeout: maxTimeout}
-	} else {
-		d = *c.Dialer
-	}
-	network := c.Net
 	if network == "" {
 		network = UDP
 	}
-	var conn = new(dns.Conn)
-	var err error
+	dialNetwork := network
 	if network == TCPTLS {
-		conn.Conn, err = tls.DialWithDialer(&d, TCP, t.addr, c.TLSConfig)
-	} else {
-		conn.Conn, err = d.DialContext(ctx, network, t.addr)
+		dialNetwork = TCP
 	}
+	conn, err := t.dialContext(ctx, dialNetwork, t.addr)
 	if err != nil {
 		return nil, err
 	}
-	return conn, nil
+	if network == TCPTLS {
+		if conn, err = t.handshake(ctx, conn); err != nil {
+			return nil, err
+		}
+	}
+	return &dns.Conn{Conn: conn}, nil
+}
+
+// handshake negotiates TLS over conn, closing it on failure.
+func (t *transportImpl) handshake(ctx context.Context, conn net.Conn) (net.Conn, error) {
+	cfg := t.tlsConfig
+	if cfg == nil {
+		cfg = new(tls.Config)
+	}
+	if cfg.ServerName == "" && !cfg.InsecureSkipVerify {
+		cfg = cfg.Clone()
+		cfg.ServerName = addrHost(t.addr)
+	}
+	ctx, cancel := context.WithTimeout(ctx, maxTimeout)
+	defer cancel()
+	tlsConn := tls.Client(conn, cfg)
+	if err := tlsConn.HandshakeContext(ctx); err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	return tlsConn, nil
+}
+
+// Yield returns a healthy stream connection to the pool for reuse. Datagram connections are closed.
+func (t *transportImpl) Yield(conn *dns.Conn) {
+	network := streamNetwork(conn)
+	if network == "" {
+		_ = conn.Close()
+		return
+	}
+	// the deadlines of the exchange would otherwise expire while the connection is idle, failing the
+	// liveness check of the next query
+	if err := conn.SetDeadline(time.Time{}); err != nil {
+		_ = conn.Close()
+		return
+	}
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if t.conns == nil {
+		t.conns = map[string][]*persistConn{}
+	}
+	if len(t.conns[network]) >= maxPooledConns {
+		_ = conn.Close()
+		return
+	}
+	t.conns[network] = append(t.conns[network], &persistConn{conn: conn, used: time.Now()})
+}
+
+// closeIdle closes all pooled connections and the shared UDP socket.
+func (t *transportImpl) closeIdle() {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	for network, conns := range t.conns {
+		for _, pc := range conns {
+			_ = pc.conn.Close()
+		}
+		delete(t.conns, network)
+	}
+	if t.batch != nil {
+		t.batch.close()
+		t.batch = nil
+	}
+}
+
+// pooled returns the most recently used non-expired connection for the network, if any. Connections
+// the peer has closed are evicted instead of burning an attempt on them.
+func (t *transportImpl) pooled(network string) *dns.Conn {
+	if network == UDP {
+		return nil
+	}
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	conns := t.conns[network]
+	for len(conns) > 0 {
+		pc := conns[len(conns)-1]
+		conns = conns[:len(conns)-1]
+		if time.Since(pc.used) >= connExpire {
+			_ = pc.conn.Close()
+			continue
+		}
+		if peerClosed(pc.conn.Conn) {
+			StaleConnCount.WithLabelValues(t.addr).Add(1)
+			_ = pc.conn.Close()
+			continue
+		}
+		t.conns[network] = conns
+		return pc.conn
+	}
+	t.conns[network] = conns
+	return nil
+}
+
+// pingIdle sends a query over each pooled connection idle for at least idle, returning the connections
+// which answer to the pool and closing the others.
+func (t *transportImpl) pingIdle(idle time.Duration) {
+	var idleConns []*persistConn
+	t.mutex.Lock()
+	for network, conns := range t.conns {
+		active := conns[:0]
+		for _, pc := range conns {
+			if time.Since(pc.used) >= idle {
+				idleConns = append(idleConns, pc)
+			} else {
+				active = append(active, pc)
+			}
+		}
+		t.conns[network] = active
+	}
+	t.mutex.Unlock()
+	for _, pc := range idleConns {
+		if !ping(pc.conn) {
+			StaleConnCount.WithLabelValues(t.addr).Add(1)
+			_ = pc.conn.Close()
+			continue
+		}
+		t.Yield(pc.conn)
+	}
+}
+
+// ping sends a root NS query over conn and reports whether it was answered.
+func ping(conn *dns.Conn) bool {
+	if err := conn.SetDeadline(time.Now().Add(maxTimeout)); err != nil {
+		return false
+	}
+	m := new(dns.Msg)
+	m.SetQuestion(".", dns.TypeNS)
+	if err := conn.WriteMsg(m); err != nil {
+		return false
+	}
+	ret, err := conn.ReadMsg()
+	if err != nil || ret.Id != m.Id {
+		return false
+	}
+	return conn.SetDeadline(time.Time{}) == nil
+}
+
+func streamNetwork(conn *dns.Conn) string {
+	switch conn.Conn.(type) {
+	case *tls.Conn:
+		return TCPTLS
+	case *net.TCPConn:
+		return TCP
+	default:
+		return ""
+	}
 }
@@ -0,0 +1,252 @@
+// Copyright (c) 2024 MWS and/or its affiliates.
+//
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at:
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fanout
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/coredns/caddy"
+	"github.com/coredns/coredns/plugin/test"
+	"github.com/coredns/coredns/request"
+	"github.com/miekg/dns"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBuilderWithDialerRoutesUpstreamConnections(t *testing.T) {
+	s := newServer(TCP, func(w dns.ResponseWriter, r *dns.Msg) {
+		msg := dns.Msg{Answer: []dns.RR{makeRecordA("example1. 3600 IN A 10.0.0.1")}}
+		msg.SetReply(r)
+		logErrIfNotNil(w.WriteMsg(&msg))
+	})
+	defer s.close()
+
+	var dialed atomic.Int32
+	dial := func(ctx context.Context, network, _ string) (net.Conn, error) {
+		dialed.Add(1)
+		var d net.Dialer
+		// The configured upstream is unreachable, the dialer redirects it to the test server.
+		return d.DialContext(ctx, network, s.addr)
+	}
+	f, err := NewBuilder().WithUpstream("192.0.2.1:53").WithNetwork(TCP).WithDialer(dial).Build()
+	require.NoError(t, err)
+	defer f.closeIdleClients()
+
+	req := new(dns.Msg)
+	req.SetQuestion(testQuery, dns.TypeA)
+	rec := &cachedDNSWriter{ResponseWriter: new(test.ResponseWriter)}
+	_, err = f.ServeDNS(context.Background(), rec, req)
+	require.NoError(t, err)
+	require.Len(t, rec.answers, 1)
+	require.Equal(t, dns.RcodeSuccess, rec.answers[0].Rcode)
+	require.Equal(t, int32(1), dialed.Load())
+}
+
+func TestTransportWithDialerFailsTLSHandshake(t *testing.T) {
+	s := newServer(TCP, func(dns.ResponseWriter, *dns.Msg) {})
+	defer s.close()
+
+	tr := NewTransportWithDialer(s.addr, nil)
+	tr.SetTLSConfig(new(tls.Config))
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	_, err := tr.Dial(ctx, TCP)
+	require.Error(t, err)
+}
+
+// newClosingServer answers a single query on every TCP connection, then closes it.
+func newClosingServer(t *testing.T) net.Listener {
+	l, err := net.Listen(TCP, "127.0.0.1:0")
+	require.NoError(t, err)
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer func() { _ = conn.Close() }()
+				c := &dns.Conn{Conn: conn}
+				req, err := c.ReadMsg()
+				if err != nil {
+					return
+				}
+				msg := dns.Msg{Answer: []dns.RR{makeRecordA("example1. 3600 IN A 10.0.0.1")}}
+				msg.SetReply(req)
+				_ = c.WriteMsg(&msg)
+			}()
+		}
+	}()
+	return l
+}
+
+func pooledConns(tr Transport) int {
+	t := tr.(*transportImpl)
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	return len(t.conns[TCP])
+}
+
+func TestTransportEvictsPooledConnClosedByPeer(t *testing.T) {
+	l := newClosingServer(t)
+	defer func() { _ = l.Close() }()
+	addr := l.Addr().String()
+	c := NewClient(addr, TCP)
+	tr := c.(*client).transport
+
+	req := new(dns.Msg)
+	req.SetQuestion(testQuery, dns.TypeA)
+	_, err := c.Request(context.Background(), &request.Request{W: &test.ResponseWriter{}, Req: req})
+	require.NoError(t, err)
+	require.Equal(t, 1, pooledConns(tr))
+
+	stale := testutil.ToFloat64(StaleConnCount.WithLabelValues(addr))
+	require.Eventually(t, func() bool {
+		conn := tr.(*transportImpl).pooled(TCP)
+		if conn == nil {
+			return true
+		}
+		// the close hasn't reached the client yet
+		tr.Yield(conn)
+		return false
+	}, time.Second, 10*time.Millisecond)
+	require.Equal(t, stale+1, testutil.ToFloat64(StaleConnCount.WithLabelValues(addr)))
+}
+
+func TestTransportReusesPooledConnPastReadDeadline(t *testing.T) {
+	var mu sync.Mutex
+	peers := map[string]bool{}
+	l, err := net.Listen(TCP, "127.0.0.1:0")
+	require.NoError(t, err)
+	s := &dns.Server{Listener: l, Handler: dns.HandlerFunc(func(w dns.ResponseWriter, r *dns.Msg) {
+		mu.Lock()
+		peers[w.RemoteAddr().String()] = true
+		mu.Unlock()
+		msg := new(dns.Msg)
+		msg.SetReply(r)
+		logErrIfNotNil(w.WriteMsg(msg))
+	})}
+	go func() { logErrIfNotNil(s.ActivateAndServe()) }()
+	defer func() { logErrIfNotNil(s.Shutdown()) }()
+	addr := l.Addr().String()
+	c := NewClient(addr, TCP)
+	tr := c.(*client).transport
+
+	req := new(dns.Msg)
+	req.SetQuestion(testQuery, dns.TypeA)
+	_, err = c.Request(context.Background(), &request.Request{W: &test.ResponseWriter{}, Req: req})
+	require.NoError(t, err)
+	// stand for an idle period longer than the read deadline of the exchange
+	conn := tr.(*transportImpl).pooled(TCP)
+	require.NotNil(t, conn)
+	require.NoError(t, conn.SetReadDeadline(time.Now().Add(time.Millisecond)))
+	tr.Yield(conn)
+	time.Sleep(10 * time.Millisecond)
+
+	stale := testutil.ToFloat64(StaleConnCount.WithLabelValues(addr))
+	_, err = c.Request(context.Background(), &request.Request{W: &test.ResponseWriter{}, Req: req})
+	require.NoError(t, err)
+	require.Equal(t, stale, testutil.ToFloat64(StaleConnCount.WithLabelValues(addr)))
+	mu.Lock()
+	defer mu.Unlock()
+	require.Len(t, peers, 1, "the pooled connection is reused instead of dialing a new one")
+}
+
+func TestClientRetriesResetPooledConn(t *testing.T) {
+	l, err := net.Listen(TCP, "127.0.0.1:0")
+	require.NoError(t, err)
+	defer func() { _ = l.Close() }()
+	var accepted atomic.Int32
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			accepted.Add(1)
+			go func() {
+				// answer the first query, then close the connection on the next one like an idle timeout
+				defer func() { _ = conn.Close() }()
+				c := &dns.Conn{Conn: conn}
+				req, err := c.ReadMsg()
+				if err != nil {
+					return
+				}
+				msg := dns.Msg{Answer: []dns.RR{makeRecordA("example1. 3600 IN A 10.0.0.1")}}
+				msg.SetReply(req)
+				_ = c.WriteMsg(&msg)
+				_, _ = c.ReadMsg()
+			}()
+		}
+	}()
+	addr := l.Addr().String()
+	c := NewClient(addr, TCP)
+
+	req := new(dns.Msg)
+	req.SetQuestion(testQuery, dns.TypeA)
+	_, err = c.Request(context.Background(), &request.Request{W: &test.ResponseWriter{}, Req: req})
+	require.NoError(t, err)
+	stale := testutil.ToFloat64(StaleConnCount.WithLabelValues(addr))
+	resp, err := c.Request(context.Background(), &request.Request{W: &test.ResponseWriter{}, Req: req})
+	require.NoError(t, err, "the reset pooled connection is retried on a fresh one")
+	require.Len(t, resp.Answer, 1)
+	require.Equal(t, int32(2), accepted.Load())
+	require.Equal(t, stale+1, testutil.ToFloat64(StaleConnCount.WithLabelValues(addr)))
+}
+
+func TestTransportPingIdle(t *testing.T) {
+	s := newServer(TCP, func(w dns.ResponseWriter, r *dns.Msg) {
+		msg := new(dns.Msg)
+		msg.SetReply(r)
+		logErrIfNotNil(w.WriteMsg(msg))
+	})
+	defer s.close()
+	l := newClosingServer(t)
+	defer func() { _ = l.Close() }()
+
+	for addr, pooled := range map[string]int{s.addr: 1, l.Addr().String(): 0} {
+		c := NewClient(addr, TCP)
+		req := new(dns.Msg)
+		req.SetQuestion(testQuery, dns.TypeA)
+		_, err := c.Request(context.Background(), &request.Request{W: &test.ResponseWriter{}, Req: req})
+		require.NoError(t, err)
+		tr := c.(*client).transport
+		require.Equal(t, 1, pooledConns(tr))
+
+		c.(*client).pingIdle(time.Hour)
+		require.Equal(t, 1, pooledConns(tr), "recently used connections are not pinged")
+		c.(*client).pingIdle(0)
+		require.Equal(t, pooled, pooledConns(tr), addr)
+	}
+}
+
+func TestSetupPoolPing(t *testing.T) {
+	fs, err := parseFanout(caddy.NewTestController("dns", "fanout . 127.0.0.1 {\npool-ping 30s\n}"))
+	require.NoError(t, err)
+	require.Equal(t, 30*time.Second, fs[0].poolPing)
+
+	for _, input := range []string{"pool-ping", "pool-ping 0s", "pool-ping 1s 2s"} {
+		_, err = parseFanout(caddy.NewTestController("dns", "fanout . 127.0.0.1 {\n"+input+"\n}"))
+		require.Error(t, err, input)
+	}
+}
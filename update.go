@@ -0,0 +1,149 @@
+// Copyright (c) 2024 MWS and/or its affiliates.
+//
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at:
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fanout
+
+import (
+	"context"
+	"encoding/base64"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/coredns/caddy/caddyfile"
+	"github.com/coredns/coredns/plugin/pkg/transport"
+	"github.com/coredns/coredns/request"
+	"github.com/miekg/dns"
+	"github.com/pkg/errors"
+)
+
+// tsigAlgorithms are the TSIG algorithms accepted by update-primary.
+var tsigAlgorithms = []string{dns.HmacSHA1, dns.HmacSHA224, dns.HmacSHA256, dns.HmacSHA384, dns.HmacSHA512}
+
+// updatePrimary is the primary server dynamic updates (RFC 2136) are forwarded to, signing them with
+// the TSIG key when one is set. Signed with the key, the updates of any client would be authorized by the
+// primary, so only the ones of the clients which signed them with a key verified by the server, or are in
+// the allow list, are forwarded.
+type updatePrimary struct {
+	addr       string
+	keyName    string
+	algorithm  string
+	secret     string
+	allow      *clientNetworks
+	serverKeys map[string]string
+}
+
+// parseUpdatePrimary parses `update-primary ADDR [tsig NAME ALGORITHM SECRET [allow CIDR...]]`.
+func parseUpdatePrimary(f *Fanout, c *caddyfile.Dispenser) error {
+	args := c.RemainingArgs()
+	if len(args) != 1 && (len(args) < 5 || !strings.EqualFold(args[1], "tsig")) {
+		return c.ArgErr()
+	}
+	if len(args) > 5 && (len(args) == 6 || !strings.EqualFold(args[5], "allow")) {
+		return c.ArgErr()
+	}
+	addr, err := normalizeAddr(args[0], transport.Port)
+	if err != nil {
+		return errors.Wrapf(err, "invalid update primary %q", args[0])
+	}
+	primary := &updatePrimary{addr: addr}
+	if len(args) >= 5 {
+		if err := primary.setKey(args[2], args[3], args[4]); err != nil {
+			return err
+		}
+	}
+	if len(args) > 6 {
+		primary.allow = &clientNetworks{}
+		for _, arg := range args[6:] {
+			prefix, err := parseClientNetwork(arg)
+			if err != nil {
+				return err
+			}
+			primary.allow.prefixes = append(primary.allow.prefixes, prefix)
+		}
+	}
+	if f.opcodes == nil {
+		f.opcodes = make(map[int]*opcodeRoute)
+	}
+	f.opcodes[dns.OpcodeUpdate] = &opcodeRoute{primary: primary}
+	return nil
+}
+
+// setKey sets the TSIG key updates are signed with. The secret may be an env:VAR or file:/path reference.
+func (p *updatePrimary) setKey(name, algorithm, secret string) error {
+	p.keyName = dns.CanonicalName(name)
+	p.algorithm = dns.CanonicalName(algorithm)
+	if !slices.Contains(tsigAlgorithms, p.algorithm) {
+		return errors.Errorf("unsupported TSIG algorithm %q", algorithm)
+	}
+	secret, err := resolveSecret(secret)
+	if err != nil {
+		return err
+	}
+	p.secret = strings.TrimSpace(secret)
+	if _, err := base64.StdEncoding.DecodeString(p.secret); err != nil {
+		return errors.Wrap(err, "TSIG secret must be base64")
+	}
+	return nil
+}
+
+// setServerKeys sets the TSIG keys of the server, configured with the tsig plugin, which verifies the
+// signatures of the clients with them.
+func (f *Fanout) setServerKeys(keys map[string]string) {
+	if route, ok := f.opcodes[dns.OpcodeUpdate]; ok && route.primary != nil {
+		route.primary.serverKeys = keys
+	}
+}
+
+// authorized returns true if the update of req may be forwarded: without a key, the primary checks the
+// signature of the client itself; with one, the client must have signed the update with a key of the
+// server, which verified it, or be in the allow list.
+func (p *updatePrimary) authorized(req *request.Request) bool {
+	if p.secret == "" {
+		return true
+	}
+	if t := req.Req.IsTsig(); t != nil {
+		if _, ok := p.serverKeys[dns.CanonicalName(t.Hdr.Name)]; ok && req.W.TsigStatus() == nil {
+			return true
+		}
+	}
+	return p.allow != nil && p.allow.allows(req.IP())
+}
+
+// forward sends the update to the primary over TCP and returns its reply. With a TSIG key, any signature
+// of the client is replaced by one made with the key, and the verified signature of the reply is removed
+// as the client can't check it.
+func (p *updatePrimary) forward(ctx context.Context, req *request.Request) (*dns.Msg, error) {
+	m := req.Req
+	c := &dns.Client{Net: TCP}
+	if p.secret != "" {
+		m = m.Copy()
+		if m.IsTsig() != nil {
+			m.Extra = m.Extra[:len(m.Extra)-1]
+		}
+		m.SetTsig(p.keyName, p.algorithm, tsigFudge, time.Now().Unix())
+		c.TsigSecret = map[string]string{p.keyName: p.secret}
+	}
+	resp, _, err := c.ExchangeContext(ctx, m, p.addr)
+	if err != nil {
+		return nil, errors.Wrapf(err, "forwarding update to %s", p.addr)
+	}
+	if p.secret != "" && resp.IsTsig() != nil {
+		resp.Extra = resp.Extra[:len(resp.Extra)-1]
+	}
+	resp.Id = req.Req.Id
+	return resp, nil
+}
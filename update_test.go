@@ -0,0 +1,127 @@
+// Copyright (c) 2024 MWS and/or its affiliates.
+//
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at:
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fanout
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/coredns/caddy"
+	"github.com/coredns/coredns/plugin/pkg/dnstest"
+	"github.com/coredns/coredns/plugin/test"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+)
+
+func TestUpdatePrimary(t *testing.T) {
+	const secret = "c2VjcmV0LXNlY3JldC1zZWNyZXQ="
+	l, err := net.Listen(TCP, "127.0.0.1:0")
+	require.NoError(t, err)
+	started := make(chan struct{})
+	signed := make(chan bool, 1)
+	s := &dns.Server{
+		Listener:          l,
+		TsigSecret:        map[string]string{"update-key.": secret},
+		NotifyStartedFunc: func() { close(started) },
+		MsgAcceptFunc:     func(dns.Header) dns.MsgAcceptAction { return dns.MsgAccept },
+		Handler: dns.HandlerFunc(func(w dns.ResponseWriter, r *dns.Msg) {
+			signed <- r.IsTsig() != nil && w.TsigStatus() == nil
+			msg := new(dns.Msg)
+			msg.SetReply(r)
+			if r.IsTsig() != nil {
+				msg.SetTsig("update-key.", dns.HmacSHA256, tsigFudge, int64(r.IsTsig().TimeSigned))
+			}
+			logErrIfNotNil(w.WriteMsg(msg))
+		}),
+	}
+	go func() { logErrIfNotNil(s.ActivateAndServe()) }()
+	<-started
+	defer func() { logErrIfNotNil(s.Shutdown()) }()
+
+	t.Setenv("UPDATE_SECRET", secret)
+	fs, err := parseFanout(caddy.NewTestController("dns", "fanout . 127.0.0.1 {\nupdate-primary "+l.Addr().String()+" tsig update-key hmac-sha256 env:UPDATE_SECRET allow 10.240.0.0/16\n}"))
+	require.NoError(t, err)
+
+	newUpdate := func() *dns.Msg {
+		update := new(dns.Msg)
+		update.SetUpdate("example.org.")
+		rr, err := dns.NewRR("host.example.org. 300 IN A 10.0.0.7")
+		require.NoError(t, err)
+		update.Insert([]dns.RR{rr})
+		return update
+	}
+	update := newUpdate()
+	rec := dnstest.NewRecorder(&test.ResponseWriter{})
+	_, err = fs[0].ServeDNS(context.Background(), rec, update)
+	require.NoError(t, err)
+	require.True(t, <-signed, "the update of an allowed client reaches the primary signed with the key")
+	require.Equal(t, dns.RcodeSuccess, rec.Msg.Rcode)
+	require.Equal(t, update.Id, rec.Msg.Id)
+	require.Nil(t, rec.Msg.IsTsig(), "the signature of the reply is removed")
+
+	// outside of the allow list, only the updates signed with a key of the server are forwarded
+	fs, err = parseFanout(caddy.NewTestController("dns", "fanout . 127.0.0.1 {\nupdate-primary "+l.Addr().String()+" tsig update-key hmac-sha256 env:UPDATE_SECRET\n}"))
+	require.NoError(t, err)
+	fs[0].setServerKeys(map[string]string{"client-key.": secret})
+
+	rcode, err := fs[0].ServeDNS(context.Background(), dnstest.NewRecorder(&test.ResponseWriter{}), newUpdate())
+	require.Error(t, err)
+	require.Equal(t, dns.RcodeRefused, rcode, "an unsigned update is refused")
+
+	update = newUpdate()
+	update.SetTsig("client-key.", dns.HmacSHA256, tsigFudge, time.Now().Unix())
+	rcode, err = fs[0].ServeDNS(context.Background(), dnstest.NewRecorder(&badSignatureWriter{}), update)
+	require.Error(t, err)
+	require.Equal(t, dns.RcodeRefused, rcode, "an update failing the verification of the server is refused")
+
+	update = newUpdate()
+	update.SetTsig("unknown-key.", dns.HmacSHA256, tsigFudge, time.Now().Unix())
+	rcode, err = fs[0].ServeDNS(context.Background(), dnstest.NewRecorder(&test.ResponseWriter{}), update)
+	require.Error(t, err)
+	require.Equal(t, dns.RcodeRefused, rcode, "an update signed with a key the server cannot verify is refused")
+	require.Empty(t, signed, "the refused updates never reach the primary")
+
+	update = newUpdate()
+	update.SetTsig("client-key.", dns.HmacSHA256, tsigFudge, time.Now().Unix())
+	rec = dnstest.NewRecorder(&test.ResponseWriter{})
+	_, err = fs[0].ServeDNS(context.Background(), rec, update)
+	require.NoError(t, err)
+	require.True(t, <-signed, "a verified update reaches the primary signed with its key")
+	require.Equal(t, dns.RcodeSuccess, rec.Msg.Rcode)
+
+	for _, config := range []string{
+		"update-primary",
+		"update-primary 10.0.0.1 tsig key.",
+		"update-primary 10.0.0.1 tsig key. hmac-md4 " + secret,
+		"update-primary 10.0.0.1 tsig key. hmac-sha256 not-base64!",
+		"update-primary 10.0.0.1 tsig key. hmac-sha256 " + secret + " allow",
+		"update-primary 10.0.0.1 tsig key. hmac-sha256 " + secret + " allow not-a-network",
+		"update-primary 10.0.0.1 tsig key. hmac-sha256 " + secret + " from 10.0.0.0/8",
+	} {
+		_, err = parseFanout(caddy.NewTestController("dns", "fanout . 127.0.0.1 {\n"+config+"\n}"))
+		require.Error(t, err, config)
+	}
+}
+
+// badSignatureWriter is a writer of the requests whose signature failed the verification of the server.
+type badSignatureWriter struct {
+	test.ResponseWriter
+}
+
+func (*badSignatureWriter) TsigStatus() error { return dns.ErrSig }
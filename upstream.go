@@ -0,0 +1,220 @@
+// Copyright (c) 2024 MWS and/or its affiliates.
+//
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at:
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fanout
+
+import (
+	"strings"
+	"time"
+
+	"github.com/coredns/caddy/caddyfile"
+	"github.com/coredns/coredns/plugin"
+	"github.com/coredns/coredns/plugin/pkg/parse"
+	"github.com/miekg/dns"
+	"github.com/pkg/errors"
+)
+
+// upstreamOptions holds settings configured for a single upstream with the upstream directive.
+type upstreamOptions struct {
+	socket           socketOptions
+	authoritativeFor []string
+	schedule         schedule
+	slo              *latencySLO
+	minSizeTCP       int
+	dualStack        string
+	delay            time.Duration
+}
+
+// zoneAuthority lists upstreams configured as authoritative for a zone.
+type zoneAuthority struct {
+	zone      string
+	upstreams map[string]bool
+}
+
+func newUpstreamOptions() *upstreamOptions {
+	return &upstreamOptions{socket: socketOptions{dscp: -1}}
+}
+
+// parseUpstream parses `upstream ADDR KEY VALUE [KEY VALUE]...` lines. Options of the same upstream may be
+// split across several lines.
+func parseUpstream(f *Fanout, c *caddyfile.Dispenser) error {
+	args := c.RemainingArgs()
+	if len(args) < 3 || len(args)%2 == 0 {
+		return c.ArgErr()
+	}
+	addr, err := upstreamKey(args[0])
+	if err != nil {
+		return err
+	}
+	if f.upstreamOptions == nil {
+		f.upstreamOptions = map[string]*upstreamOptions{}
+	}
+	opts, ok := f.upstreamOptions[addr]
+	if !ok {
+		opts = newUpstreamOptions()
+		f.upstreamOptions[addr] = opts
+	}
+	for i := 1; i < len(args); i += 2 {
+		if err := opts.set(strings.ToLower(args[i]), args[i+1]); err != nil {
+			return errors.Wrapf(err, "upstream %s", args[0])
+		}
+	}
+	return nil
+}
+
+func (o *upstreamOptions) set(key, value string) error {
+	switch key {
+	case "dscp", "mark", "device", "keepalive":
+		return o.socket.set(key, value)
+	case "authoritative-for":
+		return o.setAuthoritativeFor(value)
+	case "schedule":
+		s, err := parseSchedule(value)
+		if err != nil {
+			return err
+		}
+		o.schedule = append(o.schedule, s...)
+	case "slo":
+		return o.setSLO(value)
+	case "min-size-tcp":
+		return o.setMinSizeTCP(value)
+	case "dual-stack":
+		o.dualStack = value
+	case "delay":
+		return o.setDelay(value)
+	default:
+		return errors.Errorf("unknown upstream option %v", key)
+	}
+	return nil
+}
+
+// setAuthoritativeFor parses the comma separated zones of `upstream ADDR authoritative-for ZONES`.
+func (o *upstreamOptions) setAuthoritativeFor(value string) error {
+	for _, zone := range strings.Split(value, ",") {
+		normalized := plugin.Host(zone).NormalizeExact()
+		if len(normalized) == 0 {
+			return errors.Errorf("unable to normalize '%s'", zone)
+		}
+		o.authoritativeFor = append(o.authoritativeFor, normalized[0])
+	}
+	return nil
+}
+
+// checkUpstreamOptions reports upstream directives referring to addresses missing from hosts.
+func checkUpstreamOptions(f *Fanout, hosts []string) error {
+	known := make(map[string]struct{}, len(hosts))
+	for _, host := range hosts {
+		_, h := parse.Transport(host)
+		known[h] = struct{}{}
+	}
+	for addr := range f.upstreamOptions {
+		if _, ok := known[addr]; !ok {
+			return errors.Errorf("upstream %s is not in the list of upstreams", addr)
+		}
+	}
+	return nil
+}
+
+// checkDuplicateUpstreams reports upstreams listed more than once with the same address and transport in
+// the TO list or in a group, which would otherwise receive twice the traffic and skew the selection policy.
+// It warns about upstreams of domain redirects also listed in TO.
+func checkDuplicateUpstreams(f *Fanout, hosts []string) error {
+	to, err := uniqueHosts(hosts)
+	if err != nil {
+		return err
+	}
+	for _, g := range f.groups {
+		keys, err := uniqueHosts(g.hosts)
+		if err != nil {
+			return err
+		}
+		if g.domains == nil {
+			continue
+		}
+		for key := range keys {
+			if _, ok := to[key]; ok {
+				log.Warningf("fanout: upstream %s of an except redirect is also in the list of upstreams", key)
+			}
+		}
+	}
+	return nil
+}
+
+// uniqueHosts returns the set of hosts keyed by transport and address, failing on duplicates.
+func uniqueHosts(hosts []string) (map[string]struct{}, error) {
+	keys := make(map[string]struct{}, len(hosts))
+	for _, host := range hosts {
+		key := host
+		if _, ok := lookupClientFactory(host); !ok && !isDoH(host) && !isODoH(host) {
+			trans, h := parse.Transport(host)
+			key = trans + "://" + h
+		}
+		if _, ok := keys[key]; ok {
+			return nil, errors.Errorf("upstream %s is listed more than once", key)
+		}
+		keys[key] = struct{}{}
+	}
+	return keys, nil
+}
+
+// initZoneAuthorities groups upstreams by the zones they are authoritative for.
+func initZoneAuthorities(f *Fanout) {
+	f.zoneAuthorities = nil
+	byZone := map[string]map[string]bool{}
+	for addr, opts := range f.upstreamOptions {
+		for _, zone := range opts.authoritativeFor {
+			if byZone[zone] == nil {
+				byZone[zone] = map[string]bool{}
+				f.zoneAuthorities = append(f.zoneAuthorities, zoneAuthority{zone: zone, upstreams: byZone[zone]})
+			}
+			byZone[zone][addr] = true
+		}
+	}
+}
+
+// authoritativeUpstreams returns upstreams authoritative for the closest zone enclosing name, or nil.
+func (f *Fanout) authoritativeUpstreams(name string) map[string]bool {
+	var closest *zoneAuthority
+	for i := range f.zoneAuthorities {
+		za := &f.zoneAuthorities[i]
+		if !dns.IsSubDomain(za.zone, name) {
+			continue
+		}
+		if closest == nil || dns.CountLabel(za.zone) > dns.CountLabel(closest.zone) {
+			closest = za
+		}
+	}
+	if closest == nil {
+		return nil
+	}
+	return closest.upstreams
+}
+
+// upstreamKey normalizes an upstream address the same way as the TO list, without the transport prefix.
+func upstreamKey(addr string) (string, error) {
+	if _, ok := lookupClientFactory(addr); ok {
+		return addr, nil
+	}
+	hosts, err := parse.HostPortOrFile(addr)
+	if err != nil {
+		return "", err
+	}
+	if len(hosts) != 1 {
+		return "", errors.Errorf("upstream %q must be a single address", addr)
+	}
+	_, h := parse.Transport(hosts[0])
+	return h, nil
+}
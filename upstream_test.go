@@ -0,0 +1,122 @@
+// Copyright (c) 2024 MWS and/or its affiliates.
+//
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at:
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fanout
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	golog "log"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/coredns/caddy"
+	"github.com/coredns/coredns/plugin/test"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSetupUpstreamOptions(t *testing.T) {
+	input := "fanout . 127.0.0.1 tls://127.0.0.2 {\nupstream 127.0.0.1 dscp 46 mark 0x10\nupstream 127.0.0.1:53 keepalive 30s\n}"
+	fs, err := parseFanout(caddy.NewTestController("dns", input))
+	require.NoError(t, err)
+	f := fs[0]
+	require.Len(t, f.upstreamOptions, 1)
+	opts := f.upstreamOptions["127.0.0.1:53"]
+	require.Equal(t, socketOptions{dscp: 46, mark: 0x10, keepalive: 30 * time.Second}, opts.socket)
+	require.NotNil(t, f.clients[0].(*client).transport.(*transportImpl).dialContext)
+
+	tests := map[string]string{
+		"fanout . 127.0.0.1 {\nupstream 127.0.0.1 dscp 64\n}":          "dscp must be between 0 and 63",
+		"fanout . 127.0.0.1 {\nupstream 127.0.0.1 mark x\n}":           "invalid mark",
+		"fanout . 127.0.0.1 {\nupstream 127.0.0.1 keepalive -1s\n}":    "invalid keepalive",
+		"fanout . 127.0.0.1 {\nupstream 127.0.0.1 color red\n}":        "unknown upstream option color",
+		"fanout . 127.0.0.1 {\nupstream 127.0.0.1 dscp\n}":             "Wrong argument count",
+		"fanout . 127.0.0.1 {\nupstream 127.0.0.2 dscp 46\n}":          "upstream 127.0.0.2:53 is not in the list of upstreams",
+		"fanout . 127.0.0.1 {\nupstream 127.0.0.1 dscp 46 mark 1 x\n}": "Wrong argument count",
+	}
+	for input, expectedErr := range tests {
+		_, err := parseFanout(caddy.NewTestController("dns", input))
+		require.ErrorContains(t, err, expectedErr, input)
+	}
+}
+
+func TestFanoutPrefersAuthoritativeUpstream(t *testing.T) {
+	fast := newServer(UDP, func(w dns.ResponseWriter, r *dns.Msg) {
+		msg := dns.Msg{Answer: []dns.RR{makeRecordA("host.corp.example. 3600 IN A 192.0.2.1")}}
+		msg.SetReply(r)
+		logErrIfNotNil(w.WriteMsg(&msg))
+	})
+	defer fast.close()
+	authoritative := newServer(UDP, func(w dns.ResponseWriter, r *dns.Msg) {
+		<-time.After(50 * time.Millisecond)
+		msg := dns.Msg{Answer: []dns.RR{makeRecordA(r.Question[0].Name + " 3600 IN A 10.0.0.1")}}
+		msg.SetReply(r)
+		logErrIfNotNil(w.WriteMsg(&msg))
+	})
+	defer authoritative.close()
+
+	input := fmt.Sprintf("fanout . %s %s {\nupstream %s authoritative-for example.net,corp.example\n}", fast.addr, authoritative.addr, authoritative.addr)
+	fs, err := parseFanout(caddy.NewTestController("dns", input))
+	require.NoError(t, err)
+	f := fs[0]
+
+	for name, expected := range map[string]string{"host.corp.example.": "10.0.0.1", "host.example.org.": "192.0.2.1"} {
+		req := new(dns.Msg)
+		req.SetQuestion(name, dns.TypeA)
+		rec := &cachedDNSWriter{ResponseWriter: new(test.ResponseWriter)}
+		_, err = f.ServeDNS(context.Background(), rec, req)
+		require.NoError(t, err)
+		require.Len(t, rec.answers, 1)
+		require.Equal(t, expected, rec.answers[0].Answer[0].(*dns.A).A.String(), name)
+	}
+}
+
+func TestAuthoritativeUpstreamsUsesClosestZone(t *testing.T) {
+	f := New()
+	f.upstreamOptions = map[string]*upstreamOptions{
+		"192.0.2.1:53": {authoritativeFor: []string{"example."}},
+		"192.0.2.2:53": {authoritativeFor: []string{"corp.example."}},
+	}
+	initZoneAuthorities(f)
+	require.Equal(t, map[string]bool{"192.0.2.2:53": true}, f.authoritativeUpstreams("a.corp.example."))
+	require.Equal(t, map[string]bool{"192.0.2.1:53": true}, f.authoritativeUpstreams("a.example."))
+	require.Nil(t, f.authoritativeUpstreams("a.example.org."))
+}
+
+func TestSetupDuplicateUpstreams(t *testing.T) {
+	tests := map[string]string{
+		"fanout . 127.0.0.1 127.0.0.1:53":                                      "upstream dns://127.0.0.1:53 is listed more than once",
+		"fanout . tls://127.0.0.1 tls://127.0.0.1:853":                         "upstream tls://127.0.0.1:853 is listed more than once",
+		"fanout . https://dns.example/dns-query https://dns.example/dns-query": "upstream https://dns.example/dns-query is listed more than once",
+		"fanout . 127.0.0.1 {\nqtype PTR {\nto 127.0.0.2 127.0.0.2\n}\n}":      "upstream dns://127.0.0.2:53 is listed more than once",
+	}
+	for input, expectedErr := range tests {
+		_, err := parseFanout(caddy.NewTestController("dns", input))
+		require.ErrorContains(t, err, expectedErr, input)
+	}
+	_, err := parseFanout(caddy.NewTestController("dns", "fanout . 127.0.0.1 tls://127.0.0.1"))
+	require.NoError(t, err, "the same address over different transports is not a duplicate")
+
+	var buf bytes.Buffer
+	golog.SetOutput(&buf)
+	defer golog.SetOutput(os.Stderr)
+	_, err = parseFanout(caddy.NewTestController("dns", "fanout . 127.0.0.1 127.0.0.2 {\nexcept corp.example -> 127.0.0.2\n}"))
+	require.NoError(t, err)
+	require.Contains(t, buf.String(), "upstream dns://127.0.0.2:53 of an except redirect is also in the list of upstreams")
+}
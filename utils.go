@@ -26,7 +26,6 @@ import (
 	"github.com/coredns/coredns/request"
 
 	tap "github.com/dnstap/golang-dnstap"
-	"github.com/miekg/dns"
 )
 
 func logErrIfNotNil(err error) {
@@ -36,21 +35,12 @@ func logErrIfNotNil(err error) {
 	log.Error(err)
 }
 
-func toDnstap(tapPlugin *dnstap.Dnstap, client Client, state *request.Request, reply *dns.Msg, start time.Time) {
+func toDnstap(tapPlugin *dnstap.Dnstap, result *response, state *request.Request) {
+	reply, start := result.response, result.start
 	// Query
 	q := new(tap.Message)
 	msg.SetQueryTime(q, start)
-	h, p, _ := net.SplitHostPort(client.Endpoint()) // this is preparsed and can't err here
-	port, _ := strconv.ParseUint(p, 10, 32)         // same here
-	ip := net.ParseIP(h)
-
-	var ta net.Addr = &net.UDPAddr{IP: ip, Port: int(port)}
-	t := client.Net()
-
-	if t == TCP {
-		ta = &net.TCPAddr{IP: ip, Port: int(port)}
-	}
-
+	ta := tapAddr(result.client, result.proto)
 	var _ = msg.SetQueryAddress(q, ta)
 
 	if tapPlugin.IncludeRawMessage {
@@ -75,3 +65,18 @@ func toDnstap(tapPlugin *dnstap.Dnstap, client Client, state *request.Request, r
 		tapPlugin.TapMessage(r)
 	}
 }
+
+// tapAddr returns the address of client as recorded in dnstap messages, a TCP one if the exchange used
+// proto over TCP, or the client network if proto is unknown.
+func tapAddr(client Client, proto string) net.Addr {
+	h, p, _ := net.SplitHostPort(client.Endpoint()) // this is preparsed and can't err here
+	port, _ := strconv.ParseUint(p, 10, 32)         // same here
+	ip := net.ParseIP(h)
+	if proto == "" {
+		proto = client.Net()
+	}
+	if proto != UDP {
+		return &net.TCPAddr{IP: ip, Port: int(port)}
+	}
+	return &net.UDPAddr{IP: ip, Port: int(port)}
+}
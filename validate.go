@@ -0,0 +1,138 @@
+// Copyright (c) 2024 MWS and/or its affiliates.
+//
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at:
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fanout
+
+import (
+	"net/netip"
+	"slices"
+	"strings"
+
+	"github.com/coredns/coredns/request"
+	"github.com/miekg/dns"
+	"github.com/pkg/errors"
+)
+
+// responseValidator applies sanity checks to upstream responses before they are accepted as a result.
+// With logOnly, failures are only logged and counted. Names under privateZones may resolve to private
+// addresses.
+type responseValidator struct {
+	checks       []string
+	logOnly      bool
+	privateZones Domain
+}
+
+func newResponseValidator() *responseValidator {
+	v := &responseValidator{privateZones: NewDomain()}
+	for _, zone := range defaultPrivateZones {
+		v.privateZones.AddString(zone)
+	}
+	return v
+}
+
+// addCheck enables the check unless it already is.
+func (v *responseValidator) addCheck(check string) {
+	if !slices.Contains(v.checks, check) {
+		v.checks = append(v.checks, check)
+	}
+}
+
+// check returns an error if msg fails one of the checks and failures are rejected.
+func (v *responseValidator) check(c Client, r *request.Request, msg *dns.Msg) error {
+	if v == nil {
+		return nil
+	}
+	for _, name := range v.checks {
+		var ok bool
+		switch name {
+		case validateQuestion:
+			ok = answersQuestion(msg, r.Name(), r.QType())
+		case validateRebind:
+			ok = v.privateZones.Contains(r.Name()) || !hasPrivateAddress(msg)
+		case validateTTL:
+			ok = hasSaneTTLs(msg)
+		}
+		if ok {
+			continue
+		}
+		ValidationFailureCount.WithLabelValues(name, c.Endpoint()).Add(1)
+		if v.logOnly {
+			log.Warningf("response from %s for %s %s failed the %s check", c.Endpoint(), r.Name(), r.Type(), name)
+			continue
+		}
+		return errors.Errorf("response from %s failed the %s check", c.Endpoint(), name)
+	}
+	return nil
+}
+
+// answersQuestion returns true if every answer record is owned by name or by a name the CNAME chain leads
+// to, and has the query type, unless it's part of the chain or a signature.
+func answersQuestion(msg *dns.Msg, name string, qtype uint16) bool {
+	owners := []string{strings.ToLower(name)}
+	for _, rr := range msg.Answer {
+		if cname, ok := rr.(*dns.CNAME); ok && slices.Contains(owners, strings.ToLower(cname.Hdr.Name)) {
+			owners = append(owners, strings.ToLower(cname.Target))
+		}
+	}
+	for _, rr := range msg.Answer {
+		h := rr.Header()
+		if !slices.Contains(owners, strings.ToLower(h.Name)) && h.Rrtype != dns.TypeDNAME {
+			return false
+		}
+		switch h.Rrtype {
+		case qtype, dns.TypeCNAME, dns.TypeDNAME, dns.TypeRRSIG:
+		default:
+			if qtype != dns.TypeANY {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// hasPrivateAddress returns true if an address record of the answer points to a private, loopback,
+// link-local or unspecified address, as DNS rebinding attacks do.
+func hasPrivateAddress(msg *dns.Msg) bool {
+	for _, rr := range msg.Answer {
+		var addr netip.Addr
+		switch rr := rr.(type) {
+		case *dns.A:
+			addr, _ = netip.AddrFromSlice(rr.A.To4())
+		case *dns.AAAA:
+			addr, _ = netip.AddrFromSlice(rr.AAAA)
+		default:
+			continue
+		}
+		addr = addr.Unmap()
+		if addr.IsPrivate() || addr.IsLoopback() || addr.IsLinkLocalUnicast() || addr.IsUnspecified() {
+			return true
+		}
+	}
+	return false
+}
+
+// hasSaneTTLs returns false if a record has a TTL above maxSaneTTL, such as one with the high bit set,
+// which RFC 2181 says must be treated as zero.
+func hasSaneTTLs(msg *dns.Msg) bool {
+	for _, section := range [][]dns.RR{msg.Answer, msg.Ns, msg.Extra} {
+		for _, rr := range section {
+			if rr.Header().Rrtype != dns.TypeOPT && rr.Header().Ttl > maxSaneTTL {
+				return false
+			}
+		}
+	}
+	return true
+}
@@ -0,0 +1,147 @@
+// Copyright (c) 2024 MWS and/or its affiliates.
+//
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at:
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fanout
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/coredns/caddy"
+	"github.com/coredns/coredns/plugin/test"
+	"github.com/miekg/dns"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/require"
+)
+
+func answerMsg(t *testing.T, records ...string) *dns.Msg {
+	m := new(dns.Msg)
+	for _, s := range records {
+		rr, err := dns.NewRR(s)
+		require.NoError(t, err)
+		m.Answer = append(m.Answer, rr)
+	}
+	return m
+}
+
+func TestAnswersQuestion(t *testing.T) {
+	require.True(t, answersQuestion(answerMsg(t, "a.example. 300 IN A 198.51.100.1"), "A.example.", dns.TypeA))
+	require.True(t, answersQuestion(answerMsg(t,
+		"a.example. 300 IN CNAME b.example.",
+		"b.example. 300 IN A 198.51.100.1",
+	), "a.example.", dns.TypeA))
+	require.False(t, answersQuestion(answerMsg(t, "other.example. 300 IN A 198.51.100.1"), "a.example.", dns.TypeA))
+	require.False(t, answersQuestion(answerMsg(t, "a.example. 300 IN AAAA 2001:db8::1"), "a.example.", dns.TypeA))
+	require.True(t, answersQuestion(answerMsg(t, "a.example. 300 IN AAAA 2001:db8::1"), "a.example.", dns.TypeANY))
+}
+
+func TestHasPrivateAddress(t *testing.T) {
+	for _, rr := range []string{"a. 300 IN A 10.1.2.3", "a. 300 IN A 127.0.0.1", "a. 300 IN A 169.254.1.1", "a. 300 IN A 0.0.0.0",
+		"a. 300 IN AAAA fd00::1", "a. 300 IN AAAA ::1", "a. 300 IN AAAA ::ffff:192.168.1.1"} {
+		require.True(t, hasPrivateAddress(answerMsg(t, rr)), rr)
+	}
+	require.False(t, hasPrivateAddress(answerMsg(t, "a. 300 IN A 198.51.100.1", "a. 300 IN AAAA 2001:db8::1", "a. 300 IN TXT \"10.0.0.1\"")))
+}
+
+func TestHasSaneTTLs(t *testing.T) {
+	require.True(t, hasSaneTTLs(answerMsg(t, "a. 604800 IN A 198.51.100.1")))
+	require.False(t, hasSaneTTLs(answerMsg(t, "a. 2147483648 IN A 198.51.100.1")))
+}
+
+func TestValidateRejectsResponses(t *testing.T) {
+	reply := func(rr string) func(w dns.ResponseWriter, r *dns.Msg) {
+		return func(w dns.ResponseWriter, r *dns.Msg) {
+			msg := dns.Msg{Answer: []dns.RR{makeRecordA(rr)}}
+			msg.SetReply(r)
+			logErrIfNotNil(w.WriteMsg(&msg))
+		}
+	}
+	rebind := newServer(UDP, reply(testQuery+" 300 IN A 192.168.1.1"))
+	defer rebind.close()
+	good := newServer(UDP, reply(testQuery+" 300 IN A 198.51.100.1"))
+	defer good.close()
+
+	input := fmt.Sprintf("fanout . %s %s {\nvalidate question rebind ttl\n}", rebind.addr, good.addr)
+	fs, err := parseFanout(caddy.NewTestController("dns", input))
+	require.NoError(t, err)
+	failures := testutil.ToFloat64(ValidationFailureCount.WithLabelValues(validateRebind, rebind.addr))
+
+	req := new(dns.Msg)
+	req.SetQuestion(testQuery, dns.TypeA)
+	writer := &cachedDNSWriter{ResponseWriter: new(test.ResponseWriter)}
+	_, err = fs[0].ServeDNS(context.Background(), writer, req)
+	require.NoError(t, err)
+	require.Len(t, writer.answers, 1)
+	require.Equal(t, "198.51.100.1", writer.answers[0].Answer[0].(*dns.A).A.String())
+	require.Eventually(t, func() bool {
+		return testutil.ToFloat64(ValidationFailureCount.WithLabelValues(validateRebind, rebind.addr)) == failures+1
+	}, time.Second, 10*time.Millisecond)
+}
+
+func TestValidateLogOnly(t *testing.T) {
+	c := &staticClient{addr: "203.0.113.54:53"}
+	v := newResponseValidator()
+	v.checks, v.logOnly = []string{validateRebind}, true
+	failures := testutil.ToFloat64(ValidationFailureCount.WithLabelValues(validateRebind, c.addr))
+	msg := answerMsg(t, testQuery+" 300 IN A 127.0.0.1")
+	require.NoError(t, v.check(c, fuzzRequest(), msg))
+	require.Equal(t, failures+1, testutil.ToFloat64(ValidationFailureCount.WithLabelValues(validateRebind, c.addr)))
+
+	v.logOnly = false
+	require.ErrorContains(t, v.check(c, fuzzRequest(), msg), "failed the rebind check")
+}
+
+func TestSetupValidate(t *testing.T) {
+	fs, err := parseFanout(caddy.NewTestController("dns", "fanout . 127.0.0.1 {\nvalidate rebind log\n}"))
+	require.NoError(t, err)
+	require.Equal(t, []string{validateRebind}, fs[0].validator.checks)
+	require.True(t, fs[0].validator.logOnly)
+
+	for _, input := range []string{"validate", "validate reject", "validate bogus"} {
+		_, err = parseFanout(caddy.NewTestController("dns", "fanout . 127.0.0.1 {\n"+input+"\n}"))
+		require.Error(t, err, input)
+	}
+}
+
+func TestDenyPrivateAnswers(t *testing.T) {
+	private := newServer(UDP, func(w dns.ResponseWriter, r *dns.Msg) {
+		msg := dns.Msg{Answer: []dns.RR{makeRecordA(r.Question[0].Name + " 300 IN A 192.168.1.10")}}
+		msg.SetReply(r)
+		logErrIfNotNil(w.WriteMsg(&msg))
+	})
+	defer private.close()
+
+	input := fmt.Sprintf("fanout . %s {\ndeny-private-answers corp.example\n}", private.addr)
+	fs, err := parseFanout(caddy.NewTestController("dns", input))
+	require.NoError(t, err)
+	require.Equal(t, []string{validateRebind}, fs[0].validator.checks)
+
+	for name, allowed := range map[string]bool{"www.example.com.": false, "printer.local.": true, "db.corp.example.": true} {
+		req := new(dns.Msg)
+		req.SetQuestion(name, dns.TypeA)
+		writer := &cachedDNSWriter{ResponseWriter: new(test.ResponseWriter)}
+		_, err = fs[0].ServeDNS(context.Background(), writer, req)
+		if !allowed {
+			require.ErrorContains(t, err, "failed the rebind check", name)
+			continue
+		}
+		require.NoError(t, err, name)
+		require.Len(t, writer.answers, 1)
+		require.Len(t, writer.answers[0].Answer, 1)
+	}
+}